@@ -293,10 +293,81 @@ fn benchmark_large_response(c: &mut Criterion) {
     group.finish();
 }
 
+fn benchmark_pipeline_slow_read(c: &mut Criterion) {
+    let mut group = c.benchmark_group("pipeline_slow_read");
+    group.measurement_time(Duration::from_secs(10));
+    
+    const LIST_LEN: usize = 50_000;
+    const FAST_GETS: usize = 100;
+    
+    // One large list for the slow read and a small key for the fast ones
+    let (_temp, rt) = setup_server(false, 6386);
+    rt.block_on(async {
+        let mut stream = tokio::net::TcpStream::connect("127.0.0.1:6386").await.unwrap();
+        use tokio::io::{AsyncWriteExt, AsyncBufReadExt, BufReader};
+        
+        let mut commands = String::from("SET fastkey value\n");
+        for chunk in 0..LIST_LEN / 1000 {
+            let items: Vec<String> = (0..1000).map(|i| format!("item{}", chunk * 1000 + i)).collect();
+            commands.push_str(&format!("RPUSH biglist {}\n", items.join(" ")));
+        }
+        stream.write_all(commands.as_bytes()).await.unwrap();
+        
+        let mut reader = BufReader::new(&mut stream);
+        for _ in 0..=LIST_LEN / 1000 {
+            let mut line = String::new();
+            reader.read_line(&mut line).await.unwrap();
+        }
+    });
+    
+    // Pipeline optionally led by a slow LRANGE, followed by many fast GETs,
+    // measuring until the last reply arrives
+    for slow in [false, true] {
+        let name = if slow { "lrange_then_gets" } else { "gets_only" };
+        group.bench_function(name, |b| {
+            b.iter_batched(
+                || {
+                    rt.block_on(async {
+                        tokio::net::TcpStream::connect("127.0.0.1:6386").await.unwrap()
+                    })
+                },
+                |mut stream| {
+                    rt.block_on(async {
+                        use tokio::io::{AsyncWriteExt, AsyncBufReadExt, BufReader};
+                        
+                        let mut commands = String::new();
+                        if slow {
+                            commands.push_str("LRANGE biglist 0 -1\n");
+                        }
+                        for _ in 0..FAST_GETS {
+                            commands.push_str("GET fastkey\n");
+                        }
+                        stream.write_all(commands.as_bytes()).await.unwrap();
+                        
+                        // The list reply spans one line per item
+                        let expected = FAST_GETS + if slow { LIST_LEN } else { 0 };
+                        let mut reader = BufReader::new(&mut stream);
+                        let mut line = String::new();
+                        for _ in 0..expected {
+                            line.clear();
+                            reader.read_line(&mut line).await.unwrap();
+                        }
+                        assert_eq!(line.trim(), "value");
+                    })
+                },
+                BatchSize::SmallInput,
+            );
+        });
+    }
+    
+    group.finish();
+}
+
 criterion_group!(
     benches,
     benchmark_single_request,
     benchmark_pipeline_requests,
+    benchmark_pipeline_slow_read,
     benchmark_client_connection_pool,
     benchmark_large_response
 );
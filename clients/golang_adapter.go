@@ -2,73 +2,2107 @@ package diskdb
 
 import (
 	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"math"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// Client represents a DiskDB client connection
+var (
+	// ErrEmpty is returned by commands that sample the database when it holds no keys
+	ErrEmpty = errors.New("database is empty")
+
+	// ErrTooManyClients is returned when the server refuses the connection
+	// because its maxclients limit has been reached
+	ErrTooManyClients = errors.New("max number of clients reached")
+
+	// ErrKeyNotFound is returned when a command needs a key that does not exist
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrTooManyArguments is returned when a command has more arguments
+	// than the server's max-args limit allows
+	ErrTooManyArguments = errors.New("too many arguments")
+
+	// ErrCommandTimedOut is returned when a read ran past the server's
+	// execution budget for its command class and was cancelled
+	ErrCommandTimedOut = errors.New("command timed out")
+
+	// ErrKeyExists is returned by RestoreKey when the key already exists and
+	// replace was not requested
+	ErrKeyExists = errors.New("target key name already exists")
+
+	// ErrWarmupInProgress is returned by Warmup while an earlier warmup is
+	// still running
+	ErrWarmupInProgress = errors.New("warmup already in progress")
+
+	// ErrCompactionInProgress is returned by Compact while an earlier
+	// compaction is still running
+	ErrCompactionInProgress = errors.New("compaction already in progress")
+
+	// ErrSnapshotInProgress is returned by SaveSnapshot and
+	// BackgroundSaveSnapshot while an earlier snapshot is still being saved
+	ErrSnapshotInProgress = errors.New("snapshot already in progress")
+
+	// ErrOffsetNotRetained is returned by StreamChanges when the changes
+	// from the requested offset have already been dropped from the
+	// server's change log
+	ErrOffsetNotRetained = errors.New("offset no longer retained")
+
+	// ErrUnknownCommand is returned when the server does not recognize a
+	// command, usually because it is older than the client or the name is
+	// misspelled. The error names the command.
+	ErrUnknownCommand = errors.New("unknown command")
+
+	// ErrKeyLimitExceeded is returned when a write would create a key in a
+	// database that already holds as many keys as the server allows it.
+	// Overwriting or deleting existing keys still works.
+	ErrKeyLimitExceeded = errors.New("key limit exceeded")
+
+	// ErrBusy is returned when the server refuses a write because too many
+	// writes are already waiting to be applied. Nothing was written; the
+	// write can be retried after backing off.
+	ErrBusy = errors.New("server busy, try again")
+
+	// ErrRateLimited is returned when the connection sent more commands per
+	// second than the server's max-commands-per-second allows. The command
+	// was not run and the connection stays open; it can be retried after
+	// slowing down.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrCrossSlot is returned by KeysSlot when keys that must be served
+	// together hash to different slots. Giving them a common hash tag,
+	// such as "{tenant42}", puts them in one slot.
+	ErrCrossSlot = errors.New("keys hash to different slots")
+
+	// ErrPoolClosed is returned by a Pool's Get after the pool was closed
+	ErrPoolClosed = errors.New("pool is closed")
+
+	// ErrWrongType is returned when a command is used on a key holding a
+	// different kind of value, such as a list command on a string
+	ErrWrongType = errors.New("wrong kind of value")
+
+	// ErrNoJob is returned by ClaimJob when the queue holds no job ready to
+	// be claimed
+	ErrNoJob = errors.New("no job ready")
+)
+
+// ServerError is an error reply from the server. Code is the machine-readable
+// code the reply starts with, such as "ERR" or "WRONGTYPE", which stays the
+// same across server versions while the rest of the message may not.
+// errors.Is matches a ServerError against the sentinel error for its code,
+// if there is one: ErrWrongType, ErrKeyNotFound, ErrKeyLimitExceeded,
+// ErrCommandTimedOut, ErrBusy, ErrRateLimited or ErrKeyExists.
+type ServerError struct {
+	// Command is the name of the command that failed, lowercased
+	Command string
+	// Code is the first word of the reply, or "ERR" if it has none
+	Code string
+	// Message is the reply as the server sent it, code included
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Command, e.Message)
+}
+
+// Unwrap returns the sentinel error for the code, or nil
+func (e *ServerError) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// codeErrors maps the codes of error replies to their sentinel errors
+var codeErrors = map[string]error{
+	"WRONGTYPE": ErrWrongType,
+	"NOTFOUND":  ErrKeyNotFound,
+	"OOM":       ErrKeyLimitExceeded,
+	"TIMEOUT":   ErrCommandTimedOut,
+	"TRYAGAIN":  ErrBusy,
+	"BUSYKEY":   ErrKeyExists,
+	"RATELIMIT": ErrRateLimited,
+}
+
+// replyCode returns the code an error reply starts with: its first word if
+// that is all capital letters, as codes are, or else "ERR"
+func replyCode(msg string) string {
+	code, _, _ := strings.Cut(msg, " ")
+	if code == "" || strings.TrimLeft(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "ERR"
+	}
+	return code
+}
+
+// Sentinel durations returned by TTL
+const (
+	// NoExpiry is returned for a key that exists but has no expiry
+	NoExpiry time.Duration = -1
+	// KeyMissing is returned for a key that does not exist
+	KeyMissing time.Duration = -2
+)
+
+// Client represents a DiskDB client connection.
+//
+// A Client is NOT safe for concurrent use. Each command writes a request and
+// reads its reply on one connection, so goroutines sharing a Client can read
+// each other's replies. Give every goroutine its own Client, or share a
+// SyncClient instead.
 type Client struct {
-	host   string
-	port   int
+	host    string
+	port    int
+	address string
+	options ClientOptions
+
+	// Connection state, shared with the views made by WithTimeout so a
+	// reconnect or Select through a view is seen by the client too
+	*connState
+
+	// Deadlines applied to every command; zero means no deadline
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// connState is the connection a Client and its views run commands on
+type connState struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// Database selected with Select, restored when reconnecting
+	db int
+
+	// Whether SetTiming turned timing on, restored when reconnecting
+	timing bool
+
+	// Name given with SetName, restored when reconnecting
+	name string
+
+	// When the connection last carried a command, for heartbeats
+	lastUsed time.Time
+}
+
+// ClientOptions configures a connection created by NewClientWithOptions
+type ClientOptions struct {
+	// ReadBufferSize is the size of the buffer replies are read through.
+	// A reply that fits in the buffer is usually read in one syscall;
+	// values much larger than the buffer are read straight into their
+	// destination, so a huge buffer gains nothing for them. Zero uses the
+	// bufio default of 4 KiB.
+	ReadBufferSize int
+
+	// WriteBufferSize is the size of the buffer commands are written
+	// through. Zero uses the bufio default of 4 KiB.
+	WriteBufferSize int
+
+	// DisableNoDelay turns Nagle's algorithm back on. By default TCP_NODELAY
+	// is set so every command is sent as soon as it is flushed, which keeps
+	// request/reply latency low. With Nagle's algorithm the kernel holds
+	// small writes back while earlier data is unacknowledged, adding up to
+	// a round trip (tens of milliseconds with delayed ACKs) to a lone
+	// command but sending fewer packets when many commands are pipelined.
+	DisableNoDelay bool
+
+	// KeepAlive is the interval between TCP keep-alive probes on an idle
+	// connection, which lets the kernel notice a dead peer and keeps NAT
+	// entries and firewall flows alive. Zero uses Go's default of 15
+	// seconds; negative disables keep-alives.
+	KeepAlive time.Duration
+
+	// HeartbeatInterval, if positive, makes a SyncClient send PING on its
+	// connection whenever it has been idle that long, reconnecting if the
+	// PING fails. A dead connection is then replaced in the background
+	// instead of failing the next command. A Client is not safe for
+	// concurrent use, so it cannot heartbeat itself and ignores this.
+	HeartbeatInterval time.Duration
+
+	// Name, if set, names the connection as SetName does as soon as it is
+	// opened, so it can be told apart in the server's CLIENT LIST. Services
+	// opening several connections can add an index, as in "billing-3".
+	Name string
+}
+
+// NewClient creates a new DiskDB client
+func NewClient(address string) (*Client, error) {
+	return NewClientWithOptions(address, ClientOptions{})
+}
+
+// NewClientWithOptions creates a new DiskDB client configured by opts
+func NewClientWithOptions(address string, opts ClientOptions) (*Client, error) {
+	c := &Client{
+		address:   address,
+		options:   opts,
+		connState: &connState{name: opts.Name},
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newClientContext is NewClientWithOptions with the dial abandoned once ctx
+// is done
+func newClientContext(ctx context.Context, address string, opts ClientOptions) (*Client, error) {
+	c := &Client{
+		address:   address,
+		options:   opts,
+		connState: &connState{name: opts.Name},
+	}
+	if err := c.connectContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// connect dials a new connection for the client, replacing any previous
+// one, and restores the selected database
+func (c *Client) connect() error {
+	return c.connectContext(context.Background())
+}
+
+// connectContext is connect with the dial abandoned once ctx is done
+func (c *Client) connectContext(ctx context.Context) error {
+	// The dialer enables TCP keep-alives with this period itself
+	dialer := net.Dialer{KeepAlive: c.options.KeepAlive}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return err
+	}
+	if err := setNoDelay(conn, !c.options.DisableNoDelay); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	c.reader = bufio.NewReaderSize(conn, bufferSize(c.options.ReadBufferSize))
+	c.writer = bufio.NewWriterSize(conn, bufferSize(c.options.WriteBufferSize))
+
+	// Switch the connection to length-framed replies so values and arrays
+	// can be decoded unambiguously
+	if _, err := c.sendCommand("HELLO", "2"); err != nil {
+		conn.Close()
+		return err
+	}
+	if c.db != 0 {
+		if _, err := c.sendCommand("SELECT", fmt.Sprint(c.db)); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if c.timing {
+		if _, err := c.sendCommand("DEBUG", "TIMING", "ON"); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if c.name != "" {
+		if _, err := c.sendCommand("CLIENT", "SETNAME", c.name); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setNoDelay sets TCP_NODELAY on the TCP connection underneath conn,
+// looking through wrappers such as *tls.Conn that expose it with NetConn
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c.SetNoDelay(noDelay)
+	case interface{ NetConn() net.Conn }:
+		return setNoDelay(c.NetConn(), noDelay)
+	}
+	return nil
+}
+
+// SetTimeouts sets the default read and write timeouts applied to every
+// command. Zero disables the corresponding deadline.
+func (c *Client) SetTimeouts(read, write time.Duration) {
+	c.readTimeout = read
+	c.writeTimeout = write
+}
+
+// WithTimeout returns a view of the client whose commands use d as both the
+// read and write timeout. It shares the connection and the selected
+// database with the client, leaves the client's own defaults untouched and
+// is meant for a single call:
+//
+//	stats, err := client.WithTimeout(30 * time.Second).Get("report")
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	return &Client{
+		host:         c.host,
+		port:         c.port,
+		address:      c.address,
+		options:      c.options,
+		connState:    c.connState,
+		readTimeout:  d,
+		writeTimeout: d,
+	}
+}
+
+// sendCommand sends a command to the server and returns the response.
+// Error replies from the server are returned as errors.
+func (c *Client) sendCommand(name string, args ...string) (*reply, error) {
+	return c.roundTrip(name, func(w *bufio.Writer) error {
+		_, err := w.Write(encodeCommand(name, args...))
+		return err
+	}, readReply)
+}
+
+// roundTrip writes one command with write and reads its reply with read,
+// applying the client's deadlines. Error replies are returned as errors.
+func (c *Client) roundTrip(name string, write func(*bufio.Writer) error, read func(*bufio.Reader) (*reply, error)) (*reply, error) {
+	c.lastUsed = time.Now()
+	// Deadlines are set on every call so an override never outlives it
+	if err := c.conn.SetWriteDeadline(deadline(c.writeTimeout)); err != nil {
+		return nil, err
+	}
+	// Commands go through the write buffer and are flushed explicitly, so
+	// several of them written back to back leave in as few syscalls as
+	// the buffer allows
+	if err := write(c.writer); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if err := c.conn.SetReadDeadline(deadline(c.readTimeout)); err != nil {
+		return nil, err
+	}
+	r, err := read(c.reader)
+	if err != nil {
+		// After a late, cut-off or malformed reply the next command would
+		// read leftovers of this one, so the connection cannot be reused
+		c.conn.Close()
+		return nil, err
+	}
+
+	if r.kind == kindError {
+		return nil, serverError(name, r.str)
+	}
+
+	return r, nil
+}
+
+// bufferSize returns size, or the bufio default when it is not positive
+func bufferSize(size int) int {
+	if size <= 0 {
+		return 4096
+	}
+	return size
+}
+
+// pipeline sends every command before reading any reply, so the batch
+// costs one round trip instead of one per command. Error replies are
+// returned as replies; an error is only returned if the connection failed,
+// in which case it is closed because the replies still in flight would be
+// read by the next command.
+func (c *Client) pipeline(cmds [][]string) ([]*reply, error) {
+	lines := make([][]byte, len(cmds))
+	for i, cmd := range cmds {
+		lines[i] = encodeCommand(cmd[0], cmd[1:]...)
+	}
+	return c.pipelineLines(lines)
+}
+
+// pipelineLines is pipeline for commands that are already encoded, one per
+// newline-terminated line
+func (c *Client) pipelineLines(lines [][]byte) ([]*reply, error) {
+	c.lastUsed = time.Now()
+	if err := c.conn.SetWriteDeadline(deadline(c.writeTimeout)); err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if _, err := c.writer.Write(line); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if err := c.conn.SetReadDeadline(deadline(c.readTimeout)); err != nil {
+		return nil, err
+	}
+	replies := make([]*reply, len(lines))
+	for i := range replies {
+		r, err := readReply(c.reader)
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// deadline converts a timeout into a connection deadline, where zero means none
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// serverError converts an error reply into a Go error: a ServerError,
+// matching the sentinel error for its code, or one of the sentinel errors
+// for replies that share the ERR code but are told apart by their message
+func serverError(name, msg string) error {
+	switch {
+	case strings.Contains(msg, "max number of clients reached"):
+		return ErrTooManyClients
+	case strings.HasPrefix(msg, "ERR too many arguments"):
+		return ErrTooManyArguments
+	case msg == "ERR warmup already in progress":
+		return ErrWarmupInProgress
+	case msg == "ERR compaction already in progress":
+		return ErrCompactionInProgress
+	case msg == "ERR snapshot already in progress":
+		return ErrSnapshotInProgress
+	case strings.HasPrefix(msg, "ERR Invalid command: "), strings.HasPrefix(msg, "ERR unknown command"):
+		return fmt.Errorf("%w %q", ErrUnknownCommand, name)
+	case strings.HasPrefix(msg, "ERR offset is no longer retained, "):
+		return fmt.Errorf("%w: %s", ErrOffsetNotRetained, strings.TrimPrefix(msg, "ERR offset is no longer retained, "))
+	}
+	return &ServerError{Command: strings.ToLower(name), Code: replyCode(msg), Message: msg}
+}
+
+// Do sends a command built from args, the command name first, and returns
+// its reply. It covers commands the typed methods do not, and encodes the
+// arguments the same way they do, so any content is passed through as is.
+// An error reply is returned as an error, along with the reply itself.
+func (c *Client) Do(args ...string) (Reply, error) {
+	if len(args) == 0 {
+		return Reply{}, errors.New("do failed: no command given")
+	}
+
+	var raw *reply
+	_, err := c.roundTrip(args[0], func(w *bufio.Writer) error {
+		_, err := w.Write(encodeCommand(args[0], args[1:]...))
+		return err
+	}, func(r *bufio.Reader) (*reply, error) {
+		var err error
+		raw, err = readReply(r)
+		return raw, err
+	})
+	if raw == nil {
+		return Reply{}, err
+	}
+	return Reply{r: raw, cmd: args[0]}, err
+}
+
+// Set stores a key-value pair in the database
+func (c *Client) Set(key, value string) error {
+	response, err := c.sendCommand("SET", key, value)
+	if err != nil {
+		return err
+	}
+
+	if response.kind != kindStatus || response.str != "OK" {
+		return fmt.Errorf("set failed: %s", response.str)
+	}
+
+	return nil
+}
+
+// SetGet stores a key-value pair like Set and returns the value it
+// replaced in one round trip; existed is false if the key did not exist.
+// The old value is read in the same step as the write, so no other write
+// of a string, whether a plain Set, a SetGet or a read-modify-write command
+// such as INCR, can fall between the two. A key holding something other than a string is
+// left alone and an error returned.
+func (c *Client) SetGet(key, value string) (old string, existed bool, err error) {
+	response, err := c.sendCommand("SET", key, value, "GET")
+	if err != nil {
+		return "", false, err
+	}
+
+	if response.kind == kindNil {
+		return "", false, nil
+	}
+
+	return response.str, true, nil
+}
+
+// Encoding is how SetEncoded asks the server to store a value
+type Encoding string
+
+const (
+	// EncodingRaw stores the value as is, never compressed
+	EncodingRaw Encoding = "raw"
+	// EncodingInt stores an integer as is, never compressed
+	EncodingInt Encoding = "int"
+	// EncodingCompressed compresses the value whatever its size, even on a
+	// server without compression configured
+	EncodingCompressed Encoding = "compressed"
+)
+
+// SetEncoded stores a key-value pair like Set, asking the server to store
+// the value as enc, which trades memory and disk for CPU per key. The
+// server falls back to its default for a value the hint does not suit: an
+// EncodingInt value that is not an integer, or an EncodingCompressed value
+// compression would not shrink. ObjectEncoding reports what was chosen.
+// Later writes to the key without a hint store it the default way again.
+func (c *Client) SetEncoded(key, value string, enc Encoding) error {
+	switch enc {
+	case EncodingRaw, EncodingInt, EncodingCompressed:
+	default:
+		return fmt.Errorf("set failed: unknown encoding %q", enc)
+	}
+
+	response, err := c.sendCommand("SET", key, value, "ENCODING", string(enc))
+	if err != nil {
+		return err
+	}
+
+	if response.kind != kindStatus || response.str != "OK" {
+		return fmt.Errorf("set failed: %s", response.str)
+	}
+
+	return nil
+}
+
+// SetIdempotent stores a key-value pair once per requestID: the server
+// remembers the id for window, and a repeat within it succeeds without
+// being applied again. Retrying with the same id after an ambiguous
+// failure, such as a timeout, is then safe even if a later write has
+// changed the key since. Ids are shared by all keys and clients, so they
+// must be unique, and at most 256 bytes. The server bounds how many ids it
+// remembers (DISKDB_MAX_REQUEST_IDS) and forgets the oldest early under
+// load. window has millisecond precision.
+func (c *Client) SetIdempotent(key, value, requestID string, window time.Duration) error {
+	if window < time.Millisecond {
+		return fmt.Errorf("setidem failed: invalid window %v", window)
+	}
+
+	response, err := c.sendCommand("SETIDEM", key, value, requestID, fmt.Sprint(window.Milliseconds()))
+	if err != nil {
+		return err
+	}
+
+	if response.kind != kindStatus || response.str != "OK" {
+		return fmt.Errorf("setidem failed: %s", response.str)
+	}
+
+	return nil
+}
+
+// SetWithDeadLetter stores a key-value pair that expires after ttl and,
+// when it does, has its value appended to the list dlq instead of being
+// dropped, which makes timed-out work visible. The server moves the value in
+// one atomic write, so it is never lost or appended twice, and it reaches
+// the list within about 100ms of the expiry. Deleting the
+// key, clearing its expiry or setting it again without a dead-letter list
+// cancels the append. ttl has millisecond precision.
+func (c *Client) SetWithDeadLetter(key, value string, ttl time.Duration, dlq string) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("set failed: invalid ttl %v", ttl)
+	}
+
+	response, err := c.sendCommand("SET", key, value, "PX", fmt.Sprint(ttl.Milliseconds()), "DEADLETTER", dlq)
+	if err != nil {
+		return err
+	}
+
+	if response.kind != kindStatus || response.str != "OK" {
+		return fmt.Errorf("set failed: %s", response.str)
+	}
+
+	return nil
+}
+
+// Get retrieves a value by key from the database
+func (c *Client) Get(key string) (string, error) {
+	response, err := c.sendCommand("GET", key)
+	if err != nil {
+		return "", err
+	}
+
+	if response.kind == kindNil {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return response.str, nil
+}
+
+// GetAndRefresh retrieves the value of key and resets its expiry to ttl
+// from now, as one atomic operation, so every read extends the key's
+// lifetime, as for sliding-window sessions. It returns ErrKeyNotFound if
+// the key does not exist or has expired. ttl has millisecond precision.
+func (c *Client) GetAndRefresh(key string, ttl time.Duration) (string, error) {
+	if ttl < time.Millisecond {
+		return "", fmt.Errorf("getex failed: invalid ttl %v", ttl)
+	}
+
+	response, err := c.sendCommand("GETEX", key, "PX", fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return "", err
+	}
+
+	if response.kind == kindNil {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return response.str, nil
+}
+
+// GetOrSet returns the value at key, first setting it to defaultValue if
+// the key does not exist, as one atomic operation; created reports whether
+// it was set. Concurrent callers with different defaults all get back the
+// one value that was stored.
+func (c *Client) GetOrSet(key, defaultValue string) (value string, created bool, err error) {
+	response, err := c.sendCommand("GETORSET", key, defaultValue)
+	if err != nil {
+		return "", false, err
+	}
+	if len(response.elems) != 2 {
+		return "", false, fmt.Errorf("getorset failed: unexpected reply")
+	}
+
+	return response.elems[0].str, response.elems[1].num == 1, nil
+}
+
+// IncrWithExpire increments the counter at key and, if this created it,
+// sets it to expire after ttl, as one atomic operation. It suits fixed-window
+// rate limiting: the first hit of a window starts the clock, and concurrent
+// first hits cannot leave a counter that never expires. An existing counter
+// keeps its expiry, or lack of one. ttl has millisecond precision.
+func (c *Client) IncrWithExpire(key string, ttl time.Duration) (int64, error) {
+	if ttl < time.Millisecond {
+		return 0, fmt.Errorf("incrpx failed: invalid ttl %v", ttl)
+	}
+
+	response, err := c.sendCommand("INCRPX", key, fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return response.num, nil
+}
+
+// IncrMulti increments each counter in deltas by its delta, as one atomic
+// operation, and returns their new values. Either every counter is
+// incremented or, if any holds something other than an integer, none is.
+// A missing counter starts at 0, and counters keep their expiry, as with
+// IncrBy.
+func (c *Client) IncrMulti(deltas map[string]int64) (map[string]int64, error) {
+	values := make(map[string]int64, len(deltas))
+	if len(deltas) == 0 {
+		return values, nil
+	}
+
+	keys := make([]string, 0, len(deltas))
+	args := make([]string, 0, 2*len(deltas))
+	for key, delta := range deltas {
+		keys = append(keys, key)
+		args = append(args, key, strconv.FormatInt(delta, 10))
+	}
+	response, err := c.sendCommand("INCRMULTI", args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.elems) != len(keys) {
+		return nil, fmt.Errorf("incrmulti failed: unexpected reply")
+	}
+
+	for i, key := range keys {
+		values[key] = response.elems[i].num
+	}
+	return values, nil
+}
+
+// DecrAndReap decrements the counter at key and, if that takes it to zero
+// or below, deletes it, as one atomic operation. It suits reference
+// counting: of clients releasing the last references concurrently, exactly
+// one gets deleted true and should free the resource, and the key is never
+// left at zero. A missing key counts as 0, so a release after the key was
+// reaped returns -1 and deleted false. A key that is not reaped keeps its
+// expiry.
+func (c *Client) DecrAndReap(key string) (newVal int64, deleted bool, err error) {
+	response, err := c.sendCommand("DECRREAP", key)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(response.elems) != 2 {
+		return 0, false, fmt.Errorf("decrreap failed: unexpected reply")
+	}
+
+	return response.elems[0].num, response.elems[1].num == 1, nil
+}
+
+// ExpireMatching sets every key matching the glob-style pattern of SCAN's
+// MATCH option to expire after ttl, and returns how many keys it set. Readers
+// then see misses for those keys instead of stale values, without the keys
+// being deleted first. The server walks the keyspace a page at a time in
+// one command, so no key list is sent over the connection; keys written
+// while it runs may or may not be included. ttl has millisecond precision.
+// If the server has a keyspace command budget and the walk runs past it,
+// the keys expired so far keep their TTL and a TIMEOUT error is returned;
+// calling it again covers the rest.
+func (c *Client) ExpireMatching(pattern string, ttl time.Duration) (int, error) {
+	if ttl < time.Millisecond {
+		return 0, fmt.Errorf("expirematching failed: invalid ttl %v", ttl)
+	}
+
+	response, err := c.sendCommand("EXPIREMATCHING", pattern, fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// GetReset returns the integer stored at key and resets it to 0 as one
+// atomic operation, so no increment is lost between reading a counter and
+// clearing it. A missing key reads as 0 and is created. The key keeps its
+// expiry, if it has one.
+func (c *Client) GetReset(key string) (int64, error) {
+	response, err := c.sendCommand("GETRESET", key)
+	if err != nil {
+		return 0, err
+	}
+
+	return response.num, nil
+}
+
+// Rotate returns the string stored at key and empties it as one atomic
+// operation, so nothing appended between reading the value and resetting
+// it is lost: the accumulated contents of a log kept in one key can be
+// archived while writers keep appending. The key keeps its expiry, if it
+// has one. A missing key returns ErrKeyNotFound and stays missing.
+func (c *Client) Rotate(key string) (string, error) {
+	response, err := c.sendCommand("ROTATE", key)
+	if err != nil {
+		return "", err
+	}
+
+	if response.kind == kindNil {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return response.str, nil
+}
+
+// AppendCapped appends suffix to the string stored at key, creating it if
+// missing, then drops bytes from the front so it is at most maxBytes long,
+// as one atomic operation. It suits a rolling log kept in one value: when
+// a newline falls within 256 bytes after the cut, the value is trimmed just
+// past it so only whole lines remain. It returns the resulting length.
+func (c *Client) AppendCapped(key, suffix string, maxBytes int) (int, error) {
+	if maxBytes <= 0 {
+		return 0, fmt.Errorf("appendcapped failed: maxBytes must be positive")
+	}
+
+	response, err := c.sendCommand("APPENDCAPPED", key, fmt.Sprint(maxBytes), suffix)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// SetBit sets the bit at offset in the bitmap stored at key to value, 0 or
+// 1, and returns the bit it replaced. The bitmap is created if key does not
+// exist and grows with zero bits to hold offset, which must be below 2^32.
+// Bit 0 is the most significant bit of the first byte.
+func (c *Client) SetBit(key string, offset int64, value int) (int, error) {
+	if value != 0 && value != 1 {
+		return 0, fmt.Errorf("setbit failed: value must be 0 or 1")
+	}
+
+	response, err := c.sendCommand("SETBIT", key, fmt.Sprint(offset), fmt.Sprint(value))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// GetBit returns the bit at offset in the bitmap stored at key. Bits past
+// the end of the bitmap, and of a missing key, are 0.
+func (c *Client) GetBit(key string, offset int64) (int, error) {
+	response, err := c.sendCommand("GETBIT", key, fmt.Sprint(offset))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// BitCount returns the number of bits set in the bytes start to end, both
+// inclusive, of the bitmap stored at key. Negative offsets count from the
+// last byte, so 0 and -1 cover the whole bitmap. A missing key counts 0.
+func (c *Client) BitCount(key string, start, end int64) (int64, error) {
+	response, err := c.sendCommand("BITCOUNT", key, fmt.Sprint(start), fmt.Sprint(end))
+	if err != nil {
+		return 0, err
+	}
+
+	return response.num, nil
+}
+
+// PFAdd adds elements to the HyperLogLog stored at key, creating it if
+// needed, and reports whether its estimate changed. A HyperLogLog counts
+// distinct elements approximately, with a standard error of 0.81%, in a
+// fixed 12KB however many elements it has seen.
+func (c *Client) PFAdd(key string, elements ...string) (bool, error) {
+	response, err := c.sendCommand("PFADD", append([]string{key}, elements...)...)
+	if err != nil {
+		return false, err
+	}
+
+	return response.num == 1, nil
+}
+
+// PFCount returns the estimated number of distinct elements added to the
+// HyperLogLogs stored at keys, counting elements added to several of them
+// once. Missing keys count as empty.
+func (c *Client) PFCount(keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("pfcount failed: no keys given")
+	}
+
+	response, err := c.sendCommand("PFCOUNT", keys...)
+	if err != nil {
+		return 0, err
+	}
+
+	return response.num, nil
+}
+
+// PFMerge stores at dest a HyperLogLog of the union of dest and the
+// HyperLogLogs stored at sources
+func (c *Client) PFMerge(dest string, sources ...string) error {
+	_, err := c.sendCommand("PFMERGE", append([]string{dest}, sources...)...)
+	return err
+}
+
+// LPushCapped prepends values to the list stored at key and trims it to the
+// maxLen most recently pushed items, as one atomic operation, so the list
+// never holds more than maxLen items. It returns the resulting length.
+func (c *Client) LPushCapped(key string, maxLen int, values ...string) (int, error) {
+	return c.pushCapped("LPUSHCAPPED", key, maxLen, values)
+}
+
+// RPushCapped appends values to the list stored at key and trims it to the
+// maxLen most recently pushed items, as one atomic operation, so the list
+// never holds more than maxLen items. It returns the resulting length.
+func (c *Client) RPushCapped(key string, maxLen int, values ...string) (int, error) {
+	return c.pushCapped("RPUSHCAPPED", key, maxLen, values)
+}
+
+func (c *Client) pushCapped(name, key string, maxLen int, values []string) (int, error) {
+	if maxLen <= 0 {
+		return 0, fmt.Errorf("%s failed: maxLen must be positive", strings.ToLower(name))
+	}
+	if len(values) == 0 {
+		return c.LLen(key)
+	}
+
+	args := append([]string{key, fmt.Sprint(maxLen)}, values...)
+	response, err := c.sendCommand(name, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// LPopN removes and returns up to count items from the head of the list
+// stored at key, in the order they were popped, as one atomic operation.
+// It returns fewer items when the list is shorter and none when it does
+// not exist.
+func (c *Client) LPopN(key string, count int) ([]string, error) {
+	return c.popN("LPOP", key, count)
+}
+
+// RPopN removes and returns up to count items from the tail of the list
+// stored at key, last item first, as one atomic operation
+func (c *Client) RPopN(key string, count int) ([]string, error) {
+	return c.popN("RPOP", key, count)
+}
+
+func (c *Client) popN(name, key string, count int) ([]string, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("%s failed: count must not be negative", strings.ToLower(name))
+	}
+
+	response, err := c.sendCommand(name, key, fmt.Sprint(count))
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]string, len(response.elems))
+	for i, elem := range response.elems {
+		items[i] = elem.str
+	}
+	return items, nil
+}
+
+// LLen returns the length of the list stored at key, or 0 if it does not exist
+func (c *Client) LLen(key string) (int, error) {
+	response, err := c.sendCommand("LLEN", key)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// LTrim trims the list stored at key to the elements between start and stop,
+// both inclusive. Negative indices count from the end of the list; a range
+// that covers no elements empties the list.
+func (c *Client) LTrim(key string, start, stop int) error {
+	_, err := c.sendCommand("LTRIM", key, fmt.Sprint(start), fmt.Sprint(stop))
+	return err
+}
+
+// ClaimJob takes the job at the head of the queue stored at key and returns
+// it with the id to acknowledge it by. The job stays claimed for the
+// visibility timeout; if it is not acknowledged with AckJob by then, it goes
+// back to the head of the queue to be claimed again, so a job is never lost
+// to a worker that crashed. Jobs are added to the queue with RPUSH; claimed
+// jobs are kept in a hash at key + ":claimed". It returns ErrNoJob when no
+// job is ready.
+func (c *Client) ClaimJob(queue string, visibility time.Duration) (id, job string, err error) {
+	if visibility < time.Millisecond {
+		return "", "", fmt.Errorf("claimjob failed: invalid visibility timeout %v", visibility)
+	}
+
+	response, err := c.sendCommand("CLAIMJOB", queue, fmt.Sprint(visibility.Milliseconds()))
+	if err != nil {
+		return "", "", err
+	}
+	if response.kind == kindNil {
+		return "", "", ErrNoJob
+	}
+	if len(response.elems) != 2 {
+		return "", "", fmt.Errorf("claimjob failed: unexpected reply")
+	}
+
+	return response.elems[0].str, response.elems[1].str, nil
+}
+
+// AckJob marks the job claimed from queue as id done, removing it for good.
+// It returns an error wrapping ErrKeyNotFound when no job is claimed as id,
+// as when its visibility timeout passed and it went back to the queue.
+func (c *Client) AckJob(queue, id string) error {
+	response, err := c.sendCommand("ACKJOB", queue, id)
+	if err != nil {
+		return err
+	}
+	if response.num == 0 {
+		return fmt.Errorf("ackjob failed: job %s: %w", id, ErrKeyNotFound)
+	}
+
+	return nil
+}
+
+// SMIsMember reports, for each of members, whether it belongs to the set
+// stored at key. The result is aligned with members; a missing key yields
+// all false.
+func (c *Client) SMIsMember(key string, members ...string) ([]bool, error) {
+	if len(members) == 0 {
+		return []bool{}, nil
+	}
+
+	response, err := c.sendCommand("SMISMEMBER", append([]string{key}, members...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]bool, len(response.elems))
+	for i, elem := range response.elems {
+		result[i] = elem.num == 1
+	}
+	return result, nil
+}
+
+// SRandMember returns up to count random members of the set stored at key.
+// A positive count returns distinct members; a negative count may return
+// the same member several times and always yields -count members for a
+// non-empty set. The server refuses negative counts below -1,000,000.
+func (c *Client) SRandMember(key string, count int) ([]string, error) {
+	response, err := c.sendCommand("SRANDMEMBER", key, fmt.Sprint(count))
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, len(response.elems))
+	for i, elem := range response.elems {
+		members[i] = elem.str
+	}
+	return members, nil
+}
+
+// ZRemRangeByRank removes the members of the sorted set stored at key
+// ranked start to stop by ascending score, both inclusive, and returns how
+// many it removed. Negative ranks count from the highest score, so
+// ZRemRangeByRank(key, 0, -11) keeps only the top 10. The key is deleted
+// once empty.
+func (c *Client) ZRemRangeByRank(key string, start, stop int) (int, error) {
+	response, err := c.sendCommand("ZREMRANGEBYRANK", key, fmt.Sprint(start), fmt.Sprint(stop))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// ZRemRangeByScore removes the members of the sorted set stored at key
+// scored between min and max, both inclusive, and returns how many it
+// removed. Infinite bounds leave that end of the range open. The key is
+// deleted once empty.
+func (c *Client) ZRemRangeByScore(key string, min, max float64) (int, error) {
+	response, err := c.sendCommand("ZREMRANGEBYSCORE", key, formatScore(min), formatScore(max))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// formatScore formats a sorted set score the way the server parses it
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// RandomKey returns a random existing key, or ErrEmpty when the database
+// holds no keys
+func (c *Client) RandomKey() (string, error) {
+	response, err := c.sendCommand("RANDOMKEY")
+	if err != nil {
+		return "", err
+	}
+
+	if response.kind == kindNil {
+		return "", ErrEmpty
+	}
+
+	return response.str, nil
+}
+
+// Scan returns up to count keys following cursor, in key order, and the
+// cursor to continue from. Start with "0"; a returned cursor of "0" means
+// the iteration is complete. Keys added or removed during the iteration may
+// or may not be returned.
+func (c *Client) Scan(cursor string, count int) (string, []string, error) {
+	return c.cursorPage("SCAN", cursor, "COUNT", fmt.Sprint(count))
+}
+
+// Iterate returns an iterator over the keys matching the glob pattern, or
+// every key if pattern is empty, driving SCAN one page at a time as the
+// loop advances:
+//
+//	for key, err := range client.Iterate("user:*") {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// A failed page is yielded as an error with an empty key and ends the
+// iteration. The same guarantees as Scan apply to keys changed meanwhile.
+func (c *Client) Iterate(pattern string) iter.Seq2[string, error] {
+	return iterateKeys(pattern, c.cursorPage)
+}
+
+// iterateKeys yields the keys matching pattern, fetching each SCAN page
+// with page
+func iterateKeys(pattern string, page func(name, cursor string, args ...string) (string, []string, error)) iter.Seq2[string, error] {
+	var args []string
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	return func(yield func(string, error) bool) {
+		cursor := "0"
+		for {
+			next, keys, err := page("SCAN", cursor, args...)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, key := range keys {
+				if !yield(key, nil) {
+					return
+				}
+			}
+			if next == "0" {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+// KV is a key and the string value stored at it, as GetMatching yields
+// them. Value holds the bytes stored, binary data included.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// getMatchingBatch is the number of keys GetMatching examines per round trip
+const getMatchingBatch = 100
+
+// GetMatching returns an iterator over the keys matching the glob pattern,
+// or every key if pattern is empty, with their values. The server reads the
+// values of a page of keys as it scans them, so a page takes one round trip
+// rather than one GET per key, and neither end holds more than a page at a
+// time:
+//
+//	for kv, err := range client.GetMatching("user:*") {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Keys holding anything but a string are skipped. A failed page is yielded
+// as an error with an empty KV and ends the iteration. The same guarantees
+// as Scan apply to keys changed meanwhile.
+func (c *Client) GetMatching(pattern string) iter.Seq2[KV, error] {
+	return iterateValues(pattern, c.cursorPage)
+}
+
+// iterateValues yields the string values of the keys matching pattern,
+// fetching each GETMATCHING page with page
+func iterateValues(pattern string, page func(name, cursor string, args ...string) (string, []string, error)) iter.Seq2[KV, error] {
+	args := []string{"COUNT", fmt.Sprint(getMatchingBatch)}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	return func(yield func(KV, error) bool) {
+		cursor := "0"
+		for {
+			next, pairs, err := page("GETMATCHING", cursor, args...)
+			if err != nil {
+				yield(KV{}, err)
+				return
+			}
+			if len(pairs)%2 != 0 {
+				yield(KV{}, fmt.Errorf("getmatching failed: unexpected reply"))
+				return
+			}
+			for i := 0; i < len(pairs); i += 2 {
+				if !yield(KV{Key: pairs[i], Value: pairs[i+1]}, nil) {
+					return
+				}
+			}
+			if next == "0" {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+// ScanByAge returns up to count keys whose value was last written at least
+// olderThan ago, such as to prune data never given an expiry. It walks the
+// keyspace in key order a page of count keys at a time until it has count
+// keys or reaches the end, so deleting the keys returned and calling it
+// again moves on to the next ones. Keys last written before the server
+// recorded write times are never returned, as their age is unknown.
+func (c *Client) ScanByAge(olderThan time.Duration, count int) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		next, page, err := c.cursorPage("SCANBYAGE", cursor, fmt.Sprint(olderThan.Milliseconds()), "COUNT", fmt.Sprint(count))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if len(keys) >= count {
+			return keys[:count], nil
+		}
+		if next == "0" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// cursorPage runs one step of a cursor-based command that replies with the
+// next cursor and a page of items
+func (c *Client) cursorPage(name, cursor string, args ...string) (string, []string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	response, err := c.sendCommand(name, append([]string{cursor}, args...)...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(response.elems) != 2 {
+		return "", nil, fmt.Errorf("%s failed: unexpected reply", strings.ToLower(name))
+	}
+	items := make([]string, len(response.elems[1].elems))
+	for i, elem := range response.elems[1].elems {
+		items[i] = elem.str
+	}
+	return response.elems[0].str, items, nil
 }
 
-// NewClient creates a new DiskDB client
-func NewClient(address string) (*Client, error) {
-	conn, err := net.Dial("tcp", address)
+// Expire sets a timeout on key, after which it is deleted. It is PExpire
+// with ttl truncated to whole seconds, so 1.9s expires after 1s and a ttl
+// below one second deletes the key immediately. It returns false when the
+// key does not exist.
+func (c *Client) Expire(key string, ttl time.Duration) (bool, error) {
+	return c.PExpire(key, ttl.Truncate(time.Second))
+}
+
+// PExpire sets a timeout on key with millisecond precision, after which it
+// is deleted. ttl is truncated to whole milliseconds; below one millisecond
+// the key is deleted immediately. It returns false when the key does not
+// exist.
+func (c *Client) PExpire(key string, ttl time.Duration) (bool, error) {
+	response, err := c.sendCommand("PEXPIRE", key, fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return false, err
+	}
+
+	return response.num == 1, nil
+}
+
+// TTL returns the remaining time to live of key rounded to the nearest
+// second, as PTTL reports it, or NoExpiry if it has no expiry or KeyMissing
+// if it does not exist. A key with under half a second left reads as 0.
+func (c *Client) TTL(key string) (time.Duration, error) {
+	ttl, err := c.PTTL(key)
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	return ttl.Round(time.Second), nil
+}
+
+// PTTL returns the remaining time to live of key with millisecond
+// precision, or NoExpiry or KeyMissing like TTL
+func (c *Client) PTTL(key string) (time.Duration, error) {
+	response, err := c.sendCommand("PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.num < 0 {
+		return time.Duration(response.num), nil
+	}
+	return time.Duration(response.num) * time.Millisecond, nil
+}
+
+// MTTL returns the time to live of every key in one round trip, aligned with
+// keys. Like TTL, missing keys yield KeyMissing and keys without expiry
+// NoExpiry.
+func (c *Client) MTTL(keys ...string) ([]time.Duration, error) {
+	if len(keys) == 0 {
+		return []time.Duration{}, nil
+	}
+
+	response, err := c.sendCommand("MTTL", keys...)
 	if err != nil {
 		return nil, err
 	}
-	
-	return &Client{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-	}, nil
+
+	if len(response.elems) != len(keys) {
+		return nil, fmt.Errorf("mttl failed: expected %d replies, got %d", len(keys), len(response.elems))
+	}
+	ttls := make([]time.Duration, len(keys))
+	for i, elem := range response.elems {
+		ttls[i] = ttlDuration(elem.num)
+	}
+	return ttls, nil
+}
+
+// ttlDuration converts a TTL reply in seconds, passing the negative
+// sentinels through unchanged
+func ttlDuration(seconds int64) time.Duration {
+	if seconds < 0 {
+		return time.Duration(seconds)
+	}
+	return time.Duration(seconds) * time.Second
 }
 
-// sendCommand sends a command to the server and returns the response
-func (c *Client) sendCommand(command string) (string, error) {
-	_, err := c.conn.Write([]byte(command + "\n"))
+// Persist removes the expiry of key, reporting whether it had one
+func (c *Client) Persist(key string) (bool, error) {
+	response, err := c.sendCommand("PERSIST", key)
 	if err != nil {
-		return "", err
+		return false, err
+	}
+
+	return response.num == 1, nil
+}
+
+// RenamePersist renames src to dst and removes its expiry in one step,
+// replacing any value dst held. A key written under a temporary name with a
+// safety TTL can be promoted this way without a window in which it is
+// renamed but could still expire. It returns ErrKeyNotFound if src does not
+// exist.
+func (c *Client) RenamePersist(src, dst string) error {
+	_, err := c.sendCommand("RENAMEPERSIST", src, dst)
+	if errors.Is(err, ErrKeyNotFound) {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, src)
 	}
-	
-	response, err := c.reader.ReadString('\n')
+	return err
+}
+
+// Swap exchanges the values of keyA and keyB, of any type, in one step that
+// no other client can observe half done. A missing key takes part like any
+// other, so swapping with one moves the value over and deletes the
+// original. Each key keeps its own expiry; see SwapWithTTL.
+func (c *Client) Swap(keyA, keyB string) error {
+	_, err := c.sendCommand("SWAP", keyA, keyB)
+	return err
+}
+
+// SwapWithTTL is Swap with the expiries exchanged along with the values, so
+// a value keeps the expiry it was written with under its new key
+func (c *Client) SwapWithTTL(keyA, keyB string) error {
+	_, err := c.sendCommand("SWAP", keyA, keyB, "WITHTTL")
+	return err
+}
+
+// DeleteIfEquals deletes key only if it holds the string expected, as one
+// atomic compare-and-delete on the server, and reports whether it did. A
+// missing key or a different value leaves the database untouched; a key
+// holding another type is an error.
+func (c *Client) DeleteIfEquals(key, expected string) (bool, error) {
+	response, err := c.sendCommand("DELIFEQ", key, expected)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	
-	return strings.TrimSpace(response), nil
+
+	return response.num == 1, nil
 }
 
-// Set stores a key-value pair in the database
-func (c *Client) Set(key, value string) error {
-	response, err := c.sendCommand(fmt.Sprintf("SET %s %s", key, value))
+// SetIfVersion stores value at key only if the key's version is
+// expectedVersion, as one atomic check-and-set on the server, for
+// optimistic concurrency without comparing whole values. On success ok is
+// true and newVersion is the key's new version; otherwise nothing is
+// written and newVersion is the current version, to merge against and
+// retry with.
+//
+// A missing key is at version 0. Every write of the key raises its version,
+// however it is written, and a version never comes back, not even after
+// the key is deleted and written again. Versions are not consecutive;
+// GetIfChanged reads the current one along with the value.
+func (c *Client) SetIfVersion(key, value string, expectedVersion int64) (newVersion int64, ok bool, err error) {
+	if expectedVersion < 0 {
+		return 0, false, fmt.Errorf("setifversion failed: expectedVersion must not be negative")
+	}
+
+	response, err := c.sendCommand("SETIFVERSION", key, fmt.Sprint(expectedVersion), value)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(response.elems) != 2 {
+		return 0, false, fmt.Errorf("setifversion failed: unexpected reply")
+	}
+
+	return response.elems[0].num, response.elems[1].num == 1, nil
+}
+
+// GetIfChanged retrieves the value of key only if it changed since
+// sinceVersion, like an HTTP conditional request with an ETag, so pollers
+// do not transfer values they already hold. The server keeps a version per
+// key that every write of it raises, however it is written, and that never
+// goes back; it is the version SetIfVersion checks. version is the key's current
+// version, to pass as sinceVersion next time, and changed says whether value
+// was sent. Pass 0 to fetch the value whatever its version. It returns
+// ErrKeyNotFound if the key does not exist or has expired.
+func (c *Client) GetIfChanged(key string, sinceVersion int64) (value string, version int64, changed bool, err error) {
+	if sinceVersion < 0 {
+		return "", 0, false, fmt.Errorf("getifchanged failed: sinceVersion must not be negative")
+	}
+
+	response, err := c.sendCommand("GETIFCHANGED", key, fmt.Sprint(sinceVersion))
+	if err != nil {
+		return "", 0, false, err
+	}
+	if response.kind == kindNil {
+		return "", 0, false, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	if len(response.elems) != 2 {
+		return "", 0, false, fmt.Errorf("getifchanged failed: unexpected reply")
+	}
+
+	if response.elems[1].kind == kindNil {
+		return "", response.elems[0].num, false, nil
+	}
+	return response.elems[1].str, response.elems[0].num, true, nil
+}
+
+// SetTagged stores a key-value pair like Set and replaces the key's tags
+// with tags, so KeysByTag finds the key under each of them, as one write.
+// The key keeps its tags when its value is written any other way, and
+// loses them when it is deleted or expires; SetTagged without tags clears
+// them.
+func (c *Client) SetTagged(key, value string, tags ...string) error {
+	response, err := c.sendCommand("SETTAGGED", append([]string{key, value}, tags...)...)
 	if err != nil {
 		return err
 	}
-	
-	if response != "OK" {
-		return fmt.Errorf("set failed: %s", response)
+
+	if response.kind != kindStatus || response.str != "OK" {
+		return fmt.Errorf("settagged failed: %s", response.str)
 	}
-	
+
 	return nil
 }
 
-// Get retrieves a value by key from the database
-func (c *Client) Get(key string) (string, error) {
-	response, err := c.sendCommand(fmt.Sprintf("GET %s", key))
+// KeysByTag returns the keys tagged tag with SetTagged, in key order. The
+// server reads them from an index kept per tag rather than scanning the
+// keyspace, so it suits grouped lookups such as all sessions of a user.
+func (c *Client) KeysByTag(tag string) ([]string, error) {
+	response, err := c.sendCommand("KEYSBYTAG", tag)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(response.elems))
+	for i, elem := range response.elems {
+		keys[i] = elem.str
+	}
+	return keys, nil
+}
+
+// SetName names the connection, so it can be told apart from others in the
+// server's CLIENT LIST, and keeps the name across reconnects. Names cannot
+// contain spaces or control characters; an empty name clears it.
+func (c *Client) SetName(name string) error {
+	if _, err := c.sendCommand("CLIENT", "SETNAME", name); err != nil {
+		return err
+	}
+	c.name = name
+	return nil
+}
+
+// SetTiming turns on or off the server's reporting of how long it takes to
+// execute each command on this connection, which Reply.ServerTime returns
+// for replies to Do. Comparing it with the round trip separates time spent
+// on the server from time spent on the network. Timing is off by default.
+func (c *Client) SetTiming(on bool) error {
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	if _, err := c.sendCommand("DEBUG", "TIMING", state); err != nil {
+		return err
+	}
+	c.timing = on
+	return nil
+}
+
+// Select switches this connection to the database with the given index
+func (c *Client) Select(db int) error {
+	if _, err := c.sendCommand("SELECT", fmt.Sprint(db)); err != nil {
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+// Move transfers key from the currently selected database to db. It returns
+// false, leaving both databases untouched, when the key does not exist in
+// the current database or already exists in db.
+func (c *Client) Move(key string, db int) (bool, error) {
+	response, err := c.sendCommand("MOVE", key, fmt.Sprint(db))
+	if err != nil {
+		return false, err
+	}
+
+	return response.num == 1, nil
+}
+
+// SwapDB exchanges the contents of databases a and b in one atomic step:
+// every client, whichever database it has selected, sees either the old or
+// the new contents, never a mix. Building a dataset in one database and
+// swapping it with the live one gives an instant cutover, and swapping back
+// an instant rollback.
+//
+// The swap is not persisted. Each database keeps its own files, and after a
+// restart every index opens its files again, which undoes the swap.
+func (c *Client) SwapDB(a, b int) error {
+	_, err := c.sendCommand("SWAPDB", fmt.Sprint(a), fmt.Sprint(b))
+	return err
+}
+
+// DumpKey returns an opaque, versioned and checksummed serialization of the
+// value stored at key, suitable for RestoreKey on another instance
+func (c *Client) DumpKey(key string) ([]byte, error) {
+	response, err := c.sendCommand("DUMP", key)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.kind == kindNil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	data, err := hex.DecodeString(response.str)
+	if err != nil {
+		return nil, fmt.Errorf("dump failed: invalid payload: %w", err)
+	}
+	return data, nil
+}
+
+// RestoreKey recreates key from data produced by DumpKey. A ttl of zero
+// creates a key without expiry; the server rejects corrupt payloads. Unless
+// replace is set, an existing key is left alone and ErrKeyExists returned.
+func (c *Client) RestoreKey(key string, ttl time.Duration, data []byte, replace bool) error {
+	args := []string{key, fmt.Sprint(ttl.Milliseconds()), hex.EncodeToString(data)}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+
+	_, err := c.sendCommand("RESTORE", args...)
+	return err
+}
+
+// KeyStats returns the GET hits and misses counted for keys starting with
+// prefix since the server started. Only the prefixes listed in the server's
+// DISKDB_KEYSTATS_PREFIXES are counted; asking for any other is an error.
+func (c *Client) KeyStats(prefix string) (hits, misses int64, err error) {
+	response, err := c.sendCommand("KEYSTATS", prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(response.elems) != 2 {
+		return 0, 0, fmt.Errorf("keystats failed: unexpected reply with %d elements", len(response.elems))
+	}
+	return response.elems[0].num, response.elems[1].num, nil
+}
+
+// DebugInfo holds the internal details of a key reported by DEBUG OBJECT
+type DebugInfo struct {
+	// Encoding is the in-memory representation: "int" or "raw" for strings,
+	// "vector", "hashtable", "btree" or "json" for the other types
+	Encoding string
+	// SerializedLength is the size of the value as DUMP serializes it
+	SerializedLength int64
+	// Fields holds every field of the reply, including ones without a
+	// dedicated member such as "memory" and "ttl"
+	Fields map[string]string
+}
+
+// DebugObject returns low-level details about key. The server only allows it
+// when started with DISKDB_ENABLE_DEBUG=1. It keeps no LRU or LFU metadata
+// since it does not evict keys.
+func (c *Client) DebugObject(key string) (DebugInfo, error) {
+	response, err := c.sendCommand("DEBUG", "OBJECT", key)
+	if err != nil {
+		return DebugInfo{}, err
+	}
+
+	if response.kind == kindNil {
+		return DebugInfo{}, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	info := DebugInfo{Fields: make(map[string]string)}
+	for _, field := range strings.Fields(response.str) {
+		name, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		info.Fields[name] = value
+		switch name {
+		case "encoding":
+			info.Encoding = value
+		case "serializedlength":
+			info.SerializedLength, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return info, nil
+}
+
+// ServerLogTail returns the last lines lines of the server's log, oldest
+// first: its errors, warnings and lifecycle events, kept in memory whatever
+// the log level. Like DebugObject it needs a server started with
+// DISKDB_ENABLE_DEBUG=1.
+func (c *Client) ServerLogTail(lines int) ([]string, error) {
+	if lines < 0 {
+		return nil, fmt.Errorf("debug logtail failed: invalid line count %d", lines)
+	}
+
+	response, err := c.sendCommand("DEBUG", "LOGTAIL", fmt.Sprint(lines))
+	if err != nil {
+		return nil, err
+	}
+
+	tail := make([]string, 0, len(response.elems))
+	for _, elem := range response.elems {
+		tail = append(tail, elem.str)
+	}
+	return tail, nil
+}
+
+// MemoryUsage estimates the bytes key occupies, counting its name, value and
+// expiry
+func (c *Client) MemoryUsage(key string) (int64, error) {
+	response, err := c.sendCommand("MEMORY", "USAGE", key)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.kind == kindNil {
+		return 0, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return response.num, nil
+}
+
+// ObjectEncoding returns how the value at key is stored: "compressed" for a
+// value stored compressed, or else the encoding of its type, such as "int"
+// or "raw" for strings and "hashtable" for sets and hashes. It returns
+// ErrKeyNotFound if key does not exist.
+func (c *Client) ObjectEncoding(key string) (string, error) {
+	response, err := c.sendCommand("OBJECT", "ENCODING", key)
+	if err != nil {
+		return "", err
+	}
+
+	if response.kind == kindNil {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return response.str, nil
+}
+
+// Warmup has the server read every key in the selected database matching
+// one of the glob patterns, or every key if none are given, so they are
+// already cached when clients first ask for them, such as after a restart.
+// It returns once the warmup has started; the Warmup section of INFO shows
+// its progress. Only one warmup runs at a time: starting another before it
+// ends fails with ErrWarmupInProgress.
+func (c *Client) Warmup(patterns ...string) error {
+	_, err := c.sendCommand("WARMUP", patterns...)
+	return err
+}
+
+// CompactInfo is the state of the latest compaction, as reported by
+// CompactStatus
+type CompactInfo struct {
+	// Running is whether a compaction is in progress
+	Running bool
+	// Progress is the percentage of keys compacted so far, estimated from
+	// the number of keys the storage engine reports. It only reaches 100
+	// once the compaction completes; a cancelled one stays below.
+	Progress int
+	// ReclaimedBytes is the disk space freed so far
+	ReclaimedBytes int64
+}
+
+// Compact has the server compact the selected database in the background,
+// rewriting its data without what was overwritten or deleted to reclaim
+// the space, a range of keys at a time. It returns once the compaction has
+// started; CompactStatus shows its progress. Only one compaction runs at a
+// time: starting another before it ends fails with
+// ErrCompactionInProgress.
+func (c *Client) Compact() error {
+	_, err := c.sendCommand("COMPACT")
+	return err
+}
+
+// CompactStatus reports the running compaction, or the last one if none is
+// running
+func (c *Client) CompactStatus() (CompactInfo, error) {
+	response, err := c.sendCommand("COMPACT", "STATUS")
+	if err != nil {
+		return CompactInfo{}, err
+	}
+
+	if len(response.elems) != 3 {
+		return CompactInfo{}, fmt.Errorf("compact failed: unexpected reply with %d elements", len(response.elems))
+	}
+	return CompactInfo{
+		Running:        response.elems[0].num == 1,
+		Progress:       int(response.elems[1].num),
+		ReclaimedBytes: response.elems[2].num,
+	}, nil
+}
+
+// CompactCancel stops the running compaction, such as one adding latency at
+// peak hours. It stops once the range of keys in progress is done, which
+// leaves the data consistent and the rest of it uncompacted; CompactStatus
+// reports it running until then. It does nothing when no compaction runs.
+func (c *Client) CompactCancel() error {
+	_, err := c.sendCommand("COMPACT", "CANCEL")
+	return err
+}
+
+// CompactKey has the server compact the data of key alone, dropping the
+// versions of its value that were overwritten, such as by many APPENDs or
+// SETRANGEs, without compacting the whole database. The value itself is
+// unchanged. Unlike Compact it returns once the compaction is done. It
+// returns an error wrapping ErrKeyNotFound if key does not exist.
+func (c *Client) CompactKey(key string) error {
+	_, err := c.sendCommand("COMPACT", "KEY", key)
+	return err
+}
+
+// SaveSnapshot has the server write a consistent snapshot of the selected
+// database to a new directory at path, and waits until it is done. Writes
+// go on meanwhile; the snapshot holds the data as of one moment. A server
+// pointed at the directory with DISKDB_PATH opens it as a database of its
+// own. The path is relative to the server's snapshot directory,
+// DISKDB_SNAPSHOT_DIR, and may contain neither "." nor "..", so clients
+// cannot write anywhere else on the server host. It must not exist yet;
+// missing parent directories are created. Only one snapshot is saved at a time: starting
+// another before it ends fails with ErrSnapshotInProgress.
+func (c *Client) SaveSnapshot(path string) error {
+	_, err := c.sendCommand("SAVE", path)
+	return err
+}
+
+// BackgroundSaveSnapshot is SaveSnapshot in the background: it returns once
+// the snapshot has started. The Snapshot section of INFO reports whether it
+// is still running and whether it succeeded, and LastSaveTime moves forward
+// once it is saved.
+func (c *Client) BackgroundSaveSnapshot(path string) error {
+	_, err := c.sendCommand("BGSAVE", path)
+	return err
+}
+
+// SnapshotMeta describes a snapshot, as reported by SnapshotInfo
+type SnapshotMeta struct {
+	// Version is the layout of the snapshot; a server only loads the
+	// version it writes
+	Version int
+	// Created is when the snapshot was taken
+	Created time.Time
+	// Keys is the number of keys in the snapshot, including expired ones
+	// not yet removed when it was taken
+	Keys int64
+	// Checksum is the SHA-256 of the snapshot's files, in hex
+	Checksum string
+	// Valid is whether the server would load the snapshot: it is of the
+	// server's version and its files match the checksum
+	Valid bool
+}
+
+// SnapshotInfo reads the manifest of the snapshot at path and checks its
+// files, without loading it, to validate a backup before relying on it.
+// The path is relative to the server's snapshot directory, as for
+// SaveSnapshot; nothing outside it is read. A snapshot is loaded by starting
+// the server with DISKDB_RESTORE_SNAPSHOT set to its full path.
+func (c *Client) SnapshotInfo(path string) (SnapshotMeta, error) {
+	response, err := c.sendCommand("SNAPSHOT", "INFO", path)
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+
+	var meta SnapshotMeta
+	for i := 0; i+1 < len(response.elems); i += 2 {
+		value := response.elems[i+1]
+		switch response.elems[i].str {
+		case "version":
+			meta.Version = int(value.num)
+		case "created-ms":
+			meta.Created = time.UnixMilli(value.num)
+		case "keys":
+			meta.Keys = value.num
+		case "checksum":
+			meta.Checksum = value.str
+		case "valid":
+			meta.Valid = value.num == 1
+		}
+	}
+	return meta, nil
+}
+
+// LastSaveTime returns when the latest snapshot was saved, to the second,
+// or the zero time if none has been since the server started
+func (c *Client) LastSaveTime() (time.Time, error) {
+	response, err := c.sendCommand("LASTSAVE")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if response.num == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(response.num, 0), nil
+}
+
+// AuditEntry is a command the server refused, as reported by AuditLog
+type AuditEntry struct {
+	// ID counts up from 1 over the server's lifetime, resets included
+	ID int64
+	// Time is when the command was refused
+	Time time.Time
+	// Addr is the client's address, as in CLIENT LIST
+	Addr string
+	// Command is the name of the refused command, or empty if it was
+	// refused before being read, such as a client over the connection
+	// limit
+	Command string
+	// Reason is the error the client got
+	Reason string
+}
+
+// AuditLog returns the latest count commands the server refused, newest
+// first: clients over the connection limit, commands with too many
+// arguments or invalid UTF-8, disabled DEBUG and SHUTDOWN commands, writes
+// refused by a full write backlog and writes over the key limit. The server keeps the
+// latest DISKDB_AUDIT_LOG_SIZE, 128 by default, dropping the oldest first.
+func (c *Client) AuditLog(count int) ([]AuditEntry, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("auditlog failed: invalid count %d", count)
+	}
+
+	response, err := c.sendCommand("AUDITLOG", "GET", fmt.Sprint(count))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(response.elems))
+	for _, elem := range response.elems {
+		if len(elem.elems) != 5 {
+			return nil, fmt.Errorf("auditlog failed: unexpected entry with %d elements", len(elem.elems))
+		}
+		entries = append(entries, AuditEntry{
+			ID:      elem.elems[0].num,
+			Time:    time.UnixMilli(elem.elems[1].num),
+			Addr:    elem.elems[2].str,
+			Command: elem.elems[3].str,
+			Reason:  elem.elems[4].str,
+		})
+	}
+	return entries, nil
+}
+
+// ResetAuditLog clears the server's audit log
+func (c *Client) ResetAuditLog() error {
+	_, err := c.sendCommand("AUDITLOG", "RESET")
+	return err
+}
+
+// Shutdown stops the server: it stops accepting connections and the
+// process exits. With save, every open database is first flushed to disk,
+// so the restart replays no log; without it the server stops at once and
+// recovers what it had accepted from its write-ahead log on restart, as
+// after a crash. If the flush fails the server keeps running and the error
+// is returned. The server only accepts it when started with
+// DISKDB_ENABLE_SHUTDOWN=1. The client cannot be used afterwards.
+func (c *Client) Shutdown(save bool) error {
+	mode := "NOSAVE"
+	if save {
+		mode = "SAVE"
+	}
+	_, err := c.sendCommand("SHUTDOWN", mode)
+	// The server may exit before its reply is read
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// MemoryStats returns an overall breakdown for the server and the selected
+// database, such as "connected-clients", "expires.count" and
+// "memtables.bytes". The figures available depend on the storage engine.
+func (c *Client) MemoryStats() (map[string]int64, error) {
+	response, err := c.sendCommand("MEMORY", "STATS")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int64, len(response.elems)/2)
+	for i := 0; i+1 < len(response.elems); i += 2 {
+		stats[response.elems[i].str] = response.elems[i+1].num
+	}
+	return stats, nil
+}
+
+// ExpireInfo is the state of keys with an expiry across the open databases
+// and of the server's background reaper, as reported by ExpireStats
+type ExpireInfo struct {
+	// Keys is the number of keys with an expiry
+	Keys int64
+	// Pending counts keys past their expiry that are not yet removed; they
+	// go unseen by clients but still take up memory and disk
+	Pending int64
+	// KeysPerCycle is the most expired keys the reaper removes from each
+	// database per cycle, every 100ms; 0 means it is off and expired keys
+	// stay until they are read
+	KeysPerCycle int64
+	// Cycles counts the reaper's cycles since the server started
+	Cycles int64
+	// ScanRate is how many keys with an expiry the reaper looked at per
+	// second in its latest cycle
+	ScanRate int64
+	// LastReaped counts the keys removed in the latest cycle
+	LastReaped int64
+	// TotalReaped counts the keys the reaper removed since the server
+	// started
+	TotalReaped int64
+}
+
+// ExpireStats reports how many keys are past their expiry and not yet
+// removed, and what the background reaper removed lately. Pending staying
+// high while LastReaped equals KeysPerCycle means the reaper falls behind;
+// raising its active-expire-keys setting with ConfigSet lets it catch up.
+func (c *Client) ExpireStats() (ExpireInfo, error) {
+	response, err := c.sendCommand("EXPIRESTATS")
+	if err != nil {
+		return ExpireInfo{}, err
+	}
+
+	var info ExpireInfo
+	fields := map[string]*int64{
+		"expires.count":         &info.Keys,
+		"expires.due":           &info.Pending,
+		"reaper.keys-per-cycle": &info.KeysPerCycle,
+		"reaper.cycles":         &info.Cycles,
+		"reaper.scan-rate":      &info.ScanRate,
+		"reaper.last-reaped":    &info.LastReaped,
+		"reaper.total-reaped":   &info.TotalReaped,
+	}
+	for i := 0; i+1 < len(response.elems); i += 2 {
+		if field, ok := fields[response.elems[i].str]; ok {
+			*field = response.elems[i+1].num
+		}
+	}
+	return info, nil
+}
+
+// ConfigGet returns the value of a server setting: "active-expire-keys",
+// the most expired keys the background reaper removes from each database
+// per cycle, or "max-commands-per-second", the most commands each
+// connection may send per second, zero for no limit.
+func (c *Client) ConfigGet(parameter string) (string, error) {
+	response, err := c.sendCommand("CONFIG", "GET", parameter)
 	if err != nil {
 		return "", err
 	}
-	
-	if strings.HasPrefix(response, "ERROR:") {
-		return "", fmt.Errorf("key not found: %s", key)
+
+	if len(response.elems) != 2 {
+		return "", fmt.Errorf("config get failed: unexpected reply with %d elements", len(response.elems))
+	}
+	return response.elems[1].str, nil
+}
+
+// ConfigSet changes a server setting while it runs. Only
+// "active-expire-keys" can be changed; "max-commands-per-second" is fixed
+// at startup, so rate-limited clients cannot lift it. The change lasts
+// until the server restarts, which goes back to its environment, such as
+// DISKDB_ACTIVE_EXPIRE_KEYS.
+func (c *Client) ConfigSet(parameter, value string) error {
+	_, err := c.sendCommand("CONFIG", "SET", parameter, value)
+	return err
+}
+
+// Metrics returns the server's metrics in the Prometheus text exposition
+// format: commands executed by kind, connected clients, pending writes,
+// memory, and keys, disk usage and evictions of each open database. The
+// same page is served over HTTP when the server sets DISKDB_METRICS_ADDR.
+func (c *Client) Metrics() (string, error) {
+	response, err := c.sendCommand("METRICS")
+	if err != nil {
+		return "", err
+	}
+	return response.str, nil
+}
+
+// WriteStats returns the bytes written to the selected database since the
+// server started: logicalBytes as clients wrote them, keys and values
+// before compression, and physicalBytes as they reached the disk through
+// the write-ahead log, flushes and compactions. Their ratio, the write
+// amplification, shows in the Disk section of INFO; it falls as
+// compaction is tuned to rewrite less.
+func (c *Client) WriteStats() (logicalBytes, physicalBytes int64, err error) {
+	response, err := c.sendCommand("INFO")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var logical, physical bool
+	for _, line := range strings.Split(response.str, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "logical_bytes_written":
+			logicalBytes, err = strconv.ParseInt(value, 10, 64)
+			logical = true
+		case "physical_bytes_written":
+			physicalBytes, err = strconv.ParseInt(value, 10, 64)
+			physical = true
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("info failed: invalid %s %q", name, value)
+		}
+	}
+	if !logical || !physical {
+		return 0, 0, errors.New("info failed: the server does not report bytes written")
+	}
+	return logicalBytes, physicalBytes, nil
+}
+
+// Ping checks that the connection and the server are alive
+func (c *Client) Ping() error {
+	_, err := c.sendCommand("PING")
+	return err
+}
+
+// InvokeFunction runs the server function name on key and returns its
+// reply. The function reads the key's value and writes the new one with no
+// other write in between, which covers read-modify-write updates the
+// typed commands do not. The server has these built in:
+//
+//   - clamp min max [delta]: adds delta to the integer at key and keeps it
+//     within min and max, replying with the new value
+//   - merge-json patch: merges patch into the JSON document at key as a
+//     JSON merge patch, replying with the merged document
+//   - cap-list max [value...]: appends the values to the list at key and
+//     drops its oldest items beyond max, replying with the new length
+//
+// An error reply, including one for an unknown function, is returned as
+// an error along with the reply.
+func (c *Client) InvokeFunction(name, key string, args ...string) (Reply, error) {
+	return c.Do(append([]string{"INVOKE", name, key}, args...)...)
+}
+
+// Time returns the server's clock, to microsecond precision. Computing
+// deadlines from it instead of the local clock keeps clients whose clocks
+// disagree consistent with each other. The round trip is not subtracted, so
+// the time is up to one round trip old when it returns.
+func (c *Client) Time() (time.Time, error) {
+	response, err := c.sendCommand("TIME")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(response.elems) != 2 {
+		return time.Time{}, fmt.Errorf("time failed: unexpected reply")
 	}
-	
-	return response, nil
+
+	seconds, err := strconv.ParseInt(response.elems[0].str, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time failed: %w", err)
+	}
+	micros, err := strconv.ParseInt(response.elems[1].str, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time failed: %w", err)
+	}
+	return time.Unix(seconds, micros*int64(time.Microsecond)), nil
 }
 
 // Close closes the connection to the server
@@ -86,17 +2120,17 @@ func ExampleUsage() {
 		panic(err)
 	}
 	defer client.Close()
-	
+
 	// Set some values
 	err = client.Set("name", "Jane Doe")
 	if err != nil {
 		panic(err)
 	}
-	
+
 	// Get values
 	value, err := client.Get("name")
 	if err != nil {
 		panic(err)
 	}
 	fmt.Printf("Name: %s\n", value)
-}
\ No newline at end of file
+}
@@ -0,0 +1,833 @@
+package diskdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer serves a small in-memory subset of the protocol with framed
+// replies: HELLO, PING, SET and GET. Other commands are passed to
+// handle, if set, which returns the raw reply to send. It returns the
+// address to dial.
+func fakeServer(t testing.TB, handle func(args []string) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	values := make(map[string]string)
+	reply := func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "HELLO":
+			return "+OK\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		case "SET":
+			old, existed := values[args[1]]
+			var nx, get bool
+			for _, option := range args[3:] {
+				nx = nx || strings.EqualFold(option, "NX")
+				get = get || strings.EqualFold(option, "GET")
+			}
+			if !nx || !existed {
+				values[args[1]] = args[2]
+			}
+			switch {
+			case get && existed:
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(old), old)
+			case get || (nx && existed):
+				return "$-1\r\n"
+			}
+			return "+OK\r\n"
+		case "GET":
+			value, ok := values[args[1]]
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		if handle != nil {
+			return handle(args)
+		}
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					args, err := splitArgs(line)
+					if err != nil || len(args) == 0 {
+						conn.Write([]byte("-ERR protocol error\r\n"))
+						continue
+					}
+					if _, err := conn.Write([]byte(reply(args))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestWithTimeoutSharesConnection(t *testing.T) {
+	addr := fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "SELECT":
+			return "+OK\r\n"
+		case "SLOW":
+			time.Sleep(200 * time.Millisecond)
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	c, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeouts(time.Second, time.Second)
+
+	// State changed through a view is the client's state
+	before := c.lastUsed
+	if err := c.WithTimeout(time.Second).Select(3); err != nil {
+		t.Fatal(err)
+	}
+	if c.db != 3 || !c.lastUsed.After(before) {
+		t.Fatalf("client did not see the view's Select: db %d", c.db)
+	}
+	if c.readTimeout != time.Second || c.writeTimeout != time.Second {
+		t.Fatalf("view changed the client's timeouts to %v/%v", c.readTimeout, c.writeTimeout)
+	}
+
+	// A timeout through a view closes the shared connection, so the late
+	// reply can never be read by the client
+	_, err = c.WithTimeout(20 * time.Millisecond).sendCommand("SLOW")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("SLOW through a view = %v, want a timeout", err)
+	}
+	if _, err := c.Get("k"); err == nil {
+		t.Fatal("client kept using the connection closed by its view")
+	}
+}
+
+// halfServer answers HELLO, then sends reply to the next command and
+// closes the connection. It returns the address to dial.
+func halfServer(t *testing.T, reply string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		r.ReadString('\n')
+		conn.Write([]byte("+OK\r\n"))
+		r.ReadString('\n')
+		conn.Write([]byte(reply))
+	}()
+	return ln.Addr().String()
+}
+
+func TestIncompleteReplyClosesConnection(t *testing.T) {
+	for _, half := range []string{"$10\r\nhello", "+O", "*2\r\n$1\r\na\r\n", "$5\r\nhello"} {
+		c, err := NewClient(halfServer(t, half))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := c.Get("k")
+		if !errors.Is(err, ErrIncompleteResponse) || v != "" {
+			t.Fatalf("%q: Get = %q, %v; want ErrIncompleteResponse", half, v, err)
+		}
+		if _, err := c.Get("k"); err == nil {
+			t.Fatalf("%q: connection reused after an incomplete reply", half)
+		}
+	}
+}
+
+func TestMalformedReplyClosesConnection(t *testing.T) {
+	addr := fakeServer(t, func(args []string) string {
+		// A reply the client cannot parse, followed by what would look
+		// like the reply to the next command
+		return "$x\r\n+OK\r\n"
+	})
+	c, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.sendCommand("BROKEN"); err == nil || !strings.HasPrefix(err.Error(), "protocol error:") {
+		t.Fatalf("BROKEN = %v, want a protocol error", err)
+	}
+	if err := c.Set("k", "v"); err == nil {
+		t.Fatal("connection reused after a malformed reply")
+	}
+}
+
+func TestDo(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] == "ECHO ALL" {
+			var out strings.Builder
+			fmt.Fprintf(&out, "*%d\r\n", len(args)-1)
+			for _, arg := range args[1:] {
+				fmt.Fprintf(&out, "$%d\r\n%s\r\n", len(arg), arg)
+			}
+			return out.String()
+		}
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Do("SET", "k", "two words\n"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Do("GET", "k")
+	if err != nil || r.Value() != "two words\n" {
+		t.Fatalf("GET = %v, %v", r.Value(), err)
+	}
+	if r, err := c.Do("GET", "missing"); err != nil || !r.IsNil() {
+		t.Fatalf("GET missing = %v, %v", r.Value(), err)
+	}
+
+	// The command name is encoded like any other argument
+	r, err = c.Do("ECHO ALL", "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	elems, ok := r.Value().([]Reply)
+	if !ok || len(elems) != 2 || elems[0].Value() != "a" || elems[1].Value() != "" {
+		t.Fatalf("ECHO ALL = %v", r.Value())
+	}
+	r, err = c.Do("NOPE")
+	if err == nil || r.Err() == nil || err.Error() != r.Err().Error() {
+		t.Fatalf("NOPE = %v, %v", r.Value(), err)
+	}
+	if !errors.Is(err, ErrUnknownCommand) || !strings.Contains(err.Error(), `"NOPE"`) {
+		t.Fatalf("NOPE failed with %v, want ErrUnknownCommand naming it", err)
+	}
+	if _, err := c.Do(); err == nil {
+		t.Fatal("Do without a command succeeded")
+	}
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	for _, c := range []struct {
+		msg, code string
+		is        error
+	}{
+		{"WRONGTYPE Operation against a key holding the wrong kind of value", "WRONGTYPE", ErrWrongType},
+		{"NOTFOUND no such key", "NOTFOUND", ErrKeyNotFound},
+		{"OOM Key limit exceeded: the database holds at most 3 keys", "OOM", ErrKeyLimitExceeded},
+		{"TIMEOUT command timed out", "TIMEOUT", ErrCommandTimedOut},
+		{"TRYAGAIN write backlog is full, retry later", "TRYAGAIN", ErrBusy},
+		{"BUSYKEY Target key name already exists", "BUSYKEY", ErrKeyExists},
+		{"RATELIMIT too many commands per second, slow down", "RATELIMIT", ErrRateLimited},
+		{"ERR invalid cursor", "ERR", nil},
+		{"NOAUTH authentication required", "NOAUTH", nil},
+		{"Value is not an integer", "ERR", nil},
+	} {
+		err := serverError("INCR", c.msg)
+		var serr *ServerError
+		if !errors.As(err, &serr) || serr.Code != c.code || serr.Message != c.msg {
+			t.Errorf("serverError(%q) = %#v, want code %s", c.msg, err, c.code)
+			continue
+		}
+		if c.is != nil && !errors.Is(err, c.is) {
+			t.Errorf("serverError(%q) = %v, want %v", c.msg, err, c.is)
+		}
+		if want := "incr failed: " + c.msg; err.Error() != want {
+			t.Errorf("Error() = %q, want %q", err.Error(), want)
+		}
+	}
+}
+
+func TestScanByAgeFollowsCursor(t *testing.T) {
+	// Two stale keys on each of three pages
+	pages := map[string]string{"0": "p1", "p1": "p2", "p2": "0"}
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "SCANBYAGE" || args[2] != "60000" {
+			return "-ERR unexpected command\r\n"
+		}
+		next := pages[args[1]]
+		a, b := next+":a", next+":b"
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(next), next, len(a), a, len(b), b)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys, err := c.ScanByAge(time.Minute, 3)
+	if err != nil || !reflect.DeepEqual(keys, []string{"p1:a", "p1:b", "p2:a"}) {
+		t.Fatalf("ScanByAge = %q, %v", keys, err)
+	}
+	keys, err = c.ScanByAge(time.Minute, 10)
+	if err != nil || len(keys) != 6 {
+		t.Fatalf("ScanByAge = %q, %v; want all six keys", keys, err)
+	}
+}
+
+func TestBigKeysKeepsLargestPerType(t *testing.T) {
+	pages := map[string][]string{
+		"0":  {"p1", "a", "string", "5", "l1", "list", "40", "b", "string", "900"},
+		"p1": {"p2", "c", "string", "70", "l2", "list", "3"},
+		"p2": {"0", "d", "string", "70", "l3", "list", "41"},
+	}
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		page, ok := pages[args[1]]
+		if args[0] != "BIGKEYS" || !ok {
+			return "-ERR unexpected command\r\n"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(page[0]), page[0], len(page)-1)
+		for _, item := range page[1:] {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(item), item)
+		}
+		return b.String()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	reports, err := c.BigKeys(BigKeysOptions{Top: 2})
+	want := []KeyReport{
+		{"l3", "list", 41}, {"l1", "list", 40},
+		{"b", "string", 900}, {"c", "string", 70},
+	}
+	if err != nil || !reflect.DeepEqual(reports, want) {
+		t.Fatalf("BigKeys = %v, %v; want %v", reports, err, want)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	// Two keys on each of three pages; the last page fails for "broken:*"
+	pages := map[string]string{"0": "p1", "p1": "p2", "p2": "0"}
+	var scans []string
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "SCAN" {
+			return "-ERR unexpected command\r\n"
+		}
+		scans = append(scans, strings.Join(args[1:], " "))
+		if args[1] == "p2" && len(args) == 4 && args[3] == "broken:*" {
+			return "-ERR scan failed\r\n"
+		}
+		next := pages[args[1]]
+		a, b := next+":a", next+":b"
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(next), next, len(a), a, len(b), b)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var keys []string
+	for key, err := range c.Iterate("") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if !reflect.DeepEqual(keys, []string{"p1:a", "p1:b", "p2:a", "p2:b", "0:a", "0:b"}) {
+		t.Fatalf("Iterate yielded %q", keys)
+	}
+	if !reflect.DeepEqual(scans, []string{"0", "p1", "p2"}) {
+		t.Fatalf("Iterate sent SCAN %q", scans)
+	}
+
+	// Breaking out of the loop stops fetching pages
+	scans = nil
+	for key := range c.Iterate("user:*") {
+		if key == "p1:b" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(scans, []string{"0 MATCH user:*"}) {
+		t.Fatalf("Iterate sent SCAN %q after break", scans)
+	}
+
+	keys = nil
+	var failed error
+	for key, err := range c.Iterate("broken:*") {
+		if err != nil {
+			failed = err
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if failed == nil || len(keys) != 4 {
+		t.Fatalf("Iterate yielded %q and error %v, want four keys and an error", keys, failed)
+	}
+}
+
+func TestGetMatching(t *testing.T) {
+	// One pair on each of two pages, the second value binary
+	pages := map[string][]string{"0": {"p1", "user:1", "ann"}, "p1": {"0", "user:2", "\x00\r\n\xff"}}
+	var scans []string
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "GETMATCHING" {
+			return "-ERR unexpected command\r\n"
+		}
+		scans = append(scans, strings.Join(args[1:], " "))
+		page := pages[args[1]]
+		reply := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*2\r\n", len(page[0]), page[0])
+		for _, s := range page[1:] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+		}
+		return reply
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got []KV
+	for kv, err := range c.GetMatching("user:*") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, kv)
+	}
+	want := []KV{{"user:1", "ann"}, {"user:2", "\x00\r\n\xff"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetMatching yielded %q", got)
+	}
+	if !reflect.DeepEqual(scans, []string{"0 COUNT 100 MATCH user:*", "p1 COUNT 100 MATCH user:*"}) {
+		t.Fatalf("GetMatching sent GETMATCHING %q", scans)
+	}
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "GETEX" || args[2] != "PX" || args[3] != "1800000" {
+			return "-ERR unexpected command\r\n"
+		}
+		if args[1] != "session:1" {
+			return "$-1\r\n"
+		}
+		return "$3\r\nann\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if value, err := c.GetAndRefresh("session:1", 30*time.Minute); err != nil || value != "ann" {
+		t.Fatalf("GetAndRefresh(session:1) = %q, %v", value, err)
+	}
+	if _, err := c.GetAndRefresh("session:2", 30*time.Minute); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetAndRefresh(session:2) = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := c.GetAndRefresh("session:1", 0); err == nil {
+		t.Fatal("GetAndRefresh with no ttl succeeded")
+	}
+}
+
+func TestCompactKey(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "COMPACT" || args[1] != "KEY" {
+			return "-ERR unexpected command\r\n"
+		}
+		if args[2] != "hot" {
+			return "-NOTFOUND no such key\r\n"
+		}
+		return "+OK\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.CompactKey("hot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CompactKey("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("CompactKey(missing) = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	var lastSave int64
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "SAVE":
+			if args[1] == "/backups/busy" {
+				return "-ERR snapshot already in progress\r\n"
+			}
+			lastSave = 1700000000
+			return "+OK\r\n"
+		case "BGSAVE":
+			return "+OK\r\n"
+		case "LASTSAVE":
+			return fmt.Sprintf(":%d\r\n", lastSave)
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if saved, err := c.LastSaveTime(); err != nil || !saved.IsZero() {
+		t.Fatalf("LastSaveTime() before any snapshot = %v, %v; want the zero time", saved, err)
+	}
+	if err := c.SaveSnapshot("/backups/today"); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := c.LastSaveTime(); err != nil || !saved.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("LastSaveTime() = %v, %v", saved, err)
+	}
+	if err := c.SaveSnapshot("/backups/busy"); !errors.Is(err, ErrSnapshotInProgress) {
+		t.Fatalf("SaveSnapshot during another = %v, want ErrSnapshotInProgress", err)
+	}
+	if err := c.BackgroundSaveSnapshot("/backups/tonight"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotInfo(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "SNAPSHOT" || args[1] != "INFO" {
+			return "-ERR unexpected command\r\n"
+		}
+		if args[2] != "/backups/today" {
+			return "-ERR Database error: " + args[2] + " is not a snapshot\r\n"
+		}
+		return "*10\r\n$7\r\nversion\r\n:1\r\n$10\r\ncreated-ms\r\n:1700000000123\r\n" +
+			"$4\r\nkeys\r\n:42\r\n$8\r\nchecksum\r\n$6\r\nab12cd\r\n$5\r\nvalid\r\n:1\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	meta, err := c.SnapshotInfo("/backups/today")
+	want := SnapshotMeta{Version: 1, Created: time.UnixMilli(1700000000123), Keys: 42, Checksum: "ab12cd", Valid: true}
+	if err != nil || meta != want {
+		t.Fatalf("SnapshotInfo() = %+v, %v; want %+v", meta, err, want)
+	}
+	if _, err := c.SnapshotInfo("/tmp"); err == nil {
+		t.Fatal("SnapshotInfo of a directory that is no snapshot succeeded")
+	}
+}
+
+func TestExpireStats(t *testing.T) {
+	keysPerCycle := "1000"
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch {
+		case args[0] == "EXPIRESTATS":
+			return "*14\r\n$13\r\nexpires.count\r\n:500\r\n$11\r\nexpires.due\r\n:120\r\n" +
+				"$21\r\nreaper.keys-per-cycle\r\n:1000\r\n$13\r\nreaper.cycles\r\n:42\r\n" +
+				"$16\r\nreaper.scan-rate\r\n:20000\r\n$18\r\nreaper.last-reaped\r\n:1000\r\n" +
+				"$19\r\nreaper.total-reaped\r\n:9000\r\n"
+		case args[0] == "CONFIG" && args[1] == "GET" && args[2] == "active-expire-keys":
+			return fmt.Sprintf("*2\r\n$18\r\nactive-expire-keys\r\n$%d\r\n%s\r\n", len(keysPerCycle), keysPerCycle)
+		case args[0] == "CONFIG" && args[1] == "SET" && args[2] == "active-expire-keys":
+			keysPerCycle = args[3]
+			return "+OK\r\n"
+		case args[0] == "CONFIG":
+			return "-ERR Unknown CONFIG parameter '" + args[2] + "'\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	info, err := c.ExpireStats()
+	want := ExpireInfo{Keys: 500, Pending: 120, KeysPerCycle: 1000, Cycles: 42, ScanRate: 20000, LastReaped: 1000, TotalReaped: 9000}
+	if err != nil || info != want {
+		t.Fatalf("ExpireStats() = %+v, %v; want %+v", info, err, want)
+	}
+
+	if err := c.ConfigSet("active-expire-keys", "5000"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.ConfigGet("active-expire-keys"); err != nil || value != "5000" {
+		t.Fatalf("ConfigGet(active-expire-keys) = %q, %v", value, err)
+	}
+	if _, err := c.ConfigGet("maxmemory"); err == nil {
+		t.Fatal("ConfigGet(maxmemory) succeeded")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "AUDITLOG" || args[1] != "GET" || args[2] != "5" {
+			return "-ERR unexpected command\r\n"
+		}
+		return "*2\r\n" +
+			"*5\r\n:2\r\n:1700000000000\r\n$14\r\n127.0.0.1:5000\r\n$3\r\nSET\r\n$7\r\nrefused\r\n" +
+			"*5\r\n:1\r\n:1600000000000\r\n$14\r\n127.0.0.1:5001\r\n$-1\r\n$4\r\nfull\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.AuditLog(5)
+	want := []AuditEntry{
+		{2, time.UnixMilli(1700000000000), "127.0.0.1:5000", "SET", "refused"},
+		{1, time.UnixMilli(1600000000000), "127.0.0.1:5001", "", "full"},
+	}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Fatalf("AuditLog = %v, %v; want %v", entries, err, want)
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	info := "# Server\nversion:0.1.0\n# Disk\nlogical_bytes_written:1000\nphysical_bytes_written:3500\nwrite_amplification:3.50"
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	logical, physical, err := c.WriteStats()
+	if err != nil || logical != 1000 || physical != 3500 {
+		t.Fatalf("WriteStats = %d, %d, %v; want 1000, 3500", logical, physical, err)
+	}
+
+	info = "# Server\nversion:0.1.0"
+	if _, _, err := c.WriteStats(); err == nil {
+		t.Fatal("WriteStats succeeded without a Disk section")
+	}
+}
+
+func TestIncrMulti(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "INCRMULTI" || len(args)%2 == 0 {
+			return "-ERR unexpected command\r\n"
+		}
+		// Each counter starts at 100
+		reply := fmt.Sprintf("*%d\r\n", len(args)/2)
+		for i := 2; i < len(args); i += 2 {
+			delta, _ := strconv.ParseInt(args[i], 10, 64)
+			reply += fmt.Sprintf(":%d\r\n", 100+delta)
+		}
+		return reply
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	values, err := c.IncrMulti(map[string]int64{"total": 1, "type:click": 2, "region:eu": -3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values["total"] != 101 || values["type:click"] != 102 || values["region:eu"] != 97 {
+		t.Fatalf("IncrMulti = %v", values)
+	}
+	if values, err := c.IncrMulti(nil); err != nil || len(values) != 0 {
+		t.Fatalf("IncrMulti(nil) = %v, %v", values, err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	tagged := map[string][]string{}
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "SETTAGGED":
+			for _, tag := range args[3:] {
+				tagged[tag] = append(tagged[tag], args[1])
+			}
+			return "+OK\r\n"
+		case "KEYSBYTAG":
+			keys := tagged[args[1]]
+			reply := fmt.Sprintf("*%d\r\n", len(keys))
+			for _, key := range keys {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+			}
+			return reply
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.SetTagged("session:1", "a", "user:42", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTagged("session:2", "b", "user:42"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := c.KeysByTag("user:42"); err != nil || !reflect.DeepEqual(keys, []string{"session:1", "session:2"}) {
+		t.Fatalf("KeysByTag(user:42) = %v, %v", keys, err)
+	}
+	if keys, err := c.KeysByTag("user:7"); err != nil || len(keys) != 0 {
+		t.Fatalf("KeysByTag(user:7) = %v, %v", keys, err)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	jobs := []string{"resize:1"}
+	claimed := map[string]string{}
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "CLAIMJOB":
+			if args[2] != "30000" {
+				return "-ERR unexpected visibility timeout\r\n"
+			}
+			if len(jobs) == 0 {
+				return "$-1\r\n"
+			}
+			id, job := fmt.Sprintf("id%d", len(claimed)), jobs[0]
+			jobs = jobs[1:]
+			claimed[id] = job
+			return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(id), id, len(job), job)
+		case "ACKJOB":
+			if _, ok := claimed[args[2]]; !ok {
+				return ":0\r\n"
+			}
+			delete(claimed, args[2])
+			return ":1\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, job, err := c.ClaimJob("jobs", 30*time.Second)
+	if err != nil || id != "id0" || job != "resize:1" {
+		t.Fatalf("ClaimJob = %q, %q, %v", id, job, err)
+	}
+	if _, _, err := c.ClaimJob("jobs", 30*time.Second); !errors.Is(err, ErrNoJob) {
+		t.Fatalf("ClaimJob of an empty queue = %v, want ErrNoJob", err)
+	}
+	if _, _, err := c.ClaimJob("jobs", 0); err == nil {
+		t.Fatal("ClaimJob with no visibility timeout succeeded")
+	}
+	if err := c.AckJob("jobs", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AckJob("jobs", id); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("AckJob twice = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] == "SHUTDOWN" && args[1] == "NOSAVE" {
+			return "+OK\r\n"
+		}
+		return "-ERR SHUTDOWN command not allowed\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Shutdown(false); err != nil {
+		t.Fatalf("Shutdown(false) = %v", err)
+	}
+	if err := c.Shutdown(true); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Shutdown(true) = %v, want the server's error", err)
+	}
+
+	// A server that exits before replying has still shut down
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || strings.HasPrefix(line, "SHUTDOWN") {
+				return
+			}
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+	c, err = NewClient(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Shutdown(true); err != nil {
+		t.Fatalf("Shutdown(true) = %v, want nil when the connection closes", err)
+	}
+}
+
+func TestGetIfChanged(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "GETIFCHANGED" || len(args) != 3 {
+			return "-ERR unexpected command\r\n"
+		}
+		switch {
+		case args[1] == "missing":
+			return "$-1\r\n"
+		case args[2] == "1700000000000000":
+			return "*2\r\n:1700000000000000\r\n$-1\r\n"
+		default:
+			return "*2\r\n:1700000000000000\r\n$5\r\nlimit\r\n"
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	value, version, changed, err := c.GetIfChanged("config", 0)
+	if err != nil || value != "limit" || version != 1700000000000000 || !changed {
+		t.Fatalf("GetIfChanged = %q, %d, %v, %v", value, version, changed, err)
+	}
+	value, version, changed, err = c.GetIfChanged("config", version)
+	if err != nil || value != "" || version != 1700000000000000 || changed {
+		t.Fatalf("GetIfChanged of an unchanged key = %q, %d, %v, %v", value, version, changed, err)
+	}
+	if _, _, _, err := c.GetIfChanged("missing", 0); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetIfChanged of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	if _, _, _, err := c.GetIfChanged("config", -1); err == nil {
+		t.Fatal("GetIfChanged with a negative version succeeded")
+	}
+}
@@ -0,0 +1,344 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyDistribution is how a Benchmark picks the key of each command
+type KeyDistribution int
+
+const (
+	// Uniform picks every key equally often
+	Uniform KeyDistribution = iota
+	// Zipfian picks a few hot keys most of the time, as real workloads
+	// tend to: the key ranked k is picked about 1/k as often as the first
+	Zipfian
+)
+
+// Benchmark generates load against a server from this process, like
+// redis-benchmark but scriptable: a mix of GETs and SETs over a fixed
+// keyspace, sent by Concurrency connections as fast as replies come back.
+// Its zero value, given an Address, runs 10 connections of writes for 10
+// seconds.
+type Benchmark struct {
+	// Address of the server, as for NewClient
+	Address string
+	// ClientOptions configures each connection
+	ClientOptions ClientOptions
+
+	// Concurrency is the number of connections sending commands at once,
+	// each with its own Client; defaults to 10
+	Concurrency int
+	// Duration is how long to send commands for; defaults to 10 seconds
+	Duration time.Duration
+
+	// ReadRatio is the fraction of commands that are GETs, from 0 to 1;
+	// the rest are SETs
+	ReadRatio float64
+	// Keys is the number of distinct keys commands touch; defaults to
+	// 10000
+	Keys int
+	// KeyPrefix is prepended to every key, which are numbered from 0;
+	// defaults to "bench:"
+	KeyPrefix string
+	// Distribution is how keys are picked; Uniform by default
+	Distribution KeyDistribution
+
+	// ValueSize is the size in bytes of the values SET writes; defaults
+	// to 3, as in redis-benchmark
+	ValueSize int
+	// MaxValueSize, if greater than ValueSize, makes every SET write a
+	// value of a size picked uniformly between the two
+	MaxValueSize int
+}
+
+// BenchResult is what a Benchmark measured
+type BenchResult struct {
+	// Duration is how long commands were sent for
+	Duration time.Duration
+	// Ops counts the commands that got a reply, Errors included
+	Ops    int64
+	Reads  int64
+	Writes int64
+	// Misses counts GETs of keys that did not exist
+	Misses int64
+	// Errors counts commands that failed
+	Errors int64
+	// OpsPerSecond is the throughput over Duration
+	OpsPerSecond float64
+	// Latency is the time from sending each command to reading its reply
+	Latency LatencyStats
+}
+
+// LatencyStats summarises a set of latencies. Percentiles are within about
+// 3% of the exact value; Min, Mean and Max are exact.
+type LatencyStats struct {
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	P999 time.Duration
+	Max  time.Duration
+}
+
+// Run sends commands until the Duration has passed or ctx is done, and
+// reports what it measured. It fails only if a connection cannot be opened;
+// commands that fail are counted as errors.
+func (b *Benchmark) Run(ctx context.Context) (BenchResult, error) {
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 10
+	}
+	duration := b.Duration
+	if duration <= 0 {
+		duration = 10 * time.Second
+	}
+	if b.ReadRatio < 0 || b.ReadRatio > 1 {
+		return BenchResult{}, fmt.Errorf("benchmark failed: read ratio %v is not between 0 and 1", b.ReadRatio)
+	}
+
+	clients := make([]*Client, 0, concurrency)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i < concurrency; i++ {
+		c, err := NewClientWithOptions(b.Address, b.ClientOptions)
+		if err != nil {
+			return BenchResult{}, fmt.Errorf("benchmark failed: %w", err)
+		}
+		clients = append(clients, c)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	// Values are prefixes of one payload, so no command waits on building
+	// its value
+	payload := strings.Repeat("x", max(b.ValueSize, b.MaxValueSize, 3))
+
+	stats := make([]benchStats, concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	seed := start.UnixNano()
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c *Client, stats *benchStats, rng *rand.Rand) {
+			defer wg.Done()
+			b.work(ctx, c, stats, rng, payload)
+		}(c, &stats[i], rand.New(rand.NewSource(seed+int64(i))))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var total benchStats
+	for i := range stats {
+		total.merge(&stats[i])
+	}
+	return total.result(elapsed), nil
+}
+
+// work sends commands on c until ctx is done
+func (b *Benchmark) work(ctx context.Context, c *Client, stats *benchStats, rng *rand.Rand, payload string) {
+	keys := b.Keys
+	if keys <= 0 {
+		keys = 10000
+	}
+	prefix := b.KeyPrefix
+	if prefix == "" {
+		prefix = "bench:"
+	}
+	valueSize := b.ValueSize
+	if valueSize <= 0 {
+		valueSize = 3
+	}
+
+	nextKey := func() int { return rng.Intn(keys) }
+	if b.Distribution == Zipfian && keys > 1 {
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(keys-1))
+		nextKey = func() int { return int(zipf.Uint64()) }
+	}
+
+	for ctx.Err() == nil {
+		key := prefix + strconv.Itoa(nextKey())
+		read := rng.Float64() < b.ReadRatio
+		size := valueSize
+		if b.MaxValueSize > valueSize {
+			size += rng.Intn(b.MaxValueSize - valueSize + 1)
+		}
+
+		sent := time.Now()
+		var err error
+		if read {
+			_, err = c.Get(key)
+		} else {
+			err = c.Set(key, payload[:size])
+		}
+		latency := time.Since(sent)
+
+		// A command cut short by the end of the run is not counted
+		if ctx.Err() != nil {
+			return
+		}
+		stats.record(latency, read, err)
+	}
+}
+
+// benchStats is what one connection of a Benchmark measured
+type benchStats struct {
+	reads, writes, misses, errors int64
+	latency                       latencyHistogram
+}
+
+func (s *benchStats) record(latency time.Duration, read bool, err error) {
+	if read {
+		s.reads++
+	} else {
+		s.writes++
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrKeyNotFound):
+		s.misses++
+	default:
+		s.errors++
+	}
+	s.latency.record(latency)
+}
+
+func (s *benchStats) merge(o *benchStats) {
+	s.reads += o.reads
+	s.writes += o.writes
+	s.misses += o.misses
+	s.errors += o.errors
+	s.latency.merge(&o.latency)
+}
+
+func (s *benchStats) result(elapsed time.Duration) BenchResult {
+	r := BenchResult{
+		Duration: elapsed,
+		Ops:      s.reads + s.writes,
+		Reads:    s.reads,
+		Writes:   s.writes,
+		Misses:   s.misses,
+		Errors:   s.errors,
+		Latency:  s.latency.stats(),
+	}
+	if elapsed > 0 {
+		r.OpsPerSecond = float64(r.Ops) / elapsed.Seconds()
+	}
+	return r
+}
+
+// histogramSubBits sets the precision of a latencyHistogram: every power of
+// two is split into 1<<histogramSubBits buckets
+const histogramSubBits = 5
+
+// latencyHistogram counts latencies in buckets that widen as latencies
+// grow, so it takes the same memory however many it counts and reports
+// percentiles within 1/32 of their value. Latencies below 32ns are counted
+// exactly.
+type latencyHistogram struct {
+	counts   [(64 - histogramSubBits) << histogramSubBits]int64
+	count    int64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+// bucketOf returns the bucket counting a latency of ns nanoseconds
+func bucketOf(ns uint64) int {
+	shift := bits.Len64(ns) - histogramSubBits - 1
+	if shift < 0 {
+		return int(ns)
+	}
+	// ns>>shift has histogramSubBits+1 bits, the top one always set
+	return shift<<histogramSubBits + int(ns>>shift)
+}
+
+// bucketTop returns the largest latency counted in bucket i
+func bucketTop(i int) time.Duration {
+	if i < 1<<histogramSubBits {
+		return time.Duration(i)
+	}
+	shift := i>>histogramSubBits - 1
+	mantissa := uint64(i&(1<<histogramSubBits-1) + 1<<histogramSubBits)
+	return time.Duration((mantissa+1)<<shift - 1)
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bucketOf(uint64(d))
+	h.counts[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// percentile returns the latency that p percent of those counted are at or
+// below
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(p / 100 * float64(h.count))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			return min(max(bucketTop(i), h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	if h.count == 0 {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Min:  h.min,
+		Mean: h.sum / time.Duration(h.count),
+		P50:  h.percentile(50),
+		P90:  h.percentile(90),
+		P99:  h.percentile(99),
+		P999: h.percentile(99.9),
+		Max:  h.max,
+	}
+}
@@ -0,0 +1,108 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	for us := 1; us <= 10000; us++ {
+		h.record(time.Duration(us) * time.Microsecond)
+	}
+
+	stats := h.stats()
+	if stats.Min != time.Microsecond || stats.Max != 10*time.Millisecond {
+		t.Fatalf("Min, Max = %v, %v; want 1µs, 10ms", stats.Min, stats.Max)
+	}
+	if want := 5000500 * time.Nanosecond; stats.Mean != want {
+		t.Fatalf("Mean = %v, want %v", stats.Mean, want)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"P50", stats.P50, 5 * time.Millisecond},
+		{"P90", stats.P90, 9 * time.Millisecond},
+		{"P99", stats.P99, 9900 * time.Microsecond},
+		{"P999", stats.P999, 9990 * time.Microsecond},
+	} {
+		// Percentiles are the top of their bucket, so at most 1/32 above
+		if c.got < c.want || c.got > c.want+c.want/32 {
+			t.Errorf("%s = %v, want within 1/32 above %v", c.name, c.got, c.want)
+		}
+	}
+
+	// Small latencies are counted exactly
+	var small latencyHistogram
+	for _, d := range []time.Duration{3, 7, 7, 31} {
+		small.record(d)
+	}
+	if got := small.percentile(50); got != 7 {
+		t.Fatalf("percentile(50) = %v, want 7ns", got)
+	}
+
+	// Every latency lands in the bucket it is below the top of
+	for _, ns := range []uint64{0, 31, 32, 33, 63, 64, 65, 1000, 1 << 40, 1<<63 - 1} {
+		i := bucketOf(ns)
+		if uint64(bucketTop(i)) < ns {
+			t.Errorf("bucketTop(bucketOf(%d)) = %d, below it", ns, bucketTop(i))
+		}
+		if i > 0 && uint64(bucketTop(i-1)) >= ns {
+			t.Errorf("bucketTop(bucketOf(%d) - 1) = %d, not below it", ns, bucketTop(i-1))
+		}
+	}
+	var empty latencyHistogram
+	if empty.stats() != (LatencyStats{}) {
+		t.Fatal("stats of an empty histogram are not zero")
+	}
+}
+
+func TestBenchStatsMerge(t *testing.T) {
+	var a, b, total benchStats
+	a.record(2*time.Millisecond, true, nil)
+	a.record(time.Millisecond, true, ErrKeyNotFound)
+	b.record(4*time.Millisecond, false, nil)
+	b.record(3*time.Millisecond, false, errors.New("broken pipe"))
+	total.merge(&a)
+	total.merge(&b)
+	total.merge(&benchStats{})
+
+	r := total.result(2 * time.Second)
+	if r.Ops != 4 || r.Reads != 2 || r.Writes != 2 || r.Misses != 1 || r.Errors != 1 || r.OpsPerSecond != 2 {
+		t.Fatalf("result = %+v", r)
+	}
+	if r.Latency.Min != time.Millisecond || r.Latency.Max != 4*time.Millisecond || r.Latency.Mean != 2500*time.Microsecond {
+		t.Fatalf("latency = %+v", r.Latency)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	b := Benchmark{
+		Address:      fakeServer(t, nil),
+		Concurrency:  4,
+		Duration:     100 * time.Millisecond,
+		ReadRatio:    0.5,
+		Keys:         100,
+		Distribution: Zipfian,
+		ValueSize:    10,
+		MaxValueSize: 100,
+	}
+	r, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ops == 0 || r.Reads == 0 || r.Writes == 0 || r.Errors != 0 {
+		t.Fatalf("result = %+v", r)
+	}
+	if r.Reads+r.Writes != r.Ops || r.Latency.P50 == 0 || r.Latency.Max < r.Latency.P99 {
+		t.Fatalf("result = %+v", r)
+	}
+
+	b.ReadRatio = 2
+	if _, err := b.Run(context.Background()); err == nil {
+		t.Fatal("Run with a read ratio of 2 succeeded")
+	}
+}
@@ -0,0 +1,120 @@
+package diskdb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// BigKeysOptions controls Client.BigKeys
+type BigKeysOptions struct {
+	// Top is the number of keys reported per type; defaults to 10
+	Top int
+
+	// Match limits the report to keys matching a glob-style pattern
+	// (*, ? and [...]); empty examines every key
+	Match string
+
+	// Type limits the report to keys of one type as reported by TYPE,
+	// such as "string" or "hash"; empty reports every type
+	Type string
+
+	// BatchSize is the number of keys examined per round trip; defaults
+	// to 100
+	BatchSize int
+}
+
+// KeyReport is one of the keys returned by Client.BigKeys
+type KeyReport struct {
+	Key  string
+	Type string
+
+	// Size is the length in bytes of strings, bitmaps, HyperLogLogs and
+	// JSON documents (serialized), and the number of elements of lists,
+	// sets, hashes, sorted sets and streams
+	Size int64
+}
+
+// BigKeys returns the largest keys of the selected database, up to
+// opts.Top of each type, ordered by type and then by size, largest first.
+// The server measures every key, but the keyspace is walked incrementally
+// with its cursor like ExportNDJSON, so the report never blocks the server
+// for long; keys changed during the walk may or may not be reflected.
+func (c *Client) BigKeys(opts BigKeysOptions) ([]KeyReport, error) {
+	top := opts.Top
+	if top <= 0 {
+		top = 10
+	}
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	args := []string{"COUNT", fmt.Sprint(batch)}
+	if opts.Match != "" {
+		args = append(args, "MATCH", opts.Match)
+	}
+	if opts.Type != "" {
+		args = append(args, "TYPE", opts.Type)
+	}
+
+	byType := make(map[string][]KeyReport)
+	cursor := "0"
+	for {
+		next, items, err := c.cursorPage("BIGKEYS", cursor, args...)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%3 != 0 {
+			return nil, fmt.Errorf("bigkeys failed: unexpected reply")
+		}
+
+		for i := 0; i < len(items); i += 3 {
+			size, err := strconv.ParseInt(items[i+2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bigkeys failed: unexpected size %q", items[i+2])
+			}
+			reports := append(byType[items[i+1]], KeyReport{Key: items[i], Type: items[i+1], Size: size})
+			// Trimming only once twice as many are held keeps the sorting
+			// cost per key constant
+			if len(reports) >= 2*top {
+				reports = largest(reports, top)
+			}
+			byType[items[i+1]] = reports
+		}
+
+		if next == "0" {
+			break
+		}
+		cursor = next
+	}
+
+	var result []KeyReport
+	for _, reports := range byType {
+		result = append(result, largest(reports, top)...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Key < b.Key
+	})
+	return result, nil
+}
+
+// largest sorts reports by size, largest first, and keeps the first n
+func largest(reports []KeyReport, n int) []KeyReport {
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Size != reports[j].Size {
+			return reports[i].Size > reports[j].Size
+		}
+		return reports[i].Key < reports[j].Key
+	})
+	if len(reports) > n {
+		reports = reports[:n]
+	}
+	return reports
+}
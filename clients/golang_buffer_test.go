@@ -0,0 +1,42 @@
+package diskdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// BenchmarkGetBufferSize reads values of several sizes through buffers of
+// several sizes, zero being the 4 KiB default. Run it with
+// -bench GetBufferSize.
+func BenchmarkGetBufferSize(b *testing.B) {
+	addr := fakeServer(b, nil)
+	for _, valueSize := range []int{2 << 10, 16 << 10, 64 << 10, 1 << 20} {
+		for _, bufferSize := range []int{0, 64 << 10, 1 << 20} {
+			name := fmt.Sprintf("value=%dKiB/buffer=%dKiB", valueSize>>10, bufferSize>>10)
+			b.Run(name, func(b *testing.B) {
+				client, err := NewClientWithOptions(addr, ClientOptions{
+					ReadBufferSize:  bufferSize,
+					WriteBufferSize: bufferSize,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer client.Close()
+
+				key := fmt.Sprintf("value:%d", valueSize)
+				if err := client.Set(key, strings.Repeat("x", valueSize)); err != nil {
+					b.Fatal(err)
+				}
+
+				b.SetBytes(int64(valueSize))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Get(key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BulkRecord is a single key to load
+type BulkRecord struct {
+	Key   string
+	Value string
+	// TTL, if positive, makes the key expire after this long
+	TTL time.Duration
+}
+
+// BulkSource yields the records to load. Records are addressed by their
+// zero-based offset in a stable order, which is what makes a load resumable.
+type BulkSource interface {
+	// SeekRecord positions the source so that the next record returned by
+	// Next is the one at offset
+	SeekRecord(offset int64) error
+	// Next returns the next record, or io.EOF when there are no more
+	Next() (BulkRecord, error)
+}
+
+// BulkProgress reports how far a BulkLoader has got
+type BulkProgress struct {
+	// Offset of the next record to load; a restart resumes from here
+	Offset int64
+	// ResumedFrom is the offset this run started at
+	ResumedFrom int64
+	// Loaded is the number of records applied by this run
+	Loaded int64
+	// Elapsed is the time spent by this run
+	Elapsed time.Duration
+}
+
+// RecordsPerSecond is the throughput of this run so far
+func (p BulkProgress) RecordsPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Loaded) / p.Elapsed.Seconds()
+}
+
+// BulkLoaderOptions controls a BulkLoader
+type BulkLoaderOptions struct {
+	// BatchSize is the number of records sent per pipelined batch; the
+	// checkpoint advances after each batch. Defaults to 1000.
+	BatchSize int
+
+	// Checkpoint, if set, stores the offset of the next record to load. It
+	// is read when Load starts and overwritten after every batch, so a
+	// file passed here makes a restarted process resume automatically.
+	Checkpoint io.ReadWriteSeeker
+
+	// StartOffset is where to start when there is no Checkpoint, for
+	// callers that persist OnCheckpoint's offset themselves
+	StartOffset int64
+
+	// OnCheckpoint, if set, is called after every batch has been applied
+	// and the checkpoint written. Returning an error stops the load.
+	OnCheckpoint func(BulkProgress) error
+
+	// Retries is the number of times a batch is retried after a connection
+	// failure, reconnecting before each attempt. Defaults to 3; negative
+	// disables retries.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry, doubling after
+	// each failed attempt. Defaults to 100ms.
+	RetryBackoff time.Duration
+}
+
+// BulkLoader loads a large number of records with pipelined SETs,
+// checkpointing its position so an interrupted load can be resumed instead
+// of replayed.
+//
+// Records are applied in batches: every batch is sent in one round trip and
+// the checkpoint only moves past it once the server has acknowledged all of
+// it. A batch interrupted by a failure is sent again in full on retry or
+// resume; this is safe because setting a key to the same value twice has no
+// further effect, but a TTL restarts when its record is reapplied.
+type BulkLoader struct {
+	client *Client
+	opts   BulkLoaderOptions
+}
+
+// NewBulkLoader returns a loader that writes through c. After a connection
+// failure the loader reconnects c, keeping its selected database.
+func NewBulkLoader(c *Client, opts BulkLoaderOptions) *BulkLoader {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+	return &BulkLoader{client: c, opts: opts}
+}
+
+// Load applies the records of src from the checkpointed offset to the end.
+// It returns the final progress, or the progress up to the last applied
+// batch together with the error that stopped it.
+func (l *BulkLoader) Load(ctx context.Context, src BulkSource) (BulkProgress, error) {
+	offset, err := l.resumeOffset()
+	if err != nil {
+		return BulkProgress{}, err
+	}
+	progress := BulkProgress{Offset: offset, ResumedFrom: offset}
+	if err := src.SeekRecord(offset); err != nil {
+		return progress, err
+	}
+
+	start := time.Now()
+	batch := make([][]string, 0, l.opts.BatchSize)
+	for done := false; !done; {
+		batch = batch[:0]
+		for len(batch) < l.opts.BatchSize {
+			record, err := src.Next()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return progress, err
+			}
+			batch = append(batch, setCommand(record))
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		if err := l.apply(ctx, batch); err != nil {
+			return progress, err
+		}
+		progress.Offset += int64(len(batch))
+		progress.Loaded += int64(len(batch))
+		progress.Elapsed = time.Since(start)
+
+		if err := l.saveCheckpoint(progress.Offset); err != nil {
+			return progress, err
+		}
+		if l.opts.OnCheckpoint != nil {
+			if err := l.opts.OnCheckpoint(progress); err != nil {
+				return progress, err
+			}
+		}
+	}
+
+	progress.Elapsed = time.Since(start)
+	return progress, nil
+}
+
+// apply sends one batch, retrying connection failures over a new
+// connection. Error replies from the server are not retried.
+func (l *BulkLoader) apply(ctx context.Context, batch [][]string) error {
+	delay := l.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var err error
+		if attempt > 0 {
+			// Failing to reconnect counts as a failed attempt
+			l.client.conn.Close()
+			err = l.client.connect()
+		}
+		if err == nil {
+			var replies []*reply
+			replies, err = l.client.pipeline(batch)
+			if err == nil {
+				for i, r := range replies {
+					if r.kind == kindError {
+						return fmt.Errorf("bulk load failed at key %q: %w", batch[i][1], serverError("SET", r.str))
+					}
+				}
+				return nil
+			}
+		}
+		if attempt >= l.opts.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// resumeOffset reads the offset to start from
+func (l *BulkLoader) resumeOffset() (int64, error) {
+	if l.opts.Checkpoint == nil {
+		return l.opts.StartOffset, nil
+	}
+
+	if _, err := l.opts.Checkpoint.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(l.opts.Checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.New("bulk load failed: invalid checkpoint")
+	}
+	return offset, nil
+}
+
+// saveCheckpoint overwrites the stored offset. Offsets are written at a
+// fixed width so a shorter one never leaves digits of the previous behind.
+func (l *BulkLoader) saveCheckpoint(offset int64) error {
+	if l.opts.Checkpoint == nil {
+		return nil
+	}
+
+	if _, err := l.opts.Checkpoint.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(l.opts.Checkpoint, "%020d\n", offset)
+	return err
+}
+
+// msetBatchSize is the number of entries MSetEX sends per round trip, so
+// replies are read before the server's send buffer fills
+const msetBatchSize = 1000
+
+// EntryErrors is the error MSetEX returns when the server refused some
+// entries: the error at index i is that of entries[i], nil if it was set
+type EntryErrors []error
+
+func (e EntryErrors) Error() string {
+	var failed int
+	var first error
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("msetex failed for %d of %d entries: %v", failed, len(e), first)
+}
+
+// Unwrap returns the errors of the entries that failed
+func (e EntryErrors) Unwrap() []error {
+	var errs []error
+	for _, err := range e {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// MSetEX sets every entry, each with its own TTL, as pipelined SETs sent a
+// thousand to a round trip. Each entry is applied atomically on its own,
+// with its expiry, but not together with the others. An entry whose TTL is
+// not positive does not expire. If the server refuses some entries the
+// others are still set and the error is an EntryErrors; a connection
+// failure stops at the batch it interrupted, leaving entries before it set.
+func (c *Client) MSetEX(entries []BulkRecord) error {
+	var failed EntryErrors
+	for start := 0; start < len(entries); start += msetBatchSize {
+		batch := entries[start:min(start+msetBatchSize, len(entries))]
+		cmds := make([][]string, len(batch))
+		for i, entry := range batch {
+			cmds[i] = setCommand(entry)
+		}
+		replies, err := c.pipeline(cmds)
+		if err != nil {
+			return err
+		}
+		for i, r := range replies {
+			if r.kind != kindError {
+				continue
+			}
+			if failed == nil {
+				failed = make(EntryErrors, len(entries))
+			}
+			failed[start+i] = fmt.Errorf("key %q: %w", batch[i].Key, serverError("SET", r.str))
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
+
+// setCommand builds the SET for a record
+func setCommand(record BulkRecord) []string {
+	if record.TTL > 0 {
+		ms := record.TTL.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		return []string{"SET", record.Key, record.Value, "PX", fmt.Sprint(ms)}
+	}
+	return []string{"SET", record.Key, record.Value}
+}
@@ -0,0 +1,148 @@
+package diskdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingSource yields n records with keys key:0, key:1, ...
+type countingSource struct {
+	n, pos int
+}
+
+func (s *countingSource) SeekRecord(offset int64) error {
+	s.pos = int(offset)
+	return nil
+}
+
+func (s *countingSource) Next() (BulkRecord, error) {
+	if s.pos >= s.n {
+		return BulkRecord{}, io.EOF
+	}
+	s.pos++
+	return BulkRecord{Key: fmt.Sprintf("key:%d", s.pos-1), Value: "value"}, nil
+}
+
+func TestBulkLoaderReconnects(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The first batch fails on the dead connection and is retried over a
+	// new one
+	c.conn.Close()
+	l := NewBulkLoader(c, BulkLoaderOptions{BatchSize: 10, RetryBackoff: time.Millisecond})
+	progress, err := l.Load(context.Background(), &countingSource{n: 25})
+	if err != nil || progress.Offset != 25 {
+		t.Fatalf("load = %+v, %v; want offset 25", progress, err)
+	}
+	if v, err := c.Get("key:24"); err != nil || v != "value" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+func TestBulkLoaderReportsFailedReconnect(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Point the client at an address nobody listens on any more, so every
+	// reconnect fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.address = ln.Addr().String()
+	ln.Close()
+	c.conn.Close()
+
+	l := NewBulkLoader(c, BulkLoaderOptions{BatchSize: 10, Retries: 2, RetryBackoff: time.Millisecond})
+	progress, err := l.Load(context.Background(), &countingSource{n: 25})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Fatalf("load failed with %v, want the dial error", err)
+	}
+	if progress.Offset != 0 {
+		t.Fatalf("load reached offset %d, want 0", progress.Offset)
+	}
+}
+
+func TestMSetEX(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// More entries than fit in one batch
+	entries := make([]BulkRecord, 2500)
+	for i := range entries {
+		entries[i] = BulkRecord{Key: fmt.Sprintf("key:%d", i), Value: fmt.Sprint(i), TTL: time.Duration(i) * time.Second}
+	}
+	if err := c.MSetEX(entries); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get("key:2499"); err != nil || v != "2499" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+func TestMSetEXReportsEachEntry(t *testing.T) {
+	// A server that refuses keys starting with "bad"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "SET bad") {
+				conn.Write([]byte("-OOM Key limit exceeded: the database holds at most 1 keys\r\n"))
+			} else {
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+	c, err := NewClient(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.MSetEX([]BulkRecord{
+		{Key: "good:1", Value: "v", TTL: time.Minute},
+		{Key: "bad:1", Value: "v", TTL: time.Minute},
+		{Key: "good:2", Value: "v"},
+	})
+	var failed EntryErrors
+	if !errors.As(err, &failed) || len(failed) != 3 {
+		t.Fatalf("MSetEX = %v, want EntryErrors for 3 entries", err)
+	}
+	if failed[0] != nil || !errors.Is(failed[1], ErrKeyLimitExceeded) || failed[2] != nil {
+		t.Fatalf("entry errors = %v, want only the second, over the key limit", failed)
+	}
+	if !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(failed[1].Error(), `"bad:1"`) {
+		t.Fatalf("error = %q", err)
+	}
+}
@@ -0,0 +1,214 @@
+package diskdb
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// StaleCacheOptions configures a StaleCache
+type StaleCacheOptions struct {
+	// MaxStaleness bounds how old a remembered value may be when it is
+	// served in place of an error, counted from the last time the server
+	// returned it. Zero never serves stale values.
+	MaxStaleness time.Duration
+
+	// MaxEntries bounds the number of values remembered; the least
+	// recently read are forgotten first. Defaults to 10000.
+	MaxEntries int
+}
+
+// StaleCache reads keys through a SyncClient and remembers the last value
+// read for each, so that a read-mostly cache stays available while DiskDB
+// is briefly unreachable: when a Get fails to reach the server or to read
+// its reply, the remembered value is returned instead, flagged as stale,
+// as long as it is no older than MaxStaleness. Past the bound, or for a
+// key never read, the error is returned.
+//
+// Every Get still goes to the server first, so fresh values are served
+// whenever it answers. Error replies are returned as they are, and a key
+// the server reports missing is forgotten, so a deleted key is never
+// served stale. A failed connection is only replaced by the SyncClient's
+// heartbeat, so create it with a HeartbeatInterval well below
+// MaxStaleness for reads to recover once the server is back.
+//
+// A StaleCache is safe for concurrent use.
+type StaleCache struct {
+	s    *SyncClient
+	opts StaleCacheOptions
+
+	mu sync.Mutex
+	// Least recently read at the back
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// staleEntry is a value remembered by a StaleCache
+type staleEntry struct {
+	key    string
+	value  string
+	readAt time.Time
+}
+
+// NewStaleCache returns a StaleCache reading through s
+func NewStaleCache(s *SyncClient, opts StaleCacheOptions) *StaleCache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+	return &StaleCache{
+		s:       s,
+		opts:    opts,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of key from the server, or, when the server cannot
+// be reached, the value last read within MaxStaleness with stale set
+func (c *StaleCache) Get(key string) (value string, stale bool, err error) {
+	value, err = c.s.Get(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err == nil:
+		c.remember(key, value)
+		return value, false, nil
+	case errors.Is(err, ErrKeyNotFound):
+		c.forget(key)
+	case isTransportError(err):
+		if elem, ok := c.entries[key]; ok {
+			entry := elem.Value.(*staleEntry)
+			if time.Since(entry.readAt) <= c.opts.MaxStaleness {
+				c.order.MoveToFront(elem)
+				return entry.value, true, nil
+			}
+		}
+	}
+	return "", false, err
+}
+
+// remember records value as read from the server just now
+func (c *StaleCache) remember(key, value string) {
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*staleEntry)
+		entry.value, entry.readAt = value, time.Now()
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&staleEntry{key: key, value: value, readAt: time.Now()})
+	for c.order.Len() > c.opts.MaxEntries {
+		c.forget(c.order.Back().Value.(*staleEntry).key)
+	}
+}
+
+// forget drops the value remembered for key, if any
+func (c *StaleCache) forget(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// CachingClient reads keys through a SyncClient as a read-through cache:
+// GetOrLoad returns a key's value from the server and, on a miss, loads it
+// from the source of truth with a caller's loader and stores it for the
+// next read.
+//
+// Concurrent misses for the same key through one CachingClient call the
+// loader once and share its result. Across processes, the first value
+// stored wins: it is stored only if the key is still missing, and a
+// process that lost the race returns the value already stored instead of
+// its own, so every reader sees the same value.
+//
+// A CachingClient is safe for concurrent use.
+type CachingClient struct {
+	s *SyncClient
+
+	mu    sync.Mutex
+	loads map[string]*pendingLoad
+}
+
+// pendingLoad is a load in progress, which misses for the same key wait on
+type pendingLoad struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// NewCachingClient returns a CachingClient reading through s
+func NewCachingClient(s *SyncClient) *CachingClient {
+	return &CachingClient{s: s, loads: make(map[string]*pendingLoad)}
+}
+
+// GetOrLoad returns the value of key. If the key does not exist, it calls
+// loader for the value and the time to live to store it with, zero storing
+// it without expiry, and returns the value stored. An error from the
+// loader is returned as it is and nothing is stored, so the next miss
+// calls the loader again.
+func (c *CachingClient) GetOrLoad(key string, loader func() (string, time.Duration, error)) (string, error) {
+	value, err := c.s.Get(key)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return value, err
+	}
+
+	c.mu.Lock()
+	if load, ok := c.loads[key]; ok {
+		c.mu.Unlock()
+		<-load.done
+		return load.value, load.err
+	}
+	load := &pendingLoad{done: make(chan struct{})}
+	c.loads[key] = load
+	c.mu.Unlock()
+
+	load.value, load.err = c.load(key, loader)
+
+	c.mu.Lock()
+	delete(c.loads, key)
+	c.mu.Unlock()
+	close(load.done)
+	return load.value, load.err
+}
+
+// load calls loader and stores the value it returns at key unless the key
+// was stored meanwhile, returning the value the key holds after
+func (c *CachingClient) load(key string, loader func() (string, time.Duration, error)) (string, error) {
+	value, ttl, err := loader()
+	if err != nil {
+		return "", err
+	}
+	if ttl < 0 || (ttl > 0 && ttl < time.Millisecond) {
+		return "", fmt.Errorf("set failed: invalid ttl %v", ttl)
+	}
+
+	args := []string{key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", fmt.Sprint(ttl.Milliseconds()))
+	}
+	// With GET the reply is the value that kept this one from being
+	// stored, or nil if this one was
+	args = append(args, "GET")
+	err = c.s.Do(func(cl *Client) error {
+		response, err := cl.sendCommand("SET", args...)
+		if err == nil && response.kind != kindNil {
+			value = response.str
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// isTransportError reports whether err is a failure to reach the server or
+// to read its reply, as opposed to an error reply
+func isTransportError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
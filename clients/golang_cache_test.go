@@ -0,0 +1,149 @@
+package diskdb
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleCacheServesStaleWithinBound(t *testing.T) {
+	s, err := NewSyncClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cache := NewStaleCache(s, StaleCacheOptions{MaxStaleness: 200 * time.Millisecond})
+
+	if err := s.Set("fresh", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("old", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.Get("old"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if value, stale, err := cache.Get("fresh"); err != nil || stale || value != "v1" {
+		t.Fatalf("Get(fresh) = %q, %v, %v; want v1 from the server", value, stale, err)
+	}
+
+	// Cut the connection as an unreachable server would
+	s.Do(func(c *Client) error { return c.conn.Close() })
+
+	if value, stale, err := cache.Get("fresh"); err != nil || !stale || value != "v1" {
+		t.Fatalf("Get(fresh) = %q, %v, %v; want stale v1", value, stale, err)
+	}
+	if _, _, err := cache.Get("old"); err == nil {
+		t.Fatal("Get(old) served a value older than MaxStaleness")
+	}
+	if _, _, err := cache.Get("never-read"); err == nil {
+		t.Fatal("Get(never-read) succeeded without a server")
+	}
+}
+
+func TestStaleCacheEvictsLeastRecentlyRead(t *testing.T) {
+	s, err := NewSyncClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cache := NewStaleCache(s, StaleCacheOptions{MaxStaleness: time.Minute, MaxEntries: 1})
+
+	if err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	// Reading b pushes a out
+	if _, _, err := cache.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(missing) = %v, want ErrKeyNotFound", err)
+	}
+
+	s.Do(func(c *Client) error { return c.conn.Close() })
+
+	if _, _, err := cache.Get("a"); err == nil {
+		t.Fatal("Get(a) served a value evicted by MaxEntries")
+	}
+	if value, stale, err := cache.Get("b"); err != nil || !stale || value != "2" {
+		t.Fatalf("Get(b) = %q, %v, %v; want stale 2", value, stale, err)
+	}
+}
+
+func TestCachingClientLoadsOnce(t *testing.T) {
+	s, err := NewSyncClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cache := NewCachingClient(s)
+
+	var loads atomic.Int32
+	loader := func() (string, time.Duration, error) {
+		loads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return "ann", time.Minute, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := cache.GetOrLoad("user:1", loader); err != nil || value != "ann" {
+				t.Errorf("GetOrLoad(user:1) = %q, %v; want ann", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("loader called %d times, want once", n)
+	}
+
+	// A hit never calls the loader
+	if value, err := cache.GetOrLoad("user:1", loader); err != nil || value != "ann" || loads.Load() != 1 {
+		t.Fatalf("GetOrLoad(user:1) = %q, %v after %d loads", value, err, loads.Load())
+	}
+	if value, err := s.Get("user:1"); err != nil || value != "ann" {
+		t.Fatalf("Get(user:1) = %q, %v; want ann stored", value, err)
+	}
+}
+
+func TestCachingClientFirstStoreWins(t *testing.T) {
+	s, err := NewSyncClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cache := NewCachingClient(s)
+
+	// Another process stores the key while this one is loading it
+	value, err := cache.GetOrLoad("user:2", func() (string, time.Duration, error) {
+		if err := s.Set("user:2", "theirs"); err != nil {
+			return "", 0, err
+		}
+		return "mine", 0, nil
+	})
+	if err != nil || value != "theirs" {
+		t.Fatalf("GetOrLoad(user:2) = %q, %v; want theirs", value, err)
+	}
+
+	// A failed load stores nothing
+	failed := errors.New("upstream down")
+	if _, err := cache.GetOrLoad("user:3", func() (string, time.Duration, error) {
+		return "", 0, failed
+	}); !errors.Is(err, failed) {
+		t.Fatalf("GetOrLoad(user:3) = %v, want the loader's error", err)
+	}
+	if _, err := s.Get("user:3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(user:3) = %v after a failed load, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,172 @@
+package diskdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ChangeOp is the kind of write recorded in a ChangeEvent
+type ChangeOp string
+
+const (
+	// ChangeSet is a write of the key's value, by any command
+	ChangeSet ChangeOp = "set"
+	// ChangeDelete is the removal of the key, deleted or expired
+	ChangeDelete ChangeOp = "del"
+	// ChangeExpire is a change to the key's expiry
+	ChangeExpire ChangeOp = "expire"
+)
+
+const (
+	// Changes fetched per round trip by StreamChanges
+	changesBatchSize = 100
+	// How long the server waits for new changes before replying with none,
+	// which bounds how long StreamChanges takes to notice cancellation
+	changesBlock = time.Second
+)
+
+// ChangeEvent is one write read from the server's change log
+type ChangeEvent struct {
+	// Offset is the position of the change in the log. Offsets increase by
+	// one per change; StreamChanges(ctx, Offset+1) resumes after this one.
+	Offset int64
+	Op     ChangeOp
+	Key    string
+
+	// Type and Value hold the new value of a ChangeSet, typed and shaped
+	// as in ExportNDJSON. When Base64 is set, every string in Value is
+	// base64 encoded because the value holds binary data.
+	Type   string
+	Value  json.RawMessage
+	Base64 bool
+
+	// ExpiresAt is the new expiry of a ChangeExpire, or zero when the
+	// expiry was removed
+	ExpiresAt time.Time
+
+	// Err is set on the last event of a stream that failed; the channel
+	// is closed after it
+	Err error
+}
+
+// changeRecord is a change as sent by the server
+type changeRecord struct {
+	Offset    int64           `json:"offset"`
+	Op        ChangeOp        `json:"op"`
+	Key       string          `json:"key"`
+	Type      string          `json:"type"`
+	Value     json.RawMessage `json:"value"`
+	Encoding  string          `json:"encoding"`
+	ExpiresAt *int64          `json:"expires_at"`
+}
+
+// StreamChanges tails the change log of the selected database from
+// fromOffset on, sending every write (SET, DEL, EXPIRE and every other
+// command that changes a key) as an event on the returned channel, in
+// the order the writes were applied. Passing the offset after the last
+// event handled resumes a consumer where it left off, also across client
+// and server restarts.
+//
+// The server keeps a change log only when started with
+// DISKDB_CHANGELOG_RETENTION, and only the latest writes up to that many;
+// an offset that is no longer retained fails with ErrOffsetNotRetained.
+// Both are reported here, before streaming starts.
+//
+// The stream has a connection of its own. It runs until ctx is cancelled,
+// after which the channel is closed, or until the connection fails, in
+// which case the last event carries the error.
+func (c *Client) StreamChanges(ctx context.Context, fromOffset int64) (<-chan ChangeEvent, error) {
+	stream, err := NewClientWithOptions(c.address, c.options)
+	if err != nil {
+		return nil, err
+	}
+	if c.db != 0 {
+		if err := stream.Select(c.db); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+
+	// The first page does not wait, so a disabled log or a stale offset
+	// fails right away
+	next, records, err := stream.changes(fromOffset, 0)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	events := make(chan ChangeEvent)
+	go func() {
+		defer close(events)
+		defer stream.Close()
+		for {
+			for _, record := range records {
+				event, err := parseChange(record)
+				if err != nil {
+					event = ChangeEvent{Err: err}
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			next, records, err = stream.changes(next, changesBlock)
+			if err != nil {
+				select {
+				case events <- ChangeEvent{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// changes reads the changes from offset on, waiting up to block for one
+// if there are none yet, and returns them with the offset to continue from
+func (c *Client) changes(offset int64, block time.Duration) (int64, []string, error) {
+	args := []string{"COUNT", fmt.Sprint(changesBatchSize)}
+	if block > 0 {
+		args = append(args, "BLOCK", fmt.Sprint(block.Milliseconds()))
+	}
+	cursor, records, err := c.cursorPage("CHANGES", fmt.Sprint(offset), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("changes failed: invalid offset %q", cursor)
+	}
+	return next, records, nil
+}
+
+func parseChange(record string) (ChangeEvent, error) {
+	var r changeRecord
+	if err := json.Unmarshal([]byte(record), &r); err != nil {
+		return ChangeEvent{}, fmt.Errorf("changes failed: %w", err)
+	}
+	event := ChangeEvent{
+		Offset: r.Offset,
+		Op:     r.Op,
+		Key:    r.Key,
+		Type:   r.Type,
+		Value:  r.Value,
+		Base64: r.Encoding == "base64",
+	}
+	if r.ExpiresAt != nil {
+		event.ExpiresAt = time.UnixMilli(*r.ExpiresAt)
+	}
+	return event, nil
+}
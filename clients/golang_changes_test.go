@@ -0,0 +1,105 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changeLogServer serves CHANGES from log, which holds the records at
+// offsets first, first+1, ... BLOCK replies with no changes right away.
+func changeLogServer(t *testing.T, first int64, log []string) string {
+	return fakeServer(t, func(args []string) string {
+		if args[0] != "CHANGES" {
+			return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		offset, _ := strconv.ParseInt(args[1], 10, 64)
+		if offset < first {
+			return fmt.Sprintf("-ERR offset is no longer retained, the oldest is %d\r\n", first)
+		}
+		var out strings.Builder
+		records := log[min(offset-first, int64(len(log))):]
+		records = records[:min(len(records), 2)]
+		next := fmt.Sprint(offset + int64(len(records)))
+		fmt.Fprintf(&out, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(records))
+		for _, record := range records {
+			fmt.Fprintf(&out, "$%d\r\n%s\r\n", len(record), record)
+		}
+		return out.String()
+	})
+}
+
+func TestStreamChanges(t *testing.T) {
+	addr := changeLogServer(t, 3, []string{
+		`{"offset":3,"op":"set","key":"user:1","type":"string","value":"Jane"}`,
+		`{"offset":4,"op":"expire","key":"user:1","expires_at":1700000000000}`,
+		`{"offset":5,"op":"set","key":"blob","type":"string","value":"AAE=","encoding":"base64"}`,
+		`{"offset":6,"op":"del","key":"user:1"}`,
+	})
+	c, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.StreamChanges(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ChangeEvent
+	for len(got) < 3 {
+		select {
+		case event := <-events:
+			if event.Err != nil {
+				t.Fatal(event.Err)
+			}
+			got = append(got, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %+v, want three events", got)
+		}
+	}
+	if got[0].Offset != 4 || got[0].Op != ChangeExpire || !got[0].ExpiresAt.Equal(time.UnixMilli(1700000000000)) {
+		t.Fatalf("first event = %+v", got[0])
+	}
+	if got[1].Op != ChangeSet || got[1].Type != "string" || string(got[1].Value) != `"AAE="` || !got[1].Base64 {
+		t.Fatalf("second event = %+v", got[1])
+	}
+	if got[2].Offset != 6 || got[2].Op != ChangeDelete || got[2].Key != "user:1" {
+		t.Fatalf("third event = %+v", got[2])
+	}
+
+	// Cancelling closes the channel
+	cancel()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Err != nil {
+				t.Fatalf("stream failed with %v after cancel", event.Err)
+			}
+		case <-deadline:
+			t.Fatal("channel still open after cancel")
+		}
+	}
+}
+
+func TestStreamChangesOffsetNotRetained(t *testing.T) {
+	c, err := NewClient(changeLogServer(t, 3, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.StreamChanges(context.Background(), 1); !errors.Is(err, ErrOffsetNotRetained) {
+		t.Fatalf("StreamChanges failed with %v, want ErrOffsetNotRetained", err)
+	}
+}
@@ -0,0 +1,71 @@
+package diskdb
+
+import (
+	"fmt"
+	"io"
+)
+
+// ExportOptions controls Client.ExportNDJSON
+type ExportOptions struct {
+	// Match limits the export to keys matching a glob-style pattern
+	// (*, ? and [...]); empty exports every key
+	Match string
+
+	// Type limits the export to keys of one type as reported by TYPE,
+	// such as "string" or "hash"; empty exports every type
+	Type string
+
+	// BatchSize is the number of keys examined per round trip; defaults
+	// to 100
+	BatchSize int
+}
+
+// ExportNDJSON writes every key of the selected database to w as
+// newline-delimited JSON, one object per key:
+//
+//	{"key":"user:1","type":"hash","value":{"name":"Jane"},"ttl":null}
+//
+// The value is a string, an array (lists and sets), an object (hashes),
+// [{"member","score"}] (sorted sets), [{"id","fields"}] (streams) or the
+// stored document (JSON). ttl is the remaining time to live in seconds, or
+// null for keys without expiry. Values holding binary data have all their
+// strings base64 encoded and carry "encoding":"base64".
+//
+// The keyspace is walked incrementally with the server's cursor, so the
+// export neither blocks the server nor holds it in memory; keys changed
+// during the export may or may not be reflected. It returns the number of
+// keys written.
+func (c *Client) ExportNDJSON(w io.Writer, opts ExportOptions) (int64, error) {
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	args := []string{"COUNT", fmt.Sprint(batch)}
+	if opts.Match != "" {
+		args = append(args, "MATCH", opts.Match)
+	}
+	if opts.Type != "" {
+		args = append(args, "TYPE", opts.Type)
+	}
+
+	var written int64
+	cursor := "0"
+	for {
+		next, records, err := c.cursorPage("EXPORT", cursor, args...)
+		if err != nil {
+			return written, err
+		}
+
+		for _, record := range records {
+			if _, err := io.WriteString(w, record+"\n"); err != nil {
+				return written, err
+			}
+			written++
+		}
+
+		if next == "0" {
+			return written, nil
+		}
+		cursor = next
+	}
+}
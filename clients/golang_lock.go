@@ -0,0 +1,73 @@
+package diskdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// NewLockToken returns a random token identifying one holder of a cache lock.
+// Generate a fresh token for every acquisition and keep it until the lock is
+// released.
+func NewLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AcquireCacheLock takes a short-lived lock at key to protect against cache
+// stampedes: of all the callers that find a cache entry missing, only the one
+// that acquires the lock recomputes it. It returns true if the lock was
+// acquired and false if another holder has it.
+//
+// The lock is the key itself, created only if it does not exist, holding
+// token and expiring after ttl so a crashed holder cannot keep it forever.
+// The token is what makes retries safe:
+//
+//   - If the reply to an acquisition is lost and the call is retried with the
+//     same token, finding the key already set to that token reports the lock
+//     as acquired instead of held by someone else. The original expiry is
+//     kept.
+//   - ReleaseCacheLock only deletes the key while it still holds the token, so
+//     a holder whose lock expired and was taken over cannot release the new
+//     holder's lock, and releasing twice is harmless.
+//
+// Use NewLockToken for a token that is unique to this acquisition.
+func (c *Client) AcquireCacheLock(key, token string, ttl time.Duration) (bool, error) {
+	if token == "" {
+		return false, errors.New("acquire cache lock failed: empty token")
+	}
+	if ttl < time.Millisecond {
+		return false, fmt.Errorf("acquire cache lock failed: invalid ttl %v", ttl)
+	}
+
+	response, err := c.sendCommand("SET", key, token, "NX", "PX", fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return false, err
+	}
+	if response.kind != kindNil {
+		return true, nil
+	}
+
+	// Someone holds the lock; it may be us if an earlier attempt succeeded
+	// but its reply was lost
+	holder, err := c.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return holder == token, nil
+}
+
+// ReleaseCacheLock deletes the lock at key if it is still held by token, as
+// one atomic compare-and-delete on the server. It returns false if the lock
+// had expired or is held by another token, which is safe to ignore.
+func (c *Client) ReleaseCacheLock(key, token string) (bool, error) {
+	return c.DeleteIfEquals(key, token)
+}
@@ -0,0 +1,137 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MirrorOptions controls Client.MirrorTo
+type MirrorOptions struct {
+	// Cursor resumes a previous run from a cursor reported by Progress.
+	// Empty starts from the first key.
+	Cursor string
+
+	// BatchSize is the number of keys fetched per SCAN; defaults to 100
+	BatchSize int
+
+	// KeysPerSecond caps the copy rate; zero means unlimited
+	KeysPerSecond int
+
+	// Replace overwrites keys that already exist on the destination.
+	// Otherwise they are left alone and counted as skipped.
+	Replace bool
+
+	// Progress, if set, is called after every batch
+	Progress func(MirrorProgress)
+}
+
+// MirrorProgress reports how far MirrorTo has got
+type MirrorProgress struct {
+	// Cursor resumes the copy after every key handled so far; "0" once the
+	// whole keyspace has been handled
+	Cursor  string
+	Copied  int64
+	Skipped int64
+}
+
+// MirrorTo copies every key of the selected database to dst, preserving
+// each value, its type and its remaining time to live. It walks the keyspace with SCAN and copies keys
+// one at a time with DUMP and RESTORE, so the source stays online.
+//
+// Keys deleted or expired after they were scanned are skipped. A key modified during
+// the copy is mirrored with the value it had when it was dumped; later
+// writes are not followed. On error the copied count so far is returned
+// and the run can be resumed from the last cursor passed to Progress.
+func (c *Client) MirrorTo(ctx context.Context, dst *Client, opts MirrorOptions) (copied int64, err error) {
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	cursor := opts.Cursor
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var skipped, handled int64
+	start := time.Now()
+	for {
+		next, keys, err := c.Scan(cursor, batch)
+		if err != nil {
+			return copied, err
+		}
+
+		for _, key := range keys {
+			if err := throttle(ctx, start, handled, opts.KeysPerSecond); err != nil {
+				return copied, err
+			}
+			handled++
+
+			data, err := c.DumpKey(key)
+			if errors.Is(err, ErrKeyNotFound) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return copied, err
+			}
+
+			ttl, err := c.PTTL(key)
+			if err != nil {
+				return copied, err
+			}
+			switch {
+			case ttl == KeyMissing, ttl == 0:
+				// Gone or expired since it was dumped
+				skipped++
+				continue
+			case ttl == NoExpiry:
+				ttl = 0
+			}
+
+			err = dst.RestoreKey(key, ttl, data, opts.Replace)
+			if errors.Is(err, ErrKeyExists) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return copied, err
+			}
+			copied++
+		}
+
+		cursor = next
+		if opts.Progress != nil {
+			opts.Progress(MirrorProgress{Cursor: cursor, Copied: copied, Skipped: skipped})
+		}
+		if cursor == "0" {
+			return copied, nil
+		}
+	}
+}
+
+// throttle waits until handling one more key keeps the overall rate at or
+// below perSecond, or until ctx is done.
+func throttle(ctx context.Context, start time.Time, handled int64, perSecond int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if perSecond <= 0 {
+		return nil
+	}
+
+	due := start.Add(time.Duration(handled) * time.Second / time.Duration(perSecond))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
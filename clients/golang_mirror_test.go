@@ -0,0 +1,66 @@
+package diskdb
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMirrorToKeepsTTL(t *testing.T) {
+	// Remaining time to live in milliseconds per key, as PTTL reports it:
+	// "gone" was deleted after the scan and "stale" has expired but not
+	// been reaped yet
+	ttls := map[string]string{"plain": "-1", "timed": "1500", "gone": "-2", "stale": "0"}
+	src := fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "SCAN":
+			return "*2\r\n$1\r\n0\r\n*4\r\n$5\r\nplain\r\n$5\r\ntimed\r\n$4\r\ngone\r\n$5\r\nstale\r\n"
+		case "DUMP":
+			return "$4\r\n0a0b\r\n"
+		case "PTTL":
+			return ":" + ttls[args[1]] + "\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+
+	var mu sync.Mutex
+	restored := make(map[string]string)
+	dst := fakeServer(t, func(args []string) string {
+		if args[0] != "RESTORE" {
+			return "-ERR unexpected command\r\n"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		restored[args[1]] = args[2]
+		return "+OK\r\n"
+	})
+
+	srcClient, err := NewClient(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcClient.Close()
+	dstClient, err := NewClient(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstClient.Close()
+
+	var progress MirrorProgress
+	copied, err := srcClient.MirrorTo(context.Background(), dstClient, MirrorOptions{
+		Progress: func(p MirrorProgress) { progress = p },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 || progress.Skipped != 2 {
+		t.Fatalf("copied %d, skipped %d; want 2 and 2", copied, progress.Skipped)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := map[string]string{"plain": "0", "timed": "1500"}; !reflect.DeepEqual(restored, want) {
+		t.Fatalf("restored with ttls %v, want %v", restored, want)
+	}
+}
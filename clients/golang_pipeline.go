@@ -0,0 +1,96 @@
+package diskdb
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultMaxBatchBytes is the size Pipeline.Exec sends per batch when
+// MaxBatchBytes is not set
+const DefaultMaxBatchBytes = 1 << 20
+
+// Pipeline queues commands to send together, so many commands cost a few
+// round trips instead of one each. Create one with Client.Pipeline or
+// SyncClient.Pipeline, queue commands with Queue and send them with Exec.
+// A Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	// MaxBatchBytes bounds how much Exec writes before reading the replies
+	// to what it wrote, which bounds what the server buffers for one
+	// client however many commands are queued. A command larger than this
+	// is sent in a batch of its own. Defaults to DefaultMaxBatchBytes.
+	MaxBatchBytes int
+
+	c *Client
+	// Held by Exec when the pipeline belongs to a SyncClient
+	mu sync.Locker
+
+	lines [][]byte
+	names []string
+	err   error
+}
+
+// Pipeline returns an empty pipeline sending its commands over c
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Queue adds a command built from args, the command name first, encoded
+// the same way Client.Do encodes it. Nothing is sent until Exec.
+func (p *Pipeline) Queue(args ...string) {
+	if len(args) == 0 {
+		if p.err == nil {
+			p.err = errors.New("pipeline failed: no command given")
+		}
+		return
+	}
+	p.lines = append(p.lines, encodeCommand(args[0], args[1:]...))
+	p.names = append(p.names, args[0])
+}
+
+// Len returns the number of commands queued
+func (p *Pipeline) Len() int {
+	return len(p.lines)
+}
+
+// Exec sends the queued commands and returns their replies in order,
+// emptying the pipeline. Commands are written in batches of up to
+// MaxBatchBytes, reading each batch's replies before writing the next.
+// Error replies are returned as replies. If the connection fails, Exec
+// returns the replies of the batches completed before it, along with the
+// error; commands of the failed batch may or may not have run.
+func (p *Pipeline) Exec() ([]Reply, error) {
+	lines, names, err := p.lines, p.names, p.err
+	p.lines, p.names, p.err = nil, nil, nil
+	if err != nil {
+		return nil, err
+	}
+
+	maxBytes := p.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBatchBytes
+	}
+
+	if p.mu != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+
+	replies := make([]Reply, 0, len(lines))
+	for start := 0; start < len(lines); {
+		end, size := start+1, len(lines[start])
+		for end < len(lines) && size+len(lines[end]) <= maxBytes {
+			size += len(lines[end])
+			end++
+		}
+
+		batch, err := p.c.pipelineLines(lines[start:end])
+		if err != nil {
+			return replies, err
+		}
+		for i, r := range batch {
+			replies = append(replies, Reply{r: r, cmd: names[start+i]})
+		}
+		start = end
+	}
+	return replies, nil
+}
@@ -0,0 +1,54 @@
+package diskdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPipelineExecInBatches(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each SET and GET is over 16 bytes, so every command is a batch of
+	// its own, and the GETs still see the SETs before them
+	p := c.Pipeline()
+	p.MaxBatchBytes = 16
+	for i := 0; i < 50; i++ {
+		p.Queue("SET", fmt.Sprintf("key:%d", i), fmt.Sprintf("value %d", i))
+		p.Queue("GET", fmt.Sprintf("key:%d", i))
+	}
+	replies, err := p.Exec()
+	if err != nil || len(replies) != 100 {
+		t.Fatalf("Exec = %d replies, %v; want 100", len(replies), err)
+	}
+	for i := 0; i < 50; i++ {
+		if v, err := replies[2*i+1].String(); err != nil || v != fmt.Sprintf("value %d", i) {
+			t.Fatalf("reply %d = %q, %v", 2*i+1, v, err)
+		}
+	}
+	if p.Len() != 0 {
+		t.Fatalf("Len after Exec = %d, want 0", p.Len())
+	}
+}
+
+func TestPipelineRejectsEmptyCommand(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := c.Pipeline()
+	p.Queue("SET", "key", "value")
+	p.Queue()
+	if _, err := p.Exec(); err == nil {
+		t.Fatal("Exec succeeded with an empty command queued")
+	}
+	// Nothing was sent
+	if _, err := c.Get("key"); err == nil {
+		t.Fatal("the SET queued with the empty command ran")
+	}
+}
@@ -0,0 +1,126 @@
+package diskdb
+
+import (
+	"context"
+	"sync"
+)
+
+// PoolOptions controls a Pool
+type PoolOptions struct {
+	// Size is the most connections open at once, idle or in use; defaults
+	// to 10
+	Size int
+
+	// ClientOptions configures each connection
+	ClientOptions ClientOptions
+}
+
+// Pool hands out up to Size connections to one server for exclusive use,
+// opening them as needed and keeping returned ones open for reuse. Unlike
+// a SyncClient, callers holding different connections do not wait on each
+// other; once all Size are taken, Get waits for one to be returned.
+type Pool struct {
+	address string
+	opts    ClientOptions
+
+	// Holds a token for every connection handed out, so its capacity
+	// bounds them. Idle connections were all handed out once, so open
+	// connections never outnumber it either.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Client
+	closed bool
+}
+
+// NewPool returns a pool of connections to address. No connection is
+// opened until the first Get.
+func NewPool(address string, opts PoolOptions) *Pool {
+	size := opts.Size
+	if size <= 0 {
+		size = 10
+	}
+	return &Pool{
+		address: address,
+		opts:    opts.ClientOptions,
+		slots:   make(chan struct{}, size),
+	}
+}
+
+// Get returns a connection for exclusive use, waiting as long as it takes
+// for one to be free. It must be given back with Put or Discard.
+func (p *Pool) Get() (*Client, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is Get bounded by ctx: waiting for a free connection and
+// dialing a new one both count against its deadline, and once ctx is done
+// it gives up with ctx.Err(), so a saturated pool cannot silently use up a
+// request's latency budget.
+func (p *Pool) GetContext(ctx context.Context) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	c, err := newClientContext(ctx, p.address, p.opts)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put gives back a connection from Get for reuse. A connection whose last
+// command failed on the connection itself, rather than with an error
+// reply, should go to Discard instead.
+func (p *Pool) Put(c *Client) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.Discard(c)
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// Discard closes a connection from Get instead of giving it back, freeing
+// its place for a new one
+func (p *Pool) Discard(c *Client) {
+	c.Close()
+	<-p.slots
+}
+
+// Close closes the idle connections and makes Get fail with ErrPoolClosed.
+// Connections in use are closed when they are given back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolReusesConnections(t *testing.T) {
+	p := NewPool(fakeServer(t, nil), PoolOptions{Size: 2})
+	defer p.Close()
+
+	a, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(a)
+
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != a {
+		t.Fatal("Get opened a new connection with one idle")
+	}
+	p.Discard(b)
+
+	p.Close()
+	if _, err := p.Get(); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Get after Close = %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestPoolGetContext(t *testing.T) {
+	p := NewPool(fakeServer(t, nil), PoolOptions{Size: 1})
+	defer p.Close()
+
+	held, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With every connection in use, the wait counts against the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.GetContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetContext = %v, want DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("GetContext waited %v past its deadline", waited)
+	}
+
+	// A connection given back goes to the next waiter
+	got := make(chan *Client)
+	go func() {
+		c, err := p.GetContext(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Put(held)
+	if c := <-got; c != held {
+		t.Fatal("the waiter did not get the returned connection")
+	}
+}
@@ -0,0 +1,447 @@
+package diskdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// encodeCommand builds a single protocol line for the given command.
+//
+// The name and arguments that are empty, contain whitespace, quotes, backslashes or
+// control characters, or are not valid UTF-8 are wrapped in double quotes
+// and escaped, so the server always sees exactly the arguments that were
+// passed in regardless of their content. Everything else is sent as-is to
+// keep the line human readable.
+func encodeCommand(name string, args ...string) []byte {
+	buf := make([]byte, 0, len(name)+16*len(args)+1)
+	buf = appendArg(buf, name)
+	for _, arg := range args {
+		buf = append(buf, ' ')
+		buf = appendArg(buf, arg)
+	}
+	return append(buf, '\n')
+}
+
+// appendArg appends a single argument to buf, quoting it when needed.
+func appendArg(buf []byte, arg string) []byte {
+	if !needsQuoting(arg) {
+		return append(buf, arg...)
+	}
+
+	buf = append(buf, '"')
+	buf = appendEscaped(buf, arg)
+	return append(buf, '"')
+}
+
+// appendEscaped appends arg escaped for use inside double quotes. Bytes
+// that are not part of valid UTF-8 are sent as \x escapes, so the line
+// itself always stays valid; the server rejects the argument cleanly
+// unless the escaped bytes join up into valid UTF-8.
+func appendEscaped(buf []byte, arg string) []byte {
+	for i := 0; i < len(arg); i++ {
+		if arg[i] >= utf8.RuneSelf {
+			if r, size := utf8.DecodeRuneInString(arg[i:]); r != utf8.RuneError || size > 1 {
+				buf = append(buf, arg[i:i+size]...)
+				i += size - 1
+				continue
+			}
+			buf = append(buf, '\\', 'x', hexDigits[arg[i]>>4], hexDigits[arg[i]&0x0f])
+			continue
+		}
+		switch b := arg[i]; b {
+		case '"':
+			buf = append(buf, '\\', '"')
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			if b < 0x20 || b == 0x7f {
+				buf = append(buf, '\\', 'x')
+				buf = append(buf, hexDigits[b>>4], hexDigits[b&0x0f])
+			} else {
+				buf = append(buf, b)
+			}
+		}
+	}
+	return buf
+}
+
+const hexDigits = "0123456789abcdef"
+
+// needsQuoting reports whether arg cannot be sent as a bare token.
+func needsQuoting(arg string) bool {
+	if arg == "" || !utf8.ValidString(arg) {
+		return true
+	}
+	for i := 0; i < len(arg); i++ {
+		b := arg[i]
+		if b <= ' ' || b == '"' || b == '\'' || b == '\\' || b == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrIncompleteResponse is returned when the connection ends part way
+// through a reply, such as when the server dies while sending it. The part
+// that was received is discarded and the connection cannot be used again.
+var ErrIncompleteResponse = errors.New("incomplete response")
+
+// incomplete reports a reply cut short by err
+func incomplete(err error) error {
+	return fmt.Errorf("%w: %v", ErrIncompleteResponse, err)
+}
+
+// replyKind identifies how a framed reply was encoded by the server.
+type replyKind byte
+
+const (
+	kindStatus  replyKind = '+'
+	kindError   replyKind = '-'
+	kindInteger replyKind = ':'
+	kindBulk    replyKind = '$'
+	kindArray   replyKind = '*'
+	kindNil     replyKind = 0
+
+	// kindAttribute precedes a reply with metadata about it, sent with
+	// DEBUG TIMING ON. It is folded into the reply it precedes.
+	kindAttribute replyKind = '|'
+)
+
+// reply is a single decoded server reply.
+type reply struct {
+	kind  replyKind
+	str   string
+	num   int64
+	elems []*reply
+
+	// Time the server took to execute the command, if it reported it
+	serverTime time.Duration
+}
+
+// Reply is a single reply from the server
+type Reply struct {
+	r *reply
+	// Name of the command that produced the reply, for error messages
+	cmd string
+}
+
+// Value returns the reply as a Go value: a string for status and bulk
+// replies, an int64 for integers, a []Reply for arrays, an error for error
+// replies and nil for nil replies.
+func (r Reply) Value() interface{} {
+	switch r.r.kind {
+	case kindStatus, kindBulk:
+		return r.r.str
+	case kindInteger:
+		return r.r.num
+	case kindArray:
+		return r.elems()
+	case kindError:
+		return r.Err()
+	}
+	return nil
+}
+
+// Err returns the error carried by an error reply, or nil for any other
+// reply
+func (r Reply) Err() error {
+	if r.r.kind != kindError {
+		return nil
+	}
+	return serverError(r.cmd, r.r.str)
+}
+
+// ServerTime returns how long the server took to execute the command, as
+// reported on connections with timing turned on by Client.SetTiming, or
+// zero otherwise. The rest of the round trip was spent on the network and
+// waiting behind earlier commands.
+func (r Reply) ServerTime() time.Duration {
+	return r.r.serverTime
+}
+
+// IsNil reports whether the reply is a nil reply, such as GET of a missing
+// key
+func (r Reply) IsNil() bool {
+	return r.r.kind == kindNil
+}
+
+// ErrReplyType is returned by the Reply accessors for a reply that does not
+// convert to the type asked for
+var ErrReplyType = errors.New("unexpected reply type")
+
+// Int returns an integer reply, or a status or bulk reply holding a decimal
+// integer, such as GET of a counter
+func (r Reply) Int() (int64, error) {
+	switch r.r.kind {
+	case kindInteger:
+		return r.r.num, nil
+	case kindStatus, kindBulk:
+		if n, err := strconv.ParseInt(r.r.str, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, r.mismatch("an integer")
+}
+
+// String returns a status or bulk reply, or an integer reply in decimal
+func (r Reply) String() (string, error) {
+	switch r.r.kind {
+	case kindStatus, kindBulk:
+		return r.r.str, nil
+	case kindInteger:
+		return strconv.FormatInt(r.r.num, 10), nil
+	}
+	return "", r.mismatch("a string")
+}
+
+// Bytes is String returning a byte slice
+func (r Reply) Bytes() ([]byte, error) {
+	s, err := r.String()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// Slice returns the elements of an array reply
+func (r Reply) Slice() ([]Reply, error) {
+	if r.r.kind != kindArray {
+		return nil, r.mismatch("an array")
+	}
+	return r.elems(), nil
+}
+
+// Bool returns whether a reply read as by Int is non-zero, as for the 0 or 1
+// replies of commands such as EXISTS or EXPIRE
+func (r Reply) Bool() (bool, error) {
+	n, err := r.Int()
+	return n != 0, err
+}
+
+func (r Reply) elems() []Reply {
+	elems := make([]Reply, len(r.r.elems))
+	for i, elem := range r.r.elems {
+		elems[i] = Reply{r: elem, cmd: r.cmd}
+	}
+	return elems
+}
+
+// mismatch reports that the reply is not want. An error reply reports its
+// error instead.
+func (r Reply) mismatch(want string) error {
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s replied with %s, not %s", ErrReplyType, strings.ToLower(r.cmd), r.r.kind, want)
+}
+
+// String describes the kind in errors
+func (k replyKind) String() string {
+	switch k {
+	case kindStatus:
+		return "a status"
+	case kindError:
+		return "an error"
+	case kindInteger:
+		return "an integer"
+	case kindBulk:
+		return "a string"
+	case kindArray:
+		return "an array"
+	}
+	return "nil"
+}
+
+// readBulkTo reads one reply, copying the value of a bulk reply to w as it
+// arrives instead of buffering it. It returns the number of bytes copied and
+// the reply, whose value is left empty for bulk replies; other replies are
+// decoded as by readReply. If w fails, the rest of the value is still read
+// so the connection stays in step with the server.
+func readBulkTo(r *bufio.Reader, w io.Writer) (int64, *reply, error) {
+	kind, err := r.Peek(1)
+	if err == nil && replyKind(kind[0]) == kindAttribute {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, nil, incomplete(io.ErrUnexpectedEOF)
+		}
+		serverTime, err := readAttribute(r, strings.TrimSuffix(strings.TrimSuffix(line[1:], "\n"), "\r"))
+		if err != nil {
+			return 0, nil, err
+		}
+		n, rep, err := readBulkTo(r, w)
+		if rep != nil {
+			rep.serverTime = serverTime
+		}
+		return n, rep, err
+	}
+	if err != nil || replyKind(kind[0]) != kindBulk {
+		rep, err := readReply(r)
+		return 0, rep, err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, nil, incomplete(io.ErrUnexpectedEOF)
+	}
+	length := strings.TrimSuffix(strings.TrimSuffix(line[1:], "\n"), "\r")
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("protocol error: invalid length %q", length)
+	}
+	if n < 0 {
+		return 0, &reply{kind: kindNil}, nil
+	}
+
+	body := &io.LimitedReader{R: r, N: n}
+	copied, writeErr := io.Copy(w, body)
+	if writeErr != nil {
+		// The destination failed; drain the rest of the value so the
+		// connection stays aligned on the next reply
+		io.Copy(io.Discard, body)
+	}
+	if body.N > 0 {
+		return copied, nil, incomplete(io.ErrUnexpectedEOF)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return copied, nil, incomplete(io.ErrUnexpectedEOF)
+	}
+	if string(crlf[:]) != "\r\n" {
+		return copied, nil, fmt.Errorf("protocol error: bulk value of length %d is not terminated", n)
+	}
+	if writeErr != nil {
+		return copied, nil, writeErr
+	}
+	return copied, &reply{kind: kindBulk}, nil
+}
+
+// readReply decodes one framed reply. Connections are switched to framed
+// replies with HELLO 2 right after dialing, so every value carries its own
+// length and may safely contain newlines.
+//
+// A connection closed before the reply started yields io.EOF; one closed
+// part way through yields ErrIncompleteResponse.
+func readReply(r *bufio.Reader) (*reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return nil, incomplete(io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return nil, fmt.Errorf("protocol error: empty reply")
+	}
+
+	// Errors sent before HELLO completes (such as a rejected connection)
+	// still use the line format
+	if msg, ok := strings.CutPrefix(line, "ERROR:"); ok {
+		return &reply{kind: kindError, str: strings.TrimSpace(msg)}, nil
+	}
+
+	kind, body := replyKind(line[0]), line[1:]
+	switch kind {
+	case kindStatus, kindError:
+		return &reply{kind: kind, str: body}, nil
+	case kindInteger:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("protocol error: invalid integer %q", body)
+		}
+		return &reply{kind: kind, num: n}, nil
+	case kindBulk:
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("protocol error: invalid length %q", body)
+		}
+		if n < 0 {
+			return &reply{kind: kindNil}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, incomplete(io.ErrUnexpectedEOF)
+			}
+			return nil, err
+		}
+		if string(buf[n:]) != "\r\n" {
+			return nil, fmt.Errorf("protocol error: bulk value of length %d is not terminated", n)
+		}
+		return &reply{kind: kind, str: string(buf[:n])}, nil
+	case kindArray:
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("protocol error: invalid length %q", body)
+		}
+		if n < 0 {
+			return &reply{kind: kindNil}, nil
+		}
+		elems := make([]*reply, n)
+		for i := range elems {
+			if elems[i], err = readReply(r); err != nil {
+				// The array header has been read, so running out of
+				// input here leaves the reply unfinished
+				if err == io.EOF {
+					return nil, incomplete(err)
+				}
+				return nil, err
+			}
+		}
+		return &reply{kind: kind, elems: elems}, nil
+	case kindAttribute:
+		serverTime, err := readAttribute(r, body)
+		if err != nil {
+			return nil, err
+		}
+		rep, err := readReply(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil, incomplete(err)
+			}
+			return nil, err
+		}
+		rep.serverTime = serverTime
+		return rep, nil
+	default:
+		return nil, fmt.Errorf("protocol error: unexpected reply %q", line)
+	}
+}
+
+// readAttribute reads the pairs of an attribute announced with body as
+// their count and returns the server time among them
+func readAttribute(r *bufio.Reader, body string) (time.Duration, error) {
+	n, err := strconv.Atoi(body)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("protocol error: invalid length %q", body)
+	}
+	var serverTime time.Duration
+	for i := 0; i < n; i++ {
+		key, err := readReply(r)
+		if err == nil {
+			var value *reply
+			if value, err = readReply(r); err == nil && key.str == "server_time_us" {
+				serverTime = time.Duration(value.num) * time.Microsecond
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return 0, incomplete(err)
+			}
+			return 0, err
+		}
+	}
+	return serverTime, nil
+}
@@ -0,0 +1,257 @@
+package diskdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// splitArgs tokenizes a command line the way the server's split_args does,
+// decoding quoted arguments, so tests can check what the server would see.
+func splitArgs(line string) ([]string, error) {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] != '\\' {
+					arg = append(arg, line[i])
+					continue
+				}
+				if i+1 >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case 'x':
+					if i+3 > len(line) {
+						return nil, errors.New("invalid \\x escape")
+					}
+					b, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+					if err != nil {
+						return nil, errors.New("invalid \\x escape")
+					}
+					arg = append(arg, byte(b))
+					i += 2
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			i++
+		case '\'':
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '\'' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg = append(arg, line[i])
+				i++
+			}
+		}
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, string(arg))
+	}
+}
+
+// encodingCases pairs arguments with the line the server receives for
+// them. tests/protocol_quoting_test.rs checks the same lines against the
+// server's parser.
+var encodingCases = []struct {
+	args []string
+	line string
+}{
+	{[]string{"GET", "plain"}, "GET plain\n"},
+	{[]string{"SET", "greeting", "hello world"}, "SET greeting \"hello world\"\n"},
+	{[]string{"SET", "k", ""}, "SET k \"\"\n"},
+	{[]string{"SET", "k", "line1\nline2\r\n"}, "SET k \"line1\\nline2\\r\\n\"\n"},
+	{[]string{"SET", "k", "say \"hi\" \\o/"}, "SET k \"say \\\"hi\\\" \\\\o/\"\n"},
+	{[]string{"SET", "k", "it's"}, "SET k \"it's\"\n"},
+	{[]string{"SET", "k", "\x00\x01\x7f\t"}, "SET k \"\\x00\\x01\\x7f\\t\"\n"},
+	{[]string{"SET", "k", "naïve café"}, "SET k \"naïve café\"\n"},
+	{[]string{"SET", "k", "héllo"}, "SET k héllo\n"},
+	{[]string{"SET", "k", "bad\xff"}, "SET k \"bad\\xff\"\n"},
+}
+
+func TestEncodeCommand(t *testing.T) {
+	for _, tc := range encodingCases {
+		got := string(encodeCommand(tc.args[0], tc.args[1:]...))
+		if got != tc.line {
+			t.Errorf("encodeCommand(%q) = %q, want %q", tc.args, got, tc.line)
+		}
+	}
+}
+
+func TestEncodeCommandInvalidUTF8(t *testing.T) {
+	// The line stays valid UTF-8, and split halves of a character still
+	// reach the server as the original bytes
+	value := "é"
+	line := string(encodeCommand("SET", "k", value[:1]))
+	if !utf8.ValidString(line) {
+		t.Fatalf("encoded line %q is not valid UTF-8", line)
+	}
+	escaped := appendEscaped(appendEscaped(nil, value[:1]), value[1:])
+	args, err := splitArgs("SET k \"" + string(escaped) + "\"\n")
+	if err != nil || args[2] != value {
+		t.Fatalf("split halves decoded to %q, %v", args, err)
+	}
+}
+
+func FuzzEncodeCommand(f *testing.F) {
+	for _, tc := range encodingCases {
+		if len(tc.args) == 3 {
+			f.Add(tc.args[1], tc.args[2])
+		}
+	}
+	f.Add("key with spaces", "\"quoted\" 'single' \\back\\")
+	f.Add("\t", "\r\n\x00")
+
+	f.Fuzz(func(t *testing.T, key, value string) {
+		line := encodeCommand("SET", key, value)
+		if !utf8.Valid(line) {
+			t.Fatalf("encoded line %q is not valid UTF-8", line)
+		}
+		args, err := splitArgs(string(line))
+		if err != nil {
+			t.Fatalf("splitArgs(%q): %v", line, err)
+		}
+		if want := []string{"SET", key, value}; !reflect.DeepEqual(args, want) {
+			t.Fatalf("round trip of %q = %q, want %q", line, args, want)
+		}
+	})
+}
+
+func TestReplyAccessors(t *testing.T) {
+	wrap := func(r *reply) Reply { return Reply{r: r, cmd: "CMD"} }
+	integer := wrap(&reply{kind: kindInteger, num: 42})
+	bulk := wrap(&reply{kind: kindBulk, str: "hello"})
+	counter := wrap(&reply{kind: kindBulk, str: "-7"})
+	status := wrap(&reply{kind: kindStatus, str: "OK"})
+	array := wrap(&reply{kind: kindArray, elems: []*reply{{kind: kindBulk, str: "a"}, {kind: kindInteger, num: 1}}})
+	null := wrap(&reply{kind: kindNil})
+	failed := wrap(&reply{kind: kindError, str: "NOTFOUND no such key"})
+
+	if n, err := integer.Int(); n != 42 || err != nil {
+		t.Errorf("integer Int = %d, %v", n, err)
+	}
+	if n, err := counter.Int(); n != -7 || err != nil {
+		t.Errorf("counter Int = %d, %v", n, err)
+	}
+	if s, err := integer.String(); s != "42" || err != nil {
+		t.Errorf("integer String = %q, %v", s, err)
+	}
+	if s, err := status.String(); s != "OK" || err != nil {
+		t.Errorf("status String = %q, %v", s, err)
+	}
+	if b, err := bulk.Bytes(); string(b) != "hello" || err != nil {
+		t.Errorf("bulk Bytes = %q, %v", b, err)
+	}
+	if ok, err := integer.Bool(); !ok || err != nil {
+		t.Errorf("integer Bool = %v, %v", ok, err)
+	}
+	elems, err := array.Slice()
+	if err != nil || len(elems) != 2 {
+		t.Fatalf("array Slice = %v, %v", elems, err)
+	}
+	if s, err := elems[0].String(); s != "a" || err != nil {
+		t.Errorf("element String = %q, %v", s, err)
+	}
+	if n, err := elems[1].Int(); n != 1 || err != nil {
+		t.Errorf("element Int = %d, %v", n, err)
+	}
+	if !null.IsNil() || integer.IsNil() {
+		t.Error("IsNil does not match the reply kinds")
+	}
+
+	// Replies of the wrong kind fail with ErrReplyType
+	mismatches := map[string]error{}
+	_, mismatches["bulk Int"] = bulk.Int()
+	_, mismatches["bulk Bool"] = bulk.Bool()
+	_, mismatches["bulk Slice"] = bulk.Slice()
+	_, mismatches["array Int"] = array.Int()
+	_, mismatches["array String"] = array.String()
+	_, mismatches["array Bytes"] = array.Bytes()
+	_, mismatches["nil Int"] = null.Int()
+	_, mismatches["nil String"] = null.String()
+	_, mismatches["nil Slice"] = null.Slice()
+	for name, err := range mismatches {
+		if !errors.Is(err, ErrReplyType) {
+			t.Errorf("%s failed with %v, want ErrReplyType", name, err)
+		}
+	}
+
+	// Error replies report their own error
+	if _, err := failed.Int(); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("error Int failed with %v, want ErrKeyNotFound", err)
+	}
+	if _, err := failed.Slice(); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("error Slice failed with %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestReadReplyServerTime(t *testing.T) {
+	timed := "|1\r\n+server_time_us\r\n:250\r\n"
+	r := bufio.NewReader(strings.NewReader(timed + "*1\r\n$1\r\na\r\n" + ":7\r\n" + timed + "$3\r\nabc\r\n"))
+
+	rep, err := readReply(r)
+	if err != nil || rep.kind != kindArray || len(rep.elems) != 1 || rep.serverTime != 250*time.Microsecond {
+		t.Fatalf("timed array = %+v, %v", rep, err)
+	}
+	if rep, err := readReply(r); err != nil || rep.num != 7 || rep.serverTime != 0 {
+		t.Fatalf("untimed integer = %+v, %v", rep, err)
+	}
+	var out bytes.Buffer
+	if n, rep, err := readBulkTo(r, &out); err != nil || n != 3 || rep.serverTime != 250*time.Microsecond {
+		t.Fatalf("timed bulk = %d %+v %v", n, rep, err)
+	}
+
+	// An attribute without its reply is incomplete
+	if _, err := readReply(bufio.NewReader(strings.NewReader(timed))); !errors.Is(err, ErrIncompleteResponse) {
+		t.Fatalf("attribute alone failed with %v", err)
+	}
+}
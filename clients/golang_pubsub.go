@@ -0,0 +1,493 @@
+package diskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectMinDelay = 100 * time.Millisecond
+	reconnectMaxDelay = 5 * time.Second
+)
+
+// ConnState describes the connection behind a Subscription
+type ConnState int32
+
+const (
+	// StateConnected means messages are being received
+	StateConnected ConnState = iota
+	// StateReconnecting means the connection dropped and is being
+	// re-established; messages published meanwhile are lost
+	StateReconnecting
+	// StateClosed means Close was called
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// EventKind identifies what a subscription Event carries
+type EventKind int
+
+const (
+	// EventMessage carries a message published to one of the channels
+	EventMessage EventKind = iota
+	// EventReconnected is delivered once a dropped connection has been
+	// re-established and the channels subscribed again. Messages published
+	// while the connection was down were not received. It is never dropped
+	// by the overflow policy: the subscription waits for room to deliver it
+	// before reading from the new connection.
+	EventReconnected
+)
+
+// OverflowPolicy decides what a Subscription does with a message when its
+// delivery buffer is full because the consumer is not keeping up. It only
+// applies to EventMessage; other events are always delivered.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the consumer to make room. Nothing is lost,
+	// but the subscription stops reading from its connection meanwhile: the
+	// socket buffers fill up and the server holds further messages for the
+	// connection in memory until the consumer catches up, so a consumer
+	// that stays slow grows the server's memory.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered message to make room,
+	// so the consumer always sees the most recent events. Use it when only
+	// the latest state matters. The event being handed to the consumer is
+	// no longer buffered: when it is the only message left, the incoming
+	// one is discarded instead.
+	OverflowDropOldest
+	// OverflowDropNewest discards the incoming event, keeping what is
+	// already buffered. Use it when earlier events matter more than later
+	// ones.
+	OverflowDropNewest
+)
+
+// SubscribeOptions configures a Subscription created by SubscribeWithOptions
+type SubscribeOptions struct {
+	// BufferSize is the number of events held for the consumer, including
+	// the one waiting on the Events channel; defaults to 64. A larger
+	// buffer absorbs longer bursts before the overflow policy applies, at
+	// the cost of memory and of delivering older events.
+	BufferSize int
+
+	// Overflow is applied when the buffer is full; defaults to OverflowBlock
+	Overflow OverflowPolicy
+}
+
+// Event is a single item delivered by a Subscription
+type Event struct {
+	Kind    EventKind
+	Channel string
+	Payload string
+	// Err is the failure that dropped the connection, for EventReconnected
+	Err error
+}
+
+// Subscription receives messages published to a set of channels over a
+// dedicated connection, reconnecting automatically when it drops.
+type Subscription struct {
+	address  string
+	options  ClientOptions
+	channels []string
+	events   chan Event
+	overflow OverflowPolicy
+	state    atomic.Int32
+	dropped  atomic.Uint64
+
+	// Events waiting for the consumer. The one being sent on events has
+	// left queue but still counts against size while sending is set.
+	queueMu sync.Mutex
+	queue   []Event
+	size    int
+	sending bool
+	queued  chan struct{}
+	room    chan struct{}
+
+	mu     sync.Mutex
+	client *Client
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Subscribe opens a dedicated connection subscribed to channels. Messages and
+// reconnect notifications are delivered on Events until Close is called.
+// Events are buffered as described by the zero SubscribeOptions.
+func (c *Client) Subscribe(channels ...string) (*Subscription, error) {
+	return c.SubscribeWithOptions(SubscribeOptions{}, channels...)
+}
+
+// SubscribeWithOptions is Subscribe with the event buffer and the behaviour
+// on overflow configured by opts
+func (c *Client) SubscribeWithOptions(opts SubscribeOptions, channels ...string) (*Subscription, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("subscribe failed: no channels given")
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 64
+	}
+
+	s := &Subscription{
+		address:  c.address,
+		options:  c.options,
+		channels: append([]string(nil), channels...),
+		events:   make(chan Event),
+		overflow: opts.Overflow,
+		size:     size,
+		queued:   make(chan struct{}, 1),
+		room:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+
+	go s.run(client)
+	go s.forward()
+	return s, nil
+}
+
+// Publish sends message to channel and returns the number of subscribers
+// that received it
+func (c *Client) Publish(channel, message string) (int, error) {
+	response, err := c.sendCommand("PUBLISH", channel, message)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// SetAndPublish stores value at key, as Set does, and publishes key to
+// channel in one server operation, returning the number of subscribers that
+// received it. Subscribers are told only once the value is stored, so one
+// that reads the key on notification sees it, and notifications of
+// SetAndPublish calls on the same key arrive in the order they were made.
+func (c *Client) SetAndPublish(key, value, channel string) (subscribers int, err error) {
+	response, err := c.sendCommand("SETPUBLISH", key, value, channel)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.num), nil
+}
+
+// PubSubChannels returns the channels that have at least one subscriber,
+// sorted, only those matching the glob-style pattern unless it is empty.
+// Publishing to a channel missing here reaches nobody.
+func (c *Client) PubSubChannels(pattern string) ([]string, error) {
+	args := []string{"CHANNELS"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	response, err := c.sendCommand("PUBSUB", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make([]string, 0, len(response.elems))
+	for _, elem := range response.elems {
+		channels = append(channels, elem.str)
+	}
+	return channels, nil
+}
+
+// PubSubNumSub returns the number of connections subscribed to each of
+// channels, including those with none
+func (c *Client) PubSubNumSub(channels ...string) (map[string]int, error) {
+	response, err := c.sendCommand("PUBSUB", append([]string{"NUMSUB"}, channels...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.elems)%2 != 0 {
+		return nil, fmt.Errorf("pubsub numsub failed: unexpected reply")
+	}
+
+	counts := make(map[string]int, len(response.elems)/2)
+	for i := 0; i < len(response.elems); i += 2 {
+		counts[response.elems[i].str] = int(response.elems[i+1].num)
+	}
+	return counts, nil
+}
+
+// WatchExpirations delivers the name of each of keys in the selected
+// database as it expires, such as to act when a lease runs out without
+// polling its TTL. The server publishes to a channel per key, so only the
+// watched keys are sent, and it expires watched keys as they become due
+// rather than when next read, so they are reported within about 100ms.
+// Keys that are deleted are not reported.
+//
+// Expirations go over a Subscription of their own, which reconnects when
+// the connection drops; keys that expire meanwhile are not reported. The
+// channel is closed once ctx is cancelled.
+func (c *Client) WatchExpirations(ctx context.Context, keys ...string) (<-chan string, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("watch expirations failed: no keys given")
+	}
+	prefix := fmt.Sprintf("__keyspace@%d__:", c.db)
+	channels := make([]string, len(keys))
+	for i, key := range keys {
+		channels[i] = prefix + key
+	}
+	sub, err := c.Subscribe(channels...)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(chan string)
+	go func() {
+		defer close(expired)
+		defer sub.Close()
+		for {
+			select {
+			case event, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+				if event.Kind != EventMessage || event.Payload != "expired" {
+					continue
+				}
+				select {
+				case expired <- strings.TrimPrefix(event.Channel, prefix):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return expired, nil
+}
+
+// Events returns the channel messages are delivered on. It is closed after
+// Close is called.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events discarded by the overflow policy
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// State reports the current state of the underlying connection
+func (s *Subscription) State() ConnState {
+	return ConnState(s.state.Load())
+}
+
+// Close unsubscribes by closing the connection and stops reconnecting
+func (s *Subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.state.Store(int32(StateClosed))
+		close(s.done)
+		err = s.client.Close()
+	})
+	return err
+}
+
+// connect dials the server and subscribes to every channel.
+func (s *Subscription) connect() (*Client, error) {
+	client, err := NewClientWithOptions(s.address, s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := client.sendCommand("SUBSCRIBE", s.channels...); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// run delivers messages until Close, re-establishing the connection and
+// reporting the gap each time it drops.
+func (s *Subscription) run(client *Client) {
+	for {
+		err := s.receive(client)
+		client.Close()
+
+		if !s.setState(StateReconnecting) {
+			return
+		}
+		if client = s.reconnect(); client == nil {
+			return
+		}
+		if !s.deliver(Event{Kind: EventReconnected, Err: err}) {
+			return
+		}
+	}
+}
+
+// receive reads published messages from client until the connection fails.
+func (s *Subscription) receive(client *Client) error {
+	for {
+		r, err := readReply(client.reader)
+		if err != nil {
+			return err
+		}
+
+		if r.kind != kindArray || len(r.elems) != 3 || r.elems[0].str != "message" {
+			continue
+		}
+		if !s.deliver(Event{Kind: EventMessage, Channel: r.elems[1].str, Payload: r.elems[2].str}) {
+			return nil
+		}
+	}
+}
+
+// reconnect retries with exponential backoff until a new connection is
+// subscribed, or returns nil once the subscription is closed.
+func (s *Subscription) reconnect() *Client {
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		client, err := s.connect()
+		if err != nil {
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.State() == StateClosed {
+			client.Close()
+			return nil
+		}
+		s.client = client
+		s.state.Store(int32(StateConnected))
+		return client
+	}
+}
+
+// setState moves to state unless the subscription has been closed.
+func (s *Subscription) setState(state ConnState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.State() == StateClosed {
+		return false
+	}
+	s.state.Store(int32(state))
+	return true
+}
+
+// deliver queues ev for the consumer, applying the overflow policy to
+// messages when the buffer is full; other events always wait for room. It
+// reports false once the subscription is closed.
+func (s *Subscription) deliver(ev Event) bool {
+	for {
+		s.queueMu.Lock()
+		held := len(s.queue)
+		if s.sending {
+			held++
+		}
+		if held < s.size {
+			s.queue = append(s.queue, ev)
+			s.queueMu.Unlock()
+			signal(s.queued)
+			return true
+		}
+		if ev.Kind == EventMessage && s.overflow != OverflowBlock {
+			if i := oldestMessage(s.queue); s.overflow == OverflowDropOldest && i >= 0 {
+				copy(s.queue[i:], s.queue[i+1:])
+				s.queue[len(s.queue)-1] = ev
+			}
+			s.queueMu.Unlock()
+			s.dropped.Add(1)
+			return true
+		}
+		s.queueMu.Unlock()
+
+		select {
+		case <-s.room:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// forward hands queued events to the consumer in order until Close, then
+// closes the Events channel.
+func (s *Subscription) forward() {
+	defer close(s.events)
+
+	for {
+		s.queueMu.Lock()
+		if len(s.queue) == 0 {
+			s.queueMu.Unlock()
+			select {
+			case <-s.queued:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		ev := s.queue[0]
+		s.queue = s.queue[1:]
+		s.sending = true
+		s.queueMu.Unlock()
+
+		select {
+		case s.events <- ev:
+		case <-s.done:
+			return
+		}
+
+		s.queueMu.Lock()
+		s.sending = false
+		s.queueMu.Unlock()
+		signal(s.room)
+	}
+}
+
+// oldestMessage returns the index of the first EventMessage in queue, or
+// -1 if it holds none.
+func oldestMessage(queue []Event) int {
+	for i, ev := range queue {
+		if ev.Kind == EventMessage {
+			return i
+		}
+	}
+	return -1
+}
+
+// signal wakes up whoever waits on ch without blocking; ch has room for
+// one pending wake-up.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,235 @@
+package diskdb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPubSubServer publishes bursts[i] messages on channel "news" to the
+// i-th subscriber connection right after it subscribes, closing every
+// connection but the last one afterwards so the subscription reconnects.
+// Messages are numbered across connections. It returns the address to
+// dial.
+func flakyPubSubServer(t *testing.T, bursts ...int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	subscriptions, next := 0, 0
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args, _ := splitArgs(line)
+			if len(args) == 0 || args[0] != "SUBSCRIBE" {
+				conn.Write([]byte("+OK\r\n"))
+				continue
+			}
+
+			mu.Lock()
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"))
+			for i := 0; i < bursts[subscriptions]; i++ {
+				payload := fmt.Sprint(next)
+				next++
+				fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$%d\r\n%s\r\n", len(payload), payload)
+			}
+			subscriptions++
+			last := subscriptions == len(bursts)
+			mu.Unlock()
+			if !last {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSubscribeNeverDropsReconnects(t *testing.T) {
+	const reconnected = "reconnected"
+	for _, tc := range []struct {
+		name    string
+		policy  OverflowPolicy
+		bursts  []int
+		dropped uint64
+		// The events received end with tail. With OverflowDropOldest, the
+		// event already being handed over when the burst arrives may
+		// survive as well, so only the newest ones are certain.
+		count int
+		tail  []string
+	}{
+		// The buffer is full when the connection drops: the reconnect
+		// waits for room instead of being dropped
+		{"full/newest", OverflowDropNewest, []int{6, 0}, 2, 5, []string{"0", "1", "2", "3", reconnected}},
+		{"full/oldest", OverflowDropOldest, []int{6, 0}, 2, 5, []string{"3", "4", "5", reconnected}},
+		// The reconnect is buffered when messages overflow: only messages
+		// make room
+		{"buffered/newest", OverflowDropNewest, []int{3, 5}, 5, 4, []string{"0", "1", "2", reconnected}},
+		{"buffered/oldest", OverflowDropOldest, []int{3, 5}, 5, 4, []string{reconnected, "6", "7"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewClient(flakyPubSubServer(t, tc.bursts...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			sub, err := c.SubscribeWithOptions(SubscribeOptions{BufferSize: 4, Overflow: tc.policy}, "news")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for sub.Dropped() < tc.dropped || sub.State() != StateConnected {
+				if time.Now().After(deadline) {
+					t.Fatalf("dropped %d events in state %v, want %d dropped", sub.Dropped(), sub.State(), tc.dropped)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// Let anything still in flight settle
+			time.Sleep(50 * time.Millisecond)
+
+			var got []string
+			for len(got) < tc.count {
+				select {
+				case ev := <-sub.Events():
+					if ev.Kind == EventReconnected {
+						got = append(got, reconnected)
+					} else {
+						got = append(got, ev.Payload)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("received %q, want it to end with %q", got, tc.tail)
+				}
+			}
+			if !reflect.DeepEqual(got[len(got)-len(tc.tail):], tc.tail) {
+				t.Fatalf("received %q, want it to end with %q", got, tc.tail)
+			}
+			if sub.Dropped() != tc.dropped {
+				t.Fatalf("dropped %d events, want %d", sub.Dropped(), tc.dropped)
+			}
+		})
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch {
+		case len(args) == 3 && args[1] == "CHANNELS" && args[2] == "orders.*":
+			return "*1\r\n$11\r\norders.paid\r\n"
+		case len(args) == 4 && args[1] == "NUMSUB":
+			return "*4\r\n$11\r\norders.paid\r\n:2\r\n$5\r\nstale\r\n:0\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	channels, err := c.PubSubChannels("orders.*")
+	if err != nil || !reflect.DeepEqual(channels, []string{"orders.paid"}) {
+		t.Fatalf("PubSubChannels = %v, %v", channels, err)
+	}
+	counts, err := c.PubSubNumSub("orders.paid", "stale")
+	if err != nil || !reflect.DeepEqual(counts, map[string]int{"orders.paid": 2, "stale": 0}) {
+		t.Fatalf("PubSubNumSub = %v, %v", counts, err)
+	}
+}
+
+func TestSetAndPublish(t *testing.T) {
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		if args[0] != "SETPUBLISH" || len(args) != 4 {
+			return "-ERR unexpected command\r\n"
+		}
+		if args[3] == "invalidations" {
+			return ":3\r\n"
+		}
+		return ":0\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if n, err := c.SetAndPublish("user:1", "ann", "invalidations"); err != nil || n != 3 {
+		t.Fatalf("SetAndPublish = %d, %v; want 3", n, err)
+	}
+	if n, err := c.SetAndPublish("user:1", "ann", "nobody"); err != nil || n != 0 {
+		t.Fatalf("SetAndPublish to a channel without subscribers = %d, %v", n, err)
+	}
+}
+
+func TestWatchExpirations(t *testing.T) {
+	message := func(channel, payload string) string {
+		return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+	}
+	c, err := NewClient(fakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "SELECT":
+			return "+OK\r\n"
+		case "SUBSCRIBE":
+			if !reflect.DeepEqual(args[1:], []string{"__keyspace@2__:lease:1", "__keyspace@2__:lease:2"}) {
+				return "-ERR unexpected channels\r\n"
+			}
+			var reply string
+			for i, channel := range args[1:] {
+				reply += fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(channel), channel, i+1)
+			}
+			return reply + message("__keyspace@2__:lease:1", "del") + message("__keyspace@2__:lease:2", "expired")
+		}
+		return "-ERR unexpected command\r\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Select(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	expired, err := c.WatchExpirations(ctx, "lease:1", "lease:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-expired:
+		if key != "lease:2" {
+			t.Fatalf("WatchExpirations delivered %q, want lease:2", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no expiration delivered")
+	}
+
+	cancel()
+	for range expired {
+	}
+	if _, err := c.WatchExpirations(context.Background()); err == nil {
+		t.Fatal("WatchExpirations with no keys succeeded")
+	}
+}
@@ -0,0 +1,100 @@
+package diskdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ScriptOptions controls Client.RunScriptWithOptions
+type ScriptOptions struct {
+	// ChunkSize is the number of commands sent per pipelined round trip;
+	// defaults to 1000
+	ChunkSize int
+
+	// StopOnError stops the script at the first error reply instead of
+	// running every command. Commands already sent in the same chunk as
+	// the failing one have run by then, but their replies are dropped.
+	StopOnError bool
+}
+
+// RunScript runs the commands read from r, one per line, and returns their
+// replies in order. It is RunScriptWithOptions with the default options,
+// running every command whatever the replies.
+func (c *Client) RunScript(r io.Reader) ([]Reply, error) {
+	return c.RunScriptWithOptions(r, ScriptOptions{})
+}
+
+// RunScriptWithOptions runs the commands read from r, one per line and
+// written as they would be typed at the server, such as
+//
+//	SET greeting "hello world"
+//	DEL stale:key
+//
+// Blank lines and lines starting with # are skipped. Commands are sent in
+// pipelined chunks, so a script costs one round trip per chunk rather than
+// one per command. Error replies are returned as replies; with StopOnError
+// the script stops at the first one and also returns it as an error, along
+// with the replies up to and including it.
+func (c *Client) RunScriptWithOptions(r io.Reader, opts ScriptOptions) ([]Reply, error) {
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+
+	var replies []Reply
+	scanner := bufio.NewScanner(r)
+	// Allow lines as long as the largest values the server accepts
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	lineNo := 0
+	lines := make([][]byte, 0, chunkSize)
+	// Script line numbers and command names of the chunk, for errors
+	numbers := make([]int, 0, chunkSize)
+	names := make([]string, 0, chunkSize)
+
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		batch, err := c.pipelineLines(lines)
+		if err != nil {
+			return err
+		}
+		for i, r := range batch {
+			reply := Reply{r: r, cmd: names[i]}
+			replies = append(replies, reply)
+			if opts.StopOnError && r.kind == kindError {
+				return fmt.Errorf("run script failed at line %d: %w", numbers[i], reply.Err())
+			}
+		}
+		lines, numbers, names = lines[:0], numbers[:0], names[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// The scanner reuses its buffer, so the line is copied
+		cmd := make([]byte, len(line)+1)
+		copy(cmd, line)
+		cmd[len(line)] = '\n'
+		name, _, _ := bytes.Cut(line, []byte(" "))
+		lines = append(lines, cmd)
+		numbers = append(numbers, lineNo)
+		names = append(names, string(name))
+		if len(lines) == chunkSize {
+			if err := flush(); err != nil {
+				return replies, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return replies, err
+	}
+	return replies, flush()
+}
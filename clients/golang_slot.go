@@ -0,0 +1,67 @@
+package diskdb
+
+import "fmt"
+
+// SlotCount is the number of hash slots keys are spread over, as in Redis
+// Cluster
+const SlotCount = 16384
+
+// HashTag returns the part of key that decides its slot: the text between
+// the first "{" and the first "}" after it, if that is not empty, or else
+// the whole key. Keys sharing a tag, such as "{tenant42}:profile" and
+// "{tenant42}:orders", always hash to the same slot.
+func HashTag(key string) string {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 {
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+// KeySlot returns the hash slot of key: the CRC16 of its hash tag modulo
+// SlotCount, the same slot Redis Cluster assigns it
+func KeySlot(key string) int {
+	return int(crc16(HashTag(key)) % SlotCount)
+}
+
+// KeysSlot returns the slot shared by keys, which a command touching all of
+// them must be routed to, or ErrCrossSlot if they do not all hash to one
+// slot
+func KeysSlot(keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("no keys to route")
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return 0, fmt.Errorf("%w: %q and %q", ErrCrossSlot, keys[0], key)
+		}
+	}
+	return slot, nil
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis Cluster hashes keys with
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,44 @@
+package diskdb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	for key, want := range map[string]int{
+		"123456789": 0x31C3,
+		"foo":       12182,
+		"{foo}bar":  12182,
+	} {
+		if got := KeySlot(key); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+
+	for key, want := range map[string]string{
+		"{tenant42}:profile": "tenant42",
+		"a{b}{c}":            "b",
+		"foo{{bar}}zap":      "{bar",
+		"foo{}{bar}":         "foo{}{bar}",
+		"foo{bar":            "foo{bar",
+		"plain":              "plain",
+	} {
+		if got := HashTag(key); got != want {
+			t.Errorf("HashTag(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestKeysSlot(t *testing.T) {
+	slot, err := KeysSlot("{tenant42}:profile", "{tenant42}:orders", "tenant42")
+	if err != nil || slot != KeySlot("tenant42") {
+		t.Fatalf("KeysSlot = %d, %v; want the slot of tenant42", slot, err)
+	}
+	if _, err := KeysSlot("{tenant42}:profile", "{tenant43}:profile"); !errors.Is(err, ErrCrossSlot) {
+		t.Fatalf("KeysSlot across tenants = %v, want ErrCrossSlot", err)
+	}
+	if _, err := KeysSlot(); err == nil {
+		t.Fatal("KeysSlot without keys succeeded")
+	}
+}
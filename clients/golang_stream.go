@@ -0,0 +1,126 @@
+package diskdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamChunk is how much of a value SetFrom reads from its source at a time
+const streamChunk = 32 * 1024
+
+// GetTo writes the value of key to w as it arrives from the server, without
+// holding the whole value in memory, and returns the number of bytes
+// written. It returns ErrKeyNotFound if key does not exist.
+//
+// Only the client streams: the server still loads the value in full to
+// send it.
+func (c *Client) GetTo(key string, w io.Writer) (int64, error) {
+	var written int64
+	dst := &errRecorder{w: w}
+	response, err := c.roundTrip("GET", func(bw *bufio.Writer) error {
+		_, err := bw.Write(encodeCommand("GET", key))
+		return err
+	}, func(r *bufio.Reader) (*reply, error) {
+		n, rep, err := readBulkTo(r, dst)
+		written = n
+		if err != nil && err == dst.err {
+			// The value was still read in full, so unlike a failed read
+			// this leaves the connection usable
+			return &reply{kind: kindBulk}, nil
+		}
+		return rep, err
+	})
+	if err != nil {
+		return written, err
+	}
+	if dst.err != nil {
+		return written, dst.err
+	}
+
+	if response.kind == kindNil {
+		return 0, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return written, nil
+}
+
+// SetFrom stores the size bytes read from r as the value of key, like Set,
+// sending them to the server as they are read instead of holding the whole
+// value in memory. If r ends before size bytes or fails, nothing is stored
+// and the error is returned.
+//
+// Only the client streams: the server still receives the value in full
+// before storing it.
+func (c *Client) SetFrom(key string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("set failed: invalid size %d", size)
+	}
+
+	var srcErr error
+	_, err := c.roundTrip("SET", func(w *bufio.Writer) error {
+		// The value is always quoted so it can be escaped chunk by chunk
+		prefix := encodeCommand("SET", key)
+		if _, err := w.Write(append(prefix[:len(prefix)-1], ' ', '"')); err != nil {
+			return err
+		}
+
+		chunk := make([]byte, streamChunk)
+		escaped := make([]byte, 0, 2*streamChunk)
+		src := io.LimitReader(r, size)
+		var sent int64
+		for sent < size {
+			n, err := src.Read(chunk)
+			if n > 0 {
+				escaped = appendEscaped(escaped[:0], string(chunk[:n]))
+				if _, err := w.Write(escaped); err != nil {
+					return err
+				}
+				sent += int64(n)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				srcErr = err
+				break
+			}
+		}
+		if srcErr == nil && sent < size {
+			srcErr = fmt.Errorf("set failed: value ended after %d of %d bytes", sent, size)
+		}
+
+		// Leaving the quote open makes the server reject the line, so a
+		// short value is never stored
+		if srcErr != nil {
+			return w.WriteByte('\n')
+		}
+		_, err := w.WriteString("\"\n")
+		return err
+	}, readReply)
+
+	if srcErr != nil {
+		// The server's rejection of the unterminated line is expected
+		var netErr interface{ Timeout() bool }
+		if err != nil && (errors.As(err, &netErr) || errors.Is(err, ErrIncompleteResponse)) {
+			return err
+		}
+		return srcErr
+	}
+	return err
+}
+
+// errRecorder remembers the first error returned by the writer it wraps
+type errRecorder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errRecorder) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package diskdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingWriter accepts limit bytes and then fails every write
+type failingWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		n := w.limit - w.buf.Len()
+		w.buf.Write(p[:n])
+		return n, errDiskFull
+	}
+	return w.buf.Write(p)
+}
+
+func TestReadBulkToFailingWriter(t *testing.T) {
+	value := strings.Repeat("0123456789", 1000)
+	r := bufio.NewReaderSize(strings.NewReader("$10000\r\n"+value+"\r\n+OK\r\n"), 16)
+
+	w := &failingWriter{limit: 25}
+	n, _, err := readBulkTo(r, w)
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("readBulkTo error = %v, want %v", err, errDiskFull)
+	}
+	if n != 25 || w.buf.String() != value[:25] {
+		t.Fatalf("readBulkTo wrote %d bytes %q", n, w.buf.String())
+	}
+
+	// The rest of the value was drained, so the next reply is intact
+	rep, err := readReply(r)
+	if err != nil || rep.kind != kindStatus || rep.str != "OK" {
+		t.Fatalf("next reply = %+v, %v", rep, err)
+	}
+}
+
+func TestReadBulkToShortValue(t *testing.T) {
+	cases := []string{
+		"$10\r\n01234",
+		"$10\r\n0123456789",
+		"$10\r\n0123456789\r",
+	}
+	for _, input := range cases {
+		var out bytes.Buffer
+		_, _, err := readBulkTo(bufio.NewReader(strings.NewReader(input)), &out)
+		if !errors.Is(err, ErrIncompleteResponse) {
+			t.Errorf("readBulkTo(%q) error = %v, want ErrIncompleteResponse", input, err)
+		}
+	}
+
+	var out bytes.Buffer
+	_, _, err := readBulkTo(bufio.NewReader(strings.NewReader("$3\r\nabcXY")), &out)
+	if err == nil || !strings.Contains(err.Error(), "not terminated") {
+		t.Errorf("unterminated value error = %v", err)
+	}
+}
+
+func TestReadBulkToOtherReplies(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("$-1\r\n-ERR wrong type\r\n$3\r\nabc\r\n"))
+
+	var out bytes.Buffer
+	if _, rep, err := readBulkTo(r, &out); err != nil || rep.kind != kindNil {
+		t.Fatalf("nil reply = %+v, %v", rep, err)
+	}
+	if _, rep, err := readBulkTo(r, &out); err != nil || rep.kind != kindError {
+		t.Fatalf("error reply = %+v, %v", rep, err)
+	}
+	if n, rep, err := readBulkTo(r, &out); err != nil || rep.kind != kindBulk || n != 3 || out.String() != "abc" {
+		t.Fatalf("bulk reply = %d %+v %v %q", n, rep, err, out.String())
+	}
+}
+
+func TestGetToFailingWriterKeepsConnection(t *testing.T) {
+	c, err := NewClient(fakeServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	value := strings.Repeat("0123456789", 1000)
+	if err := c.Set("big", value); err != nil {
+		t.Fatal(err)
+	}
+	w := &failingWriter{limit: 25}
+	if n, err := c.GetTo("big", w); !errors.Is(err, errDiskFull) || n != 25 {
+		t.Fatalf("GetTo = %d, %v; want 25, %v", n, err, errDiskFull)
+	}
+
+	// The value was read in full, so the connection is still in step
+	if v, err := c.Get("big"); err != nil || v != value {
+		t.Fatalf("Get after a failed GetTo = %d bytes, %v", len(v), err)
+	}
+}
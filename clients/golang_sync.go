@@ -0,0 +1,812 @@
+package diskdb
+
+import (
+	"context"
+	"io"
+	"iter"
+	"sync"
+	"time"
+)
+
+// SyncClient wraps a Client so it can be shared by several goroutines.
+// Every command holds a mutex for its full round trip, so callers are
+// serialized on the single connection: correct, but no faster than one
+// goroutine. Commands not mirrored here can be run through Do.
+//
+// Connection state is shared as well: Select changes the database for
+// every caller.
+type SyncClient struct {
+	mu sync.Mutex
+	c  *Client
+
+	// Closed to stop the heartbeat
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSyncClient connects to address and returns a client that is safe for
+// concurrent use
+func NewSyncClient(address string) (*SyncClient, error) {
+	return NewSyncClientWithOptions(address, ClientOptions{})
+}
+
+// NewSyncClientWithOptions is NewSyncClient with the connection configured
+// by opts
+func NewSyncClientWithOptions(address string, opts ClientOptions) (*SyncClient, error) {
+	c, err := NewClientWithOptions(address, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &SyncClient{c: c, done: make(chan struct{})}
+	if opts.HeartbeatInterval > 0 {
+		go s.heartbeat(opts.HeartbeatInterval)
+	}
+	return s, nil
+}
+
+// heartbeat pings the connection whenever it has been idle for interval,
+// replacing it if the ping fails, until the client is closed
+func (s *SyncClient) heartbeat(interval time.Duration) {
+	// Checking at half the interval bounds how long past the interval an
+	// idle connection can go unchecked
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if time.Since(s.c.lastUsed) >= interval {
+			if err := s.c.Ping(); err != nil {
+				s.c.conn.Close()
+				// A failed reconnect leaves the closed connection in
+				// place, so the next tick tries again
+				s.c.connect()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Do runs fn with exclusive use of the underlying Client, so a sequence of
+// commands is not interleaved with other callers
+func (s *SyncClient) Do(fn func(c *Client) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.c)
+}
+
+// Pipeline returns an empty pipeline whose Exec has exclusive use of the
+// underlying Client while it runs
+func (s *SyncClient) Pipeline() *Pipeline {
+	return &Pipeline{c: s.c, mu: &s.mu}
+}
+
+// Ping checks that the connection and the server are alive
+func (s *SyncClient) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Ping()
+}
+
+// InvokeFunction runs the server function name on key
+func (s *SyncClient) InvokeFunction(name, key string, args ...string) (Reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.InvokeFunction(name, key, args...)
+}
+
+// Time returns the server's clock
+func (s *SyncClient) Time() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Time()
+}
+
+// Set stores a key-value pair in the database
+func (s *SyncClient) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Set(key, value)
+}
+
+// SetGet stores a key-value pair and returns the value it replaced
+func (s *SyncClient) SetGet(key, value string) (old string, existed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetGet(key, value)
+}
+
+// SetEncoded stores a key-value pair, asking the server to store it as enc
+func (s *SyncClient) SetEncoded(key, value string, enc Encoding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetEncoded(key, value, enc)
+}
+
+// SetIdempotent stores a key-value pair once per requestID within window
+func (s *SyncClient) SetIdempotent(key, value, requestID string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetIdempotent(key, value, requestID, window)
+}
+
+// SetWithDeadLetter stores a key-value pair whose value moves to dlq when ttl expires
+func (s *SyncClient) SetWithDeadLetter(key, value string, ttl time.Duration, dlq string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetWithDeadLetter(key, value, ttl, dlq)
+}
+
+// Get retrieves a value by key from the database
+func (s *SyncClient) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Get(key)
+}
+
+// GetAndRefresh retrieves a value and resets its expiry to ttl
+func (s *SyncClient) GetAndRefresh(key string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetAndRefresh(key, ttl)
+}
+
+// GetOrSet returns the value at key, first setting it to defaultValue if
+// the key does not exist
+func (s *SyncClient) GetOrSet(key, defaultValue string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetOrSet(key, defaultValue)
+}
+
+// ExpireMatching sets every key matching pattern to expire after ttl
+func (s *SyncClient) ExpireMatching(pattern string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ExpireMatching(pattern, ttl)
+}
+
+// IncrWithExpire increments the counter at key, setting ttl if it was created
+func (s *SyncClient) IncrWithExpire(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.IncrWithExpire(key, ttl)
+}
+
+// IncrMulti atomically increments each counter in deltas by its delta
+func (s *SyncClient) IncrMulti(deltas map[string]int64) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.IncrMulti(deltas)
+}
+
+// DecrAndReap decrements the counter at key, deleting it at zero or below
+func (s *SyncClient) DecrAndReap(key string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.DecrAndReap(key)
+}
+
+// GetReset atomically returns the integer at key and resets it to 0
+func (s *SyncClient) GetReset(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetReset(key)
+}
+
+// MSetEX sets every entry with its own TTL in pipelined batches
+func (s *SyncClient) MSetEX(entries []BulkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.MSetEX(entries)
+}
+
+// Rotate atomically returns the string at key and empties it
+func (s *SyncClient) Rotate(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Rotate(key)
+}
+
+// GetTo writes the value of key to w as it arrives from the server
+func (s *SyncClient) GetTo(key string, w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetTo(key, w)
+}
+
+// SetFrom stores the size bytes read from r as the value of key
+func (s *SyncClient) SetFrom(key string, r io.Reader, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetFrom(key, r, size)
+}
+
+// AppendCapped appends suffix to key and trims the front to maxBytes
+func (s *SyncClient) AppendCapped(key, suffix string, maxBytes int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.AppendCapped(key, suffix, maxBytes)
+}
+
+// SetBit sets the bit at offset in the bitmap at key and returns the old bit
+func (s *SyncClient) SetBit(key string, offset int64, value int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetBit(key, offset, value)
+}
+
+// GetBit returns the bit at offset in the bitmap at key
+func (s *SyncClient) GetBit(key string, offset int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetBit(key, offset)
+}
+
+// BitCount counts the bits set in bytes start to end of the bitmap at key
+func (s *SyncClient) BitCount(key string, start, end int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.BitCount(key, start, end)
+}
+
+// PFAdd adds elements to the HyperLogLog at key
+func (s *SyncClient) PFAdd(key string, elements ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PFAdd(key, elements...)
+}
+
+// PFCount estimates the distinct elements in the union of the HyperLogLogs at keys
+func (s *SyncClient) PFCount(keys ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PFCount(keys...)
+}
+
+// PFMerge stores the union of dest and the HyperLogLogs at sources in dest
+func (s *SyncClient) PFMerge(dest string, sources ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PFMerge(dest, sources...)
+}
+
+// LPushCapped prepends values to the list at key, keeping at most maxLen items
+func (s *SyncClient) LPushCapped(key string, maxLen int, values ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.LPushCapped(key, maxLen, values...)
+}
+
+// RPushCapped appends values to the list at key, keeping at most maxLen items
+func (s *SyncClient) RPushCapped(key string, maxLen int, values ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.RPushCapped(key, maxLen, values...)
+}
+
+// LPopN atomically pops up to count items from the head of the list at key
+func (s *SyncClient) LPopN(key string, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.LPopN(key, count)
+}
+
+// RPopN atomically pops up to count items from the tail of the list at key
+func (s *SyncClient) RPopN(key string, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.RPopN(key, count)
+}
+
+// LLen returns the length of the list stored at key
+func (s *SyncClient) LLen(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.LLen(key)
+}
+
+// LTrim trims the list stored at key to the elements between start and stop
+func (s *SyncClient) LTrim(key string, start, stop int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.LTrim(key, start, stop)
+}
+
+// ClaimJob takes the job at the head of a queue until the visibility timeout
+func (s *SyncClient) ClaimJob(queue string, visibility time.Duration) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ClaimJob(queue, visibility)
+}
+
+// AckJob marks a claimed job done
+func (s *SyncClient) AckJob(queue, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.AckJob(queue, id)
+}
+
+// SMIsMember reports whether each of members belongs to the set at key
+func (s *SyncClient) SMIsMember(key string, members ...string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SMIsMember(key, members...)
+}
+
+// SRandMember returns up to count random members of the set at key
+func (s *SyncClient) SRandMember(key string, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SRandMember(key, count)
+}
+
+// ZRemRangeByRank removes the members of the sorted set at key ranked start to stop
+func (s *SyncClient) ZRemRangeByRank(key string, start, stop int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ZRemRangeByRank(key, start, stop)
+}
+
+// ZRemRangeByScore removes the members of the sorted set at key scored min to max
+func (s *SyncClient) ZRemRangeByScore(key string, min, max float64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ZRemRangeByScore(key, min, max)
+}
+
+// RandomKey returns a random existing key, or ErrEmpty
+func (s *SyncClient) RandomKey() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.RandomKey()
+}
+
+// Scan returns up to count keys following cursor and the next cursor
+func (s *SyncClient) Scan(cursor string, count int) (string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Scan(cursor, count)
+}
+
+// Iterate returns an iterator over the keys matching pattern. The mutex is
+// held while each page is fetched, not while the loop body runs, so the
+// body may use the client.
+func (s *SyncClient) Iterate(pattern string) iter.Seq2[string, error] {
+	return iterateKeys(pattern, func(name, cursor string, args ...string) (string, []string, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.c.cursorPage(name, cursor, args...)
+	})
+}
+
+// GetMatching returns an iterator over the keys matching pattern and their
+// values. As with Iterate, the mutex is held only while each page is
+// fetched.
+func (s *SyncClient) GetMatching(pattern string) iter.Seq2[KV, error] {
+	return iterateValues(pattern, func(name, cursor string, args ...string) (string, []string, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.c.cursorPage(name, cursor, args...)
+	})
+}
+
+// ScanByAge returns up to count keys not written within olderThan
+func (s *SyncClient) ScanByAge(olderThan time.Duration, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ScanByAge(olderThan, count)
+}
+
+// Expire sets a timeout on key, after which it is deleted
+func (s *SyncClient) Expire(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Expire(key, ttl)
+}
+
+// PExpire sets a timeout on key with millisecond precision
+func (s *SyncClient) PExpire(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PExpire(key, ttl)
+}
+
+// TTL returns the remaining time to live of key, NoExpiry or KeyMissing
+func (s *SyncClient) TTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.TTL(key)
+}
+
+// PTTL returns the remaining time to live of key in milliseconds, NoExpiry
+// or KeyMissing
+func (s *SyncClient) PTTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PTTL(key)
+}
+
+// MTTL returns the time to live of every key, aligned with keys
+func (s *SyncClient) MTTL(keys ...string) ([]time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.MTTL(keys...)
+}
+
+// Persist removes the expiry of key, reporting whether it had one
+func (s *SyncClient) Persist(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Persist(key)
+}
+
+// RenamePersist renames src to dst and removes its expiry in one step
+func (s *SyncClient) RenamePersist(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.RenamePersist(src, dst)
+}
+
+// Swap exchanges the values of keyA and keyB atomically
+func (s *SyncClient) Swap(keyA, keyB string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Swap(keyA, keyB)
+}
+
+// SwapWithTTL exchanges the values and expiries of keyA and keyB atomically
+func (s *SyncClient) SwapWithTTL(keyA, keyB string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SwapWithTTL(keyA, keyB)
+}
+
+// DeleteIfEquals deletes key only if it holds expected
+func (s *SyncClient) DeleteIfEquals(key, expected string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.DeleteIfEquals(key, expected)
+}
+
+// SetIfVersion stores value at key only if its version is expectedVersion
+func (s *SyncClient) SetIfVersion(key, value string, expectedVersion int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetIfVersion(key, value, expectedVersion)
+}
+
+// GetIfChanged retrieves the value of key only if it changed since sinceVersion
+func (s *SyncClient) GetIfChanged(key string, sinceVersion int64) (string, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetIfChanged(key, sinceVersion)
+}
+
+// SetTagged stores a key-value pair and replaces the key's tags
+func (s *SyncClient) SetTagged(key, value string, tags ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetTagged(key, value, tags...)
+}
+
+// KeysByTag returns the keys tagged tag
+func (s *SyncClient) KeysByTag(tag string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.KeysByTag(tag)
+}
+
+// AcquireCacheLock takes the lock at key for token if nobody holds it
+func (s *SyncClient) AcquireCacheLock(key, token string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.AcquireCacheLock(key, token, ttl)
+}
+
+// ReleaseCacheLock deletes the lock at key if it is still held by token
+func (s *SyncClient) ReleaseCacheLock(key, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ReleaseCacheLock(key, token)
+}
+
+// ExportNDJSON writes the keys of the selected database to w as
+// newline-delimited JSON. The connection is held for the whole export.
+func (s *SyncClient) ExportNDJSON(w io.Writer, opts ExportOptions) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ExportNDJSON(w, opts)
+}
+
+// BigKeys returns the largest keys of each type in the selected database.
+// The connection is held for the whole walk.
+func (s *SyncClient) BigKeys(opts BigKeysOptions) ([]KeyReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.BigKeys(opts)
+}
+
+// SetName names the connection in the server's CLIENT LIST
+func (s *SyncClient) SetName(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetName(name)
+}
+
+// SetTiming turns the server's reporting of command execution times on or off
+func (s *SyncClient) SetTiming(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetTiming(on)
+}
+
+// Select switches the shared connection to database db
+func (s *SyncClient) Select(db int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Select(db)
+}
+
+// Move transfers key from the selected database to db
+func (s *SyncClient) Move(key string, db int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Move(key, db)
+}
+
+// SwapDB atomically exchanges the contents of databases a and b
+func (s *SyncClient) SwapDB(a, b int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SwapDB(a, b)
+}
+
+// DumpKey returns a serialized copy of the value stored at key
+func (s *SyncClient) DumpKey(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.DumpKey(key)
+}
+
+// RestoreKey recreates key from data produced by DumpKey
+func (s *SyncClient) RestoreKey(key string, ttl time.Duration, data []byte, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.RestoreKey(key, ttl, data, replace)
+}
+
+// KeyStats returns the GET hits and misses counted for prefix
+func (s *SyncClient) KeyStats(prefix string) (hits, misses int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.KeyStats(prefix)
+}
+
+// DebugObject returns low-level details about key
+func (s *SyncClient) DebugObject(key string) (DebugInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.DebugObject(key)
+}
+
+// ServerLogTail returns the last lines lines of the server's log
+func (s *SyncClient) ServerLogTail(lines int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ServerLogTail(lines)
+}
+
+// MemoryUsage estimates the bytes key occupies
+func (s *SyncClient) MemoryUsage(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.MemoryUsage(key)
+}
+
+// ObjectEncoding returns how the value at key is stored
+func (s *SyncClient) ObjectEncoding(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ObjectEncoding(key)
+}
+
+// Warmup starts reading the keys matching patterns in the background
+func (s *SyncClient) Warmup(patterns ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Warmup(patterns...)
+}
+
+// Compact starts compacting the selected database in the background
+func (s *SyncClient) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Compact()
+}
+
+// CompactStatus reports the running compaction, or the last one
+func (s *SyncClient) CompactStatus() (CompactInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.CompactStatus()
+}
+
+// CompactCancel stops the running compaction after the range in progress
+func (s *SyncClient) CompactCancel() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.CompactCancel()
+}
+
+// CompactKey compacts the data of one key and waits until it is done
+func (s *SyncClient) CompactKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.CompactKey(key)
+}
+
+// SaveSnapshot writes a snapshot of the selected database on the server
+// host and waits until it is done
+func (s *SyncClient) SaveSnapshot(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SaveSnapshot(path)
+}
+
+// BackgroundSaveSnapshot starts writing a snapshot in the background
+func (s *SyncClient) BackgroundSaveSnapshot(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.BackgroundSaveSnapshot(path)
+}
+
+// SnapshotInfo describes the snapshot at path and checks its files
+func (s *SyncClient) SnapshotInfo(path string) (SnapshotMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SnapshotInfo(path)
+}
+
+// LastSaveTime returns when the latest snapshot was saved
+func (s *SyncClient) LastSaveTime() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.LastSaveTime()
+}
+
+// AuditLog returns the latest count commands the server refused
+func (s *SyncClient) AuditLog(count int) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.AuditLog(count)
+}
+
+// ResetAuditLog clears the server's audit log
+func (s *SyncClient) ResetAuditLog() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ResetAuditLog()
+}
+
+// Shutdown stops the server, flushing every open database first if save
+func (s *SyncClient) Shutdown(save bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Shutdown(save)
+}
+
+// StreamChanges tails the change log of the selected database from
+// fromOffset on, over a connection of its own
+func (s *SyncClient) StreamChanges(ctx context.Context, fromOffset int64) (<-chan ChangeEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.StreamChanges(ctx, fromOffset)
+}
+
+// MemoryStats returns an overall memory breakdown
+func (s *SyncClient) MemoryStats() (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.MemoryStats()
+}
+
+// ExpireStats reports pending expired keys and the background reaper
+func (s *SyncClient) ExpireStats() (ExpireInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ExpireStats()
+}
+
+// ConfigGet returns the value of a runtime server setting
+func (s *SyncClient) ConfigGet(parameter string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ConfigGet(parameter)
+}
+
+// ConfigSet changes a runtime server setting until the server restarts
+func (s *SyncClient) ConfigSet(parameter, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.ConfigSet(parameter, value)
+}
+
+// Metrics returns the server's metrics in the Prometheus text format
+func (s *SyncClient) Metrics() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Metrics()
+}
+
+// WriteStats returns the bytes written to the selected database since the
+// server started, as clients wrote them and as they reached the disk
+func (s *SyncClient) WriteStats() (logicalBytes, physicalBytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.WriteStats()
+}
+
+// Publish sends message to channel and returns the number of receivers
+func (s *SyncClient) Publish(channel, message string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Publish(channel, message)
+}
+
+// SetAndPublish stores value at key and publishes key to channel at once
+func (s *SyncClient) SetAndPublish(key, value, channel string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SetAndPublish(key, value, channel)
+}
+
+// PubSubChannels returns the channels with subscribers matching pattern
+func (s *SyncClient) PubSubChannels(pattern string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PubSubChannels(pattern)
+}
+
+// PubSubNumSub returns the number of subscribers of each of channels
+func (s *SyncClient) PubSubNumSub(channels ...string) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.PubSubNumSub(channels...)
+}
+
+// WatchExpirations delivers the name of each of keys as it expires, over a
+// subscription of its own
+func (s *SyncClient) WatchExpirations(ctx context.Context, keys ...string) (<-chan string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.WatchExpirations(ctx, keys...)
+}
+
+// Subscribe opens a dedicated subscription connection
+func (s *SyncClient) Subscribe(channels ...string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Subscribe(channels...)
+}
+
+// SubscribeWithOptions opens a dedicated subscription connection with the
+// event buffer configured by opts
+func (s *SyncClient) SubscribeWithOptions(opts SubscribeOptions, channels ...string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.SubscribeWithOptions(opts, channels...)
+}
+
+// Close closes the connection to the server
+func (s *SyncClient) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Close()
+}
@@ -0,0 +1,56 @@
+package diskdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with -race: every goroutine shares one connection through the
+// SyncClient, including the heartbeat
+func TestSyncClientConcurrentUse(t *testing.T) {
+	s, err := NewSyncClientWithOptions(fakeServer(t, nil), ClientOptions{
+		HeartbeatInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const goroutines, commands = 16, 200
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < commands; i++ {
+				key := fmt.Sprintf("sync:%d:%d", g, i)
+				if err := s.Set(key, key); err != nil {
+					t.Errorf("Set(%s): %v", key, err)
+					return
+				}
+				if value, err := s.Get(key); err != nil || value != key {
+					t.Errorf("Get(%s) = %q, %v", key, value, err)
+					return
+				}
+				err := s.Do(func(c *Client) error {
+					value, err := c.Get(key)
+					if err == nil && value != key {
+						err = fmt.Errorf("got %q", value)
+					}
+					return err
+				})
+				if err != nil {
+					t.Errorf("Do(Get(%s)): %v", key, err)
+					return
+				}
+				if err := s.Ping(); err != nil {
+					t.Errorf("Ping: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -12,6 +12,38 @@ from contextlib import contextmanager
 from .exceptions import ConnectionError, CommandError, TypeMismatchError, TimeoutError
 
 
+def encode_command(*args: Any) -> str:
+    """
+    Build a command line the server splits back into exactly ``args``.
+
+    Arguments that are empty or contain whitespace, quotes, backslashes or
+    control characters are double-quoted and escaped; everything else is
+    sent as-is.
+    """
+    parts = []
+    for arg in args:
+        arg = str(arg)
+        if arg and not any(c <= " " or c in "\"'\\\x7f" for c in arg):
+            parts.append(arg)
+            continue
+        escaped = []
+        for c in arg:
+            if c in "\"\\":
+                escaped.append("\\" + c)
+            elif c == "\n":
+                escaped.append("\\n")
+            elif c == "\r":
+                escaped.append("\\r")
+            elif c == "\t":
+                escaped.append("\\t")
+            elif c < " " or c == "\x7f":
+                escaped.append("\\x%02x" % ord(c))
+            else:
+                escaped.append(c)
+        parts.append('"' + "".join(escaped) + '"')
+    return " ".join(parts)
+
+
 class DiskDB:
     """
     DiskDB client for Python.
@@ -146,7 +178,7 @@ class DiskDB:
         Returns:
             True if successful
         """
-        response = self._send_command(f"SET {key} {value}")
+        response = self._send_command(encode_command("SET", key, value))
         return response == "OK"
     
     def get(self, key: str) -> Optional[str]:
@@ -159,7 +191,7 @@ class DiskDB:
         Returns:
             The value or None if key doesn't exist
         """
-        response = self._send_command(f"GET {key}")
+        response = self._send_command(encode_command("GET", key))
         return None if response == "(nil)" else response
     
     def incr(self, key: str) -> int:
@@ -172,7 +204,7 @@ class DiskDB:
         Returns:
             The value after increment
         """
-        response = self._send_command(f"INCR {key}")
+        response = self._send_command(encode_command("INCR", key))
         return int(response)
     
     def decr(self, key: str) -> int:
@@ -185,7 +217,7 @@ class DiskDB:
         Returns:
             The value after decrement
         """
-        response = self._send_command(f"DECR {key}")
+        response = self._send_command(encode_command("DECR", key))
         return int(response)
     
     def incrby(self, key: str, increment: int) -> int:
@@ -199,7 +231,7 @@ class DiskDB:
         Returns:
             The value after increment
         """
-        response = self._send_command(f"INCRBY {key} {increment}")
+        response = self._send_command(encode_command("INCRBY", key, increment))
         return int(response)
     
     def append(self, key: str, value: str) -> int:
@@ -213,7 +245,7 @@ class DiskDB:
         Returns:
             The length of the string after append
         """
-        response = self._send_command(f"APPEND {key} {value}")
+        response = self._send_command(encode_command("APPEND", key, value))
         return int(response)
     
     # List Operations
@@ -229,8 +261,7 @@ class DiskDB:
         Returns:
             The length of the list after push
         """
-        values_str = " ".join(values)
-        response = self._send_command(f"LPUSH {key} {values_str}")
+        response = self._send_command(encode_command("LPUSH", key, *values))
         return int(response)
     
     def rpush(self, key: str, *values: str) -> int:
@@ -244,8 +275,7 @@ class DiskDB:
         Returns:
             The length of the list after push
         """
-        values_str = " ".join(values)
-        response = self._send_command(f"RPUSH {key} {values_str}")
+        response = self._send_command(encode_command("RPUSH", key, *values))
         return int(response)
     
     def lpop(self, key: str) -> Optional[str]:
@@ -258,7 +288,7 @@ class DiskDB:
         Returns:
             The popped element or None if list is empty
         """
-        response = self._send_command(f"LPOP {key}")
+        response = self._send_command(encode_command("LPOP", key))
         return None if response == "(nil)" else response
     
     def rpop(self, key: str) -> Optional[str]:
@@ -271,7 +301,7 @@ class DiskDB:
         Returns:
             The popped element or None if list is empty
         """
-        response = self._send_command(f"RPOP {key}")
+        response = self._send_command(encode_command("RPOP", key))
         return None if response == "(nil)" else response
     
     def lrange(self, key: str, start: int, stop: int) -> List[str]:
@@ -287,7 +317,7 @@ class DiskDB:
             List of elements
         """
         self._ensure_connected()
-        self.socket.send(f"LRANGE {key} {start} {stop}\n".encode())
+        self.socket.send(f"{encode_command('LRANGE', key, start, stop)}\n".encode())
         
         # Read the array response
         return self._read_array()
@@ -302,7 +332,7 @@ class DiskDB:
         Returns:
             The length of the list
         """
-        response = self._send_command(f"LLEN {key}")
+        response = self._send_command(encode_command("LLEN", key))
         return int(response)
     
     # Set Operations
@@ -318,8 +348,7 @@ class DiskDB:
         Returns:
             The number of members added
         """
-        members_str = " ".join(members)
-        response = self._send_command(f"SADD {key} {members_str}")
+        response = self._send_command(encode_command("SADD", key, *members))
         return int(response)
     
     def srem(self, key: str, *members: str) -> int:
@@ -333,8 +362,7 @@ class DiskDB:
         Returns:
             The number of members removed
         """
-        members_str = " ".join(members)
-        response = self._send_command(f"SREM {key} {members_str}")
+        response = self._send_command(encode_command("SREM", key, *members))
         return int(response)
     
     def sismember(self, key: str, member: str) -> bool:
@@ -348,7 +376,7 @@ class DiskDB:
         Returns:
             True if member exists in set
         """
-        response = self._send_command(f"SISMEMBER {key} {member}")
+        response = self._send_command(encode_command("SISMEMBER", key, member))
         return response == "1"
     
     def smembers(self, key: str) -> TypeSet[str]:
@@ -362,7 +390,7 @@ class DiskDB:
             Set of all members
         """
         self._ensure_connected()
-        self.socket.send(f"SMEMBERS {key}\n".encode())
+        self.socket.send(f"{encode_command('SMEMBERS', key)}\n".encode())
         members = self._read_array()
         return set(members)
     
@@ -376,7 +404,7 @@ class DiskDB:
         Returns:
             The cardinality (number of members) of the set
         """
-        response = self._send_command(f"SCARD {key}")
+        response = self._send_command(encode_command("SCARD", key))
         return int(response)
     
     # Hash Operations
@@ -393,7 +421,7 @@ class DiskDB:
         Returns:
             1 if field is new, 0 if field existed
         """
-        response = self._send_command(f"HSET {key} {field} {value}")
+        response = self._send_command(encode_command("HSET", key, field, value))
         return int(response)
     
     def hget(self, key: str, field: str) -> Optional[str]:
@@ -407,7 +435,7 @@ class DiskDB:
         Returns:
             The value or None if field doesn't exist
         """
-        response = self._send_command(f"HGET {key} {field}")
+        response = self._send_command(encode_command("HGET", key, field))
         return None if response == "(nil)" else response
     
     def hdel(self, key: str, *fields: str) -> int:
@@ -421,8 +449,7 @@ class DiskDB:
         Returns:
             The number of fields removed
         """
-        fields_str = " ".join(fields)
-        response = self._send_command(f"HDEL {key} {fields_str}")
+        response = self._send_command(encode_command("HDEL", key, *fields))
         return int(response)
     
     def hgetall(self, key: str) -> Dict[str, str]:
@@ -436,7 +463,7 @@ class DiskDB:
             Dictionary of field-value pairs
         """
         self._ensure_connected()
-        self.socket.send(f"HGETALL {key}\n".encode())
+        self.socket.send(f"{encode_command('HGETALL', key)}\n".encode())
         
         result = {}
         lines = self._read_array()
@@ -459,7 +486,7 @@ class DiskDB:
         Returns:
             True if field exists
         """
-        response = self._send_command(f"HEXISTS {key} {field}")
+        response = self._send_command(encode_command("HEXISTS", key, field))
         return response == "1"
     
     # Sorted Set Operations
@@ -478,8 +505,7 @@ class DiskDB:
         parts = []
         for member, score in mapping.items():
             parts.extend([str(score), member])
-        args_str = " ".join(parts)
-        response = self._send_command(f"ZADD {key} {args_str}")
+        response = self._send_command(encode_command("ZADD", key, *parts))
         return int(response)
     
     def zrem(self, key: str, *members: str) -> int:
@@ -493,8 +519,7 @@ class DiskDB:
         Returns:
             The number of members removed
         """
-        members_str = " ".join(members)
-        response = self._send_command(f"ZREM {key} {members_str}")
+        response = self._send_command(encode_command("ZREM", key, *members))
         return int(response)
     
     def zscore(self, key: str, member: str) -> Optional[float]:
@@ -508,7 +533,7 @@ class DiskDB:
         Returns:
             The score or None if member doesn't exist
         """
-        response = self._send_command(f"ZSCORE {key} {member}")
+        response = self._send_command(encode_command("ZSCORE", key, member))
         return None if response == "(nil)" else float(response)
     
     def zrange(self, key: str, start: int, stop: int, withscores: bool = False) -> Union[List[str], List[Tuple[str, float]]]:
@@ -524,9 +549,10 @@ class DiskDB:
         Returns:
             List of members or list of (member, score) tuples
         """
-        command = f"ZRANGE {key} {start} {stop}"
+        args = ["ZRANGE", key, start, stop]
         if withscores:
-            command += " WITHSCORES"
+            args.append("WITHSCORES")
+        command = encode_command(*args)
         
         self._ensure_connected()
         self.socket.send(f"{command}\n".encode())
@@ -553,7 +579,7 @@ class DiskDB:
         Returns:
             The cardinality of the sorted set
         """
-        response = self._send_command(f"ZCARD {key}")
+        response = self._send_command(encode_command("ZCARD", key))
         return int(response)
     
     # JSON Operations
@@ -571,7 +597,7 @@ class DiskDB:
             True if successful
         """
         json_str = json.dumps(value, separators=(',', ':'))
-        response = self._send_command(f"JSON.SET {key} {path} {json_str}")
+        response = self._send_command(encode_command("JSON.SET", key, path, json_str))
         return response == "OK"
     
     def json_get(self, key: str, path: str) -> Any:
@@ -585,7 +611,7 @@ class DiskDB:
         Returns:
             Python object parsed from JSON
         """
-        response = self._send_command(f"JSON.GET {key} {path}")
+        response = self._send_command(encode_command("JSON.GET", key, path))
         if response == "(nil)":
             return None
         return json.loads(response)
@@ -601,7 +627,7 @@ class DiskDB:
         Returns:
             Number of paths deleted
         """
-        response = self._send_command(f"JSON.DEL {key} {path}")
+        response = self._send_command(encode_command("JSON.DEL", key, path))
         return int(response)
     
     # Stream Operations
@@ -621,8 +647,7 @@ class DiskDB:
         parts = [id]
         for field, value in fields.items():
             parts.extend([field, value])
-        args_str = " ".join(parts)
-        response = self._send_command(f"XADD {key} {args_str}")
+        response = self._send_command(encode_command("XADD", key, *parts))
         return response
     
     def xlen(self, key: str) -> int:
@@ -635,7 +660,7 @@ class DiskDB:
         Returns:
             The number of entries
         """
-        response = self._send_command(f"XLEN {key}")
+        response = self._send_command(encode_command("XLEN", key))
         return int(response)
     
     def xrange(self, key: str, start: str = "-", end: str = "+", count: Optional[int] = None) -> List[Dict[str, Any]]:
@@ -651,9 +676,10 @@ class DiskDB:
         Returns:
             List of entries with id and fields
         """
-        command = f"XRANGE {key} {start} {end}"
+        args = ["XRANGE", key, start, end]
         if count:
-            command += f" COUNT {count}"
+            args.extend(["COUNT", count])
+        command = encode_command(*args)
         
         self._ensure_connected()
         self.socket.send(f"{command}\n".encode())
@@ -695,7 +721,7 @@ class DiskDB:
         Returns:
             Type string: string, list, set, zset, hash, json, stream, or none
         """
-        response = self._send_command(f"TYPE {key}")
+        response = self._send_command(encode_command("TYPE", key))
         return response
     
     def exists(self, *keys: str) -> int:
@@ -708,8 +734,7 @@ class DiskDB:
         Returns:
             Number of keys that exist
         """
-        keys_str = " ".join(keys)
-        response = self._send_command(f"EXISTS {keys_str}")
+        response = self._send_command(encode_command("EXISTS", *keys))
         return int(response)
     
     def delete(self, *keys: str) -> int:
@@ -722,8 +747,7 @@ class DiskDB:
         Returns:
             Number of keys deleted
         """
-        keys_str = " ".join(keys)
-        response = self._send_command(f"DEL {keys_str}")
+        response = self._send_command(encode_command("DEL", *keys))
         return int(response)
     
     # Aliases for common operations
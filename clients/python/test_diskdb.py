@@ -33,6 +33,11 @@ class TestDiskDBStrings:
         assert self.db.get("test_key") == "test_value"
         assert self.db.get("nonexistent") is None
     
+    def test_set_get_quoted(self):
+        for value in ["hello world", '"quoted"', "it's", "back\\slash", "tab\there", ""]:
+            assert self.db.set("test_key", value) is True
+            assert self.db.get("test_key") == value
+    
     def test_incr_decr(self):
         self.db.set("counter", "10")
         assert self.db.incr("counter") == 11
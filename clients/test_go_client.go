@@ -1,3 +1,6 @@
+//go:build ignore
+
+// Standalone smoke test, run with: go run clients/test_go_client.go
 package main
 
 import (
@@ -0,0 +1,77 @@
+use crate::storage::expiry::now_ms;
+use std::collections::VecDeque;
+use std::sync::Mutex;
+
+/// Entries the audit log keeps unless configured otherwise.
+pub const DEFAULT_AUDIT_LOG_SIZE: usize = 128;
+
+/// A command the server refused, as listed by AUDITLOG GET.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AuditEntry {
+    /// Counts up from 1 over the server's lifetime, across resets
+    pub id: u64,
+    /// When it was refused, in milliseconds since the epoch
+    pub at_ms: u64,
+    /// Address of the client, as in CLIENT LIST
+    pub addr: String,
+    /// Name of the refused command, if it got far enough to be read
+    pub command: Option<String>,
+    /// Why it was refused: the error the client got
+    pub reason: String,
+}
+
+/// The latest refused commands, in a ring buffer of fixed size so a flood
+/// of them cannot use up memory; the oldest are dropped first.
+#[derive(Debug)]
+pub struct AuditLog {
+    size: usize,
+    log: Mutex<Log>,
+}
+
+#[derive(Debug, Default)]
+struct Log {
+    entries: VecDeque<AuditEntry>,
+    next_id: u64,
+}
+
+impl AuditLog {
+    /// Keep the latest `size` entries. Zero keeps none.
+    pub fn new(size: usize) -> Self {
+        Self { size, log: Mutex::new(Log { entries: VecDeque::with_capacity(size), next_id: 1 }) }
+    }
+
+    /// Record that a command from `addr` was refused. Only the command name
+    /// is kept, since its arguments may hold secrets or be large.
+    pub fn record(&self, addr: &str, command: Option<&str>, reason: &str) {
+        if self.size == 0 {
+            return;
+        }
+        let mut log = self.log.lock().unwrap();
+        let id = log.next_id;
+        log.next_id += 1;
+        if log.entries.len() == self.size {
+            log.entries.pop_front();
+        }
+        log.entries.push_back(AuditEntry {
+            id,
+            at_ms: now_ms(),
+            addr: addr.to_string(),
+            command: command.map(str::to_uppercase),
+            reason: reason.to_string(),
+        });
+    }
+
+    /// The latest `count` entries, newest first.
+    pub fn latest(&self, count: usize) -> Vec<AuditEntry> {
+        self.log.lock().unwrap().entries.iter().rev().take(count).cloned().collect()
+    }
+
+    pub fn len(&self) -> usize {
+        self.log.lock().unwrap().entries.len()
+    }
+
+    /// Drop every entry. Ids keep counting up.
+    pub fn reset(&self) {
+        self.log.lock().unwrap().entries.clear();
+    }
+}
@@ -0,0 +1,96 @@
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+/// A connected client as shown by CLIENT LIST.
+#[derive(Debug)]
+pub struct ClientInfo {
+    id: u64,
+    addr: String,
+    connected_at: Instant,
+    /// Set with CLIENT SETNAME; empty when unnamed
+    name: Mutex<String>,
+}
+
+impl ClientInfo {
+    pub fn addr(&self) -> &str {
+        &self.addr
+    }
+
+    pub fn name(&self) -> String {
+        self.name.lock().unwrap().clone()
+    }
+
+    pub fn set_name(&self, name: String) {
+        *self.name.lock().unwrap() = name;
+    }
+
+    /// This client's CLIENT LIST line.
+    fn describe(&self) -> String {
+        format!(
+            "id={} addr={} name={} age={}",
+            self.id,
+            self.addr,
+            self.name(),
+            self.connected_at.elapsed().as_secs(),
+        )
+    }
+}
+
+/// The connections currently open, for CLIENT LIST.
+#[derive(Debug, Default)]
+pub struct ClientRegistry {
+    clients: Mutex<BTreeMap<u64, Arc<ClientInfo>>>,
+    next_id: AtomicU64,
+}
+
+impl ClientRegistry {
+    /// Record a connection from `addr`. It is listed until the returned
+    /// handle is dropped.
+    pub fn register(self: &Arc<Self>, addr: &str) -> ClientHandle {
+        let info = Arc::new(ClientInfo {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed) + 1,
+            addr: addr.to_string(),
+            connected_at: Instant::now(),
+            name: Mutex::new(String::new()),
+        });
+        self.clients.lock().unwrap().insert(info.id, info.clone());
+        ClientHandle { info, registry: self.clone() }
+    }
+
+    /// CLIENT LIST: one line per connection, oldest first.
+    pub fn list(&self) -> String {
+        self.clients.lock().unwrap()
+            .values()
+            .map(|info| info.describe())
+            .collect::<Vec<_>>()
+            .join("\n")
+    }
+}
+
+/// A registered connection, removed from the registry on drop.
+#[derive(Debug)]
+pub struct ClientHandle {
+    info: Arc<ClientInfo>,
+    registry: Arc<ClientRegistry>,
+}
+
+impl ClientHandle {
+    pub fn info(&self) -> Arc<ClientInfo> {
+        self.info.clone()
+    }
+}
+
+impl Drop for ClientHandle {
+    fn drop(&mut self) {
+        self.registry.clients.lock().unwrap().remove(&self.info.id);
+    }
+}
+
+/// Whether `name` can be used with CLIENT SETNAME: names show up in CLIENT
+/// LIST's space-separated fields, so they cannot contain spaces or control
+/// characters.
+pub fn valid_name(name: &str) -> bool {
+    name.chars().all(|c| c.is_ascii_graphic())
+}
@@ -1,9 +1,31 @@
-use crate::data_types::DataType;
+use crate::audit::{AuditLog, DEFAULT_AUDIT_LOG_SIZE};
+use crate::clients::{valid_name, ClientInfo, ClientRegistry};
+use crate::config::Config;
+use crate::data_types::{DataType, WRONGTYPE};
+use crate::dump;
+use crate::export;
+use crate::functions::{Functions, Update, UpdateFn};
+use crate::glob::glob_match;
+use crate::hyperloglog::HyperLogLog;
+use crate::jobs::JobQueue;
+use crate::log_tail;
+use crate::metrics::{resident_memory_bytes, MetricType, MetricsWriter};
 use crate::error::Result;
-use crate::protocol::{Request, Response};
-use crate::storage::Storage;
+use crate::protocol::{CommandClass, Request, Response, ScanOptions, SetCondition};
+use crate::pubsub::{keyspace_channel, parse_keyspace_channel, PubSub, Subscriber, KEYSPACE_CHANNELS};
+use crate::request_ids::{RequestIds, DEFAULT_MAX_REQUEST_IDS};
+use crate::stats::{CommandKind, ServerStats};
+use crate::storage::compression::ValueEncoding;
+use crate::storage::expiry::now_ms;
+use crate::storage::snapshot::{self, SnapshotMeta};
+use crate::storage::{random_below, Storage, StorageFactory};
 use async_trait::async_trait;
+use std::collections::{BTreeSet, HashMap};
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tokio::sync::broadcast::error::TryRecvError;
+use tokio::sync::{broadcast, Mutex, Notify, RwLock};
 
 pub mod get;
 pub mod set;
@@ -13,80 +35,655 @@ pub trait Command: Send + Sync {
     async fn execute(&self, storage: Arc<dyn Storage>) -> Result<Response>;
 }
 
+/// Per-connection state carried between requests.
+#[derive(Debug, Default)]
+pub struct Session {
+    /// Index of the selected database
+    pub db: usize,
+    /// Whether replies use length framing (negotiated with `HELLO 2`)
+    pub framed: bool,
+    /// Mailbox for published messages, set by connections that can deliver them
+    pub subscriber: Option<Subscriber>,
+    /// Channels the connection is subscribed to
+    pub subscriptions: BTreeSet<String>,
+    /// Whether replies carry the time the command took (DEBUG TIMING ON)
+    pub timing: bool,
+    /// The connection's entry in CLIENT LIST, for connections that have one
+    pub client: Option<Arc<ClientInfo>>,
+}
+
 pub struct CommandExecutor {
-    storage: Arc<dyn Storage>,
+    databases: RwLock<Vec<Option<Arc<dyn Storage>>>>,
+    database_factory: Option<StorageFactory>,
+    stats: Arc<ServerStats>,
+    pubsub: PubSub,
+    /// Keys expiring in each open database, for keyspace channels
+    expirations: Mutex<Vec<(Arc<dyn Storage>, broadcast::Receiver<String>)>>,
+    clients: Arc<ClientRegistry>,
+    functions: Functions,
+    /// Request ids of recent SETIDEM writes
+    request_ids: RequestIds,
+    /// Commands refused, for AUDITLOG
+    audit_log: AuditLog,
+    // Serializes commands that touch several keys or databases so they
+    // apply as one step
+    write_lock: Mutex<()>,
+    debug_enabled: bool,
+    shutdown_enabled: bool,
+    /// Signalled by SHUTDOWN, for the server to stop on
+    shutdown: Notify,
+    max_args: usize,
+    command_timeouts: HashMap<CommandClass, Duration>,
+    /// Directory the paths of SAVE, BGSAVE and SNAPSHOT INFO are taken
+    /// relative to
+    snapshot_dir: PathBuf,
 }
 
 impl CommandExecutor {
     pub fn new(storage: Arc<dyn Storage>) -> Self {
-        Self { storage }
+        Self::with_stats(storage, Arc::new(ServerStats::default()))
+    }
+
+    /// An executor for `storage` set up as `config` describes, with
+    /// statistics kept in `stats`. Extra databases still need
+    /// `with_databases`.
+    pub fn from_config(config: &Config, storage: Arc<dyn Storage>, stats: Arc<ServerStats>) -> Self {
+        Self::with_stats(storage, stats)
+            .with_debug(config.debug_enabled)
+            .with_shutdown(config.shutdown_enabled)
+            .with_max_args(config.max_args)
+            .with_command_timeouts(config.command_timeouts.clone())
+            .with_max_request_ids(config.max_request_ids)
+            .with_audit_log_size(config.audit_log_size)
+            .with_snapshot_dir(config.snapshot_dir.clone())
+    }
+
+    pub fn with_stats(storage: Arc<dyn Storage>, stats: Arc<ServerStats>) -> Self {
+        let expirations = storage.watch_expirations().map(|rx| (storage.clone(), rx));
+        Self {
+            databases: RwLock::new(vec![Some(storage)]),
+            database_factory: None,
+            stats,
+            pubsub: PubSub::default(),
+            expirations: Mutex::new(expirations.into_iter().collect()),
+            clients: Arc::default(),
+            functions: Functions::default(),
+            request_ids: RequestIds::new(DEFAULT_MAX_REQUEST_IDS),
+            audit_log: AuditLog::new(DEFAULT_AUDIT_LOG_SIZE),
+            write_lock: Mutex::new(()),
+            debug_enabled: false,
+            shutdown_enabled: false,
+            shutdown: Notify::new(),
+            max_args: 0,
+            command_timeouts: HashMap::new(),
+            snapshot_dir: PathBuf::from(snapshot::DEFAULT_SNAPSHOT_DIR),
+        }
+    }
+
+    /// Allow `count` databases, opening databases other than 0 on first use
+    /// with `factory`.
+    pub fn with_databases(mut self, count: usize, factory: StorageFactory) -> Self {
+        self.databases.get_mut().resize(count.max(1), None);
+        self.database_factory = Some(factory);
+        self
+    }
+
+    /// Make `function` callable with INVOKE as `name`, alongside the
+    /// built-in functions
+    pub fn with_function(mut self, name: &str, function: UpdateFn) -> Self {
+        self.functions.register(name, function);
+        self
+    }
+
+    /// Allow DEBUG subcommands
+    pub fn with_debug(mut self, enabled: bool) -> Self {
+        self.debug_enabled = enabled;
+        self
+    }
+
+    /// Save snapshots under `dir`
+    pub fn with_snapshot_dir(mut self, dir: PathBuf) -> Self {
+        self.snapshot_dir = dir;
+        self
+    }
+
+    /// Allow SHUTDOWN
+    pub fn with_shutdown(mut self, enabled: bool) -> Self {
+        self.shutdown_enabled = enabled;
+        self
+    }
+
+    /// Completes once a client has sent SHUTDOWN and, unless it asked not
+    /// to, every open database has been flushed to disk. Meant for one
+    /// waiter, the server.
+    pub async fn shutdown_requested(&self) {
+        self.shutdown.notified().await
+    }
+
+    /// Reject commands with more than `max_args` arguments; zero means no
+    /// limit
+    pub fn with_max_args(mut self, max_args: usize) -> Self {
+        self.max_args = max_args;
+        self
+    }
+
+    /// Remember at most `max_ids` SETIDEM request ids at once; zero means
+    /// no limit
+    pub fn with_max_request_ids(mut self, max_ids: usize) -> Self {
+        self.request_ids = RequestIds::new(max_ids);
+        self
+    }
+
+    /// Keep the latest `size` refused commands for AUDITLOG; zero keeps
+    /// none
+    pub fn with_audit_log_size(mut self, size: usize) -> Self {
+        self.audit_log = AuditLog::new(size);
+        self
+    }
+
+    pub fn max_args(&self) -> usize {
+        self.max_args
+    }
+
+    /// Give read-only commands of each class an execution budget; classes
+    /// missing from `timeouts` have none
+    pub fn with_command_timeouts(mut self, timeouts: HashMap<CommandClass, Duration>) -> Self {
+        self.command_timeouts = timeouts;
+        self
+    }
+
+    /// How long `request` may run before it is abandoned, if limited
+    pub fn command_timeout(&self, request: &Request) -> Option<Duration> {
+        request.command_class().and_then(|class| self.command_timeouts.get(&class).copied())
+    }
+
+    pub fn stats(&self) -> Arc<ServerStats> {
+        self.stats.clone()
+    }
+
+    pub fn pubsub(&self) -> &PubSub {
+        &self.pubsub
+    }
+
+    pub fn clients(&self) -> &Arc<ClientRegistry> {
+        &self.clients
+    }
+
+    pub fn audit_log(&self) -> &AuditLog {
+        &self.audit_log
+    }
+
+    /// Release everything a connection holds once it goes away.
+    pub fn close_session(&self, session: &mut Session) {
+        if let Some(subscriber) = &session.subscriber {
+            for channel in std::mem::take(&mut session.subscriptions) {
+                self.pubsub.unsubscribe(&channel, subscriber);
+            }
+        }
+    }
+
+    /// Push the values of expired keys with a dead-letter list onto their
+    /// lists in every open database, returning how many were pushed. The
+    /// server runs this every DEAD_LETTER_INTERVAL.
+    pub async fn deliver_dead_letters(&self) -> Result<usize> {
+        let databases: Vec<Arc<dyn Storage>> = self.databases.read().await.iter().flatten().cloned().collect();
+        let mut delivered = 0;
+        for storage in databases {
+            let _guard = self.write_lock.lock().await;
+            delivered += storage.deliver_dead_letters().await?;
+        }
+        Ok(delivered)
+    }
+
+    /// Remove expired keys from every open database without waiting for
+    /// them to be read, up to the reaper's setting per database, returning
+    /// how many were removed. The server runs this every
+    /// EXPIRATION_INTERVAL; EXPIRESTATS reports on the latest run.
+    pub async fn reap_expired(&self) -> Result<usize> {
+        let limit = self.stats.reaper().keys_per_cycle();
+        let databases: Vec<Arc<dyn Storage>> = match limit {
+            0 => Vec::new(),
+            _ => self.databases.read().await.iter().flatten().cloned().collect(),
+        };
+        let (mut examined, mut reaped) = (0, 0);
+        for storage in databases {
+            let _guard = self.write_lock.lock().await;
+            let (e, r) = storage.reap_expired(limit).await?;
+            examined += e;
+            reaped += r;
+        }
+        self.stats.reaper().record(now_ms(), examined as u64, reaped as u64);
+        Ok(reaped)
+    }
+
+    /// Where the snapshot a client names `path` lives, for SAVE, BGSAVE and
+    /// SNAPSHOT INFO, or `None` if the name would lead outside the snapshot
+    /// directory.
+    fn snapshot_path(&self, path: &str) -> Option<PathBuf> {
+        snapshot::resolve(&self.snapshot_dir, path)
+    }
+
+    /// Start a snapshot to `path` under the snapshot directory, returning
+    /// where to write it, or the error to reply with if the path leads
+    /// outside the directory, is taken, or another snapshot is running.
+    fn start_snapshot(&self, path: &str) -> std::result::Result<PathBuf, Response> {
+        let dir = self.snapshot_path(path).ok_or_else(|| Response::Error(SNAPSHOT_PATH_INVALID.to_string()))?;
+        if dir.exists() {
+            return Err(Response::Error(format!("ERR snapshot path '{}' already exists", path)));
+        }
+        if !self.stats.snapshot().try_start() {
+            return Err(Response::Error("ERR snapshot already in progress".to_string()));
+        }
+        Ok(dir)
+    }
+
+    /// Publish "expired" to the keyspace channel of every key that expired
+    /// since the last call, in every open database, returning how many
+    /// were published. Keys with a subscribed channel are expired first if
+    /// due, so they are reported even if nobody reads them. The server
+    /// runs this every EXPIRATION_INTERVAL.
+    pub async fn notify_expirations(&self) -> Result<usize> {
+        let now = now_ms();
+        for channel in self.pubsub.channels(Some(KEYSPACE_CHANNELS)) {
+            let Some((db, key)) = parse_keyspace_channel(&channel) else {
+                continue;
+            };
+            let storage = match self.databases.read().await.get(db) {
+                Some(Some(storage)) => storage.clone(),
+                _ => continue,
+            };
+            if storage.expiry(key).await?.is_some_and(|at| at <= now) {
+                // Noticing the key is due removes it
+                storage.exists(key).await?;
+            }
+        }
+
+        // Each expired key is reported under the index its database has
+        // now, SWAPDB included
+        let databases = self.databases.read().await.clone();
+        let mut published = 0;
+        for (storage, rx) in self.expirations.lock().await.iter_mut() {
+            let db = databases.iter().position(|open| open.as_ref().is_some_and(|open| Arc::ptr_eq(open, storage)));
+            loop {
+                match rx.try_recv() {
+                    Ok(key) => {
+                        if let Some(db) = db {
+                            self.pubsub.publish(&keyspace_channel(db, &key), "expired");
+                            published += 1;
+                        }
+                    }
+                    Err(TryRecvError::Lagged(missed)) => log::warn!("Missed {} expirations for keyspace channels", missed),
+                    Err(TryRecvError::Empty | TryRecvError::Closed) => break,
+                }
+            }
+        }
+        Ok(published)
+    }
+
+    /// Server metrics in the Prometheus text exposition format, served by
+    /// METRICS and the server's metrics endpoint.
+    pub async fn metrics(&self) -> Result<String> {
+        let mut metrics = MetricsWriter::new();
+        metrics.metric("diskdb_commands_total", MetricType::Counter, "Commands executed, by kind.");
+        for kind in CommandKind::ALL {
+            metrics.sample("diskdb_commands_total", &[("kind", kind.name())], self.stats.commands(kind));
+        }
+        metrics.single("diskdb_connected_clients", MetricType::Gauge, "Clients connected.", self.stats.connected_clients());
+        metrics.single("diskdb_max_clients", MetricType::Gauge, "Most clients allowed at once, 0 for no limit.", self.stats.max_clients());
+        let (pending, _, rejected) = self.stats.write_backlog();
+        metrics.single("diskdb_pending_write_bytes", MetricType::Gauge, "Bytes of writes accepted and not yet applied.", pending);
+        metrics.single("diskdb_rejected_writes_total", MetricType::Counter, "Writes refused because too many bytes were pending.", rejected);
+        if let Some(rss) = resident_memory_bytes() {
+            metrics.single("process_resident_memory_bytes", MetricType::Gauge, "Resident memory size in bytes.", rss);
+        }
+
+        // Per database figures, for the databases open
+        let databases: Vec<(String, Arc<dyn Storage>)> = self.databases.read().await.iter()
+            .enumerate()
+            .filter_map(|(index, storage)| storage.clone().map(|storage| (index.to_string(), storage)))
+            .collect();
+        let mut keys = Vec::new();
+        let mut disk = Vec::new();
+        let mut evicted = Vec::new();
+        for (index, database) in &databases {
+            if let Some(count) = database.estimated_key_count().await? {
+                keys.push((index, count));
+            }
+            if let Some(bytes) = database.disk_usage().await? {
+                disk.push((index, bytes));
+            }
+            if let Some(count) = database.evicted_keys().await? {
+                evicted.push((index, count));
+            }
+        }
+        for (name, kind, help, samples) in [
+            ("diskdb_keys", MetricType::Gauge, "Estimated number of keys, by database.", keys),
+            ("diskdb_disk_bytes", MetricType::Gauge, "Bytes the stored values take on disk, by database.", disk),
+            ("diskdb_evicted_keys_total", MetricType::Counter, "Expired keys removed early to make room under the key limit, by database.", evicted),
+        ] {
+            if samples.is_empty() {
+                continue;
+            }
+            metrics.metric(name, kind, help);
+            for (db, value) in samples {
+                metrics.sample(name, &[("db", db)], value);
+            }
+        }
+        Ok(metrics.finish())
+    }
+
+    async fn database_count(&self) -> usize {
+        self.databases.read().await.len()
+    }
+
+    /// Resolve a database index, opening the database if needed.
+    async fn database(&self, index: usize) -> Result<Arc<dyn Storage>> {
+        if let Some(Some(storage)) = self.databases.read().await.get(index) {
+            return Ok(storage.clone());
+        }
+
+        let mut databases = self.databases.write().await;
+        let slot = databases.get_mut(index)
+            .ok_or_else(|| crate::error::DiskDBError::Database("DB index is out of range".to_string()))?;
+        if let Some(storage) = slot {
+            return Ok(storage.clone());
+        }
+        let factory = self.database_factory.as_ref()
+            .ok_or_else(|| crate::error::DiskDBError::Database("DB index is out of range".to_string()))?;
+        let storage = factory(index)?;
+        *slot = Some(storage.clone());
+        if let Some(rx) = storage.watch_expirations() {
+            self.expirations.lock().await.push((storage.clone(), rx));
+        }
+        Ok(storage)
+    }
+
+    /// Validate a client-supplied database index.
+    async fn database_index(&self, index: i64) -> Option<usize> {
+        if index >= 0 && (index as usize) < self.database_count().await {
+            Some(index as usize)
+        } else {
+            None
+        }
     }
 
     pub async fn execute(&self, request: Request) -> Result<Response> {
+        self.execute_in(&mut Session::default(), request).await
+    }
+
+    /// Execute a request on behalf of a connection, reading and updating its
+    /// session state (selected database, reply framing).
+    pub async fn execute_in(&self, session: &mut Session, request: Request) -> Result<Response> {
+        self.stats.record_command(command_kind(&request));
+        let storage = self.database(session.db).await?;
         match request {
             // String operations
             Request::Get { key } => {
-                match self.storage.get(&key).await? {
+                let value = storage.get(&key).await?;
+                self.stats.record_get(&key, value.is_some());
+                match value {
                     Some(DataType::String(value)) => Ok(Response::String(Some(value))),
                     Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                     None => Ok(Response::Null),
                 }
             }
+            Request::GetEx { key, ttl_ms } => {
+                // Read and refreshed in one step under the lock, as INCRPX
+                // is, so concurrent reads of a session each extend it from
+                // the time they ran
+                let _guard = self.write_lock.lock().await;
+                let value = storage.get(&key).await?;
+                self.stats.record_get(&key, value.is_some());
+                match value {
+                    Some(DataType::String(value)) => {
+                        storage.set_expiry(&key, Some(now_ms().saturating_add(ttl_ms))).await?;
+                        Ok(Response::String(Some(value)))
+                    }
+                    Some(_) => Ok(Response::Error(WRONGTYPE.to_string())),
+                    None => Ok(Response::Null),
+                }
+            }
             Request::Set { key, value } => {
-                self.storage.set(&key, DataType::String(value)).await?;
+                // Under the lock like every other string write, so it never
+                // lands between the read and write of SET ... GET, DELIFEQ
+                // or GETORSET, and no expiry set meanwhile survives it
+                let _guard = self.write_lock.lock().await;
+                storage.set(&key, DataType::String(value)).await?;
+                // Overwriting a key with SET discards its expiry
+                if storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                Ok(Response::Ok)
+            }
+            Request::SetWith { key, value, options } => {
+                let _guard = self.write_lock.lock().await;
+                // With GET the old value is read under the lock as well, so
+                // it is the one this write replaced
+                let old = if options.get {
+                    match storage.get(&key).await? {
+                        Some(DataType::String(old)) => Some(old),
+                        None => None,
+                        Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                    }
+                } else {
+                    None
+                };
+                if let Some(condition) = options.condition {
+                    let exists = storage.exists(&key).await?;
+                    if exists != (condition == SetCondition::Xx) {
+                        return Ok(if options.get { Response::String(old) } else { Response::Null });
+                    }
+                }
+                // An INT hint only suits integers; anything else is stored
+                // as it would be without a hint
+                let encoding = options.encoding
+                    .filter(|encoding| *encoding != ValueEncoding::Int || value.parse::<i64>().is_ok());
+                match encoding {
+                    Some(encoding) => storage.set_encoded(&key, DataType::String(value), encoding).await?,
+                    None => storage.set(&key, DataType::String(value)).await?,
+                }
+                if let Some(ms) = options.expire_ms {
+                    storage.set_expiry(&key, Some(now_ms().saturating_add(ms))).await?;
+                    // A new expiry replaces the key's dead-letter list too
+                    let dlq = options.dead_letter.as_deref();
+                    if !storage.set_dead_letter(&key, dlq).await? && dlq.is_some() {
+                        return Ok(Response::Error(DEAD_LETTERS_UNSUPPORTED.to_string()));
+                    }
+                } else if !options.keep_ttl && storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                Ok(if options.get { Response::String(old) } else { Response::Ok })
+            }
+            Request::SetIdem { key, value, request_id, window_ms } => {
+                // Checked and recorded under the lock, so a retry racing the
+                // original cannot be applied as well. A repeat is answered
+                // like the write it repeats.
+                let _guard = self.write_lock.lock().await;
+                if self.request_ids.contains(&request_id) {
+                    return Ok(Response::Ok);
+                }
+                storage.set(&key, DataType::String(value)).await?;
+                if storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                self.request_ids.record(&request_id, Duration::from_millis(window_ms));
                 Ok(Response::Ok)
             }
+            // Counters are updated under the lock so concurrent increments
+            // are never lost and GETRESET cannot miss one
             Request::Incr { key } => {
-                self.execute_incr(&key, 1).await
+                let _guard = self.write_lock.lock().await;
+                self.execute_incr(&storage, &key, 1).await
             }
             Request::Decr { key } => {
-                self.execute_incr(&key, -1).await
+                let _guard = self.write_lock.lock().await;
+                self.execute_incr(&storage, &key, -1).await
             }
             Request::IncrBy { key, delta } => {
-                self.execute_incr(&key, delta).await
+                let _guard = self.write_lock.lock().await;
+                self.execute_incr(&storage, &key, delta).await
             }
             Request::DecrBy { key, delta } => {
-                self.execute_incr(&key, -delta).await
+                let _guard = self.write_lock.lock().await;
+                self.execute_incr(&storage, &key, -delta).await
+            }
+            Request::IncrPx { key, ttl_ms } => {
+                // Checking, incrementing and setting the expiry under the
+                // lock means concurrent first hits cannot leave the counter
+                // without an expiry
+                let _guard = self.write_lock.lock().await;
+                let created = !storage.exists(&key).await?;
+                let response = self.execute_incr(&storage, &key, 1).await?;
+                if created {
+                    storage.set_expiry(&key, Some(now_ms().saturating_add(ttl_ms))).await?;
+                }
+                Ok(response)
+            }
+            Request::IncrMulti { deltas } => {
+                // Every counter is read and incremented before any is
+                // written, so one that is not an integer leaves them all
+                // as they were. A key given twice is incremented twice.
+                let _guard = self.write_lock.lock().await;
+                let mut counters: Vec<(String, DataType)> = Vec::new();
+                let mut values = Vec::with_capacity(deltas.len());
+                for (key, delta) in deltas {
+                    let i = match counters.iter().position(|(held, _)| *held == key) {
+                        Some(i) => i,
+                        None => {
+                            let data = storage.get(&key).await?.unwrap_or_else(|| DataType::String("0".to_string()));
+                            counters.push((key, data));
+                            counters.len() - 1
+                        }
+                    };
+                    let value = counters[i].1.incr(delta).map_err(crate::error::DiskDBError::Database)?;
+                    values.push(Response::Integer(value));
+                }
+                storage.set_multiple(counters).await?;
+                Ok(Response::Array(values))
+            }
+            Request::DecrReap { key } => {
+                // Replies with the new value and whether this deleted the
+                // key. Under the lock, only one of the clients racing to zero
+                // is told it deleted it, and no one sees the key left at
+                // zero. A missing key counts as 0 and stays missing, so a
+                // late decrement gets -1 and is not told it deleted it.
+                let _guard = self.write_lock.lock().await;
+                let (value, data) = match storage.get(&key).await? {
+                    Some(mut data) => (data.incr(-1).map_err(crate::error::DiskDBError::Database)?, Some(data)),
+                    None => (-1, None),
+                };
+                let deleted = match data {
+                    Some(data) if value > 0 => {
+                        storage.set(&key, data).await?;
+                        false
+                    }
+                    Some(_) => storage.delete(&key).await?,
+                    None => false,
+                };
+                Ok(Response::Array(vec![Response::Integer(value), Response::Integer(deleted as i64)]))
+            }
+            Request::GetReset { key } => {
+                let _guard = self.write_lock.lock().await;
+                let value = match storage.get(&key).await? {
+                    // Incrementing by zero validates the value like INCR
+                    Some(mut data) => data.incr(0).map_err(crate::error::DiskDBError::Database)?,
+                    None => 0,
+                };
+                // The key keeps its expiry, if it has one
+                storage.set(&key, DataType::String("0".to_string())).await?;
+                Ok(Response::Integer(value))
+            }
+            Request::Rotate { key } => {
+                // Appends are made under the lock too, so none lands between
+                // reading the value and emptying it
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
+                    Some(DataType::String(old)) => {
+                        // The key keeps its expiry, if it has one
+                        storage.set(&key, DataType::String(String::new())).await?;
+                        Ok(Response::String(Some(old)))
+                    }
+                    None => Ok(Response::Null),
+                    Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                }
             }
             Request::Append { key, value } => {
-                let result = match self.storage.get(&key).await? {
+                let _guard = self.write_lock.lock().await;
+                let result = match storage.get(&key).await? {
                     Some(DataType::String(mut s)) => {
                         s.push_str(&value);
                         let len = s.len();
-                        self.storage.set(&key, DataType::String(s)).await?;
+                        storage.set(&key, DataType::String(s)).await?;
                         len
                     }
                     None => {
                         let len = value.len();
-                        self.storage.set(&key, DataType::String(value)).await?;
+                        storage.set(&key, DataType::String(value)).await?;
                         len
                     }
                     Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                 };
                 Ok(Response::Integer(result as i64))
             }
+            Request::AppendCapped { key, max_bytes, value } => {
+                let _guard = self.write_lock.lock().await;
+                let mut s = match storage.get(&key).await? {
+                    Some(DataType::String(s)) => s,
+                    None => String::new(),
+                    Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                };
+                s.push_str(&value);
+                let s = trim_front(s, max_bytes);
+                let len = s.len();
+                storage.set(&key, DataType::String(s)).await?;
+                Ok(Response::Integer(len as i64))
+            }
             
             // List operations
             Request::LPush { key, values } => {
-                let mut data = self.storage.get_or_create_list(&key).await?;
+                // Every list mutation reads and rewrites the whole list, so
+                // they all serialize on the lock or their updates get lost
+                let _guard = self.write_lock.lock().await;
+                let mut data = storage.get_or_create_list(&key).await?;
                 let count = data.lpush(values).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Integer(count as i64))
             }
             Request::RPush { key, values } => {
-                let mut data = self.storage.get_or_create_list(&key).await?;
+                let _guard = self.write_lock.lock().await;
+                let mut data = storage.get_or_create_list(&key).await?;
                 let count = data.rpush(values).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Integer(count as i64))
             }
+            Request::LPushCapped { key, max_len, values } => {
+                // Pushing and trimming under the lock means the stored list
+                // never exceeds the cap, not even between two commands
+                let _guard = self.write_lock.lock().await;
+                let mut data = storage.get_or_create_list(&key).await?;
+                data.lpush(values).map_err(crate::error::DiskDBError::Database)?;
+                // LPUSH adds at the head, so the newest items are the first ones
+                let len = data.ltrim(0, max_len - 1).map_err(crate::error::DiskDBError::Database)?;
+                storage.set(&key, data).await?;
+                Ok(Response::Integer(len as i64))
+            }
+            Request::RPushCapped { key, max_len, values } => {
+                let _guard = self.write_lock.lock().await;
+                let mut data = storage.get_or_create_list(&key).await?;
+                data.rpush(values).map_err(crate::error::DiskDBError::Database)?;
+                let len = data.ltrim(-max_len, -1).map_err(crate::error::DiskDBError::Database)?;
+                storage.set(&key, data).await?;
+                Ok(Response::Integer(len as i64))
+            }
             Request::LPop { key } => {
-                match self.storage.get(&key).await? {
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
                     Some(mut data) => match data.lpop() {
                         Ok(Some(value)) => {
                             if data.as_list().map(|l| l.is_empty()).unwrap_or(false) {
-                                self.storage.delete(&key).await?;
+                                storage.delete(&key).await?;
                             } else {
-                                self.storage.set(&key, data).await?;
+                                storage.set(&key, data).await?;
                             }
                             Ok(Response::String(Some(value)))
                         }
@@ -97,13 +694,14 @@ impl CommandExecutor {
                 }
             }
             Request::RPop { key } => {
-                match self.storage.get(&key).await? {
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
                     Some(mut data) => match data.rpop() {
                         Ok(Some(value)) => {
                             if data.as_list().map(|l| l.is_empty()).unwrap_or(false) {
-                                self.storage.delete(&key).await?;
+                                storage.delete(&key).await?;
                             } else {
-                                self.storage.set(&key, data).await?;
+                                storage.set(&key, data).await?;
                             }
                             Ok(Response::String(Some(value)))
                         }
@@ -113,8 +711,10 @@ impl CommandExecutor {
                     None => Ok(Response::Null),
                 }
             }
+            Request::LPopCount { key, count } => self.pop_count(&storage, &key, count, true).await,
+            Request::RPopCount { key, count } => self.pop_count(&storage, &key, count, false).await,
             Request::LRange { key, start, stop } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.lrange(start, stop) {
                         Ok(values) => Ok(Response::Array(values.into_iter().map(|v| Response::String(Some(v))).collect())),
                         Err(e) => Ok(Response::Error(e)),
@@ -123,28 +723,72 @@ impl CommandExecutor {
                 }
             }
             Request::LLen { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::List(list)) => Ok(Response::Integer(list.len() as i64)),
                     Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                     None => Ok(Response::Integer(0)),
                 }
             }
+            Request::LTrim { key, start, stop } => {
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
+                    Some(mut data) => match data.ltrim(start, stop) {
+                        Ok(0) => {
+                            storage.delete(&key).await?;
+                            Ok(Response::Ok)
+                        }
+                        Ok(_) => {
+                            storage.set(&key, data).await?;
+                            Ok(Response::Ok)
+                        }
+                        Err(e) => Ok(Response::Error(e)),
+                    },
+                    None => Ok(Response::Ok),
+                }
+            }
+            Request::ClaimJob { queue, visibility_ms } => {
+                // Replies with the job's id and the job, or nil if none is
+                // waiting. Claims that lapsed are undone first, under the
+                // lock, so a job is never held by two claims at once.
+                let _guard = self.write_lock.lock().await;
+                let now = now_ms();
+                let mut queue = match JobQueue::load(&storage, &queue, now).await? {
+                    Some(queue) => queue,
+                    None => return Ok(Response::Error(WRONGTYPE.to_string())),
+                };
+                let claimed = queue.claim(now, visibility_ms);
+                queue.save(&storage).await?;
+                Ok(match claimed {
+                    Some((id, job)) => Response::Array(vec![Response::String(Some(id)), Response::String(Some(job))]),
+                    None => Response::Null,
+                })
+            }
+            Request::AckJob { queue, id } => {
+                let _guard = self.write_lock.lock().await;
+                let mut queue = match JobQueue::load(&storage, &queue, now_ms()).await? {
+                    Some(queue) => queue,
+                    None => return Ok(Response::Error(WRONGTYPE.to_string())),
+                };
+                let acked = queue.ack(&id);
+                queue.save(&storage).await?;
+                Ok(Response::Integer(acked as i64))
+            }
             
             // Set operations
             Request::SAdd { key, members } => {
-                let mut data = self.storage.get_or_create_set(&key).await?;
+                let mut data = storage.get_or_create_set(&key).await?;
                 let added = data.sadd(members).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Integer(added as i64))
             }
             Request::SRem { key, members } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(mut data) => {
                         let removed = data.srem(members).map_err(crate::error::DiskDBError::Database)?;
                         if data.as_set().map(|s| s.is_empty()).unwrap_or(false) {
-                            self.storage.delete(&key).await?;
+                            storage.delete(&key).await?;
                         } else {
-                            self.storage.set(&key, data).await?;
+                            storage.set(&key, data).await?;
                         }
                         Ok(Response::Integer(removed as i64))
                     }
@@ -152,7 +796,7 @@ impl CommandExecutor {
                 }
             }
             Request::SMembers { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::Set(set)) => {
                         let members: Vec<Response> = set.into_iter().map(|v| Response::String(Some(v))).collect();
                         Ok(Response::Array(members))
@@ -162,7 +806,7 @@ impl CommandExecutor {
                 }
             }
             Request::SIsMember { key, member } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.sismember(&member) {
                         Ok(is_member) => Ok(Response::Integer(if is_member { 1 } else { 0 })),
                         Err(e) => Ok(Response::Error(e)),
@@ -170,8 +814,28 @@ impl CommandExecutor {
                     None => Ok(Response::Integer(0)),
                 }
             }
+            Request::SMIsMember { key, members } => {
+                let flags: Vec<bool> = match storage.get(&key).await? {
+                    Some(DataType::Set(set)) => members.iter().map(|m| set.contains(m)).collect(),
+                    Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                    None => vec![false; members.len()],
+                };
+                Ok(Response::Array(flags.into_iter().map(|f| Response::Integer(if f { 1 } else { 0 })).collect()))
+            }
+            Request::SRandMember { key, count } => {
+                // Each repeat is a reply element, so bound them before allocating
+                if count < -SRANDMEMBER_MAX_REPEATS {
+                    return Ok(Response::Error(format!("ERR value is out of range, a negative count must be at least -{}", SRANDMEMBER_MAX_REPEATS)));
+                }
+                let members: Vec<String> = match storage.get(&key).await? {
+                    Some(DataType::Set(set)) => set.into_iter().collect(),
+                    Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                    None => Vec::new(),
+                };
+                Ok(Response::Array(sample_members(members, count).into_iter().map(|m| Response::String(Some(m))).collect()))
+            }
             Request::SCard { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::Set(set)) => Ok(Response::Integer(set.len() as i64)),
                     Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                     None => Ok(Response::Integer(0)),
@@ -180,13 +844,13 @@ impl CommandExecutor {
             
             // Hash operations
             Request::HSet { key, field, value } => {
-                let mut data = self.storage.get_or_create_hash(&key).await?;
+                let mut data = storage.get_or_create_hash(&key).await?;
                 let is_new = data.hset(field, value).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Integer(if is_new { 1 } else { 0 }))
             }
             Request::HGet { key, field } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.hget(&field) {
                         Ok(Some(value)) => Ok(Response::String(Some(value))),
                         Ok(None) => Ok(Response::Null),
@@ -196,13 +860,13 @@ impl CommandExecutor {
                 }
             }
             Request::HDel { key, fields } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(mut data) => {
                         let deleted = data.hdel(fields).map_err(crate::error::DiskDBError::Database)?;
                         if data.as_hash().map(|h| h.is_empty()).unwrap_or(false) {
-                            self.storage.delete(&key).await?;
+                            storage.delete(&key).await?;
                         } else {
-                            self.storage.set(&key, data).await?;
+                            storage.set(&key, data).await?;
                         }
                         Ok(Response::Integer(deleted as i64))
                     }
@@ -210,7 +874,7 @@ impl CommandExecutor {
                 }
             }
             Request::HGetAll { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::Hash(hash)) => {
                         let mut result = Vec::new();
                         for (field, value) in hash {
@@ -224,7 +888,7 @@ impl CommandExecutor {
                 }
             }
             Request::HExists { key, field } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::Hash(hash)) => {
                         Ok(Response::Integer(if hash.contains_key(&field) { 1 } else { 0 }))
                     }
@@ -235,19 +899,19 @@ impl CommandExecutor {
             
             // Sorted Set operations
             Request::ZAdd { key, members } => {
-                let mut data = self.storage.get_or_create_sorted_set(&key).await?;
+                let mut data = storage.get_or_create_sorted_set(&key).await?;
                 let added = data.zadd(members).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Integer(added as i64))
             }
             Request::ZRem { key, members } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(mut data) => {
                         let removed = data.zrem(members).map_err(crate::error::DiskDBError::Database)?;
                         if data.as_sorted_set().map(|z| z.is_empty()).unwrap_or(false) {
-                            self.storage.delete(&key).await?;
+                            storage.delete(&key).await?;
                         } else {
-                            self.storage.set(&key, data).await?;
+                            storage.set(&key, data).await?;
                         }
                         Ok(Response::Integer(removed as i64))
                     }
@@ -255,7 +919,7 @@ impl CommandExecutor {
                 }
             }
             Request::ZRange { key, start, stop, with_scores } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.zrange(start, stop, with_scores) {
                         Ok(members) => {
                             let result: Vec<Response> = members.into_iter()
@@ -274,8 +938,14 @@ impl CommandExecutor {
                     None => Ok(Response::Array(vec![])),
                 }
             }
+            Request::ZRemRangeByRank { key, start, stop } => {
+                self.zremrange(&storage, &key, |data| data.zremrange_by_rank(start, stop)).await
+            }
+            Request::ZRemRangeByScore { key, min, max } => {
+                self.zremrange(&storage, &key, |data| data.zremrange_by_score(min, max)).await
+            }
             Request::ZScore { key, member } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.zscore(&member) {
                         Ok(Some(score)) => Ok(Response::String(Some(score.to_string()))),
                         Ok(None) => Ok(Response::Null),
@@ -285,7 +955,7 @@ impl CommandExecutor {
                 }
             }
             Request::ZCard { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(DataType::SortedSet(zset)) => Ok(Response::Integer(zset.len() as i64)),
                     Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                     None => Ok(Response::Integer(0)),
@@ -297,18 +967,18 @@ impl CommandExecutor {
                 let json_value: serde_json::Value = serde_json::from_str(&value)
                     .map_err(|e| crate::error::DiskDBError::Protocol(format!("Invalid JSON: {}", e)))?;
                 
-                let mut data = match self.storage.get(&key).await? {
+                let mut data = match storage.get(&key).await? {
                     Some(DataType::Json(j)) => DataType::Json(j),
                     Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
                     None => DataType::Json(serde_json::Value::Null),
                 };
                 
                 data.json_set(&path, json_value).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(&key, data).await?;
+                storage.set(&key, data).await?;
                 Ok(Response::Ok)
             }
             Request::JsonGet { key, path } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.json_get(&path) {
                         Ok(Some(value)) => Ok(Response::String(Some(value.to_string()))),
                         Ok(None) => Ok(Response::Null),
@@ -319,7 +989,7 @@ impl CommandExecutor {
             }
             Request::JsonDel { key, path } => {
                 if path == "$" || path == "." {
-                    match self.storage.delete(&key).await? {
+                    match storage.delete(&key).await? {
                         true => Ok(Response::Integer(1)),
                         false => Ok(Response::Integer(0)),
                     }
@@ -330,19 +1000,19 @@ impl CommandExecutor {
             
             // Stream operations
             Request::XAdd { key, id, fields } => {
-                let mut data = self.storage.get_or_create_stream(&key).await?;
+                let mut data = storage.get_or_create_stream(&key).await?;
                 let id_option = if id == "*" { None } else { Some(id) };
                 let fields_map: std::collections::HashMap<String, String> = fields.into_iter().collect();
                 match data.xadd(id_option, fields_map) {
                     Ok(entry_id) => {
-                        self.storage.set(&key, data).await?;
+                        storage.set(&key, data).await?;
                         Ok(Response::String(Some(entry_id)))
                     }
                     Err(e) => Ok(Response::Error(e)),
                 }
             }
             Request::XRange { key, start, end, count } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.xrange(&start, &end, count) {
                         Ok(entries) => {
                             let mut result = Vec::new();
@@ -361,7 +1031,7 @@ impl CommandExecutor {
                 }
             }
             Request::XLen { key } => {
-                match self.storage.get(&key).await? {
+                match storage.get(&key).await? {
                     Some(data) => match data.xlen() {
                         Ok(len) => Ok(Response::Integer(len as i64)),
                         Err(e) => Ok(Response::Error(e)),
@@ -370,48 +1040,1239 @@ impl CommandExecutor {
                 }
             }
             
+            // Bitmap operations
+            Request::SetBit { key, offset, value } => {
+                let _guard = self.write_lock.lock().await;
+                let mut data = storage.get_or_create_bitmap(&key).await?;
+                let old = data.setbit(offset, value).map_err(crate::error::DiskDBError::Database)?;
+                storage.set(&key, data).await?;
+                Ok(Response::Integer(old as i64))
+            }
+            Request::GetBit { key, offset } => {
+                match storage.get(&key).await? {
+                    Some(data) => match data.getbit(offset) {
+                        Ok(bit) => Ok(Response::Integer(bit as i64)),
+                        Err(e) => Ok(Response::Error(e)),
+                    },
+                    None => Ok(Response::Integer(0)),
+                }
+            }
+            Request::BitCount { key, range } => {
+                match storage.get(&key).await? {
+                    Some(data) => match data.bitcount(range) {
+                        Ok(count) => Ok(Response::Integer(count as i64)),
+                        Err(e) => Ok(Response::Error(e)),
+                    },
+                    None => Ok(Response::Integer(0)),
+                }
+            }
+            
+            // HyperLogLog operations
+            Request::PfAdd { key, elements } => {
+                let _guard = self.write_lock.lock().await;
+                let existing = storage.get_hyperloglog(&key).await?;
+                let created = existing.is_none();
+                let mut hll = existing.unwrap_or_default();
+                let mut changed = false;
+                for element in &elements {
+                    changed |= hll.add(element.as_bytes());
+                }
+                // Adding elements already counted writes nothing
+                if created || changed {
+                    storage.set(&key, DataType::HyperLogLog(hll)).await?;
+                }
+                Ok(Response::Integer((created || changed) as i64))
+            }
+            Request::PfCount { keys } => {
+                let mut union = HyperLogLog::new();
+                for key in &keys {
+                    if let Some(hll) = storage.get_hyperloglog(key).await? {
+                        union.merge(&hll);
+                    }
+                }
+                Ok(Response::Integer(union.count() as i64))
+            }
+            Request::PfMerge { dest, sources } => {
+                // The destination's own elements are part of the union
+                let _guard = self.write_lock.lock().await;
+                let mut union = storage.get_hyperloglog(&dest).await?.unwrap_or_default();
+                for source in &sources {
+                    if let Some(hll) = storage.get_hyperloglog(source).await? {
+                        union.merge(&hll);
+                    }
+                }
+                storage.set(&dest, DataType::HyperLogLog(union)).await?;
+                Ok(Response::Ok)
+            }
+            
             // Utility operations
             Request::Type { key } => {
-                match self.storage.get_type(&key).await? {
+                match storage.get_type(&key).await? {
                     Some(type_name) => Ok(Response::String(Some(type_name))),
                     None => Ok(Response::String(Some("none".to_string()))),
                 }
             }
             Request::Del { keys } => {
-                let deleted = self.storage.delete_multiple(&keys).await?;
+                let deleted = storage.delete_multiple(&keys).await?;
                 Ok(Response::Integer(deleted as i64))
             }
             Request::Exists { keys } => {
-                let count = self.storage.exists_multiple(&keys).await?;
+                let count = storage.exists_multiple(&keys).await?;
                 Ok(Response::Integer(count as i64))
             }
+            Request::RandomKey => {
+                match storage.random_key().await? {
+                    Some(key) => Ok(Response::String(Some(key))),
+                    None => Ok(Response::Null),
+                }
+            }
+            Request::Scan { cursor, options } => {
+                let (next, keys) = match self.scan_page(&storage, &cursor, &options).await? {
+                    Some(page) => page,
+                    None => return Ok(Response::Error("ERR invalid cursor".to_string())),
+                };
+                let mut matched = Vec::with_capacity(keys.len());
+                for key in keys {
+                    // Storage calls never yield, so a long walk yields here
+                    // now and then to let a command that ran past its budget
+                    // be cancelled
+                    tokio::task::consume_budget().await;
+                    if let Some(type_name) = &options.type_name {
+                        if storage.get_type(&key).await?.as_deref() != Some(type_name.as_str()) {
+                            continue;
+                        }
+                    }
+                    matched.push(Response::String(Some(key)));
+                }
+                Ok(Response::Array(vec![Response::String(Some(next)), Response::Array(matched)]))
+            }
+            Request::Export { cursor, options } => {
+                let (next, keys) = match self.scan_page(&storage, &cursor, &options).await? {
+                    Some(page) => page,
+                    None => return Ok(Response::Error("ERR invalid cursor".to_string())),
+                };
+                let mut records = Vec::with_capacity(keys.len());
+                for key in keys {
+                    tokio::task::consume_budget().await;
+                    // Keys deleted since the scan are skipped
+                    let value = match storage.get(&key).await? {
+                        Some(value) => value,
+                        None => continue,
+                    };
+                    if options.type_name.as_deref().is_some_and(|t| t != value.type_name()) {
+                        continue;
+                    }
+                    let ttl = Some(self.ttl(&storage, &key).await?).filter(|&ttl| ttl >= 0);
+                    records.push(Response::String(Some(export::record(&key, &value, ttl))));
+                }
+                Ok(Response::Array(vec![Response::String(Some(next)), Response::Array(records)]))
+            }
+            Request::GetMatching { cursor, options } => {
+                let (next, keys) = match self.scan_page(&storage, &cursor, &options).await? {
+                    Some(page) => page,
+                    None => return Ok(Response::Error("ERR invalid cursor".to_string())),
+                };
+                // Keys deleted since the scan or holding anything but a
+                // string are skipped, as MGET would return them as nil
+                let mut pairs = Vec::new();
+                for key in keys {
+                    tokio::task::consume_budget().await;
+                    if let Some(DataType::String(value)) = storage.get(&key).await? {
+                        pairs.push(Response::String(Some(key)));
+                        pairs.push(Response::String(Some(value)));
+                    }
+                }
+                Ok(Response::Array(vec![Response::String(Some(next)), Response::Array(pairs)]))
+            }
+            Request::Changes { offset, count, block } => {
+                let mut watch = match storage.watch_changes() {
+                    Some(watch) => watch,
+                    None => return Ok(Response::Error(CHANGE_LOG_DISABLED.to_string())),
+                };
+                // BLOCK 0 waits for as long as it takes
+                let deadline = block.filter(|block| !block.is_zero()).map(|block| tokio::time::Instant::now() + block);
+                loop {
+                    // Marking the current offset seen before reading means
+                    // a change recorded meanwhile still wakes the wait below
+                    watch.borrow_and_update();
+                    let page = match storage.changes(offset, count).await? {
+                        Some(page) => page,
+                        None => return Ok(Response::Error(CHANGE_LOG_DISABLED.to_string())),
+                    };
+                    if offset < page.first {
+                        return Ok(Response::Error(format!("ERR offset is no longer retained, the oldest is {}", page.first)));
+                    }
+                    if offset > page.next {
+                        return Ok(Response::Error(format!("ERR offset is past the end of the change log at {}", page.next)));
+                    }
+                    if page.changes.is_empty() && block.is_some() {
+                        let woken = match deadline {
+                            Some(deadline) => matches!(tokio::time::timeout_at(deadline, watch.changed()).await, Ok(Ok(()))),
+                            None => watch.changed().await.is_ok(),
+                        };
+                        if woken {
+                            continue;
+                        }
+                    }
+                    let next = page.changes.last().map_or(offset, |change| change.offset + 1);
+                    let records = page.changes.iter()
+                        .map(|change| Response::String(Some(export::change(change))))
+                        .collect();
+                    return Ok(Response::Array(vec![Response::String(Some(next.to_string())), Response::Array(records)]));
+                }
+            }
+            Request::ScanByAge { cursor, min_age_ms, options } => {
+                let (next, keys) = match self.scan_page(&storage, &cursor, &options).await? {
+                    Some(page) => page,
+                    None => return Ok(Response::Error("ERR invalid cursor".to_string())),
+                };
+                let cutoff = now_ms().saturating_sub(min_age_ms);
+                let mut matched = Vec::new();
+                for key in keys {
+                    tokio::task::consume_budget().await;
+                    // Keys written before modification times were recorded
+                    // have none; their age is unknown, so they are left out
+                    // rather than offered up for pruning
+                    match storage.modified_at(&key).await? {
+                        Some(at) if at <= cutoff => {}
+                        _ => continue,
+                    }
+                    if let Some(type_name) = &options.type_name {
+                        if storage.get_type(&key).await?.as_deref() != Some(type_name.as_str()) {
+                            continue;
+                        }
+                    }
+                    matched.push(Response::String(Some(key)));
+                }
+                Ok(Response::Array(vec![Response::String(Some(next)), Response::Array(matched)]))
+            }
+            Request::BigKeys { cursor, options } => {
+                let (next, keys) = match self.scan_page(&storage, &cursor, &options).await? {
+                    Some(page) => page,
+                    None => return Ok(Response::Error("ERR invalid cursor".to_string())),
+                };
+                // Each examined key is reported with its type and size;
+                // ranking is left to the caller, which sees every page
+                let mut reports = Vec::new();
+                for key in keys {
+                    tokio::task::consume_budget().await;
+                    let value = match storage.get(&key).await? {
+                        Some(value) => value,
+                        None => continue,
+                    };
+                    if options.type_name.as_deref().is_some_and(|t| t != value.type_name()) {
+                        continue;
+                    }
+                    reports.push(Response::String(Some(key)));
+                    reports.push(Response::String(Some(value.type_name().to_string())));
+                    reports.push(Response::String(Some(value.size().to_string())));
+                }
+                Ok(Response::Array(vec![Response::String(Some(next)), Response::Array(reports)]))
+            }
+            Request::Dump { key } => {
+                match storage.get(&key).await? {
+                    Some(value) => Ok(Response::String(Some(dump::dump(&value)?))),
+                    None => Ok(Response::Null),
+                }
+            }
+            // Only affects this connection, so unlike the other DEBUG
+            // subcommands it needs no DISKDB_ENABLE_DEBUG
+            Request::DebugTiming { enabled } => {
+                session.timing = enabled;
+                Ok(Response::Ok)
+            }
+            Request::ClientSetName { name } => {
+                let client = match &session.client {
+                    Some(client) => client,
+                    None => return Ok(Response::Error("ERR CLIENT SETNAME is not supported on this connection".to_string())),
+                };
+                if !valid_name(&name) {
+                    return Ok(Response::Error("ERR Client names cannot contain spaces, newlines or special characters".to_string()));
+                }
+                client.set_name(name);
+                Ok(Response::Ok)
+            }
+            Request::ClientGetName => {
+                match session.client.as_ref().map(|client| client.name()) {
+                    Some(name) if !name.is_empty() => Ok(Response::String(Some(name))),
+                    _ => Ok(Response::Null),
+                }
+            }
+            Request::ClientList => Ok(Response::String(Some(self.clients.list()))),
+            Request::DebugObject { key } => {
+                if !self.debug_enabled {
+                    return Ok(self.refuse_debug(session));
+                }
+                let value = match storage.get(&key).await? {
+                    Some(value) => value,
+                    None => return Ok(Response::Null),
+                };
+                // There is no eviction yet, so no LRU or LFU metadata is kept
+                // to report
+                Ok(Response::String(Some(format!(
+                    "encoding:{} serializedlength:{} memory:{} ttl:{}",
+                    self.encoding(&storage, &key, &value).await?,
+                    dump::dump(&value)?.len() / 2,
+                    key.len() + value.memory_usage(),
+                    self.ttl(&storage, &key).await?,
+                ))))
+            }
+            Request::DebugLogTail { count } => {
+                if !self.debug_enabled {
+                    return Ok(self.refuse_debug(session));
+                }
+                Ok(Response::Array(log_tail::latest(count).into_iter()
+                    .map(|line| Response::String(Some(line)))
+                    .collect()))
+            }
+            Request::KeyStats { prefix } => {
+                match self.stats.key_stats(&prefix) {
+                    Some((hits, misses)) => Ok(Response::Array(vec![
+                        Response::Integer(hits as i64),
+                        Response::Integer(misses as i64),
+                    ])),
+                    None => Ok(Response::Error("ERR prefix is not tracked, add it to DISKDB_KEYSTATS_PREFIXES".to_string())),
+                }
+            }
+            Request::Warmup { patterns } => {
+                if !self.stats.warmup().try_start() {
+                    return Ok(Response::Error("ERR warmup already in progress".to_string()));
+                }
+                let stats = self.stats.clone();
+                tokio::spawn(async move {
+                    if let Err(e) = warm_up(&storage, &patterns, &stats).await {
+                        log::warn!("Warmup stopped: {}", e);
+                    }
+                    stats.warmup().finish();
+                });
+                Ok(Response::Ok)
+            }
+            Request::Compact => {
+                if !self.stats.compaction().try_start() {
+                    return Ok(Response::Error("ERR compaction already in progress".to_string()));
+                }
+                let stats = self.stats.clone();
+                tokio::spawn(async move {
+                    if let Err(e) = compact(&storage, &stats).await {
+                        log::warn!("Compaction stopped: {}", e);
+                    }
+                    stats.compaction().finish();
+                });
+                Ok(Response::Ok)
+            }
+            Request::CompactStatus => {
+                let (running, percent, reclaimed_bytes) = self.stats.compaction().snapshot();
+                Ok(Response::Array(vec![
+                    Response::Integer(running as i64),
+                    Response::Integer(percent as i64),
+                    Response::Integer(reclaimed_bytes as i64),
+                ]))
+            }
+            Request::CompactCancel => {
+                self.stats.compaction().cancel();
+                Ok(Response::Ok)
+            }
+            Request::CompactKey { key } => {
+                if !storage.exists(&key).await? {
+                    return Ok(Response::Error("NOTFOUND no such key".to_string()));
+                }
+                // Every write stores the value whole, so a value never holds
+                // slack of its own; what a key mutated many times gathers is
+                // the versions it overwrote, which compacting its range drops
+                storage.compact_range(Some(&key), Some(&key)).await?;
+                Ok(Response::Ok)
+            }
+            Request::Save { path } => {
+                let dir = match self.start_snapshot(&path) {
+                    Ok(dir) => dir,
+                    Err(refused) => return Ok(refused),
+                };
+                match save_snapshot(&storage, &self.stats, &dir).await? {
+                    true => Ok(Response::Ok),
+                    false => Ok(Response::Error(SNAPSHOTS_UNSUPPORTED.to_string())),
+                }
+            }
+            Request::BgSave { path } => {
+                let dir = match self.start_snapshot(&path) {
+                    Ok(dir) => dir,
+                    Err(refused) => return Ok(refused),
+                };
+                let stats = self.stats.clone();
+                tokio::spawn(async move {
+                    match save_snapshot(&storage, &stats, &dir).await {
+                        Ok(true) => log::info!("Snapshot saved to {}", dir.display()),
+                        Ok(false) => log::warn!("Snapshot not saved: {}", SNAPSHOTS_UNSUPPORTED),
+                        Err(e) => log::warn!("Snapshot to {} failed: {}", dir.display(), e),
+                    }
+                });
+                Ok(Response::Ok)
+            }
+            Request::LastSave => {
+                let (_, _, last_save_ms) = self.stats.snapshot().status();
+                Ok(Response::Integer((last_save_ms / 1000) as i64))
+            }
+            Request::SnapshotInfo { path } => {
+                // Only snapshots under the snapshot directory are read, so
+                // clients cannot probe or hash the rest of the host
+                let Some(dir) = self.snapshot_path(&path) else {
+                    return Ok(Response::Error(SNAPSHOT_PATH_INVALID.to_string()));
+                };
+                // Checking the files reads all of them
+                let (meta, valid) = tokio::task::spawn_blocking(move || -> Result<(SnapshotMeta, bool)> {
+                    Ok((snapshot::read_manifest(&dir)?, snapshot::verify(&dir).is_ok()))
+                })
+                .await
+                .map_err(|e| crate::error::DiskDBError::Database(format!("Snapshot check failed: {}", e)))??;
+                let fields = [
+                    ("version", Response::Integer(meta.version as i64)),
+                    ("created-ms", Response::Integer(meta.created_ms as i64)),
+                    ("keys", Response::Integer(meta.keys as i64)),
+                    ("checksum", Response::String(Some(meta.checksum))),
+                    ("valid", Response::Integer(valid as i64)),
+                ];
+                Ok(Response::Array(fields.into_iter()
+                    .flat_map(|(name, value)| [Response::String(Some(name.to_string())), value])
+                    .collect()))
+            }
+            Request::MemoryUsage { key } => {
+                let value = match storage.get(&key).await? {
+                    Some(value) => value,
+                    None => return Ok(Response::Null),
+                };
+                let mut bytes = key.len() + value.memory_usage();
+                if storage.expiry(&key).await?.is_some() {
+                    // The expiry index holds its own copy of the key
+                    bytes += key.len() + std::mem::size_of::<u64>();
+                }
+                Ok(Response::Integer(bytes as i64))
+            }
+            Request::ObjectEncoding { key } => {
+                match storage.get(&key).await? {
+                    Some(value) => Ok(Response::String(Some(self.encoding(&storage, &key, &value).await?.to_string()))),
+                    None => Ok(Response::Null),
+                }
+            }
+            Request::MemoryStats => {
+                let mut stats = vec![
+                    ("connected-clients".to_string(), self.stats.connected_clients() as i64),
+                    ("databases.open".to_string(), self.databases.read().await.iter().flatten().count() as i64),
+                ];
+                stats.extend(storage.memory_stats().await?);
+                Ok(Response::Array(stats.into_iter()
+                    .flat_map(|(name, value)| [Response::String(Some(name)), Response::Integer(value)])
+                    .collect()))
+            }
+            Request::ExpireStats => {
+                let databases: Vec<Arc<dyn Storage>> = self.databases.read().await.iter().flatten().cloned().collect();
+                let (mut count, mut due) = (0, 0);
+                for storage in databases {
+                    let (c, d) = storage.expiry_counts().await?;
+                    count += c;
+                    due += d;
+                }
+                let reaper = self.stats.reaper();
+                let (cycles, scan_rate, last_reaped, total_reaped) = reaper.snapshot();
+                let stats = [
+                    ("expires.count", count as i64),
+                    ("expires.due", due as i64),
+                    ("reaper.keys-per-cycle", reaper.keys_per_cycle() as i64),
+                    ("reaper.cycles", cycles as i64),
+                    ("reaper.scan-rate", scan_rate as i64),
+                    ("reaper.last-reaped", last_reaped as i64),
+                    ("reaper.total-reaped", total_reaped as i64),
+                ];
+                Ok(Response::Array(stats.into_iter()
+                    .flat_map(|(name, value)| [Response::String(Some(name.to_string())), Response::Integer(value)])
+                    .collect()))
+            }
+            Request::ConfigGet { parameter } => {
+                let value = match parameter.as_str() {
+                    ACTIVE_EXPIRE_KEYS => self.stats.reaper().keys_per_cycle().to_string(),
+                    MAX_COMMANDS_PER_SECOND => self.stats.max_commands_per_second().to_string(),
+                    _ => return Ok(Response::Error(format!("ERR Unknown CONFIG parameter '{}'", parameter))),
+                };
+                Ok(Response::Array(vec![Response::String(Some(parameter)), Response::String(Some(value))]))
+            }
+            Request::ConfigSet { parameter, value } => {
+                match parameter.as_str() {
+                    ACTIVE_EXPIRE_KEYS => match value.parse() {
+                        Ok(keys) => self.stats.reaper().set_keys_per_cycle(keys),
+                        Err(_) => return Ok(Response::Error(format!("ERR Invalid value '{}' for CONFIG parameter '{}'", value, parameter))),
+                    },
+                    // Any client could otherwise lift the limit it is held to
+                    MAX_COMMANDS_PER_SECOND => return Ok(Response::Error(format!(
+                        "ERR CONFIG parameter '{}' can only be set at startup, with DISKDB_MAX_COMMANDS_PER_SECOND", parameter,
+                    ))),
+                    _ => return Ok(Response::Error(format!("ERR Unknown CONFIG parameter '{}'", parameter))),
+                }
+                Ok(Response::Ok)
+            }
+            Request::Restore { key, ttl, payload, replace } => {
+                if ttl < 0 {
+                    return Ok(Response::Error("ERR Invalid TTL value, must be >= 0".to_string()));
+                }
+                let value = match dump::restore(&payload) {
+                    Some(value) => value,
+                    None => return Ok(Response::Error("ERR DUMP payload version or checksum are wrong".to_string())),
+                };
+
+                let _guard = self.write_lock.lock().await;
+                if !replace && storage.exists(&key).await? {
+                    return Ok(Response::Error("BUSYKEY Target key name already exists".to_string()));
+                }
+                storage.set(&key, value).await?;
+                let expires_at = if ttl > 0 { Some(now_ms().saturating_add(ttl as u64)) } else { None };
+                storage.set_expiry(&key, expires_at).await?;
+                Ok(Response::Ok)
+            }
+            Request::Expire { key, ttl_ms } => {
+                // Under the lock, so a SET clearing the expiry of the value
+                // it writes cannot clear this one instead
+                let _guard = self.write_lock.lock().await;
+                if ttl_ms <= 0 {
+                    // An expiry in the past deletes the key straight away
+                    return Ok(Response::Integer(storage.delete(&key).await? as i64));
+                }
+                let at_ms = now_ms().saturating_add(ttl_ms as u64);
+                Ok(Response::Integer(storage.set_expiry(&key, Some(at_ms)).await? as i64))
+            }
+            Request::ExpireMatching { pattern, ttl_ms } => {
+                // Every matching key gets the same deadline, however long
+                // the scan takes
+                let at_ms = now_ms().saturating_add(ttl_ms);
+                let deadline = self.command_timeouts.get(&CommandClass::Keyspace)
+                    .map(|budget| tokio::time::Instant::now() + *budget);
+                match expire_matching(&storage, &pattern, at_ms, deadline).await? {
+                    (expired, true) => Ok(Response::Integer(expired as i64)),
+                    (expired, false) => Ok(Response::Error(format!(
+                        "TIMEOUT command timed out after expiring {} keys, run it again for the rest", expired,
+                    ))),
+                }
+            }
+            Request::Ttl { key } => {
+                Ok(Response::Integer(self.ttl(&storage, &key).await?))
+            }
+            Request::PTtl { key } => {
+                Ok(Response::Integer(self.pttl(&storage, &key).await?))
+            }
+            Request::MTtl { keys } => {
+                let mut ttls = Vec::with_capacity(keys.len());
+                for key in &keys {
+                    ttls.push(Response::Integer(self.ttl(&storage, key).await?));
+                }
+                Ok(Response::Array(ttls))
+            }
+            Request::Persist { key } => {
+                if storage.expiry(&key).await?.is_none() {
+                    return Ok(Response::Integer(0));
+                }
+                storage.set_expiry(&key, None).await?;
+                Ok(Response::Integer(1))
+            }
+            Request::RenamePersist { src, dst } => {
+                let _guard = self.write_lock.lock().await;
+                let value = match storage.get(&src).await? {
+                    Some(value) => value,
+                    None => return Ok(Response::Error("NOTFOUND no such key".to_string())),
+                };
+                // The permanent copy is complete before the source goes, so
+                // a crash part way leaves the data under one name or both,
+                // never under neither
+                if src != dst {
+                    storage.set(&dst, value).await?;
+                }
+                if storage.expiry(&dst).await?.is_some() {
+                    storage.set_expiry(&dst, None).await?;
+                }
+                if src != dst {
+                    storage.delete(&src).await?;
+                }
+                Ok(Response::Ok)
+            }
+            Request::Swap { a, b, with_ttl } => {
+                let _guard = self.write_lock.lock().await;
+                if a != b {
+                    storage.swap(&a, &b, with_ttl).await?;
+                }
+                Ok(Response::Ok)
+            }
+            Request::DelIfEq { key, value } => {
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
+                    Some(DataType::String(current)) if current == value => {
+                        storage.delete(&key).await?;
+                        Ok(Response::Integer(1))
+                    }
+                    Some(DataType::String(_)) | None => Ok(Response::Integer(0)),
+                    Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                }
+            }
+            Request::GetOrSet { key, value } => {
+                // Replies with the value and whether it was just set
+                let _guard = self.write_lock.lock().await;
+                match storage.get(&key).await? {
+                    Some(DataType::String(current)) => Ok(Response::Array(vec![
+                        Response::String(Some(current)),
+                        Response::Integer(0),
+                    ])),
+                    Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                    None => {
+                        storage.set(&key, DataType::String(value.clone())).await?;
+                        Ok(Response::Array(vec![Response::String(Some(value)), Response::Integer(1)]))
+                    }
+                }
+            }
+            Request::SetTagged { key, value, tags } => {
+                let _guard = self.write_lock.lock().await;
+                if !storage.set_tagged(&key, DataType::String(value), &tags).await? {
+                    return Ok(Response::Error(TAGS_UNSUPPORTED.to_string()));
+                }
+                // Like SET, it discards the key's expiry
+                if storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                Ok(Response::Ok)
+            }
+            Request::KeysByTag { tag } => match storage.keys_by_tag(&tag).await? {
+                Some(keys) => Ok(Response::Array(keys.into_iter().map(|key| Response::String(Some(key))).collect())),
+                None => Ok(Response::Error(TAGS_UNSUPPORTED.to_string())),
+            },
+            Request::SetIfVersion { key, expected, value } => {
+                // Replies with the key's version and whether it was written:
+                // the new version on success, the current one otherwise.
+                // The version is the key's revision, which every write
+                // raises, so a version once seen never comes back.
+                let _guard = self.write_lock.lock().await;
+                let current = match storage.revision(&key).await? {
+                    Some(revision) => revision,
+                    None => return Ok(Response::Error(VERSIONS_UNSUPPORTED.to_string())),
+                };
+                if current != expected {
+                    return Ok(Response::Array(vec![Response::Integer(current as i64), Response::Integer(0)]));
+                }
+                let version = match storage.set_versioned(&key, DataType::String(value)).await? {
+                    Some(version) => version,
+                    None => return Ok(Response::Error(VERSIONS_UNSUPPORTED.to_string())),
+                };
+                // Like SET, the write discards the key's expiry
+                if storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                Ok(Response::Array(vec![Response::Integer(version as i64), Response::Integer(1)]))
+            }
+            Request::GetIfChanged { key, since } => {
+                // Replies with the key's revision and its value, or nil in
+                // its place if the revision is not above `since`. The
+                // revision is read first, so a write in between makes the
+                // value newer than the revision, never older, and the next
+                // call fetches it again rather than missing it.
+                let revision = match storage.revision(&key).await? {
+                    Some(revision) => revision,
+                    None => return Ok(Response::Error(REVISIONS_UNSUPPORTED.to_string())),
+                };
+                let value = storage.get(&key).await?;
+                self.stats.record_get(&key, value.is_some());
+                match value {
+                    // A key last written before revisions were kept is at
+                    // revision 0 and always sent
+                    Some(DataType::String(value)) if revision == 0 || revision > since => {
+                        Ok(Response::Array(vec![Response::Integer(revision as i64), Response::String(Some(value))]))
+                    }
+                    Some(DataType::String(_)) => Ok(Response::Array(vec![Response::Integer(revision as i64), Response::Null])),
+                    Some(_) => Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+                    None => Ok(Response::Null),
+                }
+            }
+            Request::Invoke { function, key, args } => {
+                let update = match self.functions.get(&function) {
+                    Some(update) => update,
+                    None => return Ok(Response::Error(format!("ERR unknown function '{}'", function))),
+                };
+                // The function sees the value no other write can change
+                // before its result is stored
+                let _guard = self.write_lock.lock().await;
+                let current = storage.get(&key).await?;
+                match update(current, &args) {
+                    Ok(Update { value, reply }) => {
+                        if let Some(value) = value {
+                            storage.set(&key, value).await?;
+                        }
+                        Ok(reply)
+                    }
+                    Err(message) => Ok(Response::Error(message)),
+                }
+            }
             Request::Ping => Ok(Response::String(Some("PONG".to_string()))),
+            Request::Time => {
+                // As in Redis: seconds, then microseconds within the second
+                let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default();
+                Ok(Response::Array(vec![
+                    Response::String(Some(now.as_secs().to_string())),
+                    Response::String(Some(now.subsec_micros().to_string())),
+                ]))
+            }
             Request::Echo { message } => Ok(Response::String(Some(message))),
             Request::FlushDb => {
                 // For now, return error as this is dangerous
-                Ok(Response::Error("FLUSHDB not implemented for safety".to_string()))
+                Ok(Response::Error("ERR FLUSHDB not implemented for safety".to_string()))
             }
             Request::Info => {
                 // Return basic server info
-                let info = "# Server\nversion:0.1.0\n# Storage\nengine:rocksdb".to_string();
+                let mut info = format!(
+                    "# Server\nversion:0.1.0\n# Clients\nconnected_clients:{}\nmaxclients:{}\n# Storage\nengine:rocksdb",
+                    self.stats.connected_clients(),
+                    self.stats.max_clients(),
+                );
+                let (running, scanned, loaded) = self.stats.warmup().snapshot();
+                info.push_str(&format!(
+                    "\n# Warmup\nwarmup_in_progress:{}\nwarmup_keys_scanned:{}\nwarmup_keys_loaded:{}",
+                    running as u8, scanned, loaded,
+                ));
+                let (running, failed, last_save_ms) = self.stats.snapshot().status();
+                info.push_str(&format!(
+                    "\n# Snapshot\nsnapshot_in_progress:{}\nlast_snapshot_time:{}\nlast_snapshot_status:{}",
+                    running as u8, last_save_ms / 1000, if failed { "err" } else { "ok" },
+                ));
+                let (pending, max_pending, rejected) = self.stats.write_backlog();
+                info.push_str(&format!(
+                    "\n# Writes\npending_write_bytes:{}\nmax_pending_write_bytes:{}\nrejected_writes:{}",
+                    pending, max_pending, rejected,
+                ));
+                // Compression of the selected database, over the values
+                // written since startup
+                match storage.compression_stats().await? {
+                    Some(compression) => info.push_str(&format!(
+                        "\n# Compression\ncompression:zstd\ncompression_min_size:{}\nvalues_written:{}\nvalues_compressed:{}\nbytes_before_compression:{}\nbytes_stored:{}\ncompression_ratio:{:.2}",
+                        compression.min_size,
+                        compression.values,
+                        compression.compressed,
+                        compression.raw_bytes,
+                        compression.stored_bytes,
+                        compression.ratio(),
+                    )),
+                    None => info.push_str("\n# Compression\ncompression:none"),
+                }
+                // Write amplification of the selected database since
+                // startup
+                if let Some(writes) = storage.write_stats().await? {
+                    info.push_str(&format!(
+                        "\n# Disk\nlogical_bytes_written:{}\nphysical_bytes_written:{}\nwrite_amplification:{:.2}",
+                        writes.logical_bytes,
+                        writes.physical_bytes,
+                        writes.amplification(),
+                    ));
+                }
+                // Key usage of the open databases with a key limit
+                let databases: Vec<(usize, Arc<dyn Storage>)> = self.databases.read().await.iter()
+                    .enumerate()
+                    .filter_map(|(index, storage)| storage.clone().map(|storage| (index, storage)))
+                    .collect();
+                let mut keyspace = String::new();
+                for (index, database) in databases {
+                    if let Some((keys, max_keys)) = database.key_usage().await? {
+                        keyspace.push_str(&format!("\ndb{}:keys={},max_keys={}", index, keys, max_keys));
+                    }
+                }
+                if !keyspace.is_empty() {
+                    info.push_str("\n# Keyspace");
+                    info.push_str(&keyspace);
+                }
                 Ok(Response::String(Some(info)))
             }
+            Request::AuditLogGet { count } => {
+                Ok(Response::Array(self.audit_log.latest(count).into_iter()
+                    .map(|entry| Response::Array(vec![
+                        Response::Integer(entry.id as i64),
+                        Response::Integer(entry.at_ms as i64),
+                        Response::String(Some(entry.addr)),
+                        Response::String(entry.command),
+                        Response::String(Some(entry.reason)),
+                    ]))
+                    .collect()))
+            }
+            Request::AuditLogLen => Ok(Response::Integer(self.audit_log.len() as i64)),
+            Request::AuditLogReset => {
+                self.audit_log.reset();
+                Ok(Response::Ok)
+            }
+            Request::Shutdown { save } => {
+                if !self.shutdown_enabled {
+                    return Ok(self.refuse(session, "SHUTDOWN", "ERR SHUTDOWN command not allowed, set DISKDB_ENABLE_SHUTDOWN=1 and restart the server"));
+                }
+                if save {
+                    let databases: Vec<Arc<dyn Storage>> = self.databases.read().await.iter().flatten().cloned().collect();
+                    for storage in databases {
+                        storage.flush().await?;
+                    }
+                }
+                log::info!("Shutdown requested by {}", session.client.as_ref().map_or("embedded", |client| client.addr()));
+                self.shutdown.notify_one();
+                Ok(Response::Ok)
+            }
+            Request::Metrics => Ok(Response::String(Some(self.metrics().await?))),
+            Request::Hello { protover } => {
+                match protover {
+                    1 | 2 => {
+                        session.framed = protover == 2;
+                        Ok(Response::Ok)
+                    }
+                    _ => Ok(Response::Error("NOPROTO unsupported protocol version".to_string())),
+                }
+            }
+            Request::Select { index } => {
+                match self.database_index(index).await {
+                    Some(db) => {
+                        self.database(db).await?;
+                        session.db = db;
+                        Ok(Response::Ok)
+                    }
+                    None => Ok(Response::Error("ERR DB index is out of range".to_string())),
+                }
+            }
+            Request::Move { key, db } => {
+                let target = match self.database_index(db).await {
+                    Some(target) if target == session.db => {
+                        return Ok(Response::Error("ERR source and destination objects are the same".to_string()));
+                    }
+                    Some(target) => target,
+                    None => return Ok(Response::Error("ERR DB index is out of range".to_string())),
+                };
+
+                // Both databases are looked up under the lock, so a SWAPDB
+                // cannot slip in between and redirect the move
+                let _guard = self.write_lock.lock().await;
+                let storage = self.database(session.db).await?;
+                let target = self.database(target).await?;
+                let value = match storage.get(&key).await? {
+                    Some(value) => value,
+                    None => return Ok(Response::Integer(0)),
+                };
+                if target.exists(&key).await? {
+                    return Ok(Response::Integer(0));
+                }
+                let expires_at = storage.expiry(&key).await?;
+                target.set(&key, value).await?;
+                target.set_expiry(&key, expires_at).await?;
+                storage.delete(&key).await?;
+                Ok(Response::Integer(1))
+            }
+            Request::SwapDb { a, b } => {
+                let (a, b) = match (self.database_index(a).await, self.database_index(b).await) {
+                    (Some(a), Some(b)) => (a, b),
+                    _ => return Ok(Response::Error("ERR DB index is out of range".to_string())),
+                };
+                // Open both databases first so the swap itself cannot fail
+                self.database(a).await?;
+                self.database(b).await?;
+
+                // Exchanging the two slots under the database table's write
+                // lock switches every connection at once: a command resolves
+                // its database either before or after the swap, never half
+                // way. The write lock keeps multi-key commands from
+                // straddling it.
+                let _guard = self.write_lock.lock().await;
+                self.databases.write().await.swap(a, b);
+                Ok(Response::Ok)
+            }
+            
+            // Pub/Sub operations
+            Request::Subscribe { channels } => {
+                let subscriber = match &session.subscriber {
+                    Some(subscriber) => subscriber,
+                    None => return Ok(Response::Error("ERR SUBSCRIBE is not supported on this connection".to_string())),
+                };
+                let mut replies = Vec::with_capacity(channels.len());
+                for channel in channels {
+                    if session.subscriptions.insert(channel.clone()) {
+                        self.pubsub.subscribe(&channel, subscriber);
+                    }
+                    replies.push(subscription_reply("subscribe", Some(channel), session.subscriptions.len()));
+                }
+                Ok(Response::Array(replies))
+            }
+            Request::Unsubscribe { channels } => {
+                let channels: Vec<String> = if channels.is_empty() {
+                    session.subscriptions.iter().cloned().collect()
+                } else {
+                    channels
+                };
+                if channels.is_empty() {
+                    return Ok(Response::Array(vec![subscription_reply("unsubscribe", None, 0)]));
+                }
+
+                let mut replies = Vec::with_capacity(channels.len());
+                for channel in channels {
+                    if session.subscriptions.remove(&channel) {
+                        if let Some(subscriber) = &session.subscriber {
+                            self.pubsub.unsubscribe(&channel, subscriber);
+                        }
+                    }
+                    replies.push(subscription_reply("unsubscribe", Some(channel), session.subscriptions.len()));
+                }
+                Ok(Response::Array(replies))
+            }
+            Request::Publish { channel, message } => {
+                Ok(Response::Integer(self.pubsub.publish(&channel, &message) as i64))
+            }
+            Request::SetPublish { key, value, channel } => {
+                // Under the lock the key is published only once its value is
+                // stored, and writes to it are published in the order made
+                let _guard = self.write_lock.lock().await;
+                storage.set(&key, DataType::String(value)).await?;
+                if storage.expiry(&key).await?.is_some() {
+                    storage.set_expiry(&key, None).await?;
+                }
+                Ok(Response::Integer(self.pubsub.publish(&channel, &key) as i64))
+            }
+            Request::PubSubChannels { pattern } => {
+                Ok(Response::Array(self.pubsub.channels(pattern.as_deref()).into_iter()
+                    .map(|channel| Response::String(Some(channel)))
+                    .collect()))
+            }
+            Request::PubSubNumSub { channels } => {
+                // Channel and count pairs, flattened as Redis replies
+                let mut reply = Vec::with_capacity(channels.len() * 2);
+                for channel in channels {
+                    let count = self.pubsub.subscriber_count(&channel);
+                    reply.push(Response::String(Some(channel)));
+                    reply.push(Response::Integer(count as i64));
+                }
+                Ok(Response::Array(reply))
+            }
         }
     }
     
-    async fn execute_incr(&self, key: &str, delta: i64) -> Result<Response> {
-        let result = match self.storage.get(key).await? {
+    /// The reply to a DEBUG subcommand while they are disabled, recorded in
+    /// the audit log
+    fn refuse_debug(&self, session: &Session) -> Response {
+        self.refuse(session, "DEBUG", "ERR DEBUG command not allowed, set DISKDB_ENABLE_DEBUG=1 and restart the server")
+    }
+
+    /// Refuse `command` with `reason`, recording it in the audit log
+    fn refuse(&self, session: &Session, command: &str, reason: &str) -> Response {
+        let addr = session.client.as_ref().map_or_else(|| "embedded".to_string(), |client| client.addr().to_string());
+        self.audit_log.record(&addr, Some(command), reason);
+        Response::Error(reason.to_string())
+    }
+
+    /// The encoding OBJECT ENCODING reports for `value`, stored at `key`:
+    /// "compressed" if it is stored so, or else that of its type
+    async fn encoding(&self, storage: &Arc<dyn Storage>, key: &str, value: &DataType) -> Result<&'static str> {
+        if storage.is_compressed(key).await? {
+            return Ok(ValueEncoding::Compressed.name());
+        }
+        Ok(value.encoding())
+    }
+
+    async fn execute_incr(&self, storage: &Arc<dyn Storage>, key: &str, delta: i64) -> Result<Response> {
+        let result = match storage.get(key).await? {
             Some(mut data) => {
                 let new_val = data.incr(delta).map_err(crate::error::DiskDBError::Database)?;
-                self.storage.set(key, data).await?;
+                storage.set(key, data).await?;
                 new_val
             }
             None => {
                 let data = DataType::String(delta.to_string());
-                self.storage.set(key, data).await?;
+                storage.set(key, data).await?;
                 delta
             }
         };
         Ok(Response::Integer(result))
     }
-}
\ No newline at end of file
+    
+    /// Examine up to `options.count` keys after `cursor` and return the
+    /// cursor to continue from with the examined keys that match the
+    /// pattern. Cursors are the hex encoded last key examined; "0" starts
+    /// and ends an iteration. Returns `None` for a malformed cursor.
+    async fn scan_page(&self, storage: &Arc<dyn Storage>, cursor: &str, options: &ScanOptions) -> Result<Option<(String, Vec<String>)>> {
+        let after = if cursor == "0" {
+            None
+        } else {
+            match dump::from_hex(cursor).and_then(|key| String::from_utf8(key).ok()) {
+                Some(key) => Some(key),
+                None => return Ok(None),
+            }
+        };
+        let mut keys = storage.scan_keys(after.as_deref(), options.count).await?;
+        let next = match keys.last() {
+            Some(last) if keys.len() == options.count => dump::to_hex(last.as_bytes()),
+            _ => "0".to_string(),
+        };
+        if let Some(pattern) = &options.pattern {
+            keys.retain(|key| glob_match(pattern, key));
+        }
+        Ok(Some((next, keys)))
+    }
+    
+    /// Remove members of the sorted set at `key` with `remove`, as one step
+    /// under the write lock, and reply with how many it removed. A set left
+    /// empty is deleted.
+    async fn zremrange(&self, storage: &Arc<dyn Storage>, key: &str, remove: impl FnOnce(&mut DataType) -> std::result::Result<usize, String>) -> Result<Response> {
+        let _guard = self.write_lock.lock().await;
+        let mut data = match storage.get(key).await? {
+            Some(data @ DataType::SortedSet(_)) => data,
+            Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+            None => return Ok(Response::Integer(0)),
+        };
+        let removed = remove(&mut data).map_err(crate::error::DiskDBError::Database)?;
+        if data.as_sorted_set().is_some_and(|z| z.is_empty()) {
+            storage.delete(key).await?;
+        } else if removed > 0 {
+            storage.set(key, data).await?;
+        }
+        Ok(Response::Integer(removed as i64))
+    }
+    
+    /// Pop up to `count` items from the head or tail of a list, returned in
+    /// the order they were popped.
+    async fn pop_count(&self, storage: &Arc<dyn Storage>, key: &str, count: usize, from_head: bool) -> Result<Response> {
+        // Popping under the lock hands every item to exactly one of the
+        // consumers popping concurrently
+        let _guard = self.write_lock.lock().await;
+        let mut list = match storage.get(key).await? {
+            Some(DataType::List(list)) => list,
+            Some(_) => return Ok(Response::Error("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+            None => return Ok(Response::Array(vec![])),
+        };
+
+        let count = count.min(list.len());
+        let popped: Vec<String> = if from_head {
+            list.drain(..count).collect()
+        } else {
+            list.drain(list.len() - count..).rev().collect()
+        };
+        if list.is_empty() {
+            storage.delete(key).await?;
+        } else if count > 0 {
+            storage.set(key, DataType::List(list)).await?;
+        }
+        Ok(Response::Array(popped.into_iter().map(|v| Response::String(Some(v))).collect()))
+    }
+
+    /// Remaining time to live of `key` in seconds, -1 if it has no expiry
+    /// or -2 if it does not exist.
+    async fn ttl(&self, storage: &Arc<dyn Storage>, key: &str) -> Result<i64> {
+        match self.pttl(storage, key).await? {
+            // Round to the nearest second so a fresh EXPIRE 10 reads back as 10
+            ms if ms >= 0 => Ok((ms + 500) / 1000),
+            sentinel => Ok(sentinel),
+        }
+    }
+
+    /// Remaining time to live of `key` in milliseconds, with the same
+    /// sentinels as `ttl`.
+    async fn pttl(&self, storage: &Arc<dyn Storage>, key: &str) -> Result<i64> {
+        if !storage.exists(key).await? {
+            return Ok(-2);
+        }
+        match storage.expiry(key).await? {
+            Some(at_ms) => Ok(at_ms.saturating_sub(now_ms()) as i64),
+            None => Ok(-1),
+        }
+    }
+}
+
+/// Confirmation for one channel of a SUBSCRIBE or UNSUBSCRIBE:
+/// `[kind, channel, subscriptions left on the connection]`.
+fn subscription_reply(kind: &str, channel: Option<String>, count: usize) -> Response {
+    Response::Array(vec![
+        Response::String(Some(kind.to_string())),
+        Response::String(channel),
+        Response::Integer(count as i64),
+    ])
+}
+
+/// Drop bytes from the front of `s` until it is at most `max_bytes` long.
+/// The cut moves forward to just past a newline if one is close after it,
+/// so a log keeps whole lines, and otherwise to the next character
+/// boundary.
+fn trim_front(s: String, max_bytes: usize) -> String {
+    if s.len() <= max_bytes {
+        return s;
+    }
+    let cut = s.len() - max_bytes;
+    // Starting at the byte before the cut, so a cut already at the start
+    // of a line stays there
+    let window = &s.as_bytes()[cut - 1..s.len().min(cut + TRIM_NEWLINE_WINDOW)];
+    let start = match window.iter().position(|&b| b == b'\n') {
+        Some(newline) => cut + newline,
+        None => (cut..=s.len()).find(|&i| s.is_char_boundary(i)).unwrap_or(s.len()),
+    };
+    s[start..].to_string()
+}
+
+/// How `request` is counted in METRICS.
+fn command_kind(request: &Request) -> CommandKind {
+    if request.is_read_only() {
+        CommandKind::Read
+    } else if request.is_write() {
+        CommandKind::Write
+    } else {
+        CommandKind::Other
+    }
+}
+
+const VERSIONS_UNSUPPORTED: &str = "ERR the storage backend does not keep key versions";
+
+const REVISIONS_UNSUPPORTED: &str = "ERR the storage backend does not keep key revisions";
+
+const TAGS_UNSUPPORTED: &str = "ERR the storage backend does not support tags";
+
+const DEAD_LETTERS_UNSUPPORTED: &str = "ERR the storage backend does not support dead-letter lists";
+
+const SNAPSHOTS_UNSUPPORTED: &str = "ERR the storage backend does not support snapshots";
+
+const SNAPSHOT_PATH_INVALID: &str = "ERR snapshot path must be relative to the snapshot directory, without '.' or '..'";
+
+const CHANGE_LOG_DISABLED: &str = "ERR the change log is disabled, set DISKDB_CHANGELOG_RETENTION to enable it";
+
+/// How far past the required cut APPENDCAPPED looks for a newline to trim
+/// at instead
+const TRIM_NEWLINE_WINDOW: usize = 256;
+
+/// How many keys WARMUP scans per step
+const WARMUP_PAGE: usize = 1000;
+
+/// How many keys COMPACT compacts per step; it can be cancelled between
+/// steps
+const COMPACT_PAGE: usize = 10_000;
+
+/// Write a snapshot of `storage` to `path`, returning whether the backend
+/// could, and record in `stats` how it went. The snapshot must have been
+/// started with `start_snapshot`.
+async fn save_snapshot(storage: &Arc<dyn Storage>, stats: &ServerStats, path: &Path) -> Result<bool> {
+    let saved = storage.save_snapshot(path).await;
+    stats.snapshot().finish(now_ms(), matches!(saved, Ok(true)));
+    saved
+}
+
+/// How many keys EXPIREMATCHING scans per step
+const EXPIRE_MATCHING_PAGE: usize = 1000;
+
+/// Most members SRANDMEMBER returns for a negative count, which may repeat
+/// them without bound
+const SRANDMEMBER_MAX_REPEATS: i64 = 1_000_000;
+
+/// CONFIG parameter for the most expired keys the background reaper
+/// removes from each open database per cycle
+const ACTIVE_EXPIRE_KEYS: &str = "active-expire-keys";
+
+/// CONFIG parameter for the most commands each connection may send per
+/// second, which CONFIG SET cannot change
+const MAX_COMMANDS_PER_SECOND: &str = "max-commands-per-second";
+
+/// Set the expiry of every key of `storage` matching `pattern` to `at_ms`,
+/// a page of keys at a time, returning how many were set. Keys written
+/// while the scan runs are expired only if it reaches them afterwards.
+async fn expire_matching(
+    storage: &Arc<dyn Storage>,
+    pattern: &str,
+    at_ms: u64,
+    deadline: Option<tokio::time::Instant>,
+) -> Result<(usize, bool)> {
+    let mut after: Option<String> = None;
+    let mut expired = 0;
+    loop {
+        let keys = storage.scan_keys(after.as_deref(), EXPIRE_MATCHING_PAGE).await?;
+        for key in &keys {
+            if glob_match(pattern, key) && storage.set_expiry(key, Some(at_ms)).await? {
+                expired += 1;
+            }
+        }
+        if keys.len() < EXPIRE_MATCHING_PAGE {
+            return Ok((expired, true));
+        }
+        // Stop between pages once past the budget, so the keys expired so
+        // far keep their expiry and none is half done
+        if deadline.is_some_and(|deadline| tokio::time::Instant::now() >= deadline) {
+            return Ok((expired, false));
+        }
+        after = keys.into_iter().last();
+        // Let other commands run between pages
+        tokio::task::yield_now().await;
+    }
+}
+
+/// Read every key of `storage` matching one of `patterns` (all keys if
+/// there are none) once, so its data is in RocksDB's block cache and the OS
+/// page cache when clients ask for it. Progress is recorded in `stats`.
+async fn warm_up(storage: &Arc<dyn Storage>, patterns: &[String], stats: &ServerStats) -> Result<()> {
+    let mut after: Option<String> = None;
+    loop {
+        let keys = storage.scan_keys(after.as_deref(), WARMUP_PAGE).await?;
+        let mut loaded = 0;
+        for key in &keys {
+            if patterns.is_empty() || patterns.iter().any(|pattern| glob_match(pattern, key)) {
+                if storage.get(key).await?.is_some() {
+                    loaded += 1;
+                }
+            }
+        }
+        stats.warmup().record(keys.len() as u64, loaded);
+        if keys.len() < WARMUP_PAGE {
+            return Ok(());
+        }
+        after = keys.into_iter().last();
+        // Let client commands run between pages
+        tokio::task::yield_now().await;
+    }
+}
+
+/// Compact `storage` a range of keys at a time until it is done or
+/// cancelled, recording progress in `stats`. Each range is compacted as a
+/// whole, so cancelling leaves the data consistent, only partly compacted.
+async fn compact(storage: &Arc<dyn Storage>, stats: &ServerStats) -> Result<()> {
+    let total = storage.estimated_key_count().await?.filter(|&total| total > 0);
+    let before = storage.disk_usage().await?;
+    let reclaimed = || async {
+        let after = storage.disk_usage().await?;
+        Ok::<_, crate::error::DiskDBError>(before.zip(after).map_or(0, |(before, after)| before.saturating_sub(after)))
+    };
+
+    let mut from: Option<String> = None;
+    let mut compacted = 0u64;
+    loop {
+        if stats.compaction().is_cancelled() {
+            return Ok(());
+        }
+        let keys = storage.scan_keys(from.as_deref(), COMPACT_PAGE).await?;
+        // The last range is left open so keys written past the end of the
+        // scan are compacted too
+        let to = if keys.len() < COMPACT_PAGE { None } else { keys.last().cloned() };
+        storage.compact_range(from.as_deref(), to.as_deref()).await?;
+        compacted += keys.len() as u64;
+        if to.is_none() {
+            stats.compaction().record(100, reclaimed().await?);
+            return Ok(());
+        }
+        // The estimate can be short of the keys there are, so 100% waits
+        // for the end
+        let percent = total.map_or(0, |total| (compacted * 100 / total).min(99));
+        stats.compaction().record(percent, reclaimed().await?);
+        from = to;
+    }
+}
+
+/// Pick `count` random members. A positive count returns distinct members
+/// (at most all of them), a negative count may repeat members and always
+/// returns exactly `-count` of them when the set is not empty.
+fn sample_members(mut members: Vec<String>, count: i64) -> Vec<String> {
+    if members.is_empty() || count == 0 {
+        return Vec::new();
+    }
+    if count < 0 {
+        let len = members.len() as u64;
+        return (0..count.unsigned_abs())
+            .map(|_| members[random_below(len) as usize].clone())
+            .collect();
+    }
+
+    // Partial Fisher-Yates shuffle of the first `count` slots
+    let take = (count as usize).min(members.len());
+    for i in 0..take {
+        let j = i + random_below((members.len() - i) as u64) as usize;
+        members.swap(i, j);
+    }
+    members.truncate(take);
+    members
+}
@@ -1,14 +1,97 @@
+use crate::audit::DEFAULT_AUDIT_LOG_SIZE;
+use crate::log_tail::DEFAULT_LOG_TAIL_SIZE;
+use crate::protocol::CommandClass;
+use crate::request_ids::DEFAULT_MAX_REQUEST_IDS;
+use crate::storage::compression::Compression;
+use crate::storage::snapshot::DEFAULT_SNAPSHOT_DIR;
+use std::collections::HashMap;
+use std::fmt;
 use std::path::PathBuf;
+use std::time::Duration;
 
 #[derive(Debug, Clone)]
 pub struct Config {
     pub server_port: u16,
+    /// Addresses to accept connections on, all serving the same data. When
+    /// empty the server listens on `server_port` on every interface.
+    pub listen: Vec<ListenAddress>,
+    /// Most connections each TCP listener queues before they are accepted;
+    /// a burst beyond it waits on the clients' retries
+    pub listen_backlog: u32,
+    /// Set SO_REUSEPORT on TCP listeners, so a new server can bind the
+    /// ports of one still running, as in a rolling restart, and the kernel
+    /// spreads new connections between them. SO_REUSEADDR is always set.
+    pub reuse_port: bool,
+    /// TCP address to serve `GET /metrics` on over HTTP, for Prometheus to
+    /// scrape, or `None` to leave METRICS as the only way to read them
+    pub metrics_address: Option<String>,
     pub database_path: PathBuf,
     pub use_tls: bool,
     pub cert_path: Option<PathBuf>,
     pub key_path: Option<PathBuf>,
     pub max_connections: usize,
     pub thread_pool_size: usize,
+    pub databases: usize,
+    /// Allow DEBUG subcommands, which expose internals and are meant for
+    /// diagnosing a server rather than for production use
+    pub debug_enabled: bool,
+    /// Allow SHUTDOWN, which stops the server for every client, so any
+    /// client able to connect could otherwise stop it
+    pub shutdown_enabled: bool,
+    /// Key prefixes to count GET hits and misses for, see KEYSTATS
+    pub key_stats_prefixes: Vec<String>,
+    /// Largest number of arguments, command name included, accepted in one
+    /// command. Longer commands are rejected while being read, before they
+    /// are buffered in full. Zero means no limit.
+    pub max_args: usize,
+    /// Most bytes of writes the server holds accepted but not yet applied.
+    /// Writes arriving beyond it are answered with `TRYAGAIN` until the
+    /// backlog drains, rather than buffered. Zero means no limit.
+    pub max_pending_write_bytes: usize,
+    /// Most commands each connection may send per second, with up to a
+    /// second's worth in a burst. Commands beyond it are answered with
+    /// `RATELIMIT` instead of run, and the connection stays open. CONFIG
+    /// GET max-commands-per-second reads it; it cannot be changed while
+    /// running, or limited clients could lift it. Zero means no limit.
+    pub max_commands_per_second: u64,
+    /// Refused commands kept for AUDITLOG; the oldest are dropped first.
+    /// Zero keeps none.
+    pub audit_log_size: usize,
+    /// Lines of the server log kept in memory for DEBUG LOGTAIL; the oldest
+    /// are dropped first. Zero keeps none.
+    pub log_tail_size: usize,
+    /// Most request ids of SETIDEM writes remembered at once. Past it the
+    /// oldest are forgotten before their window ends. Zero means no limit.
+    pub max_request_ids: usize,
+    /// Longest a read-only command of each class may run before the client
+    /// gets `ERR command timed out` in place of its reply. Classes missing
+    /// here have no limit. Writes always run to completion, since stopping
+    /// one partway could leave it half applied, except EXPIREMATCHING: it
+    /// stops between pages once past the KEYSPACE budget and says how many
+    /// keys it expired.
+    pub command_timeouts: HashMap<CommandClass, Duration>,
+    /// How values are compressed on disk, or `None` to store them as is
+    pub compression: Option<Compression>,
+    /// Most keys each database may hold, by index. Writes that would create
+    /// a key beyond it fail; databases missing here have no limit.
+    pub max_keys: HashMap<usize, u64>,
+    /// Number of the latest writes each database keeps in its change log
+    /// for CHANGES. Zero keeps no log.
+    pub change_log_retention: u64,
+    /// Most expired keys the server removes from each open database every
+    /// cycle of its background reaper, before they are read. CONFIG SET
+    /// active-expire-keys changes it while running. Zero leaves expired
+    /// keys until they are read.
+    pub active_expire_keys: usize,
+    /// Directory SAVE and BGSAVE write snapshots under and SNAPSHOT INFO
+    /// reads them from. Clients name a snapshot by its path relative to it
+    /// and cannot reach anywhere else.
+    pub snapshot_dir: PathBuf,
+    /// Snapshot, as SAVE writes it, to replace database 0 with at startup.
+    /// It is verified first and the server refuses to start if it is
+    /// corrupt or of another version. A database already restored from it
+    /// is not restored again.
+    pub restore_snapshot: Option<PathBuf>,
 }
 
 impl Config {
@@ -25,6 +108,28 @@ impl Config {
             }
         }
         
+        if let Ok(listen) = std::env::var("DISKDB_LISTEN") {
+            config.listen = listen.split(',')
+                .map(str::trim)
+                .filter(|address| !address.is_empty())
+                .map(ListenAddress::parse)
+                .collect();
+        }
+        
+        if let Ok(backlog) = std::env::var("DISKDB_LISTEN_BACKLOG") {
+            if let Ok(b) = backlog.parse() {
+                config.listen_backlog = b;
+            }
+        }
+        
+        if let Ok(reuse_port) = std::env::var("DISKDB_REUSEPORT") {
+            config.reuse_port = reuse_port.to_lowercase() == "true" || reuse_port == "1";
+        }
+        
+        if let Ok(address) = std::env::var("DISKDB_METRICS_ADDR") {
+            config.metrics_address = Some(address).filter(|address| !address.is_empty());
+        }
+        
         if let Ok(path) = std::env::var("DISKDB_PATH") {
             config.database_path = PathBuf::from(path);
         }
@@ -47,20 +152,231 @@ impl Config {
             }
         }
         
+        if let Ok(databases) = std::env::var("DISKDB_DATABASES") {
+            if let Ok(d) = databases.parse() {
+                config.databases = d;
+            }
+        }
+        
+        if let Ok(debug) = std::env::var("DISKDB_ENABLE_DEBUG") {
+            config.debug_enabled = debug.to_lowercase() == "true" || debug == "1";
+        }
+        
+        if let Ok(shutdown) = std::env::var("DISKDB_ENABLE_SHUTDOWN") {
+            config.shutdown_enabled = shutdown.to_lowercase() == "true" || shutdown == "1";
+        }
+        
+        // DISKDB_MAX_KEYS limits every database, and DISKDB_MAX_KEYS_<N>
+        // overrides it for database N; 0 means no limit
+        let default_max_keys = std::env::var("DISKDB_MAX_KEYS").ok()
+            .and_then(|max| max.parse::<u64>().ok());
+        for index in 0..config.databases {
+            let max_keys = std::env::var(format!("DISKDB_MAX_KEYS_{}", index)).ok()
+                .and_then(|max| max.parse::<u64>().ok())
+                .or(default_max_keys);
+            match max_keys {
+                Some(0) => {
+                    config.max_keys.remove(&index);
+                }
+                Some(max) => {
+                    config.max_keys.insert(index, max);
+                }
+                None => {}
+            }
+        }
+        
+        if let Ok(max_args) = std::env::var("DISKDB_MAX_ARGS") {
+            if let Ok(m) = max_args.parse() {
+                config.max_args = m;
+            }
+        }
+        
+        if let Ok(max_bytes) = std::env::var("DISKDB_MAX_PENDING_WRITE_BYTES") {
+            if let Ok(m) = max_bytes.parse() {
+                config.max_pending_write_bytes = m;
+            }
+        }
+        
+        if let Ok(max) = std::env::var("DISKDB_MAX_COMMANDS_PER_SECOND") {
+            if let Ok(m) = max.parse() {
+                config.max_commands_per_second = m;
+            }
+        }
+        
+        if let Ok(size) = std::env::var("DISKDB_AUDIT_LOG_SIZE") {
+            if let Ok(s) = size.parse() {
+                config.audit_log_size = s;
+            }
+        }
+        
+        if let Ok(size) = std::env::var("DISKDB_LOG_TAIL_SIZE") {
+            if let Ok(s) = size.parse() {
+                config.log_tail_size = s;
+            }
+        }
+        
+        if let Ok(max_ids) = std::env::var("DISKDB_MAX_REQUEST_IDS") {
+            if let Ok(m) = max_ids.parse() {
+                config.max_request_ids = m;
+            }
+        }
+        
+        // DISKDB_COMMAND_TIMEOUT_MS sets the budget of every class, and
+        // DISKDB_COMMAND_TIMEOUT_MS_<CLASS> overrides it; 0 means no limit
+        let default_timeout = std::env::var("DISKDB_COMMAND_TIMEOUT_MS").ok()
+            .and_then(|ms| ms.parse::<u64>().ok());
+        for class in CommandClass::ALL {
+            let timeout = std::env::var(format!("DISKDB_COMMAND_TIMEOUT_MS_{}", class.name())).ok()
+                .and_then(|ms| ms.parse::<u64>().ok())
+                .or(default_timeout);
+            match timeout {
+                Some(0) => {
+                    config.command_timeouts.remove(&class);
+                }
+                Some(ms) => {
+                    config.command_timeouts.insert(class, Duration::from_millis(ms));
+                }
+                None => {}
+            }
+        }
+        
+        if let Ok(codec) = std::env::var("DISKDB_COMPRESSION") {
+            match codec.to_lowercase().as_str() {
+                "zstd" => config.compression = Some(Compression::default()),
+                "none" | "" => config.compression = None,
+                _ => {}
+            }
+        }
+        
+        if let Some(compression) = config.compression.as_mut() {
+            if let Ok(min_size) = std::env::var("DISKDB_COMPRESSION_MIN_BYTES") {
+                if let Ok(m) = min_size.parse() {
+                    compression.min_size = m;
+                }
+            }
+            if let Ok(level) = std::env::var("DISKDB_COMPRESSION_LEVEL") {
+                if let Ok(l) = level.parse() {
+                    compression.level = l;
+                }
+            }
+        }
+        
+        if let Ok(retention) = std::env::var("DISKDB_CHANGELOG_RETENTION") {
+            if let Ok(r) = retention.parse() {
+                config.change_log_retention = r;
+            }
+        }
+        
+        if let Ok(dir) = std::env::var("DISKDB_SNAPSHOT_DIR") {
+            config.snapshot_dir = PathBuf::from(dir);
+        }
+        
+        if let Ok(path) = std::env::var("DISKDB_RESTORE_SNAPSHOT") {
+            config.restore_snapshot = Some(PathBuf::from(path)).filter(|path| !path.as_os_str().is_empty());
+        }
+        
+        if let Ok(keys) = std::env::var("DISKDB_ACTIVE_EXPIRE_KEYS") {
+            if let Ok(k) = keys.parse() {
+                config.active_expire_keys = k;
+            }
+        }
+        
+        if let Ok(prefixes) = std::env::var("DISKDB_KEYSTATS_PREFIXES") {
+            config.key_stats_prefixes = prefixes.split(',')
+                .map(|p| p.trim().to_string())
+                .filter(|p| !p.is_empty())
+                .collect();
+        }
+        
         config
     }
+
+    /// Addresses the server listens on: `listen`, or `server_port` on every
+    /// interface when that is empty.
+    pub fn listen_addresses(&self) -> Vec<ListenAddress> {
+        if self.listen.is_empty() {
+            return vec![ListenAddress::Tcp(format!("0.0.0.0:{}", self.server_port))];
+        }
+        self.listen.clone()
+    }
+
+    /// Path of the storage backing database `index`. Database 0 lives at
+    /// `database_path`; the others sit next to it with a `-db<N>` suffix.
+    pub fn database_path_for(&self, index: usize) -> PathBuf {
+        if index == 0 {
+            return self.database_path.clone();
+        }
+        let mut path = self.database_path.clone().into_os_string();
+        path.push(format!("-db{}", index));
+        PathBuf::from(path)
+    }
+
+    /// Most keys database `index` may hold, if limited.
+    pub fn max_keys_for(&self, index: usize) -> Option<u64> {
+        self.max_keys.get(&index).copied()
+    }
 }
 
 impl Default for Config {
     fn default() -> Self {
         Self {
             server_port: 6380,
+            listen: Vec::new(),
+            listen_backlog: 1024,
+            reuse_port: false,
+            metrics_address: None,
             database_path: PathBuf::from("diskdb"),
             use_tls: false,
             cert_path: None,
             key_path: None,
             max_connections: 1000,
             thread_pool_size: num_cpus::get(),
+            databases: 16,
+            debug_enabled: false,
+            shutdown_enabled: false,
+            key_stats_prefixes: Vec::new(),
+            max_args: 64 * 1024,
+            max_pending_write_bytes: 256 * 1024 * 1024,
+            max_commands_per_second: 0,
+            audit_log_size: DEFAULT_AUDIT_LOG_SIZE,
+            log_tail_size: DEFAULT_LOG_TAIL_SIZE,
+            max_request_ids: DEFAULT_MAX_REQUEST_IDS,
+            command_timeouts: HashMap::new(),
+            compression: None,
+            max_keys: HashMap::new(),
+            change_log_retention: 0,
+            active_expire_keys: 1000,
+            snapshot_dir: PathBuf::from(DEFAULT_SNAPSHOT_DIR),
+            restore_snapshot: None,
         }
     }
-}
\ No newline at end of file
+}
+/// An address the server accepts connections on.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ListenAddress {
+    /// A TCP address such as `127.0.0.1:6380`
+    Tcp(String),
+    /// A Unix domain socket at this path. Clients on it are local, so it
+    /// never uses TLS.
+    Unix(PathBuf),
+}
+
+impl ListenAddress {
+    /// Parse `unix:<path>` as a Unix socket and anything else as a TCP
+    /// address.
+    pub fn parse(address: &str) -> Self {
+        match address.strip_prefix("unix:") {
+            Some(path) => ListenAddress::Unix(PathBuf::from(path)),
+            None => ListenAddress::Tcp(address.to_string()),
+        }
+    }
+}
+
+impl fmt::Display for ListenAddress {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ListenAddress::Tcp(address) => write!(f, "{}", address),
+            ListenAddress::Unix(path) => write!(f, "unix:{}", path.display()),
+        }
+    }
+}
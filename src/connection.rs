@@ -1,15 +1,102 @@
-use crate::commands::CommandExecutor;
-use crate::error::Result;
-use crate::protocol::{Request, Response};
-use log::{error, info};
+use crate::commands::{CommandExecutor, Session};
+use crate::error::{DiskDBError, Result};
+use crate::protocol::{ArgCounter, Request, Response};
+use crate::pubsub::SUBSCRIBER_BUFFER;
+use crate::stats::WriteReservation;
+use log::{error, info, warn};
+use std::collections::VecDeque;
 use std::sync::Arc;
-use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
-use tokio::net::TcpStream;
+use std::time::Duration;
+use tokio::io::{AsyncBufRead, AsyncBufReadExt, AsyncRead, AsyncWrite, AsyncWriteExt, BufReader};
+use tokio::net::{TcpStream, UnixStream};
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+use tokio::time::Instant;
 use tokio_native_tls::TlsStream;
 
+/// Upper bound on read commands executing concurrently for one connection
+const MAX_PIPELINED_READS: usize = 64;
+
+/// Reply to a write refused because the pending writes are over
+/// `max_pending_write_bytes`. Clients can retry it once the backlog drains.
+const WRITE_BACKLOG_FULL: &str = "TRYAGAIN write backlog is full, retry later";
+
+/// Reply to a command refused because the connection is sending more than
+/// `max_commands_per_second`. The connection stays open.
+const RATE_LIMITED: &str = "RATELIMIT too many commands per second, slow down";
+
 pub enum Connection {
     Plain(TcpStream),
     Tls(TlsStream<TcpStream>),
+    Unix(UnixStream),
+}
+
+/// A request line as read from the client.
+enum RequestLine {
+    Line(String),
+    /// A line with more arguments than allowed, discarded while reading
+    TooManyArgs,
+    /// A line that is not valid UTF-8
+    InvalidUtf8,
+}
+
+/// A read-only command executing on its own task.
+struct PendingRead {
+    task: JoinHandle<Timed>,
+    /// When the client stops waiting for the command, if its class has a
+    /// budget
+    deadline: Option<Instant>,
+}
+
+/// A reply with how long its command took to execute, when the session
+/// reports it (DEBUG TIMING ON).
+struct Timed {
+    response: Response,
+    elapsed: Option<Duration>,
+}
+
+impl From<Response> for Timed {
+    fn from(response: Response) -> Self {
+        Self { response, elapsed: None }
+    }
+}
+
+/// Commands a connection may still send now, refilled continuously at the
+/// configured rate up to one second's worth.
+struct RateLimiter {
+    tokens: f64,
+    refilled: Instant,
+}
+
+impl RateLimiter {
+    fn new() -> Self {
+        Self { tokens: f64::INFINITY, refilled: Instant::now() }
+    }
+
+    /// Take one command from the allowance for `per_second` commands a
+    /// second, returning false if there is none left. Zero is unlimited.
+    fn try_acquire(&mut self, per_second: u64) -> bool {
+        if per_second == 0 {
+            return true;
+        }
+        let now = Instant::now();
+        let rate = per_second as f64;
+        let elapsed = now.duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * rate).min(rate);
+        self.refilled = now;
+        if self.tokens < 1.0 {
+            return false;
+        }
+        self.tokens -= 1.0;
+        true
+    }
+}
+
+/// What the connection loop woke up for.
+enum Input {
+    Line(Option<RequestLine>),
+    Reply(Timed),
+    Message(Response),
 }
 
 impl Connection {
@@ -18,80 +105,313 @@ impl Connection {
         
         match self {
             Connection::Plain(stream) => {
-                let (reader, mut writer) = stream.into_split();
-                let mut reader = BufReader::new(reader);
-                let mut line = String::new();
-                
-                loop {
-                    line.clear();
-                    match reader.read_line(&mut line).await {
-                        Ok(0) => break, // Connection closed
-                        Ok(_) => {
-                            if line.trim().is_empty() {
-                                continue;
-                            }
+                let (reader, writer) = stream.into_split();
+                Self::serve(reader, writer, &executor, &addr).await;
+            }
+            Connection::Tls(stream) => {
+                let (reader, writer) = tokio::io::split(stream);
+                Self::serve(reader, writer, &executor, &addr).await;
+            }
+            Connection::Unix(stream) => {
+                let (reader, writer) = stream.into_split();
+                Self::serve(reader, writer, &executor, &addr).await;
+            }
+        }
 
-                            let response = match Request::parse(&line) {
-                                Ok(request) => {
-                                    match executor.execute(request).await {
-                                        Ok(resp) => resp,
-                                        Err(e) => Response::Error(e.to_string()),
-                                    }
-                                }
-                                Err(e) => Response::Error(e.to_string()),
-                            };
-
-                            if let Err(e) = writer.write_all(response.to_string().as_bytes()).await {
-                                error!("Failed to write response: {}", e);
-                                break;
-                            }
+        info!("Connection closed: {}", addr);
+        Ok(())
+    }
+
+    /// Answer requests until the client disconnects, interleaving messages
+    /// published to the channels the connection is subscribed to.
+    ///
+    /// Pipelined read-only commands run concurrently so one slow read does
+    /// not hold up the reads queued behind it; their replies are still
+    /// written in request order. Any other command waits for the reads sent
+    /// before it, so it never observes or disturbs them out of order.
+    async fn serve<R, W>(reader: R, mut writer: W, executor: &Arc<CommandExecutor>, addr: &str)
+    where
+        R: AsyncRead + Unpin + Send + 'static,
+        W: AsyncWrite + Unpin,
+    {
+        let (mut lines, read_task) = Self::read_lines(reader, executor.max_args());
+        let (sender, mut messages) = mpsc::channel(SUBSCRIBER_BUFFER);
+        let subscriber = executor.pubsub().subscriber(sender);
+        let client = executor.clients().register(addr);
+        let mut session = Session {
+            subscriber: Some(subscriber.clone()),
+            client: Some(client.info()),
+            ..Session::default()
+        };
+        let mut pending: VecDeque<PendingRead> = VecDeque::new();
+        let mut limiter = RateLimiter::new();
+
+        loop {
+            let input = tokio::select! {
+                reply = Self::next_reply(&mut pending), if !pending.is_empty() => Input::Reply(reply),
+                line = lines.recv(), if pending.len() < MAX_PIPELINED_READS => Input::Line(line),
+                Some(message) = messages.recv() => Input::Message(message),
+                _ = subscriber.overflowed() => {
+                    warn!("Closing subscriber that fell {} messages behind", SUBSCRIBER_BUFFER);
+                    break;
+                }
+            };
+
+            let result = match input {
+                Input::Reply(reply) => Self::write(&mut writer, reply, &session).await,
+                Input::Message(message) => Self::write(&mut writer, message.into(), &session).await,
+                Input::Line(Some(rejected @ (RequestLine::TooManyArgs | RequestLine::InvalidUtf8))) => {
+                    let reason = match rejected {
+                        RequestLine::TooManyArgs => format!("ERR too many arguments, the limit is {}", executor.max_args()),
+                        _ => "ERR request is not valid UTF-8".to_string(),
+                    };
+                    executor.audit_log().record(addr, None, &reason);
+                    let response = Response::Error(reason);
+                    match Self::flush(&mut pending, &mut writer, &session).await {
+                        Ok(()) => Self::write(&mut writer, response.into(), &session).await,
+                        Err(e) => Err(e),
+                    }
+                }
+                Input::Line(Some(RequestLine::Line(line))) if !limiter.try_acquire(executor.stats().max_commands_per_second()) => {
+                    executor.audit_log().record(addr, command_name(&line), RATE_LIMITED);
+                    match Self::flush(&mut pending, &mut writer, &session).await {
+                        Ok(()) => Self::write(&mut writer, Response::Error(RATE_LIMITED.to_string()).into(), &session).await,
+                        Err(e) => Err(e),
+                    }
+                }
+                Input::Line(Some(RequestLine::Line(line))) => match Request::parse(&line) {
+                    Ok(request) if request.is_read_only() => {
+                        let deadline = executor.command_timeout(&request).map(|budget| Instant::now() + budget);
+                        let executor = executor.clone();
+                        let mut read_session = Session {
+                            db: session.db,
+                            timing: session.timing,
+                            ..Session::default()
+                        };
+                        let task = tokio::spawn(async move {
+                            Self::execute(Ok(request), None, &executor, &mut read_session).await
+                        });
+                        pending.push_back(PendingRead { task, deadline });
+                        Ok(())
+                    }
+                    Ok(request) if request.is_write() => match executor.stats().try_reserve_write(line.len()) {
+                        reservation @ Some(_) => {
+                            Self::execute_in_order(Ok(request), &line, reservation, executor, &mut session, &mut pending, &mut writer).await
                         }
-                        Err(e) => {
-                            error!("Failed to read from stream: {}", e);
-                            break;
+                        None => {
+                            executor.audit_log().record(addr, command_name(&line), WRITE_BACKLOG_FULL);
+                            match Self::flush(&mut pending, &mut writer, &session).await {
+                                Ok(()) => Self::write(&mut writer, Response::Error(WRITE_BACKLOG_FULL.to_string()).into(), &session).await,
+                                Err(e) => Err(e),
+                            }
                         }
+                    },
+                    parsed => Self::execute_in_order(parsed, &line, None, executor, &mut session, &mut pending, &mut writer).await,
+                },
+                Input::Line(None) => {
+                    // Connection closed; answer what was already sent
+                    if let Err(e) = Self::flush(&mut pending, &mut writer, &session).await {
+                        error!("Failed to write response: {}", e);
                     }
+                    break;
                 }
+            };
+
+            if let Err(e) = result {
+                error!("Failed to write response: {}", e);
+                break;
             }
-            Connection::Tls(stream) => {
-                let (reader, mut writer) = tokio::io::split(stream);
-                let mut reader = BufReader::new(reader);
-                let mut line = String::new();
-                
-                loop {
-                    line.clear();
-                    match reader.read_line(&mut line).await {
-                        Ok(0) => break, // Connection closed
-                        Ok(_) => {
-                            if line.trim().is_empty() {
-                                continue;
-                            }
+        }
 
-                            let response = match Request::parse(&line) {
-                                Ok(request) => {
-                                    match executor.execute(request).await {
-                                        Ok(resp) => resp,
-                                        Err(e) => Response::Error(e.to_string()),
-                                    }
-                                }
-                                Err(e) => Response::Error(e.to_string()),
-                            };
-
-                            if let Err(e) = writer.write_all(response.to_string().as_bytes()).await {
-                                error!("Failed to write response: {}", e);
-                                break;
-                            }
+        executor.close_session(&mut session);
+        read_task.abort();
+    }
+
+    /// Execute a request once the reads sent before it have been answered,
+    /// and write its reply. A write's `reservation` is held while it waits
+    /// for those reads and released once it is applied.
+    async fn execute_in_order<W>(
+        parsed: Result<Request>,
+        line: &str,
+        reservation: Option<WriteReservation>,
+        executor: &CommandExecutor,
+        session: &mut Session,
+        pending: &mut VecDeque<PendingRead>,
+        writer: &mut W,
+    ) -> std::io::Result<()>
+    where
+        W: AsyncWrite + Unpin,
+    {
+        Self::flush(pending, writer, session).await?;
+        let reply = Self::execute(parsed, command_name(line), executor, session).await;
+        drop(reservation);
+        Self::write(writer, reply, session).await
+    }
+
+    /// Wait for the oldest in-flight read and take its reply.
+    async fn next_reply(pending: &mut VecDeque<PendingRead>) -> Timed {
+        let read = match pending.front_mut() {
+            Some(read) => read,
+            None => return Response::Error("ERR no reply pending".to_string()).into(),
+        };
+        let joined = match read.deadline {
+            Some(deadline) => match tokio::time::timeout_at(deadline, &mut read.task).await {
+                Ok(joined) => joined,
+                Err(_) => {
+                    // The command is cancelled the next time it yields; a
+                    // storage call already under way finishes first
+                    read.task.abort();
+                    pending.pop_front();
+                    return Response::Error("TIMEOUT command timed out".to_string()).into();
+                }
+            },
+            None => (&mut read.task).await,
+        };
+        let reply = joined.unwrap_or_else(|e| Response::Error(format!("ERR command failed: {}", e)).into());
+        pending.pop_front();
+        reply
+    }
+
+    /// Write the replies of all in-flight reads, in order.
+    async fn flush<W>(pending: &mut VecDeque<PendingRead>, writer: &mut W, session: &Session) -> std::io::Result<()>
+    where
+        W: AsyncWrite + Unpin,
+    {
+        while !pending.is_empty() {
+            let reply = Self::next_reply(pending).await;
+            Self::write(writer, reply, session).await?;
+        }
+        Ok(())
+    }
+
+    async fn write<W>(writer: &mut W, reply: Timed, session: &Session) -> std::io::Result<()>
+    where
+        W: AsyncWrite + Unpin,
+    {
+        writer.write_all(Self::encode(&reply, session).as_bytes()).await
+    }
+
+    /// Read request lines on a separate task so waiting for the next request
+    /// never holds up delivery of published messages.
+    fn read_lines<R>(reader: R, max_args: usize) -> (mpsc::Receiver<RequestLine>, JoinHandle<()>)
+    where
+        R: AsyncRead + Unpin + Send + 'static,
+    {
+        let (sender, receiver) = mpsc::channel(32);
+        let task = tokio::spawn(async move {
+            let mut reader = BufReader::new(reader);
+            loop {
+                match Self::read_line(&mut reader, max_args).await {
+                    Ok(None) => break,
+                    Ok(Some(line)) => {
+                        if matches!(&line, RequestLine::Line(l) if l.trim().is_empty()) {
+                            continue;
                         }
-                        Err(e) => {
-                            error!("Failed to read from stream: {}", e);
+                        if sender.send(line).await.is_err() {
                             break;
                         }
                     }
+                    Err(e) => {
+                        error!("Failed to read from stream: {}", e);
+                        break;
+                    }
                 }
             }
+        });
+        (receiver, task)
+    }
+
+    /// Read one line, or `None` at the end of the stream. Once the line has
+    /// more than `max_args` arguments (when non-zero) the rest of it is
+    /// skipped instead of buffered.
+    async fn read_line<R>(reader: &mut R, max_args: usize) -> std::io::Result<Option<RequestLine>>
+    where
+        R: AsyncBufRead + Unpin,
+    {
+        let mut line = Vec::new();
+        let mut args = ArgCounter::default();
+        let mut too_many = false;
+        let mut read_any = false;
+
+        loop {
+            let buf = reader.fill_buf().await?;
+            if buf.is_empty() {
+                // The last line may end without a newline
+                if !read_any {
+                    return Ok(None);
+                }
+                break;
+            }
+            read_any = true;
+
+            let (chunk, complete) = match buf.iter().position(|&b| b == b'\n') {
+                Some(end) => (&buf[..=end], true),
+                None => (buf, false),
+            };
+            if !too_many {
+                if max_args > 0 && args.feed(chunk) > max_args {
+                    too_many = true;
+                    line = Vec::new();
+                } else {
+                    line.extend_from_slice(chunk);
+                }
+            }
+            let len = chunk.len();
+            reader.consume(len);
+            if complete {
+                break;
+            }
         }
 
-        info!("Connection closed: {}", addr);
-        Ok(())
+        if too_many {
+            return Ok(Some(RequestLine::TooManyArgs));
+        }
+        // A bad line is answered with an error rather than dropping the
+        // connection, so the client can tell what went wrong
+        Ok(Some(String::from_utf8(line)
+            .map(RequestLine::Line)
+            .unwrap_or(RequestLine::InvalidUtf8)))
     }
-}
\ No newline at end of file
+
+    /// Execute a single parsed request line, timing it if the session has
+    /// timing on once it completes. A write refused for going over the key
+    /// limit is recorded in the audit log under `command`.
+    async fn execute(parsed: Result<Request>, command: Option<&str>, executor: &CommandExecutor, session: &mut Session) -> Timed {
+        let start = Instant::now();
+        let response = match parsed {
+            Ok(request) => {
+                match executor.execute_in(session, request).await {
+                    Ok(resp) => resp,
+                    Err(e) => {
+                        let response = Response::error(&e);
+                        if let (DiskDBError::KeyLimitExceeded(_), Some(client), Response::Error(reason)) = (&e, &session.client, &response) {
+                            executor.audit_log().record(client.addr(), command, reason);
+                        }
+                        response
+                    }
+                }
+            }
+            Err(e) => Response::error(&e),
+        };
+        Timed { response, elapsed: session.timing.then(|| start.elapsed()) }
+    }
+
+    /// Encode a reply in the format selected by the session. A timed
+    /// framed reply is preceded by a RESP3 style attribute holding the
+    /// execution time, `|1 +server_time_us :<microseconds>`; a timed line
+    /// reply is followed by a line giving it.
+    fn encode(reply: &Timed, session: &Session) -> String {
+        let micros = reply.elapsed.map(|elapsed| elapsed.as_micros());
+        match (session.framed, micros) {
+            (true, Some(micros)) => format!("|1\r\n+server_time_us\r\n:{}\r\n{}", micros, reply.response.to_framed()),
+            (true, None) => reply.response.to_framed(),
+            (false, Some(micros)) => format!("{}(server time {} us)\n", reply.response, micros),
+            (false, None) => reply.response.to_string(),
+        }
+    }
+}
+
+/// Name of the command on a request line, for the audit log.
+fn command_name(line: &str) -> Option<&str> {
+    line.split_whitespace().next()
+}
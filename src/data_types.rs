@@ -1,7 +1,11 @@
+use crate::hyperloglog::HyperLogLog;
 use serde::{Deserialize, Serialize, Deserializer, Serializer};
 use std::collections::{HashMap, HashSet, BTreeMap};
 use std::time::SystemTime;
 
+/// The error an operation on the wrong kind of value fails with.
+pub const WRONGTYPE: &str = "WRONGTYPE Operation against a key holding the wrong kind of value";
+
 #[derive(Debug, Clone)]
 pub enum DataType {
     String(String),
@@ -11,6 +15,8 @@ pub enum DataType {
     SortedSet(BTreeMap<String, f64>), // member -> score
     Json(serde_json::Value),
     Stream(Vec<StreamEntry>),
+    Bitmap(Vec<u8>), // bit 0 is the most significant bit of the first byte
+    HyperLogLog(HyperLogLog),
 }
 
 // Custom serialization to handle JSON values
@@ -28,6 +34,8 @@ impl Serialize for DataType {
             SortedSet(BTreeMap<String, f64>),
             Json(String), // Store JSON as string
             Stream(Vec<StreamEntry>),
+            Bitmap(Vec<u8>),
+            HyperLogLog(HyperLogLog),
         }
         
         let repr = match self {
@@ -38,6 +46,8 @@ impl Serialize for DataType {
             DataType::SortedSet(z) => DataTypeRepr::SortedSet(z.clone()),
             DataType::Json(j) => DataTypeRepr::Json(j.to_string()),
             DataType::Stream(s) => DataTypeRepr::Stream(s.clone()),
+            DataType::Bitmap(b) => DataTypeRepr::Bitmap(b.clone()),
+            DataType::HyperLogLog(h) => DataTypeRepr::HyperLogLog(h.clone()),
         };
         
         repr.serialize(serializer)
@@ -58,6 +68,8 @@ impl<'de> Deserialize<'de> for DataType {
             SortedSet(BTreeMap<String, f64>),
             Json(String), // JSON stored as string
             Stream(Vec<StreamEntry>),
+            Bitmap(Vec<u8>),
+            HyperLogLog(HyperLogLog),
         }
         
         let repr = DataTypeRepr::deserialize(deserializer)?;
@@ -74,6 +86,8 @@ impl<'de> Deserialize<'de> for DataType {
                 DataType::Json(value)
             },
             DataTypeRepr::Stream(s) => DataType::Stream(s),
+            DataTypeRepr::Bitmap(b) => DataType::Bitmap(b),
+            DataTypeRepr::HyperLogLog(h) => DataType::HyperLogLog(h),
         })
     }
 }
@@ -95,6 +109,72 @@ impl DataType {
             DataType::SortedSet(_) => "zset",
             DataType::Json(_) => "json",
             DataType::Stream(_) => "stream",
+            DataType::Bitmap(_) => "bitmap",
+            DataType::HyperLogLog(_) => "hyperloglog",
+        }
+    }
+
+    /// How the value is represented in memory, as reported by DEBUG
+    /// OBJECT. Strings holding an integer are reported as `int` since INCR
+    /// and friends operate on them.
+    pub fn encoding(&self) -> &'static str {
+        match self {
+            DataType::String(s) if s.parse::<i64>().is_ok() => "int",
+            DataType::String(_) | DataType::Bitmap(_) => "raw",
+            DataType::List(_) | DataType::Stream(_) => "vector",
+            DataType::Set(_) | DataType::Hash(_) => "hashtable",
+            DataType::SortedSet(_) => "btree",
+            DataType::Json(_) => "json",
+            DataType::HyperLogLog(_) => "dense",
+        }
+    }
+
+    /// The measure BIGKEYS ranks keys of this type by: the length in bytes
+    /// of strings, bitmaps, HyperLogLogs and serialized JSON documents,
+    /// and the number of elements of everything else.
+    pub fn size(&self) -> usize {
+        match self {
+            DataType::String(s) => s.len(),
+            DataType::List(l) => l.len(),
+            DataType::Set(s) => s.len(),
+            DataType::Hash(h) => h.len(),
+            DataType::SortedSet(z) => z.len(),
+            DataType::Json(v) => v.to_string().len(),
+            DataType::Stream(entries) => entries.len(),
+            DataType::Bitmap(b) => b.len(),
+            DataType::HyperLogLog(h) => h.as_bytes().len(),
+        }
+    }
+
+    /// Rough number of bytes the value occupies in memory, including
+    /// everything it owns. Collection overhead is approximated per entry.
+    pub fn memory_usage(&self) -> usize {
+        use std::mem::size_of;
+        // Per-entry bookkeeping of the hash and tree based collections
+        const ENTRY_OVERHEAD: usize = 16;
+        let string = |s: &String| size_of::<String>() + s.capacity();
+        let fields = |h: &HashMap<String, String>| {
+            h.iter().map(|(f, v)| string(f) + string(v) + ENTRY_OVERHEAD).sum::<usize>()
+        };
+
+        size_of::<DataType>() + match self {
+            DataType::String(s) => s.capacity(),
+            DataType::List(l) => {
+                (l.capacity() - l.len()) * size_of::<String>() + l.iter().map(string).sum::<usize>()
+            }
+            DataType::Set(s) => s.iter().map(|m| string(m) + ENTRY_OVERHEAD).sum(),
+            DataType::Hash(h) => fields(h),
+            DataType::SortedSet(z) => {
+                z.keys().map(|m| string(m) + size_of::<f64>() + ENTRY_OVERHEAD).sum()
+            }
+            // Documents are a tree of small allocations; their serialized
+            // length is a fair proxy
+            DataType::Json(v) => v.to_string().len(),
+            DataType::Stream(entries) => entries.iter()
+                .map(|e| size_of::<StreamEntry>() + e.id.capacity() + fields(&e.fields))
+                .sum(),
+            DataType::Bitmap(b) => b.capacity(),
+            DataType::HyperLogLog(h) => h.as_bytes().len(),
         }
     }
 }
@@ -123,7 +203,7 @@ impl DataType {
                 *s = new_val.to_string();
                 Ok(new_val)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
@@ -153,7 +233,7 @@ impl DataType {
                 }
                 Ok(l.len())
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -163,43 +243,60 @@ impl DataType {
                 l.extend(values);
                 Ok(l.len())
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn lpop(&mut self) -> Result<Option<String>, String> {
         match self {
             DataType::List(l) => Ok(if l.is_empty() { None } else { Some(l.remove(0)) }),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn rpop(&mut self) -> Result<Option<String>, String> {
         match self {
             DataType::List(l) => Ok(l.pop()),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn lrange(&self, start: i64, stop: i64) -> Result<Vec<String>, String> {
+        match self {
+            DataType::List(l) => Ok(l[list_range(l.len(), start, stop)].to_vec()),
+            _ => Err(WRONGTYPE.to_string()),
+        }
+    }
+
+    /// Keep only the elements between start and stop (inclusive), discarding
+    /// the rest. Returns the new length.
+    pub fn ltrim(&mut self, start: i64, stop: i64) -> Result<usize, String> {
         match self {
             DataType::List(l) => {
-                let len = l.len() as i64;
-                let start = if start < 0 { (len + start).max(0) } else { start } as usize;
-                let stop = if stop < 0 { (len + stop + 1).max(0) } else { stop + 1 } as usize;
-                let stop = stop.min(l.len());
-                
-                if start >= l.len() {
-                    Ok(vec![])
-                } else {
-                    Ok(l[start..stop].to_vec())
-                }
+                let range = list_range(l.len(), start, stop);
+                l.truncate(range.end);
+                l.drain(..range.start);
+                Ok(l.len())
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
 
+/// Resolve inclusive list indices, where negative values count from the end,
+/// to a slice range. Out of bounds indices are clamped and an empty or
+/// inverted range resolves to an empty one.
+fn list_range(len: usize, start: i64, stop: i64) -> std::ops::Range<usize> {
+    let len_i = len as i64;
+    let start = if start < 0 { (len_i + start).max(0) } else { start.min(len_i) } as usize;
+    let stop = if stop < 0 { (len_i + stop + 1).max(0) } else { stop.saturating_add(1).min(len_i) } as usize;
+    if start >= stop {
+        0..0
+    } else {
+        start..stop
+    }
+}
+
 // Set operations
 impl DataType {
     pub fn as_set(&self) -> Option<&HashSet<String>> {
@@ -227,7 +324,7 @@ impl DataType {
                 }
                 Ok(added)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -242,14 +339,14 @@ impl DataType {
                 }
                 Ok(removed)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn sismember(&self, member: &str) -> Result<bool, String> {
         match self {
             DataType::Set(s) => Ok(s.contains(member)),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
@@ -277,14 +374,14 @@ impl DataType {
                 h.insert(field, value);
                 Ok(is_new)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn hget(&self, field: &str) -> Result<Option<String>, String> {
         match self {
             DataType::Hash(h) => Ok(h.get(field).cloned()),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -299,7 +396,7 @@ impl DataType {
                 }
                 Ok(deleted)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
@@ -332,7 +429,7 @@ impl DataType {
                 }
                 Ok(added)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -347,14 +444,34 @@ impl DataType {
                 }
                 Ok(removed)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
+        }
+    }
+
+    /// Remove the members ranked `start` to `stop` by score, both inclusive
+    /// and counted as in `zrange`, so negative ranks count from the highest
+    /// score.
+    pub fn zremrange_by_rank(&mut self, start: i64, stop: i64) -> Result<usize, String> {
+        let members = self.zrange(start, stop, false)?;
+        self.zrem(members.into_iter().map(|(member, _)| member).collect())
+    }
+
+    /// Remove the members scored between `min` and `max`, both inclusive.
+    pub fn zremrange_by_score(&mut self, min: f64, max: f64) -> Result<usize, String> {
+        match self {
+            DataType::SortedSet(z) => {
+                let before = z.len();
+                z.retain(|_, score| *score < min || *score > max);
+                Ok(before - z.len())
+            }
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn zscore(&self, member: &str) -> Result<Option<f64>, String> {
         match self {
             DataType::SortedSet(z) => Ok(z.get(member).copied()),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -380,7 +497,7 @@ impl DataType {
                         .collect())
                 }
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
@@ -412,7 +529,7 @@ impl DataType {
                     Err("Complex JSON paths not yet implemented".to_string())
                 }
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -426,7 +543,7 @@ impl DataType {
                     Err("Complex JSON paths not yet implemented".to_string())
                 }
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 }
@@ -467,7 +584,7 @@ impl DataType {
                 s.push(entry);
                 Ok(id)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
@@ -485,14 +602,70 @@ impl DataType {
                 
                 Ok(result)
             }
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
 
     pub fn xlen(&self) -> Result<usize, String> {
         match self {
             DataType::Stream(s) => Ok(s.len()),
-            _ => Err("Operation not supported on this type".to_string()),
+            _ => Err(WRONGTYPE.to_string()),
+        }
+    }
+}
+// Bitmap operations
+impl DataType {
+    /// Set the bit at `offset` and return its previous value, growing the
+    /// bitmap with zero bytes as needed.
+    pub fn setbit(&mut self, offset: u64, value: bool) -> Result<bool, String> {
+        match self {
+            DataType::Bitmap(bytes) => {
+                let byte = (offset / 8) as usize;
+                let mask = 0x80u8 >> (offset % 8);
+                if byte >= bytes.len() {
+                    bytes.resize(byte + 1, 0);
+                }
+                let old = bytes[byte] & mask != 0;
+                if value {
+                    bytes[byte] |= mask;
+                } else {
+                    bytes[byte] &= !mask;
+                }
+                Ok(old)
+            }
+            _ => Err(WRONGTYPE.to_string()),
+        }
+    }
+
+    /// The bit at `offset`; bits past the end of the bitmap are 0.
+    pub fn getbit(&self, offset: u64) -> Result<bool, String> {
+        match self {
+            DataType::Bitmap(bytes) => Ok(bytes
+                .get((offset / 8) as usize)
+                .is_some_and(|b| b & (0x80u8 >> (offset % 8)) != 0)),
+            _ => Err(WRONGTYPE.to_string()),
         }
     }
-}
\ No newline at end of file
+
+    /// Number of set bits in the bytes from `start` to `end`, both
+    /// inclusive and counted from the end when negative, or in the whole
+    /// bitmap without a range.
+    pub fn bitcount(&self, range: Option<(i64, i64)>) -> Result<u64, String> {
+        match self {
+            DataType::Bitmap(bytes) => {
+                let len = bytes.len() as i64;
+                let (start, end) = range.unwrap_or((0, -1));
+                let start = if start < 0 { (len + start).max(0) } else { start };
+                let end = if end < 0 { len + end } else { end.min(len - 1) };
+                if start > end {
+                    return Ok(0);
+                }
+                Ok(bytes[start as usize..=end as usize]
+                    .iter()
+                    .map(|b| b.count_ones() as u64)
+                    .sum())
+            }
+            _ => Err(WRONGTYPE.to_string()),
+        }
+    }
+}
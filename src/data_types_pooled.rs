@@ -1,5 +1,7 @@
 use crate::data_types::{DataType, StreamEntry};
 use crate::error::Result;
+#[cfg(feature = "memory_pool")]
+use crate::hyperloglog::HyperLogLog;
 use std::collections::{HashMap, HashSet, BTreeMap};
 
 #[cfg(feature = "memory_pool")]
@@ -27,6 +29,8 @@ pub enum PooledDataType {
     SortedSet(BTreeMap<PooledString, f64>),
     Json(PooledBox<serde_json::Value>),
     Stream(PooledVec<PooledStreamEntry>),
+    Bitmap(Vec<u8>),
+    HyperLogLog(HyperLogLog),
 }
 
 #[cfg(feature = "memory_pool")]
@@ -99,6 +103,8 @@ impl PooledDataType {
                 }
                 Ok(PooledDataType::Stream(pooled_stream))
             }
+            DataType::Bitmap(bytes) => Ok(PooledDataType::Bitmap(bytes)),
+            DataType::HyperLogLog(hll) => Ok(PooledDataType::HyperLogLog(hll)),
         }
     }
     
@@ -152,6 +158,8 @@ impl PooledDataType {
                 }
                 DataType::Stream(regular_stream)
             }
+            PooledDataType::Bitmap(bytes) => DataType::Bitmap(bytes),
+            PooledDataType::HyperLogLog(hll) => DataType::HyperLogLog(hll),
         }
     }
 }
@@ -0,0 +1,58 @@
+use crate::data_types::DataType;
+use crate::error::{DiskDBError, Result};
+use sha2::{Digest, Sha256};
+
+/// Version of the DUMP payload layout. Bump it whenever the layout or the
+/// encoding of the value changes.
+const DUMP_VERSION: u8 = 1;
+
+const CHECKSUM_LEN: usize = 8;
+
+/// Serialize a value for DUMP.
+///
+/// The payload is `version | value | checksum`, where the value is the JSON
+/// encoding of the data type and the checksum is the first 8 bytes of the
+/// SHA-256 of everything before it. It is sent hex encoded so it survives
+/// the line protocol.
+pub fn dump(value: &DataType) -> Result<String> {
+    let mut payload = vec![DUMP_VERSION];
+    serde_json::to_writer(&mut payload, value)
+        .map_err(|e| DiskDBError::Database(format!("Failed to serialize value: {}", e)))?;
+    let checksum = Sha256::digest(&payload);
+    payload.extend_from_slice(&checksum[..CHECKSUM_LEN]);
+    Ok(to_hex(&payload))
+}
+
+/// Decode a DUMP payload. Returns `None` if it was produced by an unknown
+/// version or altered in transit.
+pub fn restore(encoded: &str) -> Option<DataType> {
+    let payload = from_hex(encoded)?;
+    if payload.len() < 1 + CHECKSUM_LEN {
+        return None;
+    }
+    let (body, checksum) = payload.split_at(payload.len() - CHECKSUM_LEN);
+    if body[0] != DUMP_VERSION || Sha256::digest(body)[..CHECKSUM_LEN] != *checksum {
+        return None;
+    }
+    serde_json::from_slice(&body[1..]).ok()
+}
+
+pub(crate) fn to_hex(bytes: &[u8]) -> String {
+    const DIGITS: &[u8; 16] = b"0123456789abcdef";
+    let mut out = String::with_capacity(bytes.len() * 2);
+    for b in bytes {
+        out.push(DIGITS[(b >> 4) as usize] as char);
+        out.push(DIGITS[(b & 0x0f) as usize] as char);
+    }
+    out
+}
+
+pub(crate) fn from_hex(s: &str) -> Option<Vec<u8>> {
+    if s.len() % 2 != 0 {
+        return None;
+    }
+    (0..s.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(s.get(i..i + 2)?, 16).ok())
+        .collect()
+}
@@ -0,0 +1,102 @@
+use crate::commands::{CommandExecutor, Session};
+use crate::config::Config;
+use crate::error::{DiskDBError, Result};
+use crate::functions::UpdateFn;
+use crate::protocol::{Request, Response};
+use crate::stats::ServerStats;
+use crate::storage::{Storage, StorageFactory};
+use std::sync::Arc;
+
+/// A DiskDB store used from within the same process, without a server or a
+/// socket. Commands run through the same `CommandExecutor` as the network
+/// server, so they behave exactly as they would for a client; only the
+/// connection and the text protocol are skipped.
+///
+/// Like a client connection, an `Embedded` has its own selected database.
+/// Publishing works, but subscribing needs a connection to deliver
+/// messages to and is refused.
+pub struct Embedded {
+    executor: CommandExecutor,
+    session: Session,
+    databases: usize,
+}
+
+impl Embedded {
+    /// Open a store on `storage` set up as `config` describes. Only the
+    /// settings that apply to command execution are used.
+    pub fn new(config: &Config, storage: Arc<dyn Storage>) -> Self {
+        let stats = Arc::new(ServerStats::new(config.max_connections)
+            .with_key_prefixes(config.key_stats_prefixes.clone()));
+        Self {
+            executor: CommandExecutor::from_config(config, storage, stats),
+            session: Session::default(),
+            databases: config.databases,
+        }
+    }
+
+    /// Enable the configured number of databases, opening each one other
+    /// than 0 with `factory` the first time it is selected.
+    pub fn with_database_factory(self, factory: StorageFactory) -> Self {
+        Self {
+            executor: self.executor.with_databases(self.databases, factory),
+            ..self
+        }
+    }
+
+    /// Make `function` callable with INVOKE as `name`, alongside the
+    /// built-in functions.
+    pub fn with_function(self, name: &str, function: UpdateFn) -> Self {
+        Self {
+            executor: self.executor.with_function(name, function),
+            ..self
+        }
+    }
+
+    /// Push the values of expired keys set with `DEADLETTER` onto their
+    /// lists, returning how many were pushed. The server does this every
+    /// `DEAD_LETTER_INTERVAL`; embedded stores do it when this is called.
+    pub async fn deliver_dead_letters(&self) -> Result<usize> {
+        self.executor.deliver_dead_letters().await
+    }
+
+    /// Execute a request and return the reply the server would send.
+    pub async fn execute(&mut self, request: Request) -> Result<Response> {
+        self.executor.execute_in(&mut self.session, request).await
+    }
+
+    /// Parse and execute a command line written as it would be sent to the
+    /// server, such as `SET greeting "hello world"`.
+    pub async fn command(&mut self, line: &str) -> Result<Response> {
+        self.execute(Request::parse(line)?).await
+    }
+
+    /// Value of a string key, or `None` if it does not exist.
+    pub async fn get(&mut self, key: &str) -> Result<Option<String>> {
+        match self.reply(Request::Get { key: key.to_string() }).await? {
+            Response::String(value) => Ok(value),
+            _ => Ok(None),
+        }
+    }
+
+    pub async fn set(&mut self, key: &str, value: &str) -> Result<()> {
+        self.reply(Request::Set { key: key.to_string(), value: value.to_string() }).await?;
+        Ok(())
+    }
+
+    /// Delete `keys`, returning how many existed.
+    pub async fn del(&mut self, keys: &[&str]) -> Result<i64> {
+        let keys = keys.iter().map(|key| key.to_string()).collect();
+        match self.reply(Request::Del { keys }).await? {
+            Response::Integer(deleted) => Ok(deleted),
+            other => Err(DiskDBError::Database(format!("Unexpected reply to DEL: {:?}", other))),
+        }
+    }
+
+    /// Execute a request, turning an error reply into an error.
+    async fn reply(&mut self, request: Request) -> Result<Response> {
+        match self.execute(request).await? {
+            Response::Error(msg) => Err(DiskDBError::Database(msg)),
+            response => Ok(response),
+        }
+    }
+}
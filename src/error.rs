@@ -11,6 +11,9 @@ pub enum DiskDBError {
     KeyNotFound(String),
     ConnectionClosed,
     Config(String),
+    /// A write would create a key in a database already holding its
+    /// maximum number of keys
+    KeyLimitExceeded(u64),
 }
 
 impl fmt::Display for DiskDBError {
@@ -24,6 +27,7 @@ impl fmt::Display for DiskDBError {
             DiskDBError::KeyNotFound(key) => write!(f, "Key not found: {}", key),
             DiskDBError::ConnectionClosed => write!(f, "Connection closed"),
             DiskDBError::Config(msg) => write!(f, "Configuration error: {}", msg),
+            DiskDBError::KeyLimitExceeded(max) => write!(f, "Key limit exceeded: the database holds at most {} keys", max),
         }
     }
 }
@@ -0,0 +1,138 @@
+use crate::data_types::DataType;
+use crate::storage::changes::{Change, ChangeOp};
+use serde_json::{json, Map, Value};
+
+/// Render one key as a line of newline-delimited JSON for EXPORT:
+/// `{"key":...,"type":...,"value":...,"ttl":...}`, without the newline.
+///
+/// The value is shaped after its type: a string, an array for lists and
+/// sets, an object for hashes, `[{"member","score"}]` for sorted sets,
+/// `[{"id","fields"}]` for streams, the document itself for JSON and the
+/// bytes as a string for bitmaps and HyperLogLogs (their registers). `ttl`
+/// is the remaining time to live in seconds, or null without expiry.
+///
+/// If any string in the value holds control characters other than tab,
+/// newline and carriage return, every string in it is base64 encoded
+/// instead and the record carries `"encoding":"base64"`. Bitmaps and
+/// HyperLogLogs are always encoded so.
+pub fn record(key: &str, value: &DataType, ttl: Option<i64>) -> String {
+    let (rendered, binary) = render(value);
+
+    // Written out by hand to keep the fields in the documented order
+    let mut record = format!(
+        "{{\"key\":{},\"type\":\"{}\",\"value\":{},\"ttl\":{}",
+        Value::from(key),
+        value.type_name(),
+        rendered,
+        ttl.map_or(Value::Null, Value::from),
+    );
+    if binary {
+        record.push_str(",\"encoding\":\"base64\"");
+    }
+    record.push('}');
+    record
+}
+
+/// Render one change log entry as a line of JSON for CHANGES, without the
+/// newline: `{"offset":...,"op":...,"key":...}` followed by `"type"` and
+/// `"value"` (shaped as in `record`, `"encoding"` included) for a `set`, or
+/// `"expires_at"` in milliseconds since the epoch, null once removed, for
+/// an `expire`. A `del` has nothing more.
+pub fn change(change: &Change) -> String {
+    let mut record = format!(
+        "{{\"offset\":{},\"op\":\"{}\",\"key\":{}",
+        change.offset,
+        change.op.name(),
+        Value::from(change.key.as_str()),
+    );
+    match &change.op {
+        ChangeOp::Set(value) => {
+            let (rendered, binary) = render(value);
+            record.push_str(&format!(",\"type\":\"{}\",\"value\":{}", value.type_name(), rendered));
+            if binary {
+                record.push_str(",\"encoding\":\"base64\"");
+            }
+        }
+        ChangeOp::Delete => {}
+        ChangeOp::Expire(at_ms) => {
+            record.push_str(&format!(",\"expires_at\":{}", at_ms.map_or(Value::Null, Value::from)));
+        }
+    }
+    record.push('}');
+    record
+}
+
+/// `value` as JSON, and whether its strings had to be base64 encoded
+fn render(value: &DataType) -> (Value, bool) {
+    let binary = matches!(value, DataType::Bitmap(_) | DataType::HyperLogLog(_))
+        || strings(value).any(|s| is_binary(s));
+    let encode = |s: &str| if binary { base64(s.as_bytes()) } else { s.to_string() };
+    let text = |s: &String| Value::String(encode(s));
+
+    let rendered = match value {
+        DataType::String(s) => text(s),
+        DataType::List(items) => items.iter().map(text).collect(),
+        DataType::Set(members) => {
+            let mut members: Vec<&String> = members.iter().collect();
+            members.sort();
+            members.into_iter().map(text).collect()
+        }
+        DataType::Hash(fields) => Value::Object(hash_object(fields.iter(), &encode)),
+        DataType::SortedSet(members) => {
+            let mut members: Vec<(&String, &f64)> = members.iter().collect();
+            members.sort_by(|a, b| a.1.total_cmp(b.1).then_with(|| a.0.cmp(b.0)));
+            members.into_iter()
+                .map(|(member, score)| json!({ "member": text(member), "score": score }))
+                .collect()
+        }
+        DataType::Json(doc) => doc.clone(),
+        DataType::Stream(entries) => entries.iter()
+            .map(|entry| json!({ "id": entry.id, "fields": hash_object(entry.fields.iter(), &encode) }))
+            .collect(),
+        DataType::Bitmap(bytes) => Value::String(base64(bytes)),
+        DataType::HyperLogLog(hll) => Value::String(base64(hll.as_bytes())),
+    };
+    (rendered, binary)
+}
+
+fn hash_object<'a>(
+    fields: impl Iterator<Item = (&'a String, &'a String)>,
+    encode: &impl Fn(&str) -> String,
+) -> Map<String, Value> {
+    fields.map(|(field, value)| (encode(field), Value::String(encode(value)))).collect()
+}
+
+/// Every user-supplied string in a value. JSON documents are exported
+/// unchanged, so their strings are left out.
+fn strings(value: &DataType) -> Box<dyn Iterator<Item = &String> + '_> {
+    match value {
+        DataType::String(s) => Box::new(std::iter::once(s)),
+        DataType::List(items) => Box::new(items.iter()),
+        DataType::Set(members) => Box::new(members.iter()),
+        DataType::Hash(fields) => Box::new(fields.iter().flat_map(|(f, v)| [f, v])),
+        DataType::SortedSet(members) => Box::new(members.keys()),
+        DataType::Json(_) | DataType::Bitmap(_) | DataType::HyperLogLog(_) => Box::new(std::iter::empty()),
+        DataType::Stream(entries) => Box::new(entries.iter()
+            .flat_map(|entry| entry.fields.iter().flat_map(|(f, v)| [f, v]))),
+    }
+}
+
+fn is_binary(s: &str) -> bool {
+    s.chars().any(|c| c.is_control() && !matches!(c, '\t' | '\n' | '\r'))
+}
+
+fn base64(bytes: &[u8]) -> String {
+    const ALPHABET: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    let mut out = String::with_capacity(bytes.len().div_ceil(3) * 4);
+    for chunk in bytes.chunks(3) {
+        let n = chunk.iter().enumerate().fold(0u32, |n, (i, &b)| n | (b as u32) << (16 - 8 * i));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                out.push(ALPHABET[(n >> (18 - 6 * i) & 0x3f) as usize] as char);
+            } else {
+                out.push('=');
+            }
+        }
+    }
+    out
+}
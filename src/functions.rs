@@ -0,0 +1,138 @@
+use crate::data_types::{DataType, WRONGTYPE};
+use crate::protocol::Response;
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// What an update function does to its key.
+#[derive(Debug)]
+pub struct Update {
+    /// The key's new value, or `None` to leave the key as it is
+    pub value: Option<DataType>,
+    /// Reply to the INVOKE
+    pub reply: Response,
+}
+
+/// A read-modify-write step INVOKE runs on one key, with no other write
+/// in between: given the key's current value, if it exists, and the
+/// caller's arguments, it returns the update to apply, or the error reply
+/// to send instead, leaving the key untouched.
+pub type UpdateFn = Arc<dyn Fn(Option<DataType>, &[String]) -> Result<Update, String> + Send + Sync>;
+
+/// The functions INVOKE can call, by name. It starts with the built-in
+/// ones:
+///
+/// - `clamp min max [delta]` adds `delta` (0 if left out) to the integer at
+///   the key, a missing key counting as 0, and keeps the result within
+///   `min..=max`. Replies with the new value.
+/// - `merge-json patch` applies `patch` to the JSON document at the key as
+///   a JSON merge patch (RFC 7386), a missing key counting as null.
+///   Replies with the merged document.
+/// - `cap-list max [value ...]` appends the values to the list at the key
+///   and drops its oldest items beyond `max`. Replies with the new length.
+#[derive(Clone)]
+pub struct Functions {
+    functions: HashMap<String, UpdateFn>,
+}
+
+impl Default for Functions {
+    fn default() -> Self {
+        let mut functions = Self { functions: HashMap::new() };
+        functions.register("clamp", Arc::new(clamp));
+        functions.register("merge-json", Arc::new(merge_json));
+        functions.register("cap-list", Arc::new(cap_list));
+        functions
+    }
+}
+
+impl Functions {
+    /// Make `function` callable as `name`, which is matched ignoring case,
+    /// replacing any function of that name.
+    pub fn register(&mut self, name: &str, function: UpdateFn) {
+        self.functions.insert(name.to_lowercase(), function);
+    }
+
+    pub fn get(&self, name: &str) -> Option<UpdateFn> {
+        self.functions.get(&name.to_lowercase()).cloned()
+    }
+}
+
+fn clamp(current: Option<DataType>, args: &[String]) -> Result<Update, String> {
+    let parse = |arg: &String| arg.parse::<i64>().map_err(|_| "ERR clamp arguments must be integers".to_string());
+    let (min, max, delta) = match args {
+        [min, max] => (parse(min)?, parse(max)?, 0),
+        [min, max, delta] => (parse(min)?, parse(max)?, parse(delta)?),
+        _ => return Err("ERR clamp takes min, max and optionally a delta".to_string()),
+    };
+    if min > max {
+        return Err("ERR clamp min is greater than max".to_string());
+    }
+    let value = match current {
+        Some(DataType::String(s)) => s.parse::<i64>().map_err(|_| "ERR value is not an integer".to_string())?,
+        Some(_) => return Err(WRONGTYPE.to_string()),
+        None => 0,
+    };
+    let value = value.saturating_add(delta).clamp(min, max);
+    Ok(Update {
+        value: Some(DataType::String(value.to_string())),
+        reply: Response::Integer(value),
+    })
+}
+
+fn merge_json(current: Option<DataType>, args: &[String]) -> Result<Update, String> {
+    let patch: serde_json::Value = match args {
+        [patch] => serde_json::from_str(patch).map_err(|e| format!("ERR invalid JSON: {}", e))?,
+        _ => return Err("ERR merge-json takes exactly one patch".to_string()),
+    };
+    let mut document = match current {
+        Some(DataType::Json(document)) => document,
+        Some(_) => return Err(WRONGTYPE.to_string()),
+        None => serde_json::Value::Null,
+    };
+    merge_patch(&mut document, patch);
+    let reply = Response::String(Some(document.to_string()));
+    Ok(Update { value: Some(DataType::Json(document)), reply })
+}
+
+/// Apply `patch` to `target` as RFC 7386 describes: objects are merged
+/// member by member, a null member removes the member, and anything else
+/// replaces the target.
+fn merge_patch(target: &mut serde_json::Value, patch: serde_json::Value) {
+    let serde_json::Value::Object(members) = patch else {
+        *target = patch;
+        return;
+    };
+    if !target.is_object() {
+        *target = serde_json::Value::Object(serde_json::Map::new());
+    }
+    let object = target.as_object_mut().expect("target was made an object");
+    for (name, value) in members {
+        if value.is_null() {
+            object.remove(&name);
+        } else {
+            merge_patch(object.entry(name).or_insert(serde_json::Value::Null), value);
+        }
+    }
+}
+
+fn cap_list(current: Option<DataType>, args: &[String]) -> Result<Update, String> {
+    let (max, values) = match args.split_first() {
+        Some((max, values)) => match max.parse::<usize>() {
+            Ok(max) if max > 0 => (max, values),
+            _ => return Err("ERR cap-list max must be a positive integer".to_string()),
+        },
+        None => return Err("ERR cap-list takes max and the values to append".to_string()),
+    };
+    let mut list = match current {
+        Some(DataType::List(list)) => list,
+        Some(_) => return Err(WRONGTYPE.to_string()),
+        None => Vec::new(),
+    };
+    list.extend_from_slice(values);
+    if list.len() > max {
+        list.drain(..list.len() - max);
+    }
+    let reply = Response::Integer(list.len() as i64);
+    // An empty list is not stored, as with the list commands
+    let value = if list.is_empty() { None } else { Some(DataType::List(list)) };
+    Ok(Update { value, reply })
+}
@@ -0,0 +1,85 @@
+/// Match `text` against a glob-style `pattern`, as used by SCAN's MATCH
+/// option.
+///
+/// `*` matches any run of characters, `?` any single character and
+/// `[...]` one character from a set, which may contain ranges (`a-z`) and
+/// be negated with a leading `^`. A backslash makes the next character
+/// literal.
+pub fn glob_match(pattern: &str, text: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let text: Vec<char> = text.chars().collect();
+    match_from(&pattern, &text)
+}
+
+fn match_from(pattern: &[char], text: &[char]) -> bool {
+    let (mut p, mut t) = (0, 0);
+    // Where to resume after the last `*` if the rest fails to match
+    let mut backtrack: Option<(usize, usize)> = None;
+
+    while t < text.len() {
+        let step = match pattern.get(p) {
+            Some('*') => {
+                backtrack = Some((p, t));
+                p += 1;
+                continue;
+            }
+            Some('?') => Some(p + 1),
+            Some('[') => match_class(&pattern[p..], text[t]).map(|len| p + len),
+            Some('\\') if p + 1 < pattern.len() => (pattern[p + 1] == text[t]).then_some(p + 2),
+            Some(&c) => (c == text[t]).then_some(p + 1),
+            None => None,
+        };
+
+        match step {
+            Some(next) => {
+                p = next;
+                t += 1;
+            }
+            None => match backtrack {
+                // Let the last `*` swallow one more character
+                Some((star, from)) => {
+                    p = star + 1;
+                    t = from + 1;
+                    backtrack = Some((star, from + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+
+    pattern[p..].iter().all(|&c| c == '*')
+}
+
+/// Match `c` against the character class at the start of `pattern`,
+/// returning the length of the class if it matches.
+fn match_class(pattern: &[char], c: char) -> Option<usize> {
+    let mut i = 1;
+    let negate = pattern.get(i) == Some(&'^');
+    if negate {
+        i += 1;
+    }
+
+    let mut matched = false;
+    while i < pattern.len() && pattern[i] != ']' {
+        let mut lo = pattern[i];
+        if lo == '\\' && i + 1 < pattern.len() {
+            i += 1;
+            lo = pattern[i];
+        }
+        if pattern.get(i + 1) == Some(&'-') && i + 2 < pattern.len() && pattern[i + 2] != ']' {
+            let hi = pattern[i + 2];
+            let (lo, hi) = if lo <= hi { (lo, hi) } else { (hi, lo) };
+            matched |= lo <= c && c <= hi;
+            i += 3;
+        } else {
+            matched |= lo == c;
+            i += 1;
+        }
+    }
+
+    // An unterminated class is taken literally
+    if i >= pattern.len() {
+        return (c == '[').then_some(1);
+    }
+    (matched != negate).then_some(i + 1)
+}
@@ -0,0 +1,187 @@
+use serde::{Deserialize, Serialize};
+
+/// Bits of the hash that select a register
+const P: u32 = 14;
+/// Number of registers, for a standard error of 1.04 / sqrt(16384) = 0.81%
+const REGISTERS: usize = 1 << P;
+const REGISTER_BITS: usize = 6;
+/// Largest value a register takes: the position of the first set bit in the
+/// 64 - P hash bits left after the register index
+const MAX_RANK: u8 = (64 - P + 1) as u8;
+/// Bytes of the packed registers, the same for every HyperLogLog
+pub const SIZE: usize = REGISTERS * REGISTER_BITS / 8;
+
+/// A HyperLogLog sketch for PFADD, PFCOUNT and PFMERGE: an estimate of the
+/// number of distinct elements added to it, in a fixed 12KB.
+///
+/// The registers are packed six bits each, register `i` starting at bit
+/// `6 * i` counted from the least significant bit of the first byte.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "Vec<u8>", into = "Vec<u8>")]
+pub struct HyperLogLog {
+    registers: Vec<u8>,
+}
+
+impl Default for HyperLogLog {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl HyperLogLog {
+    /// An empty sketch, estimating 0.
+    pub fn new() -> Self {
+        Self { registers: vec![0; SIZE] }
+    }
+
+    /// The packed registers.
+    pub fn as_bytes(&self) -> &[u8] {
+        &self.registers
+    }
+
+    /// Add `element`, returning whether that changed the estimate.
+    pub fn add(&mut self, element: &[u8]) -> bool {
+        let hash = murmur_hash64a(element, 0xadc83b19);
+        let index = (hash & (REGISTERS as u64 - 1)) as usize;
+        // The extra high bit bounds the rank when the remaining bits are 0
+        let rank = ((hash >> P) | 1 << (64 - P)).trailing_zeros() as u8 + 1;
+        if rank > self.register(index) {
+            self.set_register(index, rank);
+            true
+        } else {
+            false
+        }
+    }
+
+    /// Fold `other` into this sketch, which then estimates the union of
+    /// both.
+    pub fn merge(&mut self, other: &HyperLogLog) {
+        for index in 0..REGISTERS {
+            let rank = other.register(index);
+            if rank > self.register(index) {
+                self.set_register(index, rank);
+            }
+        }
+    }
+
+    /// Estimated number of distinct elements added, using Ertl's improved
+    /// estimator, which needs no empirical bias correction.
+    pub fn count(&self) -> u64 {
+        let mut histogram = [0u32; MAX_RANK as usize + 1];
+        for index in 0..REGISTERS {
+            histogram[self.register(index).min(MAX_RANK) as usize] += 1;
+        }
+
+        let m = REGISTERS as f64;
+        let q = MAX_RANK as usize - 1;
+        let mut z = m * tau((m - histogram[q + 1] as f64) / m);
+        for k in (1..=q).rev() {
+            z = 0.5 * (z + histogram[k] as f64);
+        }
+        z += m * sigma(histogram[0] as f64 / m);
+        (0.5 / std::f64::consts::LN_2 * m * m / z).round() as u64
+    }
+
+    fn register(&self, index: usize) -> u8 {
+        let bit = index * REGISTER_BITS;
+        let (byte, shift) = (bit / 8, bit % 8);
+        let low = self.registers[byte] as u16;
+        let high = self.registers.get(byte + 1).copied().unwrap_or(0) as u16;
+        ((low | high << 8) >> shift) as u8 & 0x3f
+    }
+
+    fn set_register(&mut self, index: usize, rank: u8) {
+        let bit = index * REGISTER_BITS;
+        let (byte, shift) = (bit / 8, bit % 8);
+        let mask = 0x3fu16 << shift;
+        let value = (rank as u16 & 0x3f) << shift;
+        self.registers[byte] = (self.registers[byte] as u16 & !mask | value) as u8;
+        if shift > 8 - REGISTER_BITS {
+            let next = &mut self.registers[byte + 1];
+            *next = (*next as u16 & !(mask >> 8) | value >> 8) as u8;
+        }
+    }
+}
+
+impl TryFrom<Vec<u8>> for HyperLogLog {
+    type Error = String;
+
+    fn try_from(registers: Vec<u8>) -> Result<Self, String> {
+        if registers.len() != SIZE {
+            return Err(format!("HyperLogLog registers must be {} bytes, got {}", SIZE, registers.len()));
+        }
+        Ok(Self { registers })
+    }
+}
+
+impl From<HyperLogLog> for Vec<u8> {
+    fn from(hll: HyperLogLog) -> Self {
+        hll.registers
+    }
+}
+
+fn sigma(mut x: f64) -> f64 {
+    if x == 1.0 {
+        return f64::INFINITY;
+    }
+    let mut y = 1.0;
+    let mut z = x;
+    loop {
+        x *= x;
+        let previous = z;
+        z += x * y;
+        y += y;
+        if z == previous {
+            return z;
+        }
+    }
+}
+
+fn tau(mut x: f64) -> f64 {
+    if x == 0.0 || x == 1.0 {
+        return 0.0;
+    }
+    let mut y = 1.0;
+    let mut z = 1.0 - x;
+    loop {
+        x = x.sqrt();
+        let previous = z;
+        y *= 0.5;
+        z -= (1.0 - x).powi(2) * y;
+        if z == previous {
+            return z / 3.0;
+        }
+    }
+}
+
+/// MurmurHash64A, which spreads similar elements evenly over the
+/// registers and, unlike the std hashers, is stable across releases, so
+/// stored sketches stay valid.
+fn murmur_hash64a(data: &[u8], seed: u64) -> u64 {
+    const M: u64 = 0xc6a4a7935bd1e995;
+    const R: u32 = 47;
+    let mut h = seed ^ (data.len() as u64).wrapping_mul(M);
+
+    let mut chunks = data.chunks_exact(8);
+    for chunk in &mut chunks {
+        let mut k = u64::from_le_bytes(chunk.try_into().expect("chunks are 8 bytes"));
+        k = k.wrapping_mul(M);
+        k ^= k >> R;
+        k = k.wrapping_mul(M);
+        h ^= k;
+        h = h.wrapping_mul(M);
+    }
+
+    let tail = chunks.remainder();
+    if !tail.is_empty() {
+        for (i, &b) in tail.iter().enumerate() {
+            h ^= (b as u64) << (8 * i);
+        }
+        h = h.wrapping_mul(M);
+    }
+
+    h ^= h >> R;
+    h = h.wrapping_mul(M);
+    h ^= h >> R;
+    h
+}
@@ -0,0 +1,105 @@
+use crate::data_types::DataType;
+use crate::error::Result;
+use crate::storage::{random_below, Storage};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Appended to the key of a queue to name the hash of its claimed jobs.
+const CLAIMED_SUFFIX: &str = ":claimed";
+
+/// A work queue as CLAIMJOB and ACKJOB see it: a list of jobs waiting at
+/// its key, taken from the front, and a hash at the key with
+/// `CLAIMED_SUFFIX` appended mapping the id of each claimed job to when
+/// its claim lapses, in milliseconds since the epoch, and the job,
+/// separated by a space. Both are plain values that other commands can
+/// read and write, so jobs are added with RPUSH.
+pub struct JobQueue {
+    key: String,
+    jobs: Vec<String>,
+    claims: HashMap<String, String>,
+    changed: bool,
+}
+
+impl JobQueue {
+    /// Read the queue at `key`, putting the jobs whose claim lapsed at or
+    /// before `now_ms` back at its front, longest lapsed first. `None` if
+    /// either key holds another kind of value.
+    pub async fn load(storage: &Arc<dyn Storage>, key: &str, now_ms: u64) -> Result<Option<Self>> {
+        let jobs = match storage.get(key).await? {
+            Some(DataType::List(jobs)) => jobs,
+            None => Vec::new(),
+            Some(_) => return Ok(None),
+        };
+        let claims = match storage.get(&claimed_key(key)).await? {
+            Some(DataType::Hash(claims)) => claims,
+            None => HashMap::new(),
+            Some(_) => return Ok(None),
+        };
+        let mut queue = Self { key: key.to_string(), jobs, claims, changed: false };
+
+        let mut lapsed: Vec<(u64, String)> = queue.claims.iter()
+            .filter_map(|(id, claim)| parse_claim(claim).filter(|(until, _)| *until <= now_ms).map(|(until, _)| (until, id.clone())))
+            .collect();
+        lapsed.sort();
+        for (_, id) in lapsed.into_iter().rev() {
+            if let Some((_, job)) = queue.claims.remove(&id).as_deref().and_then(parse_claim) {
+                queue.jobs.insert(0, job.to_string());
+            }
+            queue.changed = true;
+        }
+        Ok(Some(queue))
+    }
+
+    /// Take the job at the front, hidden from other claims until
+    /// `visibility_ms` after `now_ms`, returning its id and the job.
+    pub fn claim(&mut self, now_ms: u64, visibility_ms: u64) -> Option<(String, String)> {
+        if self.jobs.is_empty() {
+            return None;
+        }
+        let job = self.jobs.remove(0);
+        let id = format!("{}-{:016x}", now_ms, random_below(u64::MAX));
+        let until = now_ms.saturating_add(visibility_ms);
+        self.claims.insert(id.clone(), format!("{} {}", until, job));
+        self.changed = true;
+        Some((id, job))
+    }
+
+    /// Finish the job claimed as `id`, returning whether it was claimed.
+    /// A job whose claim lapsed is back in the queue and no longer is.
+    pub fn ack(&mut self, id: &str) -> bool {
+        let acked = self.claims.remove(id).is_some();
+        self.changed |= acked;
+        acked
+    }
+
+    /// Write back what `claim`, `ack` or `load` changed, in one write
+    /// where the backend allows. A list or hash left empty is deleted.
+    pub async fn save(self, storage: &Arc<dyn Storage>) -> Result<()> {
+        if !self.changed {
+            return Ok(());
+        }
+        let claimed = claimed_key(&self.key);
+        let mut entries = Vec::new();
+        if self.jobs.is_empty() {
+            storage.delete(&self.key).await?;
+        } else {
+            entries.push((self.key, DataType::List(self.jobs)));
+        }
+        if self.claims.is_empty() {
+            storage.delete(&claimed).await?;
+        } else {
+            entries.push((claimed, DataType::Hash(self.claims)));
+        }
+        storage.set_multiple(entries).await
+    }
+}
+
+fn claimed_key(key: &str) -> String {
+    format!("{}{}", key, CLAIMED_SUFFIX)
+}
+
+/// When a claim lapses and its job, or `None` if it is not of that form.
+fn parse_claim(claim: &str) -> Option<(u64, &str)> {
+    let (until, job) = claim.split_once(' ')?;
+    Some((until.parse().ok()?, job))
+}
@@ -1,12 +1,26 @@
+pub mod audit;
+pub mod clients;
 pub mod commands;
 pub mod config;
 pub mod connection;
 pub mod data_types;
 pub mod data_types_pooled;
 pub mod db;
+pub mod dump;
+pub mod embedded;
 pub mod error;
+pub mod export;
+pub mod functions;
+pub mod glob;
+pub mod hyperloglog;
+pub mod jobs;
+pub mod log_tail;
+pub mod metrics;
 pub mod protocol;
+pub mod pubsub;
+pub mod request_ids;
 pub mod server;
+pub mod stats;
 pub mod storage;
 pub mod tls;
 pub mod network;
@@ -18,6 +32,7 @@ pub mod ffi;
 
 pub use config::Config;
 pub use db::DiskDB;
+pub use embedded::Embedded;
 pub use error::{DiskDBError, Result};
 pub use server::Server;
 pub use optimized_server::OptimizedServer;
@@ -0,0 +1,90 @@
+use crate::storage::expiry::now_ms;
+use log::{Level, Log, Metadata, Record, SetLoggerError};
+use std::collections::VecDeque;
+use std::sync::{Mutex, OnceLock};
+
+/// Log lines kept for DEBUG LOGTAIL unless configured otherwise.
+pub const DEFAULT_LOG_TAIL_SIZE: usize = 1000;
+
+/// Least severe level kept in the tail, whatever `RUST_LOG` says, so the
+/// tail holds errors, warnings and lifecycle events even when the server
+/// logs nothing to stderr.
+const TAIL_LEVEL: Level = Level::Info;
+
+static TAIL: OnceLock<LogTail> = OnceLock::new();
+
+/// The latest lines the server logged, in a ring buffer of fixed size; the
+/// oldest are dropped first.
+#[derive(Debug)]
+pub struct LogTail {
+    size: usize,
+    lines: Mutex<VecDeque<String>>,
+}
+
+impl LogTail {
+    /// Keep the latest `size` lines. Zero keeps none.
+    pub fn new(size: usize) -> Self {
+        Self { size, lines: Mutex::new(VecDeque::with_capacity(size)) }
+    }
+
+    pub fn record(&self, line: String) {
+        if self.size == 0 {
+            return;
+        }
+        let mut lines = self.lines.lock().unwrap();
+        if lines.len() == self.size {
+            lines.pop_front();
+        }
+        lines.push_back(line);
+    }
+
+    /// The latest `count` lines, oldest first, as `tail` prints them.
+    pub fn latest(&self, count: usize) -> Vec<String> {
+        let lines = self.lines.lock().unwrap();
+        lines.iter().skip(lines.len().saturating_sub(count)).cloned().collect()
+    }
+}
+
+/// Logs to stderr as configured by `RUST_LOG`, like `env_logger::init`, and
+/// keeps the latest `size` lines of level INFO or above for DEBUG LOGTAIL.
+/// Fails if a logger was already installed.
+pub fn init(size: usize) -> Result<(), SetLoggerError> {
+    let inner = env_logger::Builder::from_default_env().build();
+    let max_level = inner.filter().max(TAIL_LEVEL.to_level_filter());
+    let tail = TAIL.get_or_init(|| LogTail::new(size));
+    log::set_boxed_logger(Box::new(TailLogger { inner, tail }))?;
+    log::set_max_level(max_level);
+    Ok(())
+}
+
+/// The latest `count` lines logged since `init`, oldest first. Empty if
+/// `init` was never called, as when DiskDB is embedded.
+pub fn latest(count: usize) -> Vec<String> {
+    TAIL.get().map_or_else(Vec::new, |tail| tail.latest(count))
+}
+
+struct TailLogger {
+    inner: env_logger::Logger,
+    tail: &'static LogTail,
+}
+
+impl Log for TailLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= TAIL_LEVEL || self.inner.enabled(metadata)
+    }
+
+    fn log(&self, record: &Record) {
+        if record.level() <= TAIL_LEVEL {
+            // One entry per line, so the tail reads the same in line replies
+            let message = record.args().to_string().replace(['\r', '\n'], " ");
+            self.tail.record(format!("{} {} {}: {}", now_ms(), record.level(), record.target(), message));
+        }
+        if self.inner.matches(record) {
+            self.inner.log(record);
+        }
+    }
+
+    fn flush(&self) {
+        self.inner.flush();
+    }
+}
@@ -1,29 +1,77 @@
+mod audit;
+mod clients;
 mod commands;
 mod config;
 mod connection;
 mod data_types;
 mod db;
+mod dump;
 mod error;
+mod export;
+mod functions;
+mod glob;
+mod hyperloglog;
+mod jobs;
+mod log_tail;
+mod metrics;
 mod protocol;
+mod pubsub;
+mod request_ids;
 mod server;
+mod stats;
 mod storage;
 mod tls;
 
 use config::Config;
 use error::Result;
-use log::info;
+use log::{error, info};
 use server::Server;
 use std::sync::Arc;
 use storage::rocksdb_storage::RocksDBStorage;
+use storage::Storage;
 
 #[tokio::main]
 async fn main() -> Result<()> {
-    env_logger::init();
+    let config = Config::from_env();
+    // Keep the latest log lines for DEBUG LOGTAIL as well as printing them
+    if let Err(e) = log_tail::init(config.log_tail_size) {
+        eprintln!("Cannot install logger: {}", e);
+    }
     info!("Starting DiskDB...");
 
-    let config = Config::from_env();
-    let storage = Arc::new(RocksDBStorage::new(&config.database_path)?);
-    let server = Server::new(config, storage)?;
+    // Before the database is opened, so a bad snapshot stops the server
+    // with the data as it was
+    if let Some(snapshot) = &config.restore_snapshot {
+        match storage::snapshot::restore(snapshot, &config.database_path) {
+            Ok(Some(meta)) => info!("Restored {} keys from snapshot {}", meta.keys, snapshot.display()),
+            Ok(None) => info!("Database already restored from snapshot {}", snapshot.display()),
+            Err(e) => {
+                error!("Cannot restore snapshot: {}", e);
+                return Err(e);
+            }
+        }
+    }
+
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path)?
+        .with_compression(config.compression)
+        .with_change_log(config.change_log_retention)?
+        .with_max_keys(config.max_keys_for(0))?);
+    let database_config = config.clone();
+    let server = Server::new(config, storage)?
+        .with_database_factory(Arc::new(move |index| -> Result<Arc<dyn Storage>> {
+            let storage = RocksDBStorage::new(database_config.database_path_for(index))?
+                .with_compression(database_config.compression)
+                .with_change_log(database_config.change_log_retention)?
+                .with_max_keys(database_config.max_keys_for(index))?;
+            Ok(Arc::new(storage) as Arc<dyn Storage>)
+        }));
     
-    server.start().await
+    // Close every listener on Ctrl-C rather than leaving Unix socket files
+    // behind
+    server.run_until(async {
+        if let Err(e) = tokio::signal::ctrl_c().await {
+            error!("Cannot listen for Ctrl-C: {}", e);
+            std::future::pending::<()>().await;
+        }
+    }).await
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+use std::fmt::{Display, Write};
+
+/// Content type of a page written by `MetricsWriter`, for HTTP replies.
+pub const CONTENT_TYPE: &str = "text/plain; version=0.0.4; charset=utf-8";
+
+/// Kind of a metric, given on its TYPE line.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MetricType {
+    Counter,
+    Gauge,
+}
+
+impl MetricType {
+    fn name(&self) -> &'static str {
+        match self {
+            MetricType::Counter => "counter",
+            MetricType::Gauge => "gauge",
+        }
+    }
+}
+
+/// Builds a page of metrics in the Prometheus text exposition format.
+#[derive(Debug, Default)]
+pub struct MetricsWriter {
+    out: String,
+}
+
+impl MetricsWriter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Start the metric `name`, writing its HELP and TYPE lines. Its
+    /// samples follow with `sample`.
+    pub fn metric(&mut self, name: &str, kind: MetricType, help: &str) -> &mut Self {
+        let help = help.replace('\\', "\\\\").replace('\n', "\\n");
+        let _ = write!(self.out, "# HELP {} {}\n# TYPE {} {}\n", name, help, name, kind.name());
+        self
+    }
+
+    /// Write a sample of the metric started last, with the given labels.
+    pub fn sample(&mut self, name: &str, labels: &[(&str, &str)], value: impl Display) -> &mut Self {
+        self.out.push_str(name);
+        if !labels.is_empty() {
+            let labels: Vec<String> = labels.iter()
+                .map(|(label, value)| format!("{}=\"{}\"", label, escape_label(value)))
+                .collect();
+            let _ = write!(self.out, "{{{}}}", labels.join(","));
+        }
+        let _ = writeln!(self.out, " {}", value);
+        self
+    }
+
+    /// Write a metric with a single sample and no labels.
+    pub fn single(&mut self, name: &str, kind: MetricType, help: &str, value: impl Display) -> &mut Self {
+        self.metric(name, kind, help).sample(name, &[], value)
+    }
+
+    pub fn finish(self) -> String {
+        self.out
+    }
+}
+
+fn escape_label(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"").replace('\n', "\\n")
+}
+
+/// Resident memory of the server process in bytes, or `None` where the
+/// platform does not report it.
+pub fn resident_memory_bytes() -> Option<u64> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+    let kb: u64 = line["VmRSS:".len()..].trim().trim_end_matches("kB").trim().parse().ok()?;
+    Some(kb * 1024)
+}
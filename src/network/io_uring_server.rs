@@ -164,10 +164,10 @@ impl IoUringServer {
                 Ok(request) => {
                     match executor.execute(request).await {
                         Ok(resp) => resp,
-                        Err(e) => Response::Error(e.to_string()),
+                        Err(e) => Response::error(&e),
                     }
                 }
-                Err(e) => Response::Error(e.to_string()),
+                Err(e) => Response::error(&e),
             };
             
             // Append response to write buffer
@@ -235,10 +235,10 @@ impl OptimizedConnection {
                 Ok(request) => {
                     match executor.execute(request.clone()).await {
                         Ok(resp) => resp,
-                        Err(e) => Response::Error(e.to_string()),
+                        Err(e) => Response::error(&e),
                     }
                 }
-                Err(e) => Response::Error(e.to_string()),
+                Err(e) => Response::error(&e),
             };
             
             // Write response to buffer
@@ -282,10 +282,10 @@ impl OptimizedConnection {
                 Ok(request) => {
                     match executor.execute(request.clone()).await {
                         Ok(resp) => resp,
-                        Err(e) => Response::Error(e.to_string()),
+                        Err(e) => Response::error(&e),
                     }
                 }
-                Err(e) => Response::Error(e.to_string()),
+                Err(e) => Response::error(&e),
             };
             
             response_buffer.put(response.to_string().as_bytes());
@@ -1,31 +1,62 @@
 use crate::error::{DiskDBError, Result};
+use crate::request_ids::MAX_REQUEST_ID_LEN;
+use crate::storage::compression::ValueEncoding;
+use std::borrow::Cow;
 use std::fmt;
+use std::time::Duration;
 
 #[derive(Debug, Clone)]
 pub enum Request {
     // String operations
     Get { key: String },
     Set { key: String, value: String },
+    SetWith { key: String, value: String, options: SetOptions },
     Incr { key: String },
     Decr { key: String },
     IncrBy { key: String, delta: i64 },
     DecrBy { key: String, delta: i64 },
+    IncrPx { key: String, ttl_ms: u64 },
+    /// GET that also sets the key's expiry to `ttl_ms` from now
+    GetEx { key: String, ttl_ms: u64 },
+    /// INCRBY of every key by its delta in one step, all or none
+    IncrMulti { deltas: Vec<(String, i64)> },
+    /// DECR, deleting the key if that takes it to zero or below
+    DecrReap { key: String },
+    GetReset { key: String },
+    /// The string at `key`, which is reset to empty in the same step
+    Rotate { key: String },
+    /// SET applied once per `request_id` within `window_ms`
+    SetIdem { key: String, value: String, request_id: String, window_ms: u64 },
     Append { key: String, value: String },
+    /// APPEND, then drop bytes from the front down to `max_bytes`
+    AppendCapped { key: String, max_bytes: usize, value: String },
     
     // List operations
     LPush { key: String, values: Vec<String> },
     RPush { key: String, values: Vec<String> },
+    LPushCapped { key: String, max_len: i64, values: Vec<String> },
+    RPushCapped { key: String, max_len: i64, values: Vec<String> },
     LPop { key: String },
     RPop { key: String },
+    LPopCount { key: String, count: usize },
+    RPopCount { key: String, count: usize },
     LRange { key: String, start: i64, stop: i64 },
     LLen { key: String },
+    LTrim { key: String, start: i64, stop: i64 },
+    /// Take the next job of the list `queue`, hidden for `visibility_ms`:
+    /// unless acknowledged by then, it goes back to the queue
+    ClaimJob { queue: String, visibility_ms: u64 },
+    /// Finish the job claimed from `queue` as `id`
+    AckJob { queue: String, id: String },
     
     // Set operations
     SAdd { key: String, members: Vec<String> },
     SRem { key: String, members: Vec<String> },
     SMembers { key: String },
     SIsMember { key: String, member: String },
+    SMIsMember { key: String, members: Vec<String> },
     SCard { key: String },
+    SRandMember { key: String, count: i64 },
     
     // Hash operations
     HSet { key: String, field: String, value: String },
@@ -38,6 +69,8 @@ pub enum Request {
     ZAdd { key: String, members: Vec<(f64, String)> },
     ZRem { key: String, members: Vec<String> },
     ZRange { key: String, start: i64, stop: i64, with_scores: bool },
+    ZRemRangeByRank { key: String, start: i64, stop: i64 },
+    ZRemRangeByScore { key: String, min: f64, max: f64 },
     ZScore { key: String, member: String },
     ZCard { key: String },
     
@@ -51,17 +84,370 @@ pub enum Request {
     XRange { key: String, start: String, end: String, count: Option<usize> },
     XLen { key: String },
     
+    // Bitmap operations
+    SetBit { key: String, offset: u64, value: bool },
+    GetBit { key: String, offset: u64 },
+    /// Set bits in the bytes from `start` to `end` of `range`, or in the
+    /// whole bitmap
+    BitCount { key: String, range: Option<(i64, i64)> },
+    
+    // HyperLogLog operations
+    PfAdd { key: String, elements: Vec<String> },
+    PfCount { keys: Vec<String> },
+    PfMerge { dest: String, sources: Vec<String> },
+    
     // Utility operations
     Type { key: String },
     Del { keys: Vec<String> },
     Exists { keys: Vec<String> },
+    RandomKey,
+    Scan { cursor: String, options: ScanOptions },
+    Export { cursor: String, options: ScanOptions },
+    /// The string values of the keys of a SCAN page, as key/value pairs
+    GetMatching { cursor: String, options: ScanOptions },
+    /// Keys whose value was last written at least `min_age_ms` ago
+    ScanByAge { cursor: String, min_age_ms: u64, options: ScanOptions },
+    BigKeys { cursor: String, options: ScanOptions },
+    /// Up to `count` entries of the change log from `offset` on, waiting
+    /// up to `block` (forever for zero) for one if there are none yet
+    Changes { offset: u64, count: usize, block: Option<Duration> },
+    Move { key: String, db: i64 },
+    SwapDb { a: i64, b: i64 },
+    Dump { key: String },
+    DebugObject { key: String },
+    /// Turn reporting the execution time of each reply on the connection
+    /// on or off
+    DebugTiming { enabled: bool },
+    /// The latest `count` lines of the server log, oldest first
+    DebugLogTail { count: usize },
+    KeyStats { prefix: String },
+    MemoryUsage { key: String },
+    ObjectEncoding { key: String },
+    MemoryStats,
+    /// Keys with an expiry and due, across open databases, and the latest
+    /// cycle of the background reaper
+    ExpireStats,
+    /// Value of a runtime setting
+    ConfigGet { parameter: String },
+    /// Change a runtime setting; it is not saved across restarts
+    ConfigSet { parameter: String, value: String },
+    /// Name the connection for CLIENT LIST; an empty name clears it
+    ClientSetName { name: String },
+    ClientGetName,
+    ClientList,
+    /// Read the keys matching any of `patterns`, or every key if there are
+    /// none, in the background
+    Warmup { patterns: Vec<String> },
+    /// Compact the selected database in the background
+    Compact,
+    CompactStatus,
+    CompactCancel,
+    /// Compact the data of one key, waiting until it is done
+    CompactKey { key: String },
+    /// Write a snapshot of the selected database to a new directory at
+    /// `path` under the snapshot directory, waiting until it is done
+    Save { path: String },
+    /// Like `Save`, in the background
+    BgSave { path: String },
+    /// When the latest snapshot was saved, in seconds since the epoch
+    LastSave,
+    /// Manifest of the snapshot at `path` under the snapshot directory, and
+    /// whether it would load
+    SnapshotInfo { path: String },
+    /// The latest `count` refused commands, newest first
+    AuditLogGet { count: usize },
+    AuditLogLen,
+    AuditLogReset,
+    /// Stop the server, first flushing every open database to disk if
+    /// `save`
+    Shutdown { save: bool },
+    Restore { key: String, ttl: i64, payload: String, replace: bool },
+    /// Expire the key this many milliseconds from now; EXPIRE's seconds
+    /// are converted. Zero or less deletes it.
+    Expire { key: String, ttl_ms: i64 },
+    /// Expire every key matching `pattern` this many milliseconds from now
+    ExpireMatching { pattern: String, ttl_ms: u64 },
+    Ttl { key: String },
+    PTtl { key: String },
+    MTtl { keys: Vec<String> },
+    Persist { key: String },
+    RenamePersist { src: String, dst: String },
+    /// Exchange the values of two keys, with their expiries if `with_ttl`
+    Swap { a: String, b: String, with_ttl: bool },
+    DelIfEq { key: String, value: String },
+    /// Return the key's value, first setting it to `value` if it is missing
+    GetOrSet { key: String, value: String },
+    /// Write `value` only if the key's version is `expected`
+    SetIfVersion { key: String, expected: u64, value: String },
+    /// Return the key's revision, and its value only if the revision is
+    /// above `since`
+    GetIfChanged { key: String, since: u64 },
+    /// SET that also replaces the key's tags with `tags`
+    SetTagged { key: String, value: String, tags: Vec<String> },
+    /// Keys tagged `tag` by SETTAGGED
+    KeysByTag { tag: String },
+    /// Run the registered update function `function` on `key`
+    Invoke { function: String, key: String, args: Vec<String> },
     Ping,
+    /// The server's clock, as seconds and microseconds since the epoch
+    Time,
     Echo { message: String },
     FlushDb,
     Info,
+    /// Server metrics in the Prometheus text exposition format
+    Metrics,
+    Hello { protover: i64 },
+    Select { index: i64 },
+    
+    // Pub/Sub operations
+    Subscribe { channels: Vec<String> },
+    Unsubscribe { channels: Vec<String> },
+    Publish { channel: String, message: String },
+    /// Store `value` at `key` as SET does, then publish `key` to `channel`
+    SetPublish { key: String, value: String, channel: String },
+    /// Channels with subscribers, only those matching `pattern` if given
+    PubSubChannels { pattern: Option<String> },
+    /// The number of subscribers of each of `channels`
+    PubSubNumSub { channels: Vec<String> },
+}
+
+/// Kinds of read-only commands that get their own execution budget.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum CommandClass {
+    /// Commands that read a few keys
+    Read,
+    /// Commands that walk the keyspace: SCAN, EXPORT, SCANBYAGE, BIGKEYS
+    /// and EXPIREMATCHING
+    Keyspace,
+}
+
+impl CommandClass {
+    pub const ALL: [CommandClass; 2] = [CommandClass::Read, CommandClass::Keyspace];
+
+    /// Name used for the class in configuration
+    pub fn name(&self) -> &'static str {
+        match self {
+            CommandClass::Read => "READ",
+            CommandClass::Keyspace => "KEYSPACE",
+        }
+    }
+}
+
+/// Condition a `SET` must satisfy to write the value.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SetCondition {
+    /// Only set the key if it does not exist
+    Nx,
+    /// Only set the key if it already exists
+    Xx,
+}
+
+/// Options accepted after the value of a `SET`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct SetOptions {
+    pub condition: Option<SetCondition>,
+    /// Expire the key this many milliseconds after it is written
+    pub expire_ms: Option<u64>,
+    /// Keep the key's current expiry instead of clearing it
+    pub keep_ttl: bool,
+    /// Push the value onto this list when the key expires; needs EX or PX
+    pub dead_letter: Option<String>,
+    /// How to store the value, a hint the server may fall back from
+    pub encoding: Option<ValueEncoding>,
+    /// Reply with the value the key held before, or nil
+    pub get: bool,
+}
+
+impl SetOptions {
+    /// Parse the tokens following the value of a `SET`. Returns `None` if
+    /// any token is not an option, so the caller can fall back to treating
+    /// them as part of the value.
+    fn parse(tokens: &[&str]) -> Option<Self> {
+        let mut options = SetOptions::default();
+        let mut i = 0;
+        while i < tokens.len() {
+            match tokens[i].to_uppercase().as_str() {
+                "NX" if options.condition.is_none() => options.condition = Some(SetCondition::Nx),
+                "XX" if options.condition.is_none() => options.condition = Some(SetCondition::Xx),
+                "KEEPTTL" if !options.keep_ttl && options.expire_ms.is_none() => options.keep_ttl = true,
+                unit @ ("EX" | "PX") if !options.keep_ttl && options.expire_ms.is_none() => {
+                    let amount = tokens.get(i + 1)?.parse::<u64>().ok().filter(|&n| n > 0)?;
+                    let ms = if unit == "EX" { amount.checked_mul(1000)? } else { amount };
+                    options.expire_ms = Some(ms);
+                    i += 1;
+                }
+                "DEADLETTER" if options.dead_letter.is_none() => {
+                    options.dead_letter = Some(tokens.get(i + 1)?.to_string());
+                    i += 1;
+                }
+                "ENCODING" if options.encoding.is_none() => {
+                    options.encoding = Some(ValueEncoding::parse(tokens.get(i + 1)?)?);
+                    i += 1;
+                }
+                "GET" if !options.get => options.get = true,
+                _ => return None,
+            }
+            i += 1;
+        }
+        if options.dead_letter.is_some() && options.expire_ms.is_none() {
+            return None;
+        }
+        Some(options)
+    }
+}
+
+impl fmt::Display for SetOptions {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.condition {
+            Some(SetCondition::Nx) => write!(f, " NX")?,
+            Some(SetCondition::Xx) => write!(f, " XX")?,
+            None => {}
+        }
+        if let Some(ms) = self.expire_ms {
+            write!(f, " PX {}", ms)?;
+        }
+        if self.keep_ttl {
+            write!(f, " KEEPTTL")?;
+        }
+        if let Some(dlq) = &self.dead_letter {
+            write!(f, " DEADLETTER {}", dlq)?;
+        }
+        if let Some(encoding) = self.encoding {
+            write!(f, " ENCODING {}", encoding.name())?;
+        }
+        if self.get {
+            write!(f, " GET")?;
+        }
+        Ok(())
+    }
+}
+
+/// Options shared by the commands that iterate the keyspace with a cursor.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ScanOptions {
+    /// Number of keys examined per call; fewer may be returned when
+    /// filtering
+    pub count: usize,
+    /// Glob pattern keys must match
+    pub pattern: Option<String>,
+    /// Type keys must hold, as reported by TYPE
+    pub type_name: Option<String>,
+}
+
+impl Default for ScanOptions {
+    fn default() -> Self {
+        Self { count: 10, pattern: None, type_name: None }
+    }
+}
+
+impl ScanOptions {
+    /// Parse `[MATCH pattern] [COUNT count] [TYPE type]` in any order.
+    fn parse(command: &str, tokens: &[&str]) -> Result<Self> {
+        if tokens.len() % 2 != 0 {
+            return Err(DiskDBError::Protocol(format!("{} options must be name/value pairs", command)));
+        }
+        let mut options = ScanOptions::default();
+        for pair in tokens.chunks(2) {
+            match pair[0].to_uppercase().as_str() {
+                "COUNT" => {
+                    options.count = pair[1].parse::<usize>()
+                        .ok()
+                        .filter(|&c| c > 0)
+                        .ok_or_else(|| DiskDBError::Protocol("Invalid COUNT value".to_string()))?;
+                }
+                "MATCH" => options.pattern = Some(pair[1].to_string()),
+                "TYPE" => options.type_name = Some(pair[1].to_lowercase()),
+                other => return Err(DiskDBError::Protocol(format!("Unknown {} option '{}'", command, other))),
+            }
+        }
+        Ok(options)
+    }
+}
+
+impl fmt::Display for ScanOptions {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if let Some(pattern) = &self.pattern {
+            write!(f, " MATCH {}", pattern)?;
+        }
+        write!(f, " COUNT {}", self.count)?;
+        if let Some(type_name) = &self.type_name {
+            write!(f, " TYPE {}", type_name)?;
+        }
+        Ok(())
+    }
 }
 
-#[derive(Debug)]
+/// The machine-readable code an error reply starts with, so clients can
+/// tell errors apart without matching the rest of the message, which may
+/// change between versions. Replies without a code of their own are sent
+/// with ERR.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ErrorCode {
+    /// Any error without a more specific code
+    Err,
+    /// The key holds a different kind of value than the command works on
+    WrongType,
+    /// A key the command needs does not exist
+    NotFound,
+    /// A limit on what the server stores was reached, such as the key limit
+    Oom,
+    /// The command ran past its execution budget and was cancelled
+    Timeout,
+    /// Too many writes are waiting; the command can be retried later
+    TryAgain,
+    /// A key the command would create already exists
+    BusyKey,
+    /// The protocol version asked for by HELLO is not supported
+    NoProto,
+    /// The connection sent more commands per second than allowed; the
+    /// command was not run and can be retried later
+    RateLimit,
+}
+
+impl ErrorCode {
+    const ALL: [ErrorCode; 9] = [
+        ErrorCode::Err,
+        ErrorCode::WrongType,
+        ErrorCode::NotFound,
+        ErrorCode::Oom,
+        ErrorCode::Timeout,
+        ErrorCode::TryAgain,
+        ErrorCode::BusyKey,
+        ErrorCode::NoProto,
+        ErrorCode::RateLimit,
+    ];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            ErrorCode::Err => "ERR",
+            ErrorCode::WrongType => "WRONGTYPE",
+            ErrorCode::NotFound => "NOTFOUND",
+            ErrorCode::Oom => "OOM",
+            ErrorCode::Timeout => "TIMEOUT",
+            ErrorCode::TryAgain => "TRYAGAIN",
+            ErrorCode::BusyKey => "BUSYKEY",
+            ErrorCode::NoProto => "NOPROTO",
+            ErrorCode::RateLimit => "RATELIMIT",
+        }
+    }
+
+    /// The code error message `msg` starts with, if any.
+    pub fn of(msg: &str) -> Option<Self> {
+        let first = msg.split(' ').next()?;
+        Self::ALL.into_iter().find(|code| code.name() == first)
+    }
+}
+
+/// `msg` as an error reply carries it: prefixed with ERR unless it already
+/// starts with a code.
+fn with_code(msg: &str) -> Cow<'_, str> {
+    match ErrorCode::of(msg) {
+        Some(_) => Cow::Borrowed(msg),
+        None => Cow::Owned(format!("{} {}", ErrorCode::Err.name(), msg)),
+    }
+}
+
+#[derive(Debug, Clone)]
 pub enum Response {
     Ok,
     String(Option<String>),
@@ -72,6 +458,18 @@ pub enum Response {
 }
 
 impl Response {
+    /// The error reply for `e`, with the code that fits it. A message that
+    /// already starts with a code, such as a WRONGTYPE raised by a storage
+    /// backend, is sent as is.
+    pub fn error(e: &DiskDBError) -> Self {
+        match e {
+            DiskDBError::Database(msg) | DiskDBError::Protocol(msg) if ErrorCode::of(msg).is_some() => Response::Error(msg.clone()),
+            DiskDBError::KeyNotFound(_) => Response::Error(format!("{} {}", ErrorCode::NotFound.name(), e)),
+            DiskDBError::KeyLimitExceeded(_) => Response::Error(format!("{} {}", ErrorCode::Oom.name(), e)),
+            _ => Response::Error(with_code(&e.to_string()).into_owned()),
+        }
+    }
+
     /// Parse a response from a string
     pub fn parse(input: &str) -> Result<Self> {
         let trimmed = input.trim();
@@ -111,6 +509,7 @@ impl Request {
         match self {
             Request::Get { key } => format!("GET {}", key),
             Request::Set { key, value } => format!("SET {} {}", key, value),
+            Request::SetWith { key, value, options } => format!("SET {} {}{}", key, value, options),
             Request::Del { keys } => format!("DEL {}", keys.join(" ")),
             Request::Exists { keys } => format!("EXISTS {}", keys.join(" ")),
             Request::Type { key } => format!("TYPE {}", key),
@@ -118,18 +517,38 @@ impl Request {
             Request::Decr { key } => format!("DECR {}", key),
             Request::IncrBy { key, delta } => format!("INCRBY {} {}", key, delta),
             Request::DecrBy { key, delta } => format!("DECRBY {} {}", key, delta),
+            Request::IncrPx { key, ttl_ms } => format!("INCRPX {} {}", key, ttl_ms),
+            Request::GetEx { key, ttl_ms } => format!("GETEX {} PX {}", key, ttl_ms),
+            Request::IncrMulti { deltas } => {
+                let pairs: Vec<String> = deltas.iter().map(|(key, delta)| format!("{} {}", key, delta)).collect();
+                format!("INCRMULTI {}", pairs.join(" "))
+            }
+            Request::DecrReap { key } => format!("DECRREAP {}", key),
+            Request::GetReset { key } => format!("GETRESET {}", key),
+            Request::Rotate { key } => format!("ROTATE {}", key),
+            Request::SetIdem { key, value, request_id, window_ms } => format!("SETIDEM {} {} {} {}", key, value, request_id, window_ms),
             Request::Append { key, value } => format!("APPEND {} {}", key, value),
+            Request::AppendCapped { key, max_bytes, value } => format!("APPENDCAPPED {} {} {}", key, max_bytes, value),
             Request::LPush { key, values } => format!("LPUSH {} {}", key, values.join(" ")),
             Request::RPush { key, values } => format!("RPUSH {} {}", key, values.join(" ")),
+            Request::LPushCapped { key, max_len, values } => format!("LPUSHCAPPED {} {} {}", key, max_len, values.join(" ")),
+            Request::RPushCapped { key, max_len, values } => format!("RPUSHCAPPED {} {} {}", key, max_len, values.join(" ")),
             Request::LPop { key } => format!("LPOP {}", key),
             Request::RPop { key } => format!("RPOP {}", key),
+            Request::LPopCount { key, count } => format!("LPOP {} {}", key, count),
+            Request::RPopCount { key, count } => format!("RPOP {} {}", key, count),
             Request::LRange { key, start, stop } => format!("LRANGE {} {} {}", key, start, stop),
             Request::LLen { key } => format!("LLEN {}", key),
+            Request::LTrim { key, start, stop } => format!("LTRIM {} {} {}", key, start, stop),
+            Request::ClaimJob { queue, visibility_ms } => format!("CLAIMJOB {} {}", queue, visibility_ms),
+            Request::AckJob { queue, id } => format!("ACKJOB {} {}", queue, id),
             Request::SAdd { key, members } => format!("SADD {} {}", key, members.join(" ")),
             Request::SRem { key, members } => format!("SREM {} {}", key, members.join(" ")),
             Request::SMembers { key } => format!("SMEMBERS {}", key),
             Request::SIsMember { key, member } => format!("SISMEMBER {} {}", key, member),
+            Request::SMIsMember { key, members } => format!("SMISMEMBER {} {}", key, members.join(" ")),
             Request::SCard { key } => format!("SCARD {}", key),
+            Request::SRandMember { key, count } => format!("SRANDMEMBER {} {}", key, count),
             Request::HSet { key, field, value } => format!("HSET {} {} {}", key, field, value),
             Request::HGet { key, field } => format!("HGET {} {}", key, field),
             Request::HDel { key, fields } => format!("HDEL {} {}", key, fields.join(" ")),
@@ -150,6 +569,8 @@ impl Request {
                     format!("ZRANGE {} {} {}", key, start, stop)
                 }
             }
+            Request::ZRemRangeByRank { key, start, stop } => format!("ZREMRANGEBYRANK {} {} {}", key, start, stop),
+            Request::ZRemRangeByScore { key, min, max } => format!("ZREMRANGEBYSCORE {} {} {}", key, min, max),
             Request::ZCard { key } => format!("ZCARD {}", key),
             Request::JsonSet { key, path, value } => format!("JSON.SET {} {} {}", key, path, value),
             Request::JsonGet { key, path } => format!("JSON.GET {} {}", key, path),
@@ -169,20 +590,228 @@ impl Request {
                 }
             }
             Request::XLen { key } => format!("XLEN {}", key),
+            Request::SetBit { key, offset, value } => format!("SETBIT {} {} {}", key, offset, *value as u8),
+            Request::GetBit { key, offset } => format!("GETBIT {} {}", key, offset),
+            Request::BitCount { key, range: Some((start, end)) } => format!("BITCOUNT {} {} {}", key, start, end),
+            Request::BitCount { key, range: None } => format!("BITCOUNT {}", key),
+            Request::PfAdd { key, elements } if elements.is_empty() => format!("PFADD {}", key),
+            Request::PfAdd { key, elements } => format!("PFADD {} {}", key, elements.join(" ")),
+            Request::PfCount { keys } => format!("PFCOUNT {}", keys.join(" ")),
+            Request::PfMerge { dest, sources } if sources.is_empty() => format!("PFMERGE {}", dest),
+            Request::PfMerge { dest, sources } => format!("PFMERGE {} {}", dest, sources.join(" ")),
+            Request::RandomKey => "RANDOMKEY".to_string(),
+            Request::Scan { cursor, options } => format!("SCAN {}{}", cursor, options),
+            Request::Export { cursor, options } => format!("EXPORT {}{}", cursor, options),
+            Request::GetMatching { cursor, options } => format!("GETMATCHING {}{}", cursor, options),
+            Request::ScanByAge { cursor, min_age_ms, options } => format!("SCANBYAGE {} {}{}", cursor, min_age_ms, options),
+            Request::BigKeys { cursor, options } => format!("BIGKEYS {}{}", cursor, options),
+            Request::Move { key, db } => format!("MOVE {} {}", key, db),
+            Request::SwapDb { a, b } => format!("SWAPDB {} {}", a, b),
+            Request::Dump { key } => format!("DUMP {}", key),
+            Request::DebugObject { key } => format!("DEBUG OBJECT {}", key),
+            Request::DebugTiming { enabled } => format!("DEBUG TIMING {}", if *enabled { "ON" } else { "OFF" }),
+            Request::DebugLogTail { count } => format!("DEBUG LOGTAIL {}", count),
+            Request::KeyStats { prefix } => format!("KEYSTATS {}", prefix),
+            Request::Warmup { patterns } if patterns.is_empty() => "WARMUP".to_string(),
+            Request::Warmup { patterns } => format!("WARMUP {}", patterns.join(" ")),
+            Request::Compact => "COMPACT".to_string(),
+            Request::CompactStatus => "COMPACT STATUS".to_string(),
+            Request::CompactCancel => "COMPACT CANCEL".to_string(),
+            Request::CompactKey { key } => format!("COMPACT KEY {}", key),
+            Request::Save { path } => format!("SAVE {}", path),
+            Request::BgSave { path } => format!("BGSAVE {}", path),
+            Request::LastSave => "LASTSAVE".to_string(),
+            Request::SnapshotInfo { path } => format!("SNAPSHOT INFO {}", path),
+            Request::AuditLogGet { count } => format!("AUDITLOG GET {}", count),
+            Request::AuditLogLen => "AUDITLOG LEN".to_string(),
+            Request::AuditLogReset => "AUDITLOG RESET".to_string(),
+            Request::Shutdown { save } => format!("SHUTDOWN {}", if *save { "SAVE" } else { "NOSAVE" }),
+            Request::MemoryUsage { key } => format!("MEMORY USAGE {}", key),
+            Request::ObjectEncoding { key } => format!("OBJECT ENCODING {}", key),
+            Request::MemoryStats => "MEMORY STATS".to_string(),
+            Request::ExpireStats => "EXPIRESTATS".to_string(),
+            Request::ConfigGet { parameter } => format!("CONFIG GET {}", parameter),
+            Request::ConfigSet { parameter, value } => format!("CONFIG SET {} {}", parameter, value),
+            Request::ClientSetName { name } => format!("CLIENT SETNAME {}", name),
+            Request::ClientGetName => "CLIENT GETNAME".to_string(),
+            Request::ClientList => "CLIENT LIST".to_string(),
+            Request::Restore { key, ttl, payload, replace } => {
+                if *replace {
+                    format!("RESTORE {} {} {} REPLACE", key, ttl, payload)
+                } else {
+                    format!("RESTORE {} {} {}", key, ttl, payload)
+                }
+            }
+            Request::Expire { key, ttl_ms } => format!("PEXPIRE {} {}", key, ttl_ms),
+            Request::ExpireMatching { pattern, ttl_ms } => format!("EXPIREMATCHING {} {}", pattern, ttl_ms),
+            Request::Ttl { key } => format!("TTL {}", key),
+            Request::PTtl { key } => format!("PTTL {}", key),
+            Request::MTtl { keys } => format!("MTTL {}", keys.join(" ")),
+            Request::Changes { offset, count, block } => match block {
+                Some(block) => format!("CHANGES {} COUNT {} BLOCK {}", offset, count, block.as_millis()),
+                None => format!("CHANGES {} COUNT {}", offset, count),
+            },
+            Request::Persist { key } => format!("PERSIST {}", key),
+            Request::RenamePersist { src, dst } => format!("RENAMEPERSIST {} {}", src, dst),
+            Request::Swap { a, b, with_ttl } => format!("SWAP {} {}{}", a, b, if *with_ttl { " WITHTTL" } else { "" }),
+            Request::DelIfEq { key, value } => format!("DELIFEQ {} {}", key, value),
+            Request::GetOrSet { key, value } => format!("GETORSET {} {}", key, value),
+            Request::SetIfVersion { key, expected, value } => format!("SETIFVERSION {} {} {}", key, expected, value),
+            Request::GetIfChanged { key, since } => format!("GETIFCHANGED {} {}", key, since),
+            Request::SetTagged { key, value, tags } if tags.is_empty() => format!("SETTAGGED {} {}", key, value),
+            Request::SetTagged { key, value, tags } => format!("SETTAGGED {} {} {}", key, value, tags.join(" ")),
+            Request::KeysByTag { tag } => format!("KEYSBYTAG {}", tag),
+            Request::Invoke { function, key, args } if args.is_empty() => format!("INVOKE {} {}", function, key),
+            Request::Invoke { function, key, args } => format!("INVOKE {} {} {}", function, key, args.join(" ")),
             Request::Ping => "PING".to_string(),
+            Request::Time => "TIME".to_string(),
             Request::Echo { message } => format!("ECHO {}", message),
             Request::FlushDb => "FLUSHDB".to_string(),
             Request::Info => "INFO".to_string(),
+            Request::Metrics => "METRICS".to_string(),
+            Request::Hello { protover } => format!("HELLO {}", protover),
+            Request::Select { index } => format!("SELECT {}", index),
+            Request::Subscribe { channels } => format!("SUBSCRIBE {}", channels.join(" ")),
+            Request::Unsubscribe { channels } => {
+                if channels.is_empty() {
+                    "UNSUBSCRIBE".to_string()
+                } else {
+                    format!("UNSUBSCRIBE {}", channels.join(" "))
+                }
+            }
+            Request::Publish { channel, message } => format!("PUBLISH {} {}", channel, message),
+            Request::SetPublish { key, value, channel } => format!("SETPUBLISH {} {} {}", key, value, channel),
+            Request::PubSubChannels { pattern: Some(pattern) } => format!("PUBSUB CHANNELS {}", pattern),
+            Request::PubSubChannels { pattern: None } => "PUBSUB CHANNELS".to_string(),
+            Request::PubSubNumSub { channels } if channels.is_empty() => "PUBSUB NUMSUB".to_string(),
+            Request::PubSubNumSub { channels } => format!("PUBSUB NUMSUB {}", channels.join(" ")),
         }
     }
 }
 
 impl Request {
+    /// Whether the request only reads data and leaves the connection state
+    /// untouched, so it may run concurrently with other such requests.
+    pub fn is_read_only(&self) -> bool {
+        matches!(
+            self,
+            Request::Get { .. }
+                | Request::GetIfChanged { .. }
+                | Request::LRange { .. }
+                | Request::LLen { .. }
+                | Request::SMembers { .. }
+                | Request::SIsMember { .. }
+                | Request::SMIsMember { .. }
+                | Request::SCard { .. }
+                | Request::SRandMember { .. }
+                | Request::HGet { .. }
+                | Request::HGetAll { .. }
+                | Request::HExists { .. }
+                | Request::ZRange { .. }
+                | Request::ZScore { .. }
+                | Request::ZCard { .. }
+                | Request::JsonGet { .. }
+                | Request::XRange { .. }
+                | Request::XLen { .. }
+                | Request::GetBit { .. }
+                | Request::BitCount { .. }
+                | Request::PfCount { .. }
+                | Request::Type { .. }
+                | Request::Exists { .. }
+                | Request::RandomKey
+                | Request::Scan { .. }
+                | Request::Export { .. }
+                | Request::GetMatching { .. }
+                | Request::ScanByAge { .. }
+                | Request::BigKeys { .. }
+                | Request::KeysByTag { .. }
+                | Request::Dump { .. }
+                | Request::DebugObject { .. }
+                | Request::KeyStats { .. }
+                | Request::MemoryUsage { .. }
+                | Request::ObjectEncoding { .. }
+                | Request::MemoryStats
+                | Request::Ttl { .. }
+                | Request::PTtl { .. }
+                | Request::MTtl { .. }
+                | Request::Ping
+                | Request::Time
+                | Request::Echo { .. }
+        )
+    }
+
+    /// Whether the request changes data, so it counts towards the backlog
+    /// of pending writes and is refused while that is full. Commands that
+    /// only touch the connection or report on the server are never held
+    /// back.
+    pub fn is_write(&self) -> bool {
+        !self.is_read_only()
+            && !matches!(
+                self,
+                Request::Changes { .. }
+                    | Request::DebugTiming { .. }
+                    | Request::DebugLogTail { .. }
+                    | Request::ClientSetName { .. }
+                    | Request::ClientGetName
+                    | Request::ClientList
+                    | Request::Warmup { .. }
+                    | Request::Compact
+                    | Request::CompactStatus
+                    | Request::CompactCancel
+                    | Request::CompactKey { .. }
+                    | Request::Save { .. }
+                    | Request::BgSave { .. }
+                    | Request::LastSave
+                    | Request::SnapshotInfo { .. }
+                    | Request::ExpireStats
+                    | Request::ConfigGet { .. }
+                    | Request::ConfigSet { .. }
+                    | Request::AuditLogGet { .. }
+                    | Request::AuditLogLen
+                    | Request::AuditLogReset
+                    | Request::Shutdown { .. }
+                    | Request::Info
+                    | Request::Metrics
+                    | Request::Hello { .. }
+                    | Request::Select { .. }
+                    | Request::Subscribe { .. }
+                    | Request::Unsubscribe { .. }
+                    | Request::Publish { .. }
+                    | Request::PubSubChannels { .. }
+                    | Request::PubSubNumSub { .. }
+            )
+    }
+
+    /// The class whose execution budget applies to the request, or `None`
+    /// for requests that write, which always run to completion. The one
+    /// write with a class, EXPIREMATCHING, checks its budget itself between
+    /// pages rather than being cancelled.
+    pub fn command_class(&self) -> Option<CommandClass> {
+        match self {
+            Request::Scan { .. }
+            | Request::Export { .. }
+            | Request::GetMatching { .. }
+            | Request::ScanByAge { .. }
+            | Request::BigKeys { .. }
+            | Request::KeysByTag { .. }
+            | Request::ExpireMatching { .. } => Some(CommandClass::Keyspace),
+            request if request.is_read_only() => Some(CommandClass::Read),
+            _ => None,
+        }
+    }
+
     pub fn parse(input: &str) -> Result<Self> {
-        // Use C parser if feature is enabled
+        // Use C parser if feature is enabled. It knows neither quoting nor
+        // command options and does not check arity, so it only takes the
+        // plain forms of the hottest commands.
         #[cfg(feature = "c_parser")]
         {
-            return crate::ffi::parser::parse_request_fast(input);
+            if Self::fast_path_eligible(input) {
+                if let Ok(request) = crate::ffi::parser::parse_request_fast(input) {
+                    return Ok(request);
+                }
+            }
+            return Self::parse_rust(input);
         }
         
         // Fall back to Rust parser
@@ -192,8 +821,28 @@ impl Request {
         }
     }
     
+    /// Whether the C parser reads `input` exactly as `parse_rust` would:
+    /// an unquoted GET, INCR or DECR of one key or SET of a key and value.
+    #[cfg(feature = "c_parser")]
+    fn fast_path_eligible(input: &str) -> bool {
+        if input.contains(['"', '\'', '\\']) {
+            return false;
+        }
+        let line = input.trim_end_matches(['\r', '\n']);
+        let mut parts = line.split([' ', '\t']).filter(|part| !part.is_empty());
+        let expected = match parts.next() {
+            Some(cmd) if cmd.eq_ignore_ascii_case("GET")
+                || cmd.eq_ignore_ascii_case("INCR")
+                || cmd.eq_ignore_ascii_case("DECR") => 1,
+            Some(cmd) if cmd.eq_ignore_ascii_case("SET") => 2,
+            _ => return false,
+        };
+        parts.count() == expected
+    }
+
     pub fn parse_rust(input: &str) -> Result<Self> {
-        let parts: Vec<&str> = input.split_whitespace().collect();
+        let args = split_args(input)?;
+        let parts: Vec<&str> = args.iter().map(|s| s.as_str()).collect();
         
         if parts.is_empty() {
             return Err(DiskDBError::Protocol("Empty command".to_string()));
@@ -211,6 +860,17 @@ impl Request {
                 if parts.len() < 3 {
                     return Err(DiskDBError::Protocol("SET requires at least two arguments".to_string()));
                 }
+                // Trailing tokens are options only if all of them parse as
+                // such; otherwise they are words of an unquoted value
+                if parts.len() > 3 {
+                    if let Some(options) = SetOptions::parse(&parts[3..]) {
+                        return Ok(Request::SetWith {
+                            key: parts[1].to_string(),
+                            value: parts[2].to_string(),
+                            options,
+                        });
+                    }
+                }
                 let value = parts[2..].join(" ");
                 Ok(Request::Set { 
                     key: parts[1].to_string(), 
@@ -237,6 +897,79 @@ impl Request {
                     .map_err(|_| DiskDBError::Protocol("Invalid integer".to_string()))?;
                 Ok(Request::IncrBy { key: parts[1].to_string(), delta })
             }
+            "INCRPX" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("INCRPX requires exactly two arguments".to_string()));
+                }
+                let ttl_ms = parts[2].parse::<u64>()
+                    .ok()
+                    .filter(|&ms| ms > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid expire time".to_string()))?;
+                Ok(Request::IncrPx { key: parts[1].to_string(), ttl_ms })
+            }
+            "GETEX" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("GETEX requires a key and EX seconds or PX milliseconds".to_string()));
+                }
+                let amount = parts[3].parse::<u64>()
+                    .ok()
+                    .filter(|&n| n > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid expire time".to_string()))?;
+                let ttl_ms = match parts[2].to_uppercase().as_str() {
+                    "EX" => amount.checked_mul(1000)
+                        .ok_or_else(|| DiskDBError::Protocol("Invalid expire time".to_string()))?,
+                    "PX" => amount,
+                    other => return Err(DiskDBError::Protocol(format!("Unknown GETEX option '{}'", other))),
+                };
+                Ok(Request::GetEx { key: parts[1].to_string(), ttl_ms })
+            }
+            "INCRMULTI" => {
+                if parts.len() < 3 || parts.len() % 2 == 0 {
+                    return Err(DiskDBError::Protocol("INCRMULTI requires key and delta pairs".to_string()));
+                }
+                let deltas = parts[1..].chunks(2)
+                    .map(|pair| pair[1].parse::<i64>()
+                        .map(|delta| (pair[0].to_string(), delta))
+                        .map_err(|_| DiskDBError::Protocol("Invalid integer".to_string())))
+                    .collect::<Result<Vec<_>>>()?;
+                Ok(Request::IncrMulti { deltas })
+            }
+            "DECRREAP" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("DECRREAP requires exactly one argument".to_string()));
+                }
+                Ok(Request::DecrReap { key: parts[1].to_string() })
+            }
+            "SETIDEM" => {
+                if parts.len() != 5 {
+                    return Err(DiskDBError::Protocol("SETIDEM requires exactly four arguments".to_string()));
+                }
+                if parts[3].len() > MAX_REQUEST_ID_LEN {
+                    return Err(DiskDBError::Protocol("Request id too long".to_string()));
+                }
+                let window_ms = parts[4].parse::<u64>()
+                    .ok()
+                    .filter(|&ms| ms > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid window".to_string()))?;
+                Ok(Request::SetIdem {
+                    key: parts[1].to_string(),
+                    value: parts[2].to_string(),
+                    request_id: parts[3].to_string(),
+                    window_ms,
+                })
+            }
+            "GETRESET" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("GETRESET requires exactly one argument".to_string()));
+                }
+                Ok(Request::GetReset { key: parts[1].to_string() })
+            }
+            "ROTATE" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("ROTATE requires exactly one argument".to_string()));
+                }
+                Ok(Request::Rotate { key: parts[1].to_string() })
+            }
             "APPEND" => {
                 if parts.len() < 3 {
                     return Err(DiskDBError::Protocol("APPEND requires at least two arguments".to_string()));
@@ -244,6 +977,20 @@ impl Request {
                 let value = parts[2..].join(" ");
                 Ok(Request::Append { key: parts[1].to_string(), value })
             }
+            "APPENDCAPPED" => {
+                if parts.len() < 4 {
+                    return Err(DiskDBError::Protocol("APPENDCAPPED requires key, max bytes and a value".to_string()));
+                }
+                let max_bytes = parts[2].parse::<usize>()
+                    .ok()
+                    .filter(|&n| n > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid max bytes".to_string()))?;
+                Ok(Request::AppendCapped {
+                    key: parts[1].to_string(),
+                    max_bytes,
+                    value: parts[3..].join(" "),
+                })
+            }
             
             // List operations
             "LPUSH" => {
@@ -264,17 +1011,39 @@ impl Request {
                     values: parts[2..].iter().map(|s| s.to_string()).collect(),
                 })
             }
-            "LPOP" => {
-                if parts.len() != 2 {
-                    return Err(DiskDBError::Protocol("LPOP requires exactly one argument".to_string()));
+            "LPUSHCAPPED" | "RPUSHCAPPED" => {
+                if parts.len() < 4 {
+                    return Err(DiskDBError::Protocol(format!("{} requires key, max length and at least one value", parts[0].to_uppercase())));
+                }
+                let max_len = parts[2].parse::<i64>()
+                    .ok()
+                    .filter(|&n| n > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid max length".to_string()))?;
+                let key = parts[1].to_string();
+                let values = parts[3..].iter().map(|s| s.to_string()).collect();
+                if parts[0].eq_ignore_ascii_case("LPUSHCAPPED") {
+                    Ok(Request::LPushCapped { key, max_len, values })
+                } else {
+                    Ok(Request::RPushCapped { key, max_len, values })
                 }
-                Ok(Request::LPop { key: parts[1].to_string() })
             }
-            "RPOP" => {
-                if parts.len() != 2 {
-                    return Err(DiskDBError::Protocol("RPOP requires exactly one argument".to_string()));
+            "LPOP" | "RPOP" => {
+                let name = parts[0].to_uppercase();
+                if parts.len() != 2 && parts.len() != 3 {
+                    return Err(DiskDBError::Protocol(format!("{} requires a key and an optional count", name)));
                 }
-                Ok(Request::RPop { key: parts[1].to_string() })
+                let key = parts[1].to_string();
+                let count = match parts.get(2) {
+                    Some(count) => Some(count.parse::<usize>()
+                        .map_err(|_| DiskDBError::Protocol("Invalid count".to_string()))?),
+                    None => None,
+                };
+                Ok(match (name.as_str(), count) {
+                    ("LPOP", None) => Request::LPop { key },
+                    ("LPOP", Some(count)) => Request::LPopCount { key, count },
+                    (_, None) => Request::RPop { key },
+                    (_, Some(count)) => Request::RPopCount { key, count },
+                })
             }
             "LRANGE" => {
                 if parts.len() != 4 {
@@ -296,6 +1065,36 @@ impl Request {
                 }
                 Ok(Request::LLen { key: parts[1].to_string() })
             }
+            "LTRIM" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("LTRIM requires exactly three arguments".to_string()));
+                }
+                let start = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid start index".to_string()))?;
+                let stop = parts[3].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid stop index".to_string()))?;
+                Ok(Request::LTrim {
+                    key: parts[1].to_string(),
+                    start,
+                    stop,
+                })
+            }
+            "CLAIMJOB" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("CLAIMJOB requires exactly two arguments".to_string()));
+                }
+                let visibility_ms = parts[2].parse::<u64>()
+                    .ok()
+                    .filter(|&ms| ms > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid visibility timeout".to_string()))?;
+                Ok(Request::ClaimJob { queue: parts[1].to_string(), visibility_ms })
+            }
+            "ACKJOB" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("ACKJOB requires exactly two arguments".to_string()));
+                }
+                Ok(Request::AckJob { queue: parts[1].to_string(), id: parts[2].to_string() })
+            }
             
             // Set operations
             "SADD" => {
@@ -331,12 +1130,32 @@ impl Request {
                     member: parts[2].to_string(),
                 })
             }
+            "SMISMEMBER" => {
+                if parts.len() < 3 {
+                    return Err(DiskDBError::Protocol("SMISMEMBER requires at least two arguments".to_string()));
+                }
+                Ok(Request::SMIsMember {
+                    key: parts[1].to_string(),
+                    members: parts[2..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
             "SCARD" => {
                 if parts.len() != 2 {
                     return Err(DiskDBError::Protocol("SCARD requires exactly one argument".to_string()));
                 }
                 Ok(Request::SCard { key: parts[1].to_string() })
             }
+            "SRANDMEMBER" => {
+                if parts.len() < 2 || parts.len() > 3 {
+                    return Err(DiskDBError::Protocol("SRANDMEMBER requires one or two arguments".to_string()));
+                }
+                let count = match parts.get(2) {
+                    Some(c) => c.parse::<i64>()
+                        .map_err(|_| DiskDBError::Protocol("Invalid count".to_string()))?,
+                    None => 1,
+                };
+                Ok(Request::SRandMember { key: parts[1].to_string(), count })
+            }
             
             // Hash operations
             "HSET" => {
@@ -425,6 +1244,27 @@ impl Request {
                     with_scores,
                 })
             }
+            "ZREMRANGEBYRANK" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("ZREMRANGEBYRANK requires exactly three arguments".to_string()));
+                }
+                let start = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid start index".to_string()))?;
+                let stop = parts[3].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid stop index".to_string()))?;
+                Ok(Request::ZRemRangeByRank { key: parts[1].to_string(), start, stop })
+            }
+            "ZREMRANGEBYSCORE" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("ZREMRANGEBYSCORE requires exactly three arguments".to_string()));
+                }
+                // Float parsing takes -inf and +inf for open ends
+                let parse = |s: &str| s.parse::<f64>()
+                    .ok()
+                    .filter(|score| !score.is_nan())
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid score".to_string()));
+                Ok(Request::ZRemRangeByScore { key: parts[1].to_string(), min: parse(parts[2])?, max: parse(parts[3])? })
+            }
             "ZSCORE" => {
                 if parts.len() != 3 {
                     return Err(DiskDBError::Protocol("ZSCORE requires exactly two arguments".to_string()));
@@ -514,6 +1354,67 @@ impl Request {
                 Ok(Request::XLen { key: parts[1].to_string() })
             }
             
+            // Bitmap operations
+            "SETBIT" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("SETBIT requires exactly three arguments".to_string()));
+                }
+                let offset = parse_bit_offset(parts[2])?;
+                let value = match parts[3] {
+                    "0" => false,
+                    "1" => true,
+                    _ => return Err(DiskDBError::Protocol("ERR bit is not an integer or out of range".to_string())),
+                };
+                Ok(Request::SetBit { key: parts[1].to_string(), offset, value })
+            }
+            "GETBIT" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("GETBIT requires exactly two arguments".to_string()));
+                }
+                let offset = parse_bit_offset(parts[2])?;
+                Ok(Request::GetBit { key: parts[1].to_string(), offset })
+            }
+            "BITCOUNT" => {
+                let range = match parts.len() {
+                    2 => None,
+                    4 => {
+                        let start = parts[2].parse::<i64>()
+                            .map_err(|_| DiskDBError::Protocol("Invalid integer".to_string()))?;
+                        let end = parts[3].parse::<i64>()
+                            .map_err(|_| DiskDBError::Protocol("Invalid integer".to_string()))?;
+                        Some((start, end))
+                    }
+                    _ => return Err(DiskDBError::Protocol("BITCOUNT requires a key and optionally start and end".to_string())),
+                };
+                Ok(Request::BitCount { key: parts[1].to_string(), range })
+            }
+            
+            // HyperLogLog operations
+            "PFADD" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("PFADD requires at least one argument".to_string()));
+                }
+                Ok(Request::PfAdd {
+                    key: parts[1].to_string(),
+                    elements: parts[2..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
+            "PFCOUNT" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("PFCOUNT requires at least one argument".to_string()));
+                }
+                Ok(Request::PfCount { keys: parts[1..].iter().map(|s| s.to_string()).collect() })
+            }
+            "PFMERGE" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("PFMERGE requires at least one argument".to_string()));
+                }
+                Ok(Request::PfMerge {
+                    dest: parts[1].to_string(),
+                    sources: parts[2..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
+            
             // Utility operations
             "TYPE" => {
                 if parts.len() != 2 {
@@ -537,7 +1438,397 @@ impl Request {
                     keys: parts[1..].iter().map(|s| s.to_string()).collect(),
                 })
             }
+            "RANDOMKEY" => Ok(Request::RandomKey),
+            "SCAN" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("SCAN requires a cursor".to_string()));
+                }
+                let options = ScanOptions::parse("SCAN", &parts[2..])?;
+                Ok(Request::Scan { cursor: parts[1].to_string(), options })
+            }
+            "EXPORT" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("EXPORT requires a cursor".to_string()));
+                }
+                let options = ScanOptions::parse("EXPORT", &parts[2..])?;
+                Ok(Request::Export { cursor: parts[1].to_string(), options })
+            }
+            "GETMATCHING" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("GETMATCHING requires a cursor".to_string()));
+                }
+                let options = ScanOptions::parse("GETMATCHING", &parts[2..])?;
+                // Only string values are returned, so there is no type to pick
+                if options.type_name.is_some() {
+                    return Err(DiskDBError::Protocol("Unknown GETMATCHING option 'TYPE'".to_string()));
+                }
+                Ok(Request::GetMatching { cursor: parts[1].to_string(), options })
+            }
+            "SCANBYAGE" => {
+                if parts.len() < 3 {
+                    return Err(DiskDBError::Protocol("SCANBYAGE requires a cursor and an age in milliseconds".to_string()));
+                }
+                let min_age_ms = parts[2].parse::<u64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid age value".to_string()))?;
+                let options = ScanOptions::parse("SCANBYAGE", &parts[3..])?;
+                Ok(Request::ScanByAge { cursor: parts[1].to_string(), min_age_ms, options })
+            }
+            "BIGKEYS" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("BIGKEYS requires a cursor".to_string()));
+                }
+                let options = ScanOptions::parse("BIGKEYS", &parts[2..])?;
+                Ok(Request::BigKeys { cursor: parts[1].to_string(), options })
+            }
+            "CHANGES" => {
+                if parts.len() < 2 || parts.len() % 2 != 0 {
+                    return Err(DiskDBError::Protocol("CHANGES requires an offset and name/value option pairs".to_string()));
+                }
+                let offset = parts[1].parse::<u64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid offset value".to_string()))?;
+                let mut count = 100;
+                let mut block = None;
+                for pair in parts[2..].chunks(2) {
+                    match pair[0].to_uppercase().as_str() {
+                        "COUNT" => {
+                            count = pair[1].parse::<usize>()
+                                .ok()
+                                .filter(|&c| c > 0)
+                                .ok_or_else(|| DiskDBError::Protocol("Invalid COUNT value".to_string()))?;
+                        }
+                        "BLOCK" => {
+                            let ms = pair[1].parse::<u64>()
+                                .map_err(|_| DiskDBError::Protocol("Invalid BLOCK value".to_string()))?;
+                            block = Some(Duration::from_millis(ms));
+                        }
+                        other => return Err(DiskDBError::Protocol(format!("Unknown CHANGES option '{}'", other))),
+                    }
+                }
+                Ok(Request::Changes { offset, count, block })
+            }
+            "MOVE" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("MOVE requires exactly two arguments".to_string()));
+                }
+                let db = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid database index".to_string()))?;
+                Ok(Request::Move { key: parts[1].to_string(), db })
+            }
+            "SWAPDB" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("SWAPDB requires exactly two database indexes".to_string()));
+                }
+                let index = |s: &str| s.parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid database index".to_string()));
+                Ok(Request::SwapDb { a: index(parts[1])?, b: index(parts[2])? })
+            }
+            "DUMP" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("DUMP requires exactly one argument".to_string()));
+                }
+                Ok(Request::Dump { key: parts[1].to_string() })
+            }
+            "KEYSTATS" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("KEYSTATS requires exactly one prefix".to_string()));
+                }
+                Ok(Request::KeyStats { prefix: parts[1].to_string() })
+            }
+            "WARMUP" => Ok(Request::Warmup {
+                patterns: parts[1..].iter().map(|s| s.to_string()).collect(),
+            }),
+            "COMPACT" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (None, _) => Ok(Request::Compact),
+                    (Some("STATUS"), 2) => Ok(Request::CompactStatus),
+                    (Some("CANCEL"), 2) => Ok(Request::CompactCancel),
+                    (Some("KEY"), 3) => Ok(Request::CompactKey { key: parts[2].to_string() }),
+                    _ => Err(DiskDBError::Protocol("COMPACT takes no arguments, STATUS, CANCEL or KEY key".to_string())),
+                }
+            }
+            "SAVE" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("SAVE requires exactly one path".to_string()));
+                }
+                Ok(Request::Save { path: parts[1].to_string() })
+            }
+            "BGSAVE" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("BGSAVE requires exactly one path".to_string()));
+                }
+                Ok(Request::BgSave { path: parts[1].to_string() })
+            }
+            "LASTSAVE" => {
+                if parts.len() != 1 {
+                    return Err(DiskDBError::Protocol("LASTSAVE takes no arguments".to_string()));
+                }
+                Ok(Request::LastSave)
+            }
+            "SNAPSHOT" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("INFO"), 3) => Ok(Request::SnapshotInfo { path: parts[2].to_string() }),
+                    (Some("INFO"), _) => Err(DiskDBError::Protocol("SNAPSHOT INFO requires exactly one path".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown SNAPSHOT subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("SNAPSHOT requires a subcommand".to_string())),
+                }
+            }
+            "AUDITLOG" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("GET"), 2) => Ok(Request::AuditLogGet { count: DEFAULT_AUDIT_LOG_COUNT }),
+                    (Some("GET"), 3) => {
+                        let count = parts[2].parse::<usize>()
+                            .map_err(|_| DiskDBError::Protocol("Invalid count".to_string()))?;
+                        Ok(Request::AuditLogGet { count })
+                    }
+                    (Some("LEN"), 2) => Ok(Request::AuditLogLen),
+                    (Some("RESET"), 2) => Ok(Request::AuditLogReset),
+                    _ => Err(DiskDBError::Protocol("AUDITLOG takes GET [count], LEN or RESET".to_string())),
+                }
+            }
+            "SHUTDOWN" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (None, _) | (Some("SAVE"), 2) => Ok(Request::Shutdown { save: true }),
+                    (Some("NOSAVE"), 2) => Ok(Request::Shutdown { save: false }),
+                    _ => Err(DiskDBError::Protocol("SHUTDOWN takes no arguments, SAVE or NOSAVE".to_string())),
+                }
+            }
+            "DEBUG" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("OBJECT"), 3) => Ok(Request::DebugObject { key: parts[2].to_string() }),
+                    (Some("OBJECT"), _) => Err(DiskDBError::Protocol("DEBUG OBJECT requires exactly one key".to_string())),
+                    (Some("TIMING"), 3) => match parts[2].to_uppercase().as_str() {
+                        "ON" => Ok(Request::DebugTiming { enabled: true }),
+                        "OFF" => Ok(Request::DebugTiming { enabled: false }),
+                        _ => Err(DiskDBError::Protocol("DEBUG TIMING requires ON or OFF".to_string())),
+                    },
+                    (Some("TIMING"), _) => Err(DiskDBError::Protocol("DEBUG TIMING requires ON or OFF".to_string())),
+                    (Some("LOGTAIL"), 2) => Ok(Request::DebugLogTail { count: DEFAULT_LOG_TAIL_COUNT }),
+                    (Some("LOGTAIL"), 3) => {
+                        let count = parts[2].parse::<usize>()
+                            .map_err(|_| DiskDBError::Protocol("Invalid count".to_string()))?;
+                        Ok(Request::DebugLogTail { count })
+                    }
+                    (Some("LOGTAIL"), _) => Err(DiskDBError::Protocol("DEBUG LOGTAIL takes at most a line count".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown DEBUG subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("DEBUG requires a subcommand".to_string())),
+                }
+            }
+            "MEMORY" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("USAGE"), 3) => Ok(Request::MemoryUsage { key: parts[2].to_string() }),
+                    (Some("USAGE"), _) => Err(DiskDBError::Protocol("MEMORY USAGE requires exactly one key".to_string())),
+                    (Some("STATS"), 2) => Ok(Request::MemoryStats),
+                    (Some("STATS"), _) => Err(DiskDBError::Protocol("MEMORY STATS takes no arguments".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown MEMORY subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("MEMORY requires a subcommand".to_string())),
+                }
+            }
+            "EXPIRESTATS" => {
+                if parts.len() != 1 {
+                    return Err(DiskDBError::Protocol("EXPIRESTATS takes no arguments".to_string()));
+                }
+                Ok(Request::ExpireStats)
+            }
+            "CONFIG" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("GET"), 3) => Ok(Request::ConfigGet { parameter: parts[2].to_lowercase() }),
+                    (Some("GET"), _) => Err(DiskDBError::Protocol("CONFIG GET requires exactly one parameter".to_string())),
+                    (Some("SET"), 4) => Ok(Request::ConfigSet { parameter: parts[2].to_lowercase(), value: parts[3].to_string() }),
+                    (Some("SET"), _) => Err(DiskDBError::Protocol("CONFIG SET requires a parameter and a value".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown CONFIG subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("CONFIG requires a subcommand".to_string())),
+                }
+            }
+            "OBJECT" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("ENCODING"), 3) => Ok(Request::ObjectEncoding { key: parts[2].to_string() }),
+                    (Some("ENCODING"), _) => Err(DiskDBError::Protocol("OBJECT ENCODING requires exactly one key".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown OBJECT subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("OBJECT requires a subcommand".to_string())),
+                }
+            }
+            "CLIENT" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("SETNAME"), 3) => Ok(Request::ClientSetName { name: parts[2].to_string() }),
+                    (Some("SETNAME"), _) => Err(DiskDBError::Protocol("CLIENT SETNAME requires exactly one name".to_string())),
+                    (Some("GETNAME"), 2) => Ok(Request::ClientGetName),
+                    (Some("GETNAME"), _) => Err(DiskDBError::Protocol("CLIENT GETNAME takes no arguments".to_string())),
+                    (Some("LIST"), 2) => Ok(Request::ClientList),
+                    (Some("LIST"), _) => Err(DiskDBError::Protocol("CLIENT LIST takes no arguments".to_string())),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown CLIENT subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("CLIENT requires a subcommand".to_string())),
+                }
+            }
+            "RESTORE" => {
+                if parts.len() < 4 || parts.len() > 5 {
+                    return Err(DiskDBError::Protocol("RESTORE requires key, ttl, payload and optional REPLACE".to_string()));
+                }
+                let ttl = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid TTL value".to_string()))?;
+                let replace = match parts.get(4) {
+                    None => false,
+                    Some(opt) if opt.eq_ignore_ascii_case("REPLACE") => true,
+                    Some(_) => return Err(DiskDBError::Protocol("RESTORE only accepts the REPLACE option".to_string())),
+                };
+                Ok(Request::Restore {
+                    key: parts[1].to_string(),
+                    ttl,
+                    payload: parts[3].to_string(),
+                    replace,
+                })
+            }
+            "EXPIRE" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("EXPIRE requires exactly two arguments".to_string()));
+                }
+                let seconds = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid expire time".to_string()))?;
+                Ok(Request::Expire { key: parts[1].to_string(), ttl_ms: seconds.saturating_mul(1000) })
+            }
+            "PEXPIRE" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("PEXPIRE requires exactly two arguments".to_string()));
+                }
+                let ttl_ms = parts[2].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid expire time".to_string()))?;
+                Ok(Request::Expire { key: parts[1].to_string(), ttl_ms })
+            }
+            "EXPIREMATCHING" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("EXPIREMATCHING requires exactly two arguments".to_string()));
+                }
+                let ttl_ms = parts[2].parse::<u64>()
+                    .ok()
+                    .filter(|&ms| ms > 0)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid expire time".to_string()))?;
+                Ok(Request::ExpireMatching { pattern: parts[1].to_string(), ttl_ms })
+            }
+            "TTL" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("TTL requires exactly one argument".to_string()));
+                }
+                Ok(Request::Ttl { key: parts[1].to_string() })
+            }
+            "PTTL" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("PTTL requires exactly one argument".to_string()));
+                }
+                Ok(Request::PTtl { key: parts[1].to_string() })
+            }
+            "MTTL" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("MTTL requires at least one argument".to_string()));
+                }
+                Ok(Request::MTtl {
+                    keys: parts[1..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
+            "PERSIST" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("PERSIST requires exactly one argument".to_string()));
+                }
+                Ok(Request::Persist { key: parts[1].to_string() })
+            }
+            "RENAMEPERSIST" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("RENAMEPERSIST requires exactly two arguments".to_string()));
+                }
+                Ok(Request::RenamePersist {
+                    src: parts[1].to_string(),
+                    dst: parts[2].to_string(),
+                })
+            }
+            "SWAP" => {
+                let with_ttl = match parts.get(3) {
+                    None => false,
+                    Some(option) if option.to_uppercase() == "WITHTTL" && parts.len() == 4 => true,
+                    Some(_) => return Err(DiskDBError::Protocol("SWAP requires two keys and an optional WITHTTL".to_string())),
+                };
+                if parts.len() < 3 {
+                    return Err(DiskDBError::Protocol("SWAP requires two keys and an optional WITHTTL".to_string()));
+                }
+                Ok(Request::Swap {
+                    a: parts[1].to_string(),
+                    b: parts[2].to_string(),
+                    with_ttl,
+                })
+            }
+            "DELIFEQ" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("DELIFEQ requires exactly two arguments".to_string()));
+                }
+                Ok(Request::DelIfEq {
+                    key: parts[1].to_string(),
+                    value: parts[2].to_string(),
+                })
+            }
+            "GETORSET" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("GETORSET requires exactly two arguments".to_string()));
+                }
+                Ok(Request::GetOrSet {
+                    key: parts[1].to_string(),
+                    value: parts[2].to_string(),
+                })
+            }
+            "SETIFVERSION" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("SETIFVERSION requires exactly three arguments".to_string()));
+                }
+                let expected = parts[2].parse::<u64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid version".to_string()))?;
+                Ok(Request::SetIfVersion {
+                    key: parts[1].to_string(),
+                    expected,
+                    value: parts[3].to_string(),
+                })
+            }
+            "GETIFCHANGED" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("GETIFCHANGED requires exactly two arguments".to_string()));
+                }
+                let since = parts[2].parse::<u64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid revision".to_string()))?;
+                Ok(Request::GetIfChanged {
+                    key: parts[1].to_string(),
+                    since,
+                })
+            }
+            "SETTAGGED" => {
+                if parts.len() < 3 {
+                    return Err(DiskDBError::Protocol("SETTAGGED requires a key, a value and its tags".to_string()));
+                }
+                let mut tags: Vec<String> = Vec::new();
+                for tag in &parts[3..] {
+                    if !tags.iter().any(|held| held == tag) {
+                        tags.push(tag.to_string());
+                    }
+                }
+                Ok(Request::SetTagged { key: parts[1].to_string(), value: parts[2].to_string(), tags })
+            }
+            "KEYSBYTAG" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("KEYSBYTAG requires exactly one tag".to_string()));
+                }
+                Ok(Request::KeysByTag { tag: parts[1].to_string() })
+            }
+            "INVOKE" => {
+                if parts.len() < 3 {
+                    return Err(DiskDBError::Protocol("INVOKE requires a function and a key".to_string()));
+                }
+                Ok(Request::Invoke {
+                    function: parts[1].to_string(),
+                    key: parts[2].to_string(),
+                    args: parts[3..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
             "PING" => Ok(Request::Ping),
+            "TIME" => {
+                if parts.len() != 1 {
+                    return Err(DiskDBError::Protocol("TIME takes no arguments".to_string()));
+                }
+                Ok(Request::Time)
+            }
             "ECHO" => {
                 if parts.len() < 2 {
                     return Err(DiskDBError::Protocol("ECHO requires a message".to_string()));
@@ -546,12 +1837,328 @@ impl Request {
             }
             "FLUSHDB" => Ok(Request::FlushDb),
             "INFO" => Ok(Request::Info),
+            "METRICS" => {
+                if parts.len() != 1 {
+                    return Err(DiskDBError::Protocol("METRICS takes no arguments".to_string()));
+                }
+                Ok(Request::Metrics)
+            }
+            "HELLO" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("HELLO requires exactly one argument".to_string()));
+                }
+                let protover = parts[1].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid protocol version".to_string()))?;
+                Ok(Request::Hello { protover })
+            }
+            "SELECT" => {
+                if parts.len() != 2 {
+                    return Err(DiskDBError::Protocol("SELECT requires exactly one argument".to_string()));
+                }
+                let index = parts[1].parse::<i64>()
+                    .map_err(|_| DiskDBError::Protocol("Invalid database index".to_string()))?;
+                Ok(Request::Select { index })
+            }
+            
+            // Pub/Sub operations
+            "SUBSCRIBE" => {
+                if parts.len() < 2 {
+                    return Err(DiskDBError::Protocol("SUBSCRIBE requires at least one channel".to_string()));
+                }
+                Ok(Request::Subscribe {
+                    channels: parts[1..].iter().map(|s| s.to_string()).collect(),
+                })
+            }
+            "UNSUBSCRIBE" => Ok(Request::Unsubscribe {
+                channels: parts[1..].iter().map(|s| s.to_string()).collect(),
+            }),
+            "PUBLISH" => {
+                if parts.len() != 3 {
+                    return Err(DiskDBError::Protocol("PUBLISH requires exactly two arguments".to_string()));
+                }
+                Ok(Request::Publish {
+                    channel: parts[1].to_string(),
+                    message: parts[2].to_string(),
+                })
+            }
+            "SETPUBLISH" => {
+                if parts.len() != 4 {
+                    return Err(DiskDBError::Protocol("SETPUBLISH requires a key, a value and a channel".to_string()));
+                }
+                Ok(Request::SetPublish {
+                    key: parts[1].to_string(),
+                    value: parts[2].to_string(),
+                    channel: parts[3].to_string(),
+                })
+            }
+            "PUBSUB" => {
+                match (parts.get(1).map(|s| s.to_uppercase()).as_deref(), parts.len()) {
+                    (Some("CHANNELS"), 2) => Ok(Request::PubSubChannels { pattern: None }),
+                    (Some("CHANNELS"), 3) => Ok(Request::PubSubChannels { pattern: Some(parts[2].to_string()) }),
+                    (Some("CHANNELS"), _) => Err(DiskDBError::Protocol("PUBSUB CHANNELS takes at most one pattern".to_string())),
+                    (Some("NUMSUB"), _) => Ok(Request::PubSubNumSub {
+                        channels: parts[2..].iter().map(|s| s.to_string()).collect(),
+                    }),
+                    (Some(sub), _) => Err(DiskDBError::Protocol(format!("Unknown PUBSUB subcommand '{}'", sub))),
+                    (None, _) => Err(DiskDBError::Protocol("PUBSUB requires a subcommand".to_string())),
+                }
+            }
             
             cmd => Err(DiskDBError::InvalidCommand(cmd.to_string())),
         }
     }
 }
 
+impl Response {
+    /// Encode the response with explicit framing for connections that
+    /// negotiated protocol version 2 via `HELLO`.
+    ///
+    /// Unlike the line format, every reply carries its own length or element
+    /// count, so values may contain newlines and arrays of any size can be
+    /// read without guessing where they end.
+    pub fn to_framed(&self) -> String {
+        let mut out = String::new();
+        self.write_framed(&mut out);
+        out
+    }
+
+    fn write_framed(&self, out: &mut String) {
+        match self {
+            Response::Ok => out.push_str("+OK\r\n"),
+            Response::String(Some(val)) => {
+                out.push_str(&format!("${}\r\n", val.len()));
+                out.push_str(val);
+                out.push_str("\r\n");
+            }
+            Response::String(None) | Response::Null => out.push_str("$-1\r\n"),
+            Response::Integer(val) => out.push_str(&format!(":{}\r\n", val)),
+            Response::Array(arr) => {
+                out.push_str(&format!("*{}\r\n", arr.len()));
+                for item in arr {
+                    item.write_framed(out);
+                }
+            }
+            Response::Error(msg) => {
+                out.push('-');
+                out.push_str(&with_code(msg).replace(['\r', '\n'], " "));
+                out.push_str("\r\n");
+            }
+        }
+    }
+}
+
+/// Split a command line into arguments.
+///
+/// A single trailing `\n` or `\r\n` terminates the line and is removed.
+/// Bare tokens are separated by spaces or tabs; any other byte, including a
+/// carriage return, is part of the token. Tokens wrapped in double quotes
+/// may contain separators and the escapes `\"`, `\\`, `\n`, `\r`, `\t` and
+/// `\xHH`; tokens wrapped in single quotes are taken literally except for
+/// `\'`. A closing quote must be followed by a separator or the end of line.
+pub fn split_args(input: &str) -> Result<Vec<String>> {
+    let line = input.strip_suffix('\n')
+        .map(|line| line.strip_suffix('\r').unwrap_or(line))
+        .unwrap_or(input);
+    let mut args: Vec<Vec<u8>> = Vec::new();
+    let mut tokenizer = Tokenizer::default();
+    for &b in line.as_bytes() {
+        tokenizer.push(b, &mut |token| match token {
+            Token::Start => args.push(Vec::new()),
+            Token::Byte(b) => args.last_mut().expect("a byte belongs to a started argument").push(b),
+        })?;
+    }
+    tokenizer.finish()?;
+
+    args.into_iter()
+        .map(|arg| String::from_utf8(arg)
+            .map_err(|_| DiskDBError::Protocol("Request is not valid UTF-8".to_string())))
+        .collect()
+}
+
+/// Entries AUDITLOG GET returns when no count is given
+const DEFAULT_AUDIT_LOG_COUNT: usize = 10;
+
+/// Lines DEBUG LOGTAIL returns when no count is given
+const DEFAULT_LOG_TAIL_COUNT: usize = 100;
+
+/// Largest bit offset SETBIT and GETBIT take, which caps a bitmap at 512MB
+const MAX_BIT_OFFSET: u64 = u32::MAX as u64;
+
+fn parse_bit_offset(arg: &str) -> Result<u64> {
+    arg.parse::<u64>()
+        .ok()
+        .filter(|&offset| offset <= MAX_BIT_OFFSET)
+        .ok_or_else(|| DiskDBError::Protocol("ERR bit offset is not an integer or out of range".to_string()))
+}
+
+fn is_separator(b: u8) -> bool {
+    b == b' ' || b == b'\t'
+}
+
+/// What a byte of a command line amounts to.
+enum Token {
+    /// A new argument begins
+    Start,
+    /// The next byte of the current argument, unescaped
+    Byte(u8),
+}
+
+/// Where the tokenizer is within a command line.
+#[derive(Debug, Default, Clone, Copy)]
+enum TokenState {
+    #[default]
+    Between,
+    Bare,
+    Double,
+    /// After a backslash inside double quotes
+    DoubleEscape,
+    /// Inside a `\xHH` escape, holding the first digit once read
+    DoubleHex(Option<u8>),
+    Single,
+    /// After a backslash inside single quotes
+    SingleBackslash,
+    /// Right after a closing quote
+    Closed,
+}
+
+/// The tokenizing rules of `split_args`, applied one byte at a time so
+/// that `ArgCounter` follows exactly the same rules on a partial line. It
+/// is fed the line without its terminator.
+#[derive(Debug, Default)]
+struct Tokenizer {
+    state: TokenState,
+}
+
+impl Tokenizer {
+    fn push(&mut self, b: u8, emit: &mut impl FnMut(Token)) -> Result<()> {
+        use TokenState::*;
+        self.state = match (self.state, b) {
+            (Between, b) if is_separator(b) => Between,
+            (Between, b'"') => {
+                emit(Token::Start);
+                Double
+            }
+            (Between, b'\'') => {
+                emit(Token::Start);
+                Single
+            }
+            (Between, b) => {
+                emit(Token::Start);
+                emit(Token::Byte(b));
+                Bare
+            }
+            (Bare, b) if is_separator(b) => Between,
+            (Bare, b) => {
+                emit(Token::Byte(b));
+                Bare
+            }
+            (Double, b'"') | (Single, b'\'') => Closed,
+            (Double, b'\\') => DoubleEscape,
+            (Single, b'\\') => SingleBackslash,
+            (Double, b) | (Single, b) => {
+                emit(Token::Byte(b));
+                self.state
+            }
+            (DoubleEscape, b'x') => DoubleHex(None),
+            (DoubleEscape, b) => {
+                emit(Token::Byte(match b {
+                    b'n' => b'\n',
+                    b'r' => b'\r',
+                    b't' => b'\t',
+                    other => other,
+                }));
+                Double
+            }
+            (DoubleHex(high), b) => {
+                let digit = (b as char).to_digit(16)
+                    .ok_or_else(|| DiskDBError::Protocol("Invalid \\x escape in request".to_string()))? as u8;
+                match high {
+                    None => DoubleHex(Some(digit)),
+                    Some(high) => {
+                        emit(Token::Byte(high << 4 | digit));
+                        Double
+                    }
+                }
+            }
+            (SingleBackslash, b'\'') => {
+                emit(Token::Byte(b'\''));
+                Single
+            }
+            (SingleBackslash, b) => {
+                // Only \' is an escape; the backslash is kept and the byte
+                // read again as plain content
+                emit(Token::Byte(b'\\'));
+                self.state = Single;
+                return self.push(b, emit);
+            }
+            (Closed, b) if is_separator(b) => Between,
+            (Closed, _) => {
+                return Err(DiskDBError::Protocol("Closing quote must be followed by a space".to_string()));
+            }
+        };
+        Ok(())
+    }
+
+    /// Check that the line may end here.
+    fn finish(&self) -> Result<()> {
+        match self.state {
+            TokenState::Between | TokenState::Bare | TokenState::Closed => Ok(()),
+            TokenState::DoubleHex(_) => Err(DiskDBError::Protocol("Invalid \\x escape in request".to_string())),
+            _ => Err(DiskDBError::Protocol("Unbalanced quotes in request".to_string())),
+        }
+    }
+}
+
+/// Counts the arguments of a command line as it arrives, using the
+/// tokenizer behind `split_args`, so an oversized command can be rejected
+/// before all of it is buffered. The count always matches the number of
+/// arguments `split_args` returns for a well-formed line.
+#[derive(Debug, Default)]
+pub struct ArgCounter {
+    count: usize,
+    tokenizer: Tokenizer,
+    /// A carriage return that is only part of the line if no newline
+    /// follows it
+    carriage_return: bool,
+}
+
+impl ArgCounter {
+    /// Account for the next bytes of the line and return the number of
+    /// arguments started so far.
+    pub fn feed(&mut self, bytes: &[u8]) -> usize {
+        for &b in bytes {
+            if b == b'\n' {
+                self.carriage_return = false;
+                continue;
+            }
+            if std::mem::take(&mut self.carriage_return) {
+                self.push(b'\r');
+            }
+            if b == b'\r' {
+                self.carriage_return = true;
+            } else {
+                self.push(b);
+            }
+        }
+        self.count
+    }
+
+    fn push(&mut self, b: u8) {
+        let count = &mut self.count;
+        let counted = self.tokenizer.push(b, &mut |token| {
+            if let Token::Start = token {
+                *count += 1;
+            }
+        });
+        // A malformed line is rejected once it is read in full; until then
+        // the rest of the argument is taken as bare so that counting goes
+        // on and the line cannot dodge the limit
+        if counted.is_err() {
+            self.tokenizer.state = TokenState::Bare;
+        }
+    }
+}
+
 impl fmt::Display for Response {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         match self {
@@ -563,17 +2170,15 @@ impl fmt::Display for Response {
                 if arr.is_empty() {
                     writeln!(f, "(empty array)")
                 } else {
-                    for (i, item) in arr.iter().enumerate() {
-                        if i > 0 {
-                            write!(f, "\n")?;
-                        }
+                    // Every item already ends with its own newline
+                    for item in arr {
                         write!(f, "{}", item)?;
                     }
-                    writeln!(f)
+                    Ok(())
                 }
             }
             Response::Null => writeln!(f, "(nil)"),
-            Response::Error(msg) => writeln!(f, "ERROR: {}", msg),
+            Response::Error(msg) => writeln!(f, "ERROR: {}", with_code(msg)),
         }
     }
 }
\ No newline at end of file
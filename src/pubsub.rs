@@ -0,0 +1,139 @@
+use crate::glob::glob_match;
+use crate::protocol::Response;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use tokio::sync::mpsc::error::TrySendError;
+use tokio::sync::mpsc::Sender;
+use tokio::sync::Notify;
+
+/// How many published messages may wait in a connection's mailbox. A
+/// subscriber that falls further behind is unsubscribed from everything and
+/// its connection closed, rather than letting its backlog grow without
+/// bound.
+pub const SUBSCRIBER_BUFFER: usize = 1024;
+
+/// Glob matching every keyspace channel, see `keyspace_channel`.
+pub const KEYSPACE_CHANNELS: &str = "__keyspace@*__:*";
+
+/// Channel of `key` in database `db`, which receives "expired" when the
+/// key expires, as Redis names keyspace notification channels.
+pub fn keyspace_channel(db: usize, key: &str) -> String {
+    format!("__keyspace@{}__:{}", db, key)
+}
+
+/// The database and key of a keyspace channel, or `None` if `channel` is
+/// not one.
+pub fn parse_keyspace_channel(channel: &str) -> Option<(usize, &str)> {
+    let (db, key) = channel.strip_prefix("__keyspace@")?.split_once("__:")?;
+    Some((db.parse().ok()?, key))
+}
+
+/// A connection's mailbox for published messages.
+#[derive(Debug, Clone)]
+pub struct Subscriber {
+    id: u64,
+    sender: Sender<Response>,
+    overflow: Arc<Notify>,
+}
+
+impl Subscriber {
+    /// Completes once the mailbox has overflowed and the subscriber has been
+    /// dropped from every channel.
+    pub async fn overflowed(&self) {
+        self.overflow.notified().await
+    }
+}
+
+/// Routes published messages to the connections subscribed to a channel.
+#[derive(Debug, Default)]
+pub struct PubSub {
+    channels: Mutex<HashMap<String, HashMap<u64, Subscriber>>>,
+    next_id: AtomicU64,
+}
+
+impl PubSub {
+    /// Register a connection's mailbox, normally a channel of
+    /// `SUBSCRIBER_BUFFER` messages. Messages pushed to it are
+    /// `["message", channel, payload]` arrays.
+    pub fn subscriber(&self, sender: Sender<Response>) -> Subscriber {
+        Subscriber {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed),
+            sender,
+            overflow: Arc::new(Notify::new()),
+        }
+    }
+
+    pub fn subscribe(&self, channel: &str, subscriber: &Subscriber) {
+        let mut channels = self.channels.lock().unwrap();
+        channels.entry(channel.to_string())
+            .or_default()
+            .insert(subscriber.id, subscriber.clone());
+    }
+
+    pub fn unsubscribe(&self, channel: &str, subscriber: &Subscriber) {
+        let mut channels = self.channels.lock().unwrap();
+        if let Some(subscribers) = channels.get_mut(channel) {
+            subscribers.remove(&subscriber.id);
+            if subscribers.is_empty() {
+                channels.remove(channel);
+            }
+        }
+    }
+
+    /// Channels with at least one subscriber, sorted, only those matching
+    /// the glob `pattern` if one is given.
+    pub fn channels(&self, pattern: Option<&str>) -> Vec<String> {
+        let channels = self.channels.lock().unwrap();
+        let mut names: Vec<String> = channels.keys()
+            .filter(|channel| pattern.map_or(true, |pattern| glob_match(pattern, channel)))
+            .cloned()
+            .collect();
+        names.sort();
+        names
+    }
+
+    /// How many connections are subscribed to `channel`.
+    pub fn subscriber_count(&self, channel: &str) -> usize {
+        self.channels.lock().unwrap().get(channel).map_or(0, HashMap::len)
+    }
+
+    /// Deliver a message to every subscriber of `channel` and return how many
+    /// received it. Subscribers whose connection has gone away are dropped,
+    /// as are subscribers whose mailbox is full.
+    pub fn publish(&self, channel: &str, payload: &str) -> usize {
+        let mut channels = self.channels.lock().unwrap();
+        let Some(subscribers) = channels.get_mut(channel) else {
+            return 0;
+        };
+
+        let message = Response::Array(vec![
+            Response::String(Some("message".to_string())),
+            Response::String(Some(channel.to_string())),
+            Response::String(Some(payload.to_string())),
+        ]);
+        let mut overflowed = Vec::new();
+        subscribers.retain(|id, subscriber| match subscriber.sender.try_send(message.clone()) {
+            Ok(()) => true,
+            Err(TrySendError::Closed(_)) => false,
+            Err(TrySendError::Full(_)) => {
+                subscriber.overflow.notify_one();
+                overflowed.push(*id);
+                false
+            }
+        });
+        let delivered = subscribers.len();
+
+        // A subscriber that overflowed is disconnected, so it must not
+        // linger on its other channels either
+        if !overflowed.is_empty() {
+            for subscribers in channels.values_mut() {
+                subscribers.retain(|id, _| !overflowed.contains(id));
+            }
+            channels.retain(|_, subscribers| !subscribers.is_empty());
+        } else if delivered == 0 {
+            channels.remove(channel);
+        }
+        delivered
+    }
+}
@@ -0,0 +1,59 @@
+use std::collections::{HashMap, VecDeque};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// Longest request id SETIDEM accepts, so remembering ids takes bounded
+/// memory per id as well as in number.
+pub const MAX_REQUEST_ID_LEN: usize = 256;
+
+/// How many request ids are remembered at once unless configured otherwise.
+pub const DEFAULT_MAX_REQUEST_IDS: usize = 100_000;
+
+/// Request ids of recent idempotent writes, remembered for the window each
+/// was written with, so that a write retried within it is applied once.
+#[derive(Debug)]
+pub struct RequestIds {
+    max_ids: usize,
+    seen: Mutex<Seen>,
+}
+
+#[derive(Debug, Default)]
+struct Seen {
+    /// Until when each id is remembered
+    until: HashMap<String, Instant>,
+    /// Ids in the order they were first recorded, oldest first
+    order: VecDeque<String>,
+}
+
+impl RequestIds {
+    /// Remember up to `max_ids` ids at once. Zero means no limit.
+    pub fn new(max_ids: usize) -> Self {
+        Self { max_ids, seen: Mutex::default() }
+    }
+
+    /// Whether `id` was recorded and its window has not passed.
+    pub fn contains(&self, id: &str) -> bool {
+        let seen = self.seen.lock().unwrap();
+        seen.until.get(id).map_or(false, |until| *until > Instant::now())
+    }
+
+    /// Remember `id` for `window`. Ids whose window has passed are dropped
+    /// as new ones are recorded; past `max_ids`, the oldest are forgotten
+    /// early, so a retry arriving after that is applied again.
+    pub fn record(&self, id: &str, window: Duration) {
+        let now = Instant::now();
+        let mut seen = self.seen.lock().unwrap();
+        if seen.until.insert(id.to_string(), now + window).is_none() {
+            seen.order.push_back(id.to_string());
+        }
+        while let Some(oldest) = seen.order.front() {
+            let expired = seen.until.get(oldest).map_or(true, |until| *until <= now);
+            let over = self.max_ids > 0 && seen.until.len() > self.max_ids;
+            if !expired && !over {
+                break;
+            }
+            let oldest = seen.order.pop_front().unwrap();
+            seen.until.remove(&oldest);
+        }
+    }
+}
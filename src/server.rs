@@ -1,17 +1,48 @@
 use crate::commands::CommandExecutor;
-use crate::config::Config;
+use crate::config::{Config, ListenAddress};
 use crate::connection::Connection;
 use crate::error::Result;
-use crate::storage::Storage;
+use crate::metrics;
+use crate::protocol::Response;
+use crate::stats::ServerStats;
+use crate::storage::{Storage, StorageFactory};
 use crate::tls::create_tls_acceptor;
-use log::{error, info};
+use log::{error, info, warn};
+use std::future::Future;
+use std::os::unix::fs::FileTypeExt;
+use std::path::PathBuf;
 use std::sync::Arc;
-use tokio::net::{TcpListener, TcpStream};
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpSocket, TcpStream, UnixListener, UnixStream};
+use tokio::sync::Semaphore;
+use tokio::task::JoinSet;
+use tokio::time::timeout;
 use tokio_native_tls::TlsAcceptor;
 
+/// Most over-limit clients being told why they were refused at once
+const MAX_PENDING_REJECTIONS: usize = 64;
+
+/// Longest time spent refusing one over-limit client, TLS handshake included
+const REJECT_TIMEOUT: Duration = Duration::from_millis(500);
+
+/// Longest time spent answering one request for metrics over HTTP
+const METRICS_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Largest HTTP request head read from a metrics scraper
+const MAX_METRICS_REQUEST: usize = 8192;
+
+/// How often values of expired keys are pushed onto their dead-letter lists
+pub const DEAD_LETTER_INTERVAL: Duration = Duration::from_millis(100);
+
+/// How often expired keys are removed in the background, and keyspace
+/// channels told of the keys that expired
+pub const EXPIRATION_INTERVAL: Duration = Duration::from_millis(100);
+
 pub struct Server {
     config: Config,
     storage: Arc<dyn Storage>,
+    database_factory: Option<StorageFactory>,
     tls_acceptor: Option<TlsAcceptor>,
 }
 
@@ -31,52 +62,348 @@ impl Server {
         Ok(Self {
             config,
             storage,
+            database_factory: None,
             tls_acceptor,
         })
     }
 
+    /// Enable `config.databases` databases, opening each one other than 0
+    /// with `factory` the first time a client selects it.
+    pub fn with_database_factory(mut self, factory: StorageFactory) -> Self {
+        self.database_factory = Some(factory);
+        self
+    }
+
+    /// Serve clients on every listen address until the process ends or a
+    /// client sends SHUTDOWN.
     pub async fn start(&self) -> Result<()> {
-        let addr = format!("0.0.0.0:{}", self.config.server_port);
-        let listener = TcpListener::bind(&addr).await?;
-        info!("Server listening on {}", addr);
+        self.run_until(std::future::pending()).await
+    }
+
+    /// Serve clients on every listen address until `shutdown` completes or
+    /// a client sends SHUTDOWN, then close all the listeners. Connections
+    /// already open are left to finish on their own. Fails without serving
+    /// anyone if an address cannot be bound, and stops everything if
+    /// accepting on one fails.
+    pub async fn run_until(&self, shutdown: impl Future<Output = ()>) -> Result<()> {
+        let mut listeners = Vec::new();
+        for address in self.config.listen_addresses() {
+            listeners.push(Listener::bind(&address, &self.config).await?);
+            info!("Server listening on {}", address);
+        }
+        let metrics_listener = match &self.config.metrics_address {
+            Some(address) => {
+                let listener = bind_tcp(address, &self.config).await?;
+                info!("Serving metrics on http://{}/metrics", address);
+                Some(listener)
+            }
+            None => None,
+        };
         
         if self.config.use_tls {
             info!("TLS enabled");
         }
 
-        let executor = Arc::new(CommandExecutor::new(self.storage.clone()));
+        let stats = Arc::new(ServerStats::new(self.config.max_connections)
+            .with_key_prefixes(self.config.key_stats_prefixes.clone())
+            .with_max_pending_write_bytes(self.config.max_pending_write_bytes)
+            .with_max_commands_per_second(self.config.max_commands_per_second)
+            .with_active_expire_keys(self.config.active_expire_keys));
+        let mut executor = CommandExecutor::from_config(&self.config, self.storage.clone(), stats.clone());
+        if let Some(factory) = &self.database_factory {
+            executor = executor.with_databases(self.config.databases, factory.clone());
+        }
+        let executor = Arc::new(executor);
+        let rejections = Arc::new(Semaphore::new(MAX_PENDING_REJECTIONS));
+
+        let dead_letters = executor.clone();
+        let dead_letter_task = tokio::spawn(async move {
+            let mut interval = tokio::time::interval(DEAD_LETTER_INTERVAL);
+            loop {
+                interval.tick().await;
+                if let Err(e) = dead_letters.deliver_dead_letters().await {
+                    error!("Error delivering dead letters: {}", e);
+                }
+            }
+        });
+        let expirations = executor.clone();
+        let expiration_task = tokio::spawn(async move {
+            let mut interval = tokio::time::interval(EXPIRATION_INTERVAL);
+            loop {
+                interval.tick().await;
+                if let Err(e) = expirations.reap_expired().await {
+                    error!("Error removing expired keys: {}", e);
+                }
+                if let Err(e) = expirations.notify_expirations().await {
+                    error!("Error notifying expirations: {}", e);
+                }
+            }
+        });
+
+        // Aborting the accept loops on the way out drops the listeners they
+        // own, which closes them
+        let mut accept_loops = JoinSet::new();
+        for listener in listeners {
+            accept_loops.spawn(Self::accept_loop(
+                listener,
+                executor.clone(),
+                stats.clone(),
+                self.tls_acceptor.clone(),
+                rejections.clone(),
+            ));
+        }
+        if let Some(listener) = metrics_listener {
+            accept_loops.spawn(Self::serve_metrics(listener, executor.clone()));
+        }
+
+        let result = tokio::select! {
+            _ = shutdown => {
+                info!("Shutting down");
+                Ok(())
+            }
+            _ = executor.shutdown_requested() => {
+                info!("Shutting down on SHUTDOWN");
+                Ok(())
+            }
+            Some(joined) = accept_loops.join_next() => match joined {
+                Ok(result) => result,
+                Err(e) => Err(std::io::Error::other(e).into()),
+            },
+        };
+        accept_loops.shutdown().await;
+        dead_letter_task.abort();
+        expiration_task.abort();
+        result
+    }
+
+    /// Accept clients on `listener` and serve each on a task of its own,
+    /// until accepting fails.
+    async fn accept_loop(
+        listener: Listener,
+        executor: Arc<CommandExecutor>,
+        stats: Arc<ServerStats>,
+        tls_acceptor: Option<TlsAcceptor>,
+        rejections: Arc<Semaphore>,
+    ) -> Result<()> {
+        // Clients on Unix sockets are local and never use TLS
+        let tls_acceptor = match listener {
+            Listener::Tcp(_) => tls_acceptor,
+            Listener::Unix(..) => None,
+        };
 
         loop {
             let (stream, addr) = listener.accept().await?;
+
+            // Reject over-limit clients before spawning a task or starting a
+            // TLS handshake for them
+            let slot = match stats.try_add_client() {
+                Some(slot) => slot,
+                None => {
+                    warn!("Rejecting {}: max number of clients reached", addr);
+                    executor.audit_log().record(&addr, None, "ERR max number of clients reached");
+                    // Rejections are bounded too, so a connection storm
+                    // cannot pile up tasks holding sockets open; past the
+                    // bound, sockets are closed without an explanation
+                    if let Ok(permit) = rejections.clone().try_acquire_owned() {
+                        let tls_acceptor = tls_acceptor.clone();
+                        tokio::spawn(async move {
+                            let _permit = permit;
+                            let _ = timeout(REJECT_TIMEOUT, Self::reject_client(stream, tls_acceptor)).await;
+                        });
+                    }
+                    continue;
+                }
+            };
+
             let executor = executor.clone();
-            let tls_acceptor = self.tls_acceptor.clone();
+            let tls_acceptor = tls_acceptor.clone();
             
             tokio::spawn(async move {
-                if let Err(e) = Self::handle_client(stream, addr.to_string(), executor, tls_acceptor).await {
+                let _slot = slot;
+                if let Err(e) = Self::handle_client(stream, addr.clone(), executor, tls_acceptor).await {
                     error!("Error handling client {}: {}", addr, e);
                 }
             });
         }
     }
 
+    /// Answer HTTP requests on `listener` for `/metrics` with the server's
+    /// metrics, one request per connection, until accepting fails.
+    async fn serve_metrics(listener: TcpListener, executor: Arc<CommandExecutor>) -> Result<()> {
+        loop {
+            let (stream, addr) = listener.accept().await?;
+            let executor = executor.clone();
+            tokio::spawn(async move {
+                match timeout(METRICS_TIMEOUT, Self::answer_metrics(stream, &executor)).await {
+                    Ok(Err(e)) => warn!("Error serving metrics to {}: {}", addr, e),
+                    Err(_) => warn!("Timed out serving metrics to {}", addr),
+                    Ok(Ok(())) => {}
+                }
+            });
+        }
+    }
+
+    async fn answer_metrics(mut stream: TcpStream, executor: &CommandExecutor) -> Result<()> {
+        // Only the request line matters, but the whole head is read so that
+        // closing the socket does not reset the connection
+        let mut head = Vec::new();
+        let mut buf = [0u8; 1024];
+        while !head.windows(4).any(|window| window == b"\r\n\r\n") {
+            if head.len() > MAX_METRICS_REQUEST {
+                return Ok(());
+            }
+            let n = stream.read(&mut buf).await?;
+            if n == 0 {
+                return Ok(());
+            }
+            head.extend_from_slice(&buf[..n]);
+        }
+
+        let head = String::from_utf8_lossy(&head);
+        let mut request_line = head.lines().next().unwrap_or("").split_whitespace();
+        let method = request_line.next().unwrap_or("");
+        let path = request_line.next().unwrap_or("").split('?').next().unwrap_or("");
+        let (status, content_type, body) = match (method, path) {
+            ("GET", "/metrics") => ("200 OK", metrics::CONTENT_TYPE, executor.metrics().await?),
+            _ => ("404 Not Found", "text/plain", "Not Found\n".to_string()),
+        };
+        let reply = format!(
+            "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+            status, content_type, body.len(), body,
+        );
+        stream.write_all(reply.as_bytes()).await?;
+        stream.shutdown().await?;
+        Ok(())
+    }
+
+    /// Tell an over-limit client why it is being disconnected, completing
+    /// the TLS handshake first for TLS listeners. Input that is already in
+    /// flight is drained so that closing the socket does not reset the
+    /// connection before the client reads the error. Callers bound the
+    /// whole exchange with REJECT_TIMEOUT.
+    async fn reject_client(stream: Stream, tls_acceptor: Option<TlsAcceptor>) {
+        match (stream, tls_acceptor) {
+            (Stream::Tcp(stream), Some(acceptor)) => {
+                if let Ok(stream) = acceptor.accept(stream).await {
+                    Self::send_rejection(stream).await;
+                }
+            }
+            (Stream::Tcp(stream), None) => Self::send_rejection(stream).await,
+            (Stream::Unix(stream), _) => Self::send_rejection(stream).await,
+        }
+    }
+
+    async fn send_rejection<S>(mut stream: S)
+    where
+        S: AsyncRead + AsyncWrite + Unpin,
+    {
+        let reply = Response::Error("ERR max number of clients reached".to_string()).to_string();
+        let _ = stream.write_all(reply.as_bytes()).await;
+        let _ = stream.shutdown().await;
+
+        let mut buf = [0u8; 512];
+        while let Ok(n) = stream.read(&mut buf).await {
+            if n == 0 {
+                break;
+            }
+        }
+    }
+
     async fn handle_client(
-        stream: TcpStream,
+        stream: Stream,
         addr: String,
         executor: Arc<CommandExecutor>,
         tls_acceptor: Option<TlsAcceptor>,
     ) -> Result<()> {
-        let connection = if let Some(acceptor) = tls_acceptor {
-            match acceptor.accept(stream).await {
+        let connection = match (stream, tls_acceptor) {
+            (Stream::Tcp(stream), Some(acceptor)) => match acceptor.accept(stream).await {
                 Ok(tls_stream) => Connection::Tls(tls_stream),
                 Err(e) => {
                     error!("TLS handshake failed for {}: {}", addr, e);
                     return Err(e.into());
                 }
-            }
-        } else {
-            Connection::Plain(stream)
+            },
+            (Stream::Tcp(stream), None) => Connection::Plain(stream),
+            (Stream::Unix(stream), _) => Connection::Unix(stream),
         };
 
         connection.handle(executor, addr).await
     }
-}
\ No newline at end of file
+}
+
+/// A bound listen address.
+enum Listener {
+    Tcp(TcpListener),
+    /// The socket file is removed when the listener is dropped
+    Unix(UnixListener, PathBuf),
+}
+
+/// A client accepted by a `Listener`.
+enum Stream {
+    Tcp(TcpStream),
+    Unix(UnixStream),
+}
+
+impl Listener {
+    async fn bind(address: &ListenAddress, config: &Config) -> Result<Self> {
+        match address {
+            ListenAddress::Tcp(address) => Ok(Listener::Tcp(bind_tcp(address, config).await?)),
+            ListenAddress::Unix(path) => {
+                // A socket left behind by a server that did not shut down
+                // cleanly would fail the bind; nothing can be listening on
+                // it if connecting fails
+                let stale = std::fs::symlink_metadata(path).is_ok_and(|meta| meta.file_type().is_socket())
+                    && UnixStream::connect(path).await.is_err();
+                if stale {
+                    std::fs::remove_file(path)?;
+                }
+                Ok(Listener::Unix(UnixListener::bind(path)?, path.clone()))
+            }
+        }
+    }
+
+    /// The next client, with the address it is known by in logs and
+    /// CLIENT LIST.
+    async fn accept(&self) -> std::io::Result<(Stream, String)> {
+        match self {
+            Listener::Tcp(listener) => {
+                let (stream, addr) = listener.accept().await?;
+                Ok((Stream::Tcp(stream), addr.to_string()))
+            }
+            Listener::Unix(listener, path) => {
+                let (stream, _) = listener.accept().await?;
+                Ok((Stream::Unix(stream), format!("unix:{}", path.display())))
+            }
+        }
+    }
+}
+
+impl Drop for Listener {
+    fn drop(&mut self) {
+        if let Listener::Unix(_, path) = self {
+            let _ = std::fs::remove_file(path);
+        }
+    }
+}
+
+/// Listen on TCP `address`, trying each address a host name resolves to
+/// in turn, with the backlog and socket options `config` sets.
+/// SO_REUSEADDR lets a restarted server bind while connections of the
+/// last one linger in TIME_WAIT.
+async fn bind_tcp(address: &str, config: &Config) -> Result<TcpListener> {
+    let mut last_error = None;
+    for addr in tokio::net::lookup_host(address).await? {
+        let socket = if addr.is_ipv4() { TcpSocket::new_v4()? } else { TcpSocket::new_v6()? };
+        socket.set_reuseaddr(true)?;
+        if config.reuse_port {
+            socket.set_reuseport(true)?;
+        }
+        match socket.bind(addr).and_then(|()| socket.listen(config.listen_backlog)) {
+            Ok(listener) => return Ok(listener),
+            Err(e) => last_error = Some(e),
+        }
+    }
+    Err(last_error
+        .unwrap_or_else(|| std::io::Error::new(std::io::ErrorKind::InvalidInput, format!("{} resolves to no address", address)))
+        .into())
+}
@@ -0,0 +1,409 @@
+use std::sync::atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering};
+use std::sync::Arc;
+
+/// Server-wide counters shared between the accept loop and command execution.
+#[derive(Debug, Default)]
+pub struct ServerStats {
+    connected_clients: AtomicUsize,
+    max_clients: usize,
+    /// Size of the writes accepted and not yet applied
+    pending_write_bytes: AtomicUsize,
+    max_pending_write_bytes: usize,
+    rejected_writes: AtomicU64,
+    /// Most commands each connection may send per second. It is fixed at
+    /// startup, so a limited client cannot lift it.
+    max_commands_per_second: u64,
+    /// Commands executed, by `CommandKind`
+    commands: [AtomicU64; 3],
+    key_prefixes: Vec<PrefixStats>,
+    warmup: WarmupProgress,
+    compaction: CompactionProgress,
+    reaper: ExpirationReaper,
+    snapshot: SnapshotProgress,
+}
+
+/// GET hits and misses for keys starting with one configured prefix.
+#[derive(Debug)]
+struct PrefixStats {
+    prefix: String,
+    hits: AtomicU64,
+    misses: AtomicU64,
+}
+
+impl ServerStats {
+    /// Create stats with the given client limit. A limit of zero means unlimited.
+    pub fn new(max_clients: usize) -> Self {
+        Self {
+            connected_clients: AtomicUsize::new(0),
+            max_clients,
+            pending_write_bytes: AtomicUsize::new(0),
+            max_pending_write_bytes: 0,
+            rejected_writes: AtomicU64::new(0),
+            max_commands_per_second: 0,
+            commands: Default::default(),
+            key_prefixes: Vec::new(),
+            warmup: WarmupProgress::default(),
+            compaction: CompactionProgress::default(),
+            reaper: ExpirationReaper::default(),
+            snapshot: SnapshotProgress::default(),
+        }
+    }
+
+    /// Track GET hits and misses for keys under each of `prefixes`. Only
+    /// configured prefixes are counted, which keeps the number of counters
+    /// bounded whatever keys clients use.
+    pub fn with_key_prefixes(mut self, prefixes: Vec<String>) -> Self {
+        self.key_prefixes = prefixes.into_iter()
+            .map(|prefix| PrefixStats { prefix, hits: AtomicU64::new(0), misses: AtomicU64::new(0) })
+            .collect();
+        self
+    }
+
+    /// Refuse new writes while those pending add up to more than `max`
+    /// bytes. Zero means unlimited.
+    pub fn with_max_pending_write_bytes(mut self, max: usize) -> Self {
+        self.max_pending_write_bytes = max;
+        self
+    }
+
+    /// Refuse commands past `max` per second on each connection. Zero
+    /// means unlimited.
+    pub fn with_max_commands_per_second(mut self, max: u64) -> Self {
+        self.max_commands_per_second = max;
+        self
+    }
+
+    /// Have the background reaper remove up to `keys` expired keys from
+    /// each open database per cycle. Zero leaves them until they are read.
+    pub fn with_active_expire_keys(self, keys: usize) -> Self {
+        self.reaper.set_keys_per_cycle(keys);
+        self
+    }
+
+    /// Count a GET of `key` against every tracked prefix it starts with.
+    pub fn record_get(&self, key: &str, hit: bool) {
+        for stats in self.key_prefixes.iter().filter(|s| key.starts_with(&s.prefix)) {
+            let counter = if hit { &stats.hits } else { &stats.misses };
+            counter.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Count a command of the given kind as executed.
+    pub fn record_command(&self, kind: CommandKind) {
+        self.commands[kind as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Commands of the given kind executed since startup.
+    pub fn commands(&self, kind: CommandKind) -> u64 {
+        self.commands[kind as usize].load(Ordering::Relaxed)
+    }
+
+    /// GET hits and misses recorded for `prefix`, or `None` if it is not
+    /// tracked.
+    pub fn key_stats(&self, prefix: &str) -> Option<(u64, u64)> {
+        self.key_prefixes.iter()
+            .find(|s| s.prefix == prefix)
+            .map(|s| (s.hits.load(Ordering::Relaxed), s.misses.load(Ordering::Relaxed)))
+    }
+
+    /// Reserve a slot for a new client, or `None` when the limit is reached.
+    /// The slot is released when the returned guard is dropped.
+    pub fn try_add_client(self: &Arc<Self>) -> Option<ClientSlot> {
+        let reserved = self.connected_clients.fetch_update(Ordering::AcqRel, Ordering::Acquire, |current| {
+            if self.max_clients > 0 && current >= self.max_clients {
+                None
+            } else {
+                Some(current + 1)
+            }
+        });
+        reserved.ok().map(|_| ClientSlot(self.clone()))
+    }
+
+    /// Count a write of `size` bytes as pending, or return `None` when that
+    /// would take the pending writes over the limit. A write is let through
+    /// whatever its size when nothing else is pending, so one larger than
+    /// the limit is slowed down rather than refused forever. The bytes stay
+    /// pending until the returned guard is dropped.
+    pub fn try_reserve_write(self: &Arc<Self>, size: usize) -> Option<WriteReservation> {
+        let reserved = self.pending_write_bytes.fetch_update(Ordering::AcqRel, Ordering::Acquire, |pending| {
+            if self.max_pending_write_bytes > 0 && pending > 0 && pending + size > self.max_pending_write_bytes {
+                None
+            } else {
+                Some(pending + size)
+            }
+        });
+        match reserved {
+            Ok(_) => Some(WriteReservation { stats: self.clone(), size }),
+            Err(_) => {
+                self.rejected_writes.fetch_add(1, Ordering::Relaxed);
+                None
+            }
+        }
+    }
+
+    /// Bytes of writes pending, their limit and the number of writes
+    /// refused for going over it, for INFO.
+    pub fn write_backlog(&self) -> (usize, usize, u64) {
+        (
+            self.pending_write_bytes.load(Ordering::Acquire),
+            self.max_pending_write_bytes,
+            self.rejected_writes.load(Ordering::Relaxed),
+        )
+    }
+
+    pub fn connected_clients(&self) -> usize {
+        self.connected_clients.load(Ordering::Acquire)
+    }
+
+    pub fn max_clients(&self) -> usize {
+        self.max_clients
+    }
+
+    pub fn max_commands_per_second(&self) -> u64 {
+        self.max_commands_per_second
+    }
+
+    pub fn warmup(&self) -> &WarmupProgress {
+        &self.warmup
+    }
+
+    pub fn compaction(&self) -> &CompactionProgress {
+        &self.compaction
+    }
+
+    pub fn reaper(&self) -> &ExpirationReaper {
+        &self.reaper
+    }
+
+    pub fn snapshot(&self) -> &SnapshotProgress {
+        &self.snapshot
+    }
+}
+
+/// Kinds of commands counted separately for METRICS.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CommandKind {
+    /// Commands that only read data
+    Read = 0,
+    /// Commands that change data
+    Write = 1,
+    /// Commands that manage the connection or report on the server
+    Other = 2,
+}
+
+impl CommandKind {
+    pub const ALL: [CommandKind; 3] = [CommandKind::Read, CommandKind::Write, CommandKind::Other];
+
+    /// Name used for the kind in metric labels
+    pub fn name(&self) -> &'static str {
+        match self {
+            CommandKind::Read => "read",
+            CommandKind::Write => "write",
+            CommandKind::Other => "other",
+        }
+    }
+}
+
+/// Progress of the latest WARMUP, for INFO.
+#[derive(Debug, Default)]
+pub struct WarmupProgress {
+    running: AtomicBool,
+    scanned: AtomicU64,
+    loaded: AtomicU64,
+}
+
+impl WarmupProgress {
+    /// Mark a warmup as started and reset the counts, or return false if
+    /// one is already running.
+    pub fn try_start(&self) -> bool {
+        if self.running.compare_exchange(false, true, Ordering::AcqRel, Ordering::Acquire).is_err() {
+            return false;
+        }
+        self.scanned.store(0, Ordering::Relaxed);
+        self.loaded.store(0, Ordering::Relaxed);
+        true
+    }
+
+    /// Count `scanned` keys walked over, `loaded` of which matched and
+    /// were read.
+    pub fn record(&self, scanned: u64, loaded: u64) {
+        self.scanned.fetch_add(scanned, Ordering::Relaxed);
+        self.loaded.fetch_add(loaded, Ordering::Relaxed);
+    }
+
+    pub fn finish(&self) {
+        self.running.store(false, Ordering::Release);
+    }
+
+    /// Whether a warmup is running, with the keys it (or the last one)
+    /// scanned and loaded.
+    pub fn snapshot(&self) -> (bool, u64, u64) {
+        (
+            self.running.load(Ordering::Acquire),
+            self.scanned.load(Ordering::Relaxed),
+            self.loaded.load(Ordering::Relaxed),
+        )
+    }
+}
+
+/// Progress of the latest COMPACT, for COMPACT STATUS.
+#[derive(Debug, Default)]
+pub struct CompactionProgress {
+    running: AtomicBool,
+    cancelled: AtomicBool,
+    percent: AtomicU64,
+    reclaimed_bytes: AtomicU64,
+}
+
+impl CompactionProgress {
+    /// Mark a compaction as started and reset its progress, or return
+    /// false if one is already running.
+    pub fn try_start(&self) -> bool {
+        if self.running.compare_exchange(false, true, Ordering::AcqRel, Ordering::Acquire).is_err() {
+            return false;
+        }
+        self.cancelled.store(false, Ordering::Relaxed);
+        self.percent.store(0, Ordering::Relaxed);
+        self.reclaimed_bytes.store(0, Ordering::Relaxed);
+        true
+    }
+
+    /// Ask the running compaction, if any, to stop.
+    pub fn cancel(&self) {
+        if self.running.load(Ordering::Acquire) {
+            self.cancelled.store(true, Ordering::Release);
+        }
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.cancelled.load(Ordering::Acquire)
+    }
+
+    /// Record how far the compaction got and how many bytes it freed.
+    pub fn record(&self, percent: u64, reclaimed_bytes: u64) {
+        self.percent.store(percent.min(100), Ordering::Relaxed);
+        self.reclaimed_bytes.store(reclaimed_bytes, Ordering::Relaxed);
+    }
+
+    pub fn finish(&self) {
+        self.running.store(false, Ordering::Release);
+    }
+
+    /// Whether a compaction is running, with the percentage of the keys it
+    /// (or the last one) compacted and the bytes it reclaimed.
+    pub fn snapshot(&self) -> (bool, u64, u64) {
+        (
+            self.running.load(Ordering::Acquire),
+            self.percent.load(Ordering::Relaxed),
+            self.reclaimed_bytes.load(Ordering::Relaxed),
+        )
+    }
+}
+
+/// State of SAVE and BGSAVE, for INFO and LASTSAVE.
+#[derive(Debug, Default)]
+pub struct SnapshotProgress {
+    running: AtomicBool,
+    failed: AtomicBool,
+    /// When the latest successful snapshot finished, in milliseconds since
+    /// the epoch, or 0 if none has
+    last_save_ms: AtomicU64,
+}
+
+impl SnapshotProgress {
+    /// Mark a snapshot as started, or return false if one is already
+    /// running.
+    pub fn try_start(&self) -> bool {
+        self.running.compare_exchange(false, true, Ordering::AcqRel, Ordering::Acquire).is_ok()
+    }
+
+    /// Mark the running snapshot as done at `now_ms`, whether it was saved
+    /// or not.
+    pub fn finish(&self, now_ms: u64, saved: bool) {
+        if saved {
+            self.last_save_ms.store(now_ms, Ordering::Relaxed);
+        }
+        self.failed.store(!saved, Ordering::Relaxed);
+        self.running.store(false, Ordering::Release);
+    }
+
+    /// Whether a snapshot is running, whether the latest one failed, and
+    /// when the latest successful one finished.
+    pub fn status(&self) -> (bool, bool, u64) {
+        (
+            self.running.load(Ordering::Acquire),
+            self.failed.load(Ordering::Relaxed),
+            self.last_save_ms.load(Ordering::Relaxed),
+        )
+    }
+}
+
+/// Setting and latest cycle of the background reaper of expired keys, for
+/// EXPIRESTATS.
+#[derive(Debug, Default)]
+pub struct ExpirationReaper {
+    /// Most keys removed from each open database per cycle, changed at
+    /// runtime with CONFIG SET
+    keys_per_cycle: AtomicUsize,
+    cycles: AtomicU64,
+    last_cycle_ms: AtomicU64,
+    /// Keys with an expiry looked at per second in the latest cycle
+    scan_rate: AtomicU64,
+    last_reaped: AtomicU64,
+    total_reaped: AtomicU64,
+}
+
+impl ExpirationReaper {
+    pub fn keys_per_cycle(&self) -> usize {
+        self.keys_per_cycle.load(Ordering::Relaxed)
+    }
+
+    pub fn set_keys_per_cycle(&self, keys: usize) {
+        self.keys_per_cycle.store(keys, Ordering::Relaxed);
+    }
+
+    /// Count a cycle ending at `now_ms` that looked at `examined` keys with
+    /// an expiry and removed `reaped` of them. The scan rate spreads them
+    /// over the time since the cycle before.
+    pub fn record(&self, now_ms: u64, examined: u64, reaped: u64) {
+        let previous = self.last_cycle_ms.swap(now_ms, Ordering::Relaxed);
+        let elapsed = now_ms.saturating_sub(previous).max(1);
+        let rate = if previous == 0 { 0 } else { examined.saturating_mul(1000) / elapsed };
+        self.scan_rate.store(rate, Ordering::Relaxed);
+        self.last_reaped.store(reaped, Ordering::Relaxed);
+        self.total_reaped.fetch_add(reaped, Ordering::Relaxed);
+        self.cycles.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Cycles run, keys looked at per second and removed in the latest
+    /// one, and keys removed since startup.
+    pub fn snapshot(&self) -> (u64, u64, u64, u64) {
+        (
+            self.cycles.load(Ordering::Relaxed),
+            self.scan_rate.load(Ordering::Relaxed),
+            self.last_reaped.load(Ordering::Relaxed),
+            self.total_reaped.load(Ordering::Relaxed),
+        )
+    }
+}
+
+/// A reserved client slot, released on drop.
+pub struct ClientSlot(Arc<ServerStats>);
+
+impl Drop for ClientSlot {
+    fn drop(&mut self) {
+        self.0.connected_clients.fetch_sub(1, Ordering::AcqRel);
+    }
+}
+
+/// Bytes of a pending write, released on drop.
+pub struct WriteReservation {
+    stats: Arc<ServerStats>,
+    size: usize,
+}
+
+impl Drop for WriteReservation {
+    fn drop(&mut self) {
+        self.stats.pending_write_bytes.fetch_sub(self.size, Ordering::AcqRel);
+    }
+}
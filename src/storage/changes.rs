@@ -0,0 +1,44 @@
+use crate::data_types::DataType;
+use serde::{Deserialize, Serialize};
+
+/// What a recorded write did to its key.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum ChangeOp {
+    /// The key was written with this value
+    Set(DataType),
+    /// The key was deleted or expired
+    Delete,
+    /// The key's expiry was set, in milliseconds since the epoch, or
+    /// removed
+    Expire(Option<u64>),
+}
+
+/// One write in a change log. Offsets count up from 0 in the order the
+/// writes were applied.
+#[derive(Debug, Clone)]
+pub struct Change {
+    pub offset: u64,
+    pub key: String,
+    pub op: ChangeOp,
+}
+
+impl ChangeOp {
+    /// Name of the operation in CHANGES records
+    pub fn name(&self) -> &'static str {
+        match self {
+            ChangeOp::Set(_) => "set",
+            ChangeOp::Delete => "del",
+            ChangeOp::Expire(_) => "expire",
+        }
+    }
+}
+
+/// Changes read from a change log, with the offsets it currently holds.
+#[derive(Debug, Clone)]
+pub struct ChangePage {
+    pub changes: Vec<Change>,
+    /// Oldest offset still retained
+    pub first: u64,
+    /// Offset the next write will be recorded at
+    pub next: u64,
+}
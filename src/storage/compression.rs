@@ -0,0 +1,171 @@
+use crate::error::{DiskDBError, Result};
+use std::borrow::Cow;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+/// Start of every zstd frame. Uncompressed values are bincode encodings of
+/// `DataType`, which start with the variant index as a little-endian u32,
+/// so they never begin with these bytes and both kinds can share a column.
+const ZSTD_MAGIC: [u8; 4] = [0x28, 0xb5, 0x2f, 0xfd];
+
+/// How values are compressed on disk.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Compression {
+    /// Values whose encoding is shorter than this many bytes are stored as
+    /// is, since compressing them costs CPU for little gain
+    pub min_size: usize,
+    /// zstd compression level
+    pub level: i32,
+}
+
+impl Default for Compression {
+    fn default() -> Self {
+        Self {
+            min_size: 1024,
+            level: zstd::DEFAULT_COMPRESSION_LEVEL,
+        }
+    }
+}
+
+/// How SET ... ENCODING asks for a value to be stored. A hint the value
+/// does not suit is dropped, and the value stored as it would be without
+/// one.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ValueEncoding {
+    /// Store the value as is, never compressed
+    Raw,
+    /// Store an integer as is, never compressed; values that are not
+    /// integers are stored as without a hint
+    Int,
+    /// Compress the value whatever its size and whether or not compression
+    /// is configured, unless compressing it saves no space
+    Compressed,
+}
+
+impl ValueEncoding {
+    pub fn parse(name: &str) -> Option<Self> {
+        match name.to_lowercase().as_str() {
+            "raw" => Some(ValueEncoding::Raw),
+            "int" => Some(ValueEncoding::Int),
+            "compressed" => Some(ValueEncoding::Compressed),
+            _ => None,
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            ValueEncoding::Raw => "raw",
+            ValueEncoding::Int => "int",
+            ValueEncoding::Compressed => "compressed",
+        }
+    }
+}
+
+/// Compression figures for INFO, covering values written since startup.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct CompressionStats {
+    pub min_size: usize,
+    /// Values written, compressed or not
+    pub values: u64,
+    /// Values stored compressed
+    pub compressed: u64,
+    /// Size of the values written before compression
+    pub raw_bytes: u64,
+    /// Size of the values as stored
+    pub stored_bytes: u64,
+}
+
+impl CompressionStats {
+    /// Bytes before compression per byte stored, 1.0 before any write.
+    pub fn ratio(&self) -> f64 {
+        if self.stored_bytes == 0 {
+            return 1.0;
+        }
+        self.raw_bytes as f64 / self.stored_bytes as f64
+    }
+}
+
+/// Compresses values as configured and keeps the running totals.
+#[derive(Debug, Default)]
+pub struct Compressor {
+    compression: Compression,
+    values: AtomicU64,
+    compressed: AtomicU64,
+    raw_bytes: AtomicU64,
+    stored_bytes: AtomicU64,
+}
+
+impl Compressor {
+    pub fn new(compression: Compression) -> Self {
+        Self {
+            compression,
+            ..Self::default()
+        }
+    }
+
+    /// The form of the encoded value `raw` to store: compressed if it is
+    /// large enough, or `encoding` asks for it, and compressing it saves
+    /// space.
+    pub fn encode(&self, raw: Vec<u8>, encoding: Option<ValueEncoding>) -> Result<Vec<u8>> {
+        let raw_len = raw.len() as u64;
+        let wanted = match encoding {
+            Some(ValueEncoding::Compressed) => true,
+            Some(ValueEncoding::Raw | ValueEncoding::Int) => false,
+            None => raw.len() >= self.compression.min_size,
+        };
+        let mut stored = raw;
+        if wanted {
+            let compressed = compress(&stored, self.compression.level)?;
+            if compressed.len() < stored.len() {
+                stored = compressed;
+                self.compressed.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        self.values.fetch_add(1, Ordering::Relaxed);
+        self.raw_bytes.fetch_add(raw_len, Ordering::Relaxed);
+        self.stored_bytes.fetch_add(stored.len() as u64, Ordering::Relaxed);
+        Ok(stored)
+    }
+
+    pub fn stats(&self) -> CompressionStats {
+        CompressionStats {
+            min_size: self.compression.min_size,
+            values: self.values.load(Ordering::Relaxed),
+            compressed: self.compressed.load(Ordering::Relaxed),
+            raw_bytes: self.raw_bytes.load(Ordering::Relaxed),
+            stored_bytes: self.stored_bytes.load(Ordering::Relaxed),
+        }
+    }
+}
+
+/// The form of the encoded value `raw` to store where compression is not
+/// configured: compressed only if `encoding` asks for it and that saves
+/// space.
+pub fn encode_unconfigured(raw: Vec<u8>, encoding: Option<ValueEncoding>) -> Result<Vec<u8>> {
+    if encoding != Some(ValueEncoding::Compressed) {
+        return Ok(raw);
+    }
+    let compressed = compress(&raw, Compression::default().level)?;
+    Ok(if compressed.len() < raw.len() { compressed } else { raw })
+}
+
+fn compress(raw: &[u8], level: i32) -> Result<Vec<u8>> {
+    zstd::bulk::compress(raw, level)
+        .map_err(|e| DiskDBError::Database(format!("Compression error: {}", e)))
+}
+
+/// Whether `stored` holds a value stored compressed.
+pub fn is_compressed(stored: &[u8]) -> bool {
+    stored.starts_with(&ZSTD_MAGIC)
+}
+
+/// The encoded value held in `stored`, decompressing it if it was stored
+/// compressed. This does not depend on the configuration, so values stay
+/// readable after compression is turned off.
+pub fn decode(stored: &[u8]) -> Result<Cow<'_, [u8]>> {
+    if !is_compressed(stored) {
+        return Ok(Cow::Borrowed(stored));
+    }
+    zstd::stream::decode_all(stored)
+        .map(Cow::Owned)
+        .map_err(|e| DiskDBError::Database(format!("Decompression error: {}", e)))
+}
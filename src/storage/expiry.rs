@@ -0,0 +1,83 @@
+use std::collections::HashMap;
+use std::sync::RwLock;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Milliseconds since the Unix epoch, the unit expiry times are kept in.
+pub fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// In-memory index of key expiry times.
+///
+/// Storage backends persist expiry times alongside the data and keep this
+/// index so the check on every read never has to touch disk. Only keys with
+/// an expiry are tracked.
+#[derive(Debug, Default)]
+pub struct Expiries {
+    deadlines: RwLock<HashMap<String, u64>>,
+}
+
+impl Expiries {
+    /// Absolute expiry of `key` in milliseconds since the epoch.
+    pub fn get(&self, key: &str) -> Option<u64> {
+        self.deadlines.read().unwrap().get(key).copied()
+    }
+
+    pub fn set(&self, key: &str, at_ms: u64) {
+        self.deadlines.write().unwrap().insert(key.to_string(), at_ms);
+    }
+
+    /// Forget the expiry of `key`, returning whether it had one.
+    pub fn remove(&self, key: &str) -> bool {
+        self.deadlines.write().unwrap().remove(key).is_some()
+    }
+
+    /// Whether `key` has an expiry at or before `now_ms`.
+    pub fn is_due(&self, key: &str, now_ms: u64) -> bool {
+        matches!(self.get(key), Some(at) if at <= now_ms)
+    }
+
+    /// Keys whose expiry is at or before `now_ms`.
+    pub fn due(&self, now_ms: u64) -> Vec<String> {
+        self.deadlines.read().unwrap()
+            .iter()
+            .filter(|(_, &at)| at <= now_ms)
+            .map(|(key, _)| key.clone())
+            .collect()
+    }
+
+    /// Up to `limit` keys whose expiry is at or before `now_ms`, with the
+    /// number of keys with an expiry looked at to find them.
+    pub fn due_within(&self, now_ms: u64, limit: usize) -> (usize, Vec<String>) {
+        let deadlines = self.deadlines.read().unwrap();
+        let mut examined = 0;
+        let mut due = Vec::new();
+        for (key, &at) in deadlines.iter() {
+            if due.len() == limit {
+                break;
+            }
+            examined += 1;
+            if at <= now_ms {
+                due.push(key.clone());
+            }
+        }
+        (examined, due)
+    }
+
+    /// Number of keys whose expiry is at or before `now_ms`.
+    pub fn due_count(&self, now_ms: u64) -> usize {
+        self.deadlines.read().unwrap().values().filter(|&&at| at <= now_ms).count()
+    }
+
+    /// Number of keys that have an expiry.
+    pub fn len(&self) -> usize {
+        self.deadlines.read().unwrap().len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
@@ -1,8 +1,44 @@
 use crate::data_types::DataType;
+use crate::hyperloglog::HyperLogLog;
+use crate::storage::changes::ChangePage;
+use crate::storage::compression::{CompressionStats, ValueEncoding};
 use crate::error::Result;
 use async_trait::async_trait;
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+use std::path::Path;
+use std::sync::Arc;
+use tokio::sync::{broadcast, watch};
 
+pub mod changes;
+pub mod compression;
+pub mod expiry;
 pub mod rocksdb_storage;
+pub mod snapshot;
+
+/// Opens the storage backing a database index other than 0.
+pub type StorageFactory = Arc<dyn Fn(usize) -> Result<Arc<dyn Storage>> + Send + Sync>;
+
+/// Bytes written since startup, for INFO: as clients wrote them and as
+/// they reached the disk.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct WriteStats {
+    /// Keys and values written, before compression
+    pub logical_bytes: u64,
+    /// Bytes written to disk: the write-ahead log, flushes and compactions
+    pub physical_bytes: u64,
+}
+
+impl WriteStats {
+    /// Bytes written to disk per byte written by clients, 0.0 before any
+    /// write.
+    pub fn amplification(&self) -> f64 {
+        if self.logical_bytes == 0 {
+            return 0.0;
+        }
+        self.physical_bytes as f64 / self.logical_bytes as f64
+    }
+}
 
 #[async_trait]
 pub trait Storage: Send + Sync {
@@ -17,6 +53,228 @@ pub trait Storage: Send + Sync {
     async fn delete_multiple(&self, keys: &[String]) -> Result<usize>;
     async fn exists_multiple(&self, keys: &[String]) -> Result<usize>;
     
+    // Keyspace operations
+    async fn random_key(&self) -> Result<Option<String>>;
+    /// Up to `count` keys in key order, starting after `after` (or from the
+    /// first key when `None`).
+    async fn scan_keys(&self, after: Option<&str>, count: usize) -> Result<Vec<String>>;
+    
+    // Expiration
+    //
+    // Expired keys behave as if they did not exist for every operation.
+    // Writing a key with `set` keeps its expiry; `delete` removes it.
+    
+    /// Set the absolute expiry of an existing key in milliseconds since the
+    /// epoch, or clear it with `None`. Returns false if the key does not exist.
+    async fn set_expiry(&self, key: &str, at_ms: Option<u64>) -> Result<bool>;
+    /// Absolute expiry of `key` in milliseconds since the epoch, if it has one.
+    async fn expiry(&self, key: &str) -> Result<Option<u64>>;
+    
+    /// Exchange the values of keys `a` and `b`, which must differ. A missing
+    /// key takes part like any other, so the other key ends up deleted.
+    /// With `with_ttl` expiries move with the values; otherwise each key
+    /// keeps its own, which one that ends up deleted loses. The default
+    /// writes the keys one after the other; backends that can write both at
+    /// once override it so no reader sees one swapped and not the other.
+    async fn swap(&self, a: &str, b: &str, with_ttl: bool) -> Result<()> {
+        let (value_a, value_b) = (self.get(a).await?, self.get(b).await?);
+        let (expiry_a, expiry_b) = (self.expiry(a).await?, self.expiry(b).await?);
+        for (key, value, expiry) in [(a, value_b, expiry_b), (b, value_a, expiry_a)] {
+            match value {
+                Some(value) => {
+                    self.set(key, value).await?;
+                    if with_ttl {
+                        self.set_expiry(key, expiry).await?;
+                    }
+                }
+                None => {
+                    self.delete(key).await?;
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Write every value in `entries`, whose keys must differ, as `set`
+    /// would. The default writes them one after the other; backends that
+    /// can write them all at once override it so no reader sees some
+    /// written and not the others, and a write that fails applies none.
+    async fn set_multiple(&self, entries: Vec<(String, DataType)>) -> Result<()> {
+        for (key, value) in entries {
+            self.set(&key, value).await?;
+        }
+        Ok(())
+    }
+    
+    /// Write `value` at `key` like `set` and replace the key's tags with
+    /// `tags`, so `keys_by_tag` lists it under each. A key keeps its tags
+    /// when its value is written any other way, and loses them when it is
+    /// deleted or expires. Returns false, writing nothing, if the backend
+    /// does not support tags.
+    async fn set_tagged(&self, _key: &str, _value: DataType, _tags: &[String]) -> Result<bool> {
+        Ok(false)
+    }
+
+    /// Keys tagged `tag` with `set_tagged`, in key order, or `None` if the
+    /// backend does not support tags.
+    async fn keys_by_tag(&self, _tag: &str) -> Result<Option<Vec<String>>> {
+        Ok(None)
+    }
+    
+    /// When the value of `key` was last written with `set`, in milliseconds
+    /// since the epoch. Backends that do not record it, and keys written
+    /// before it was recorded, report `None`.
+    async fn modified_at(&self, _key: &str) -> Result<Option<u64>> {
+        Ok(None)
+    }
+    
+    /// Revision of the value of `key`, which every write of the key
+    /// raises, or `None` if the backend does not keep revisions. It is 0
+    /// for a missing key and one last written before revisions were kept.
+    async fn revision(&self, _key: &str) -> Result<Option<u64>> {
+        Ok(None)
+    }
+    
+    /// Write `value` at `key` like `set`, returning the revision it was
+    /// written at, or `None`, writing nothing, if the backend does not keep
+    /// revisions.
+    async fn set_versioned(&self, _key: &str, _value: DataType) -> Result<Option<u64>> {
+        Ok(None)
+    }
+    
+    /// Push the value of `key` onto the list `dlq` when the key expires, or
+    /// stop doing so with `None`. Only a key with an expiry can have a
+    /// dead-letter list, and only while it has one: deleting the key or
+    /// clearing its expiry drops it. Returns false if the backend does not
+    /// support dead-letter lists.
+    async fn set_dead_letter(&self, _key: &str, _dlq: Option<&str>) -> Result<bool> {
+        Ok(false)
+    }
+    
+    /// Expire keys with a dead-letter list that are due and push the
+    /// string values of those expired so far onto their lists, oldest
+    /// first, returning how many were pushed. A value leaves its key in the
+    /// same write that keeps it for its list, so none is lost or pushed
+    /// twice, but it only reaches the list when this runs. Callers must
+    /// keep other writes to the lists out meanwhile.
+    async fn deliver_dead_letters(&self) -> Result<usize> {
+        Ok(0)
+    }
+    
+    /// Backend-specific memory and size figures for MEMORY STATS, as
+    /// name/value pairs. Backends without any report none.
+    async fn memory_stats(&self) -> Result<Vec<(String, i64)>> {
+        Ok(Vec::new())
+    }
+    
+    /// Rewrite the data of the keys from `from` to `to`, both inclusive and
+    /// `None` leaving that end open, without what was overwritten or
+    /// deleted, so the space it took is reclaimed. A range is compacted as
+    /// a whole, so the data stays consistent however many ranges have
+    /// been. Backends with nothing to reclaim do nothing.
+    async fn compact_range(&self, _from: Option<&str>, _to: Option<&str>) -> Result<()> {
+        Ok(())
+    }
+
+    /// Write everything accepted so far to disk, so none of it depends on
+    /// replaying a log after a restart. Backends that write through do
+    /// nothing.
+    async fn flush(&self) -> Result<()> {
+        Ok(())
+    }
+
+    /// Write a consistent copy of the data as it is now to a new directory
+    /// at `path`, which the backend can open as a database of its own.
+    /// Writes go on while it is made; it holds the data as of one moment.
+    /// A manifest written alongside lets it be verified, see `snapshot`.
+    /// Returns false if the backend cannot make one.
+    async fn save_snapshot(&self, _path: &Path) -> Result<bool> {
+        Ok(false)
+    }
+
+    /// Bytes the stored values take on disk, or `None` if the backend does
+    /// not know.
+    async fn disk_usage(&self) -> Result<Option<u64>> {
+        Ok(None)
+    }
+
+    /// Estimated number of keys stored, or `None` if the backend cannot
+    /// estimate it.
+    async fn estimated_key_count(&self) -> Result<Option<u64>> {
+        Ok(None)
+    }
+
+    /// Write `value` at `key` like `set`, stored as `encoding` asks where
+    /// the backend and the value allow it. Backends that do not compress
+    /// values store it as `set` does.
+    async fn set_encoded(&self, key: &str, value: DataType, _encoding: ValueEncoding) -> Result<()> {
+        self.set(key, value).await
+    }
+
+    /// Whether the value of `key` is stored compressed, for OBJECT
+    /// ENCODING. False for a missing key and on backends that do not
+    /// compress values.
+    async fn is_compressed(&self, _key: &str) -> Result<bool> {
+        Ok(false)
+    }
+
+    /// How values written since startup were compressed, for INFO, or
+    /// `None` if the backend does not compress them.
+    async fn compression_stats(&self) -> Result<Option<CompressionStats>> {
+        Ok(None)
+    }
+    
+    /// Bytes written since startup, for INFO, or `None` if the backend does
+    /// not track them.
+    async fn write_stats(&self) -> Result<Option<WriteStats>> {
+        Ok(None)
+    }
+    
+    /// Keys counted against the key limit and the limit, for INFO, or
+    /// `None` if there is no limit.
+    async fn key_usage(&self) -> Result<Option<(u64, u64)>> {
+        Ok(None)
+    }
+    
+    /// Expired keys removed early to make room under the key limit since
+    /// startup, or `None` if there is no limit.
+    async fn evicted_keys(&self) -> Result<Option<u64>> {
+        Ok(None)
+    }
+    
+    /// Up to `count` changes from offset `from` on, oldest first, or `None`
+    /// if the backend keeps no change log.
+    async fn changes(&self, _from: u64, _count: usize) -> Result<Option<ChangePage>> {
+        Ok(None)
+    }
+    
+    /// Receiver of the offset the next change will get, updated as changes
+    /// are recorded, or `None` if the backend keeps no change log.
+    fn watch_changes(&self) -> Option<watch::Receiver<u64>> {
+        None
+    }
+    
+    /// Remove up to `limit` keys whose expiry has passed without waiting for
+    /// them to be read, returning how many keys with an expiry were looked
+    /// at and how many were removed. Backends that keep no index of
+    /// expiries remove none.
+    async fn reap_expired(&self, _limit: usize) -> Result<(usize, usize)> {
+        Ok((0, 0))
+    }
+    
+    /// Number of keys with an expiry, and how many of those have passed it
+    /// and are not yet removed.
+    async fn expiry_counts(&self) -> Result<(usize, usize)> {
+        Ok((0, 0))
+    }
+    
+    /// Receiver of the keys that expire from now on, sent as each is
+    /// removed, however its expiry was noticed, or `None` if the backend
+    /// does not report expirations. Keys that were deleted are not sent.
+    fn watch_expirations(&self) -> Option<broadcast::Receiver<String>> {
+        None
+    }
+    
     // Type-safe get operations
     async fn get_string(&self, key: &str) -> Result<Option<String>> {
         match self.get(key).await? {
@@ -75,4 +333,36 @@ pub trait Storage: Send + Sync {
             None => Ok(DataType::Stream(Vec::new())),
         }
     }
-}
\ No newline at end of file
+    
+    async fn get_or_create_bitmap(&self, key: &str) -> Result<DataType> {
+        match self.get(key).await? {
+            Some(data) => match data {
+                DataType::Bitmap(_) => Ok(data),
+                _ => Err(crate::error::DiskDBError::Protocol("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+            },
+            None => Ok(DataType::Bitmap(Vec::new())),
+        }
+    }
+    
+    async fn get_hyperloglog(&self, key: &str) -> Result<Option<HyperLogLog>> {
+        match self.get(key).await? {
+            Some(DataType::HyperLogLog(hll)) => Ok(Some(hll)),
+            Some(_) => Err(crate::error::DiskDBError::Protocol("WRONGTYPE Operation against a key holding the wrong kind of value".to_string())),
+            None => Ok(None),
+        }
+    }
+}
+
+/// Return a pseudo-random number in `0..bound`.
+///
+/// Seeded from the standard library's per-process random hasher keys, which
+/// is plenty for sampling commands but not suitable for anything security
+/// related.
+pub fn random_below(bound: u64) -> u64 {
+    if bound == 0 {
+        return 0;
+    }
+    let mut hasher = RandomState::new().build_hasher();
+    hasher.write_u64(bound);
+    hasher.finish() % bound
+}
@@ -1,13 +1,118 @@
 use crate::data_types::DataType;
 use crate::error::{DiskDBError, Result};
-use crate::storage::Storage;
+use crate::storage::changes::{Change, ChangeOp, ChangePage};
+use crate::storage::compression::{self, Compression, CompressionStats, Compressor, ValueEncoding};
+use crate::storage::expiry::{now_ms, Expiries};
+use crate::storage::snapshot;
+use crate::storage::{random_below, Storage, WriteStats};
 use async_trait::async_trait;
-use rocksdb::{DB, Options, WriteBatch};
-use std::sync::Arc;
+use log::warn;
+use rocksdb::checkpoint::Checkpoint;
+use rocksdb::{ColumnFamily, Direction, DB, IteratorMode, Options, WriteBatch};
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
 use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+use tokio::sync::{broadcast, watch};
+
+/// Column family mapping keys to their expiry (big-endian milliseconds
+/// since the epoch)
+const EXPIRES_CF: &str = "expires";
+
+/// Column family mapping keys to when their value was last written
+/// (big-endian milliseconds since the epoch). It costs one entry of the key
+/// plus 8 bytes per key, written in the same batch as the value.
+const MODIFIED_CF: &str = "modified";
+
+/// Column family that mapped keys to their version before versions were
+/// taken from REVISIONS_CF. Nothing reads or writes it; it is only opened
+/// because RocksDB refuses to open a database without all of its column
+/// families.
+const VERSIONS_CF: &str = "versions";
+
+/// Column family mapping keys to the revision of their value (big-endian),
+/// which every write of the key raises, however it is written. Revisions
+/// are handed out by `next_revision`, so no entry is read to raise one.
+/// SETIFVERSION checks and replies with them as versions.
+const REVISIONS_CF: &str = "revisions";
+
+/// Column family holding the change log: big-endian offsets mapping to the
+/// key written and what was done to it
+const CHANGES_CF: &str = "changes";
+
+/// Column family mapping keys with an expiry to the list their value is
+/// pushed onto when they expire
+const DEAD_LETTERS_CF: &str = "dead_letters";
+
+/// Column family holding values of expired keys not yet pushed onto their
+/// dead-letter list: big-endian sequence numbers mapping to the list and
+/// the value. Staging them here lets expiry happen without touching the
+/// list, which only `deliver_dead_letters` writes.
+const PENDING_DEAD_LETTERS_CF: &str = "pending_dead_letters";
+
+/// Column family mapping keys to their tags as set with `set_tagged`.
+/// Deleting the key removes its entry without reading it first; the
+/// entries under its tags in TAGS_CF are then stale, and dropped when
+/// `keys_by_tag` comes across them.
+const KEY_TAGS_CF: &str = "key_tags";
+
+/// Column family indexing keys by tag: the tag's length (big-endian u32),
+/// the tag and the key, mapping to nothing, so the keys of a tag are
+/// listed by one range read
+const TAGS_CF: &str = "tags";
+
+/// How many expired keys `watch_expirations` receivers can fall behind by
+/// before they miss the oldest
+const EXPIRATION_BUFFER: usize = 1024;
+
+/// How many keys RANDOMKEY chooses from after seeking to a random point
+const RANDOM_KEY_WINDOW: usize = 64;
+
+/// RocksDB statistics counting the bytes written to disk: the write-ahead
+/// log, memtables flushed to table files, and table files rewritten by
+/// compactions
+const PHYSICAL_WRITE_TICKERS: [&str; 3] = ["rocksdb.wal.bytes", "rocksdb.flush.write.bytes", "rocksdb.compact.write.bytes"];
 
 pub struct RocksDBStorage {
     db: Arc<DB>,
+    /// Options the database was opened with, which hold its statistics
+    opts: Options,
+    /// Bytes of keys and values written since startup, before compression
+    logical_bytes: AtomicU64,
+    expiries: Expiries,
+    compressor: Option<Compressor>,
+    change_log: Option<ChangeLog>,
+    /// Sequence number of the next pending dead letter. Held while one is
+    /// staged so a key expired by two readers at once is staged once.
+    next_dead_letter: Mutex<u64>,
+    key_limit: Option<KeyLimit>,
+    /// Revision last handed out by `next_revision`
+    last_revision: AtomicU64,
+    /// Carries each key to `watch_expirations` receivers as it expires
+    expirations: broadcast::Sender<String>,
+}
+
+/// Cap on the number of keys, set with `with_max_keys`.
+struct KeyLimit {
+    max_keys: u64,
+    /// Keys stored, expired ones included until they are removed. Held
+    /// while a write that creates or removes keys is applied, so concurrent
+    /// writes cannot together go past the cap.
+    keys: Mutex<u64>,
+    /// Expired keys removed early to make room for new ones
+    evicted: AtomicU64,
+}
+
+/// State of the change log, kept when enabled with `with_change_log`.
+struct ChangeLog {
+    /// Number of the most recent changes kept
+    retention: u64,
+    /// Offset of the next change. Held while a write is applied so offsets
+    /// become visible in order.
+    next: Mutex<u64>,
+    /// Carries the next offset to readers waiting for changes
+    notify: watch::Sender<u64>,
 }
 
 impl RocksDBStorage {
@@ -21,43 +126,357 @@ impl RocksDBStorage {
             std::fs::remove_dir_all(path_ref).ok();
         }
         
-        let db = DB::open(&opts, path)?;
+        opts.create_missing_column_families(true);
+        // Counts the bytes written to disk, for write amplification in INFO
+        opts.enable_statistics();
+        let db = DB::open_cf(&opts, path, [EXPIRES_CF, MODIFIED_CF, VERSIONS_CF, REVISIONS_CF, CHANGES_CF, DEAD_LETTERS_CF, PENDING_DEAD_LETTERS_CF, KEY_TAGS_CF, TAGS_CF])?;
         
-        Ok(Self {
+        let storage = Self {
             db: Arc::new(db),
-        })
+            opts,
+            logical_bytes: AtomicU64::new(0),
+            expiries: Expiries::default(),
+            compressor: None,
+            change_log: None,
+            next_dead_letter: Mutex::new(0),
+            key_limit: None,
+            last_revision: AtomicU64::new(0),
+            expirations: broadcast::channel(EXPIRATION_BUFFER).0,
+        };
+        *storage.next_dead_letter.lock().unwrap() = match storage.db.iterator_cf(storage.pending_dead_letters_cf()?, IteratorMode::End).next() {
+            Some(item) => item?.0[..].try_into()
+                .map(|bytes| u64::from_be_bytes(bytes) + 1)
+                .map_err(|_| DiskDBError::Database("Corrupt pending dead letter entry".to_string()))?,
+            None => 0,
+        };
+        storage.load_expiries()?;
+        Ok(storage)
     }
-}
+    
+    /// Compress values written from now on as `compression` describes, or
+    /// store them as is with `None`. Values already on disk are read either
+    /// way.
+    pub fn with_compression(mut self, compression: Option<Compression>) -> Self {
+        self.compressor = compression.map(Compressor::new);
+        self
+    }
+    
+    /// Record every write in a change log keeping the latest `retention`
+    /// changes, continuing from the offsets already on disk. Zero keeps no
+    /// log; changes from before are left in place but not served.
+    pub fn with_change_log(mut self, retention: u64) -> Result<Self> {
+        if retention == 0 {
+            self.change_log = None;
+            return Ok(self);
+        }
+        let cf = self.changes_cf()?;
+        let next = match self.db.iterator_cf(cf, IteratorMode::End).next() {
+            Some(item) => offset_from_key(&item?.0)? + 1,
+            None => 0,
+        };
+        // Drop what a smaller retention than last time no longer keeps
+        let first = next.saturating_sub(retention);
+        let mut batch = WriteBatch::default();
+        batch.delete_range_cf(cf, 0u64.to_be_bytes(), first.to_be_bytes());
+        self.db.write(batch)?;
 
-#[async_trait]
-impl Storage for RocksDBStorage {
-    async fn get(&self, key: &str) -> Result<Option<DataType>> {
+        self.change_log = Some(ChangeLog {
+            retention,
+            next: Mutex::new(next),
+            notify: watch::Sender::new(next),
+        });
+        Ok(self)
+    }
+    
+    /// Refuse writes that would take the number of keys past `max_keys`,
+    /// failing them with `DiskDBError::KeyLimitExceeded`. `None` or zero
+    /// means no limit. Counting the keys already stored walks them once.
+    pub fn with_max_keys(mut self, max_keys: Option<u64>) -> Result<Self> {
+        self.key_limit = match max_keys {
+            Some(max_keys) if max_keys > 0 => {
+                let mut keys = 0;
+                for item in self.db.iterator(IteratorMode::Start) {
+                    item?;
+                    keys += 1;
+                }
+                Some(KeyLimit { max_keys, keys: Mutex::new(keys), evicted: AtomicU64::new(0) })
+            }
+            _ => None,
+        };
+        Ok(self)
+    }
+    
+    fn expires_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(EXPIRES_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing expires column family".to_string()))
+    }
+    
+    fn modified_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(MODIFIED_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing modified column family".to_string()))
+    }
+    
+    fn revisions_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(REVISIONS_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing revisions column family".to_string()))
+    }
+    
+    fn changes_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(CHANGES_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing changes column family".to_string()))
+    }
+    
+    fn dead_letters_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(DEAD_LETTERS_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing dead letters column family".to_string()))
+    }
+    
+    fn pending_dead_letters_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(PENDING_DEAD_LETTERS_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing pending dead letters column family".to_string()))
+    }
+    
+    fn key_tags_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(KEY_TAGS_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing key tags column family".to_string()))
+    }
+    
+    fn tags_cf(&self) -> Result<&ColumnFamily> {
+        self.db.cf_handle(TAGS_CF)
+            .ok_or_else(|| DiskDBError::Database("Missing tags column family".to_string()))
+    }
+    
+    /// Tags of `key` as set with `set_tagged`, expired or not.
+    fn read_tags(&self, key: &str) -> Result<Vec<String>> {
+        match self.db.get_cf(self.key_tags_cf()?, key.as_bytes())? {
+            Some(value) => bincode::deserialize(&value)
+                .map_err(|e| DiskDBError::Database(format!("Deserialization error: {}", e))),
+            None => Ok(Vec::new()),
+        }
+    }
+    
+    /// Write `value` at `key`, storing it as `encoding` asks, returning
+    /// the revision it was written at.
+    fn put(&self, key: &str, value: DataType, encoding: Option<ValueEncoding>) -> Result<u64> {
+        // A key that already expired must not pass its expiry on to the
+        // new value
+        self.expire_if_due(key)?;
+        self.make_room()?;
+        let mut batch = WriteBatch::default();
+        let revision = self.stage_put(&mut batch, key, &value, encoding)?;
+        self.write(batch, vec![(key, ChangeOp::Set(value))])?;
+        Ok(revision)
+    }
+
+    /// Expired keys count against the key limit until they are removed,
+    /// so a full database makes room by removing them.
+    fn make_room(&self) -> Result<()> {
+        if let Some(limit) = self.key_limit.as_ref().filter(|limit| *limit.keys.lock().unwrap() >= limit.max_keys) {
+            let evicted = self.expire_due()?;
+            limit.evicted.fetch_add(evicted as u64, Ordering::Relaxed);
+        }
+        Ok(())
+    }
+    
+    /// Remove every key whose expiry has passed, returning how many.
+    fn expire_due(&self) -> Result<usize> {
+        let mut expired = 0;
+        for key in self.expiries.due(now_ms()) {
+            if self.expire_if_due(&key)? {
+                expired += 1;
+            }
+        }
+        Ok(expired)
+    }
+    
+    /// Add writing `value` at `key` to `batch`, as `put` does, returning
+    /// the revision it is written at.
+    fn stage_put(&self, batch: &mut WriteBatch, key: &str, value: &DataType, encoding: Option<ValueEncoding>) -> Result<u64> {
+        let serialized = bincode::serialize(value)
+            .map_err(|e| DiskDBError::Database(format!("Serialization error: {}", e)))?;
+        self.logical_bytes.fetch_add((key.len() + serialized.len()) as u64, Ordering::Relaxed);
+        let serialized = match &self.compressor {
+            Some(compressor) => compressor.encode(serialized, encoding)?,
+            None => compression::encode_unconfigured(serialized, encoding)?,
+        };
+        batch.put(key.as_bytes(), serialized);
+        batch.put_cf(self.modified_cf()?, key.as_bytes(), now_ms().to_be_bytes());
+        let revision = self.next_revision();
+        batch.put_cf(self.revisions_cf()?, key.as_bytes(), revision.to_be_bytes());
+        Ok(revision)
+    }
+    
+    /// A revision above every one handed out before, here or, as long as
+    /// the clock does not go back, in an earlier run: the time in
+    /// microseconds since the epoch, or one more than the last revision if
+    /// writes come faster than that.
+    fn next_revision(&self) -> u64 {
+        let now_us = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_micros() as u64)
+            .unwrap_or(0);
+        let last = self.last_revision
+            .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |last| Some(now_us.max(last + 1)))
+            .unwrap_or_default();
+        now_us.max(last + 1)
+    }
+    
+    /// Value stored at `key`, expired or not.
+    fn read(&self, key: &str) -> Result<Option<DataType>> {
         match self.db.get(key.as_bytes())? {
             Some(value) => {
-                let data: DataType = bincode::deserialize(&value)
+                let data: DataType = bincode::deserialize(&compression::decode(&value)?)
                     .map_err(|e| DiskDBError::Database(format!("Deserialization error: {}", e)))?;
                 Ok(Some(data))
             }
             None => Ok(None),
         }
     }
+    
+    /// Apply `batch`, adding `changes` to the change log in the same write
+    /// if it is kept. With a key limit, `changes` must list every key the
+    /// batch sets or deletes; the write fails, applying nothing, if it
+    /// would create keys past the limit.
+    fn write(&self, batch: WriteBatch, changes: Vec<(&str, ChangeOp)>) -> Result<()> {
+        let limit = match &self.key_limit {
+            Some(limit) => limit,
+            None => return self.write_logged(batch, changes),
+        };
+        let mut keys = limit.keys.lock().unwrap();
+        // Whether each key is stored once the batch is applied
+        let mut stored_after = BTreeMap::new();
+        for (key, op) in &changes {
+            match op {
+                ChangeOp::Set(_) => stored_after.insert(*key, true),
+                ChangeOp::Delete => stored_after.insert(*key, false),
+                ChangeOp::Expire(_) => None,
+            };
+        }
+        let mut count = *keys;
+        for (key, stored) in stored_after {
+            match (self.db.get(key.as_bytes())?.is_some(), stored) {
+                (false, true) => count += 1,
+                (true, false) => count = count.saturating_sub(1),
+                _ => {}
+            }
+        }
+        if count > *keys && count > limit.max_keys {
+            return Err(DiskDBError::KeyLimitExceeded(limit.max_keys));
+        }
+        self.write_logged(batch, changes)?;
+        *keys = count;
+        Ok(())
+    }
+    
+    fn write_logged(&self, mut batch: WriteBatch, changes: Vec<(&str, ChangeOp)>) -> Result<()> {
+        let log = match &self.change_log {
+            Some(log) => log,
+            None => {
+                self.db.write(batch)?;
+                return Ok(());
+            }
+        };
+        let cf = self.changes_cf()?;
+        let mut next = log.next.lock().unwrap();
+        let mut offset = *next;
+        for (key, op) in changes {
+            let entry = bincode::serialize(&(key, op))
+                .map_err(|e| DiskDBError::Database(format!("Serialization error: {}", e)))?;
+            batch.put_cf(cf, offset.to_be_bytes(), entry);
+            if offset >= log.retention {
+                batch.delete_cf(cf, (offset - log.retention).to_be_bytes());
+            }
+            offset += 1;
+        }
+        self.db.write(batch)?;
+        *next = offset;
+        log.notify.send_replace(offset);
+        Ok(())
+    }
+    
+    fn load_expiries(&self) -> Result<()> {
+        let cf = self.expires_cf()?;
+        for item in self.db.iterator_cf(cf, IteratorMode::Start) {
+            let (key, value) = item?;
+            let at_ms = value[..].try_into()
+                .map(u64::from_be_bytes)
+                .map_err(|_| DiskDBError::Database("Corrupt expiry entry".to_string()))?;
+            self.expiries.set(&String::from_utf8_lossy(&key), at_ms);
+        }
+        Ok(())
+    }
+    
+    /// Delete `key` if its expiry has passed, returning whether it did.
+    fn expire_if_due(&self, key: &str) -> Result<bool> {
+        if !self.expiries.is_due(key, now_ms()) {
+            return Ok(false);
+        }
+        let mut batch = WriteBatch::default();
+        batch.delete(key.as_bytes());
+        batch.delete_cf(self.expires_cf()?, key.as_bytes());
+        batch.delete_cf(self.modified_cf()?, key.as_bytes());
+        batch.delete_cf(self.revisions_cf()?, key.as_bytes());
+        batch.delete_cf(self.key_tags_cf()?, key.as_bytes());
+        // A string value with a dead-letter list is staged for it in the
+        // same write that removes the key
+        let mut next_dead_letter = self.next_dead_letter.lock().unwrap();
+        let mut staged = false;
+        if let Some(dlq) = self.db.get_cf(self.dead_letters_cf()?, key.as_bytes())? {
+            batch.delete_cf(self.dead_letters_cf()?, key.as_bytes());
+            if let Some(DataType::String(value)) = self.read(key)? {
+                let entry = bincode::serialize(&(String::from_utf8_lossy(&dlq), value))
+                    .map_err(|e| DiskDBError::Database(format!("Serialization error: {}", e)))?;
+                batch.put_cf(self.pending_dead_letters_cf()?, next_dead_letter.to_be_bytes(), entry);
+                staged = true;
+            }
+        }
+        self.write(batch, vec![(key, ChangeOp::Delete)])?;
+        if staged {
+            *next_dead_letter += 1;
+        }
+        drop(next_dead_letter);
+        self.expiries.remove(key);
+        // Nobody may be watching, which is not an error
+        let _ = self.expirations.send(key.to_string());
+        Ok(true)
+    }
+}
+
+#[async_trait]
+impl Storage for RocksDBStorage {
+    async fn get(&self, key: &str) -> Result<Option<DataType>> {
+        if self.expire_if_due(key)? {
+            return Ok(None);
+        }
+        self.read(key)
+    }
 
     async fn set(&self, key: &str, value: DataType) -> Result<()> {
-        let serialized = bincode::serialize(&value)
-            .map_err(|e| DiskDBError::Database(format!("Serialization error: {}", e)))?;
-        self.db.put(key.as_bytes(), serialized)?;
+        self.put(key, value, None)?;
         Ok(())
     }
 
     async fn delete(&self, key: &str) -> Result<bool> {
         let exists = self.exists(key).await?;
         if exists {
-            self.db.delete(key.as_bytes())?;
+            let mut batch = WriteBatch::default();
+            batch.delete(key.as_bytes());
+            batch.delete_cf(self.modified_cf()?, key.as_bytes());
+            batch.delete_cf(self.revisions_cf()?, key.as_bytes());
+            batch.delete_cf(self.key_tags_cf()?, key.as_bytes());
+            if self.expiries.remove(key) {
+                batch.delete_cf(self.expires_cf()?, key.as_bytes());
+                batch.delete_cf(self.dead_letters_cf()?, key.as_bytes());
+            }
+            self.write(batch, vec![(key, ChangeOp::Delete)])?;
         }
         Ok(exists)
     }
 
     async fn exists(&self, key: &str) -> Result<bool> {
+        if self.expire_if_due(key)? {
+            return Ok(false);
+        }
         Ok(self.db.get(key.as_bytes())?.is_some())
     }
 
@@ -70,20 +489,28 @@ impl Storage for RocksDBStorage {
     
     async fn delete_multiple(&self, keys: &[String]) -> Result<usize> {
         let mut batch = WriteBatch::default();
-        let mut deleted = 0;
+        let mut deleted = Vec::new();
         
         for key in keys {
             if self.exists(key).await? {
                 batch.delete(key.as_bytes());
-                deleted += 1;
+                batch.delete_cf(self.modified_cf()?, key.as_bytes());
+                batch.delete_cf(self.revisions_cf()?, key.as_bytes());
+                batch.delete_cf(self.key_tags_cf()?, key.as_bytes());
+                if self.expiries.remove(key) {
+                    batch.delete_cf(self.expires_cf()?, key.as_bytes());
+                    batch.delete_cf(self.dead_letters_cf()?, key.as_bytes());
+                }
+                deleted.push((key.as_str(), ChangeOp::Delete));
             }
         }
         
-        if deleted > 0 {
-            self.db.write(batch)?;
+        let count = deleted.len();
+        if count > 0 {
+            self.write(batch, deleted)?;
         }
         
-        Ok(deleted)
+        Ok(count)
     }
     
     async fn exists_multiple(&self, keys: &[String]) -> Result<usize> {
@@ -95,4 +522,520 @@ impl Storage for RocksDBStorage {
         }
         Ok(count)
     }
-}
\ No newline at end of file
+    
+    async fn random_key(&self) -> Result<Option<String>> {
+        // Seek to a random point between the first and last keys, then pick
+        // one of the next RANDOM_KEY_WINDOW live keys, wrapping around at
+        // the end. This costs one seek and a short scan instead of a walk
+        // over the keyspace. Landing points cluster where keys are sparse
+        // in key order; sampling from the window after them spreads the
+        // picks out again.
+        let first = match self.db.iterator(IteratorMode::Start).next() {
+            Some(item) => item?.0,
+            None => return Ok(None),
+        };
+        let last = match self.db.iterator(IteratorMode::End).next() {
+            Some(item) => item?.0,
+            None => return Ok(None),
+        };
+        let target = random_key_between(&first, &last);
+
+        let now = now_ms();
+        let after = self.db.iterator(IteratorMode::From(&target, Direction::Forward));
+        let before = self.db.iterator(IteratorMode::Start)
+            .take_while(|item| item.as_ref().map_or(true, |(key, _)| key.as_ref() < target.as_slice()));
+        let mut window = Vec::with_capacity(RANDOM_KEY_WINDOW);
+        for item in after.chain(before) {
+            let (key, _) = item?;
+            let key = String::from_utf8_lossy(&key).into_owned();
+            if self.expiries.is_empty() || !self.expiries.is_due(&key, now) {
+                window.push(key);
+                if window.len() == RANDOM_KEY_WINDOW {
+                    break;
+                }
+            }
+        }
+        if window.is_empty() {
+            return Ok(None);
+        }
+        let index = random_below(window.len() as u64) as usize;
+        Ok(Some(window.swap_remove(index)))
+    }
+    
+    async fn scan_keys(&self, after: Option<&str>, count: usize) -> Result<Vec<String>> {
+        let mode = match after {
+            Some(key) => IteratorMode::From(key.as_bytes(), Direction::Forward),
+            None => IteratorMode::Start,
+        };
+        let mut keys = Vec::with_capacity(count);
+        let now = now_ms();
+        for item in self.db.iterator(mode) {
+            if keys.len() >= count {
+                break;
+            }
+            let (key, _) = item?;
+            let key = String::from_utf8_lossy(&key).into_owned();
+            if Some(key.as_str()) != after && !self.expiries.is_due(&key, now) {
+                keys.push(key);
+            }
+        }
+        Ok(keys)
+    }
+    
+    async fn set_expiry(&self, key: &str, at_ms: Option<u64>) -> Result<bool> {
+        if !self.exists(key).await? {
+            return Ok(false);
+        }
+        match at_ms {
+            Some(at_ms) => {
+                let mut batch = WriteBatch::default();
+                batch.put_cf(self.expires_cf()?, key.as_bytes(), at_ms.to_be_bytes());
+                self.write(batch, vec![(key, ChangeOp::Expire(Some(at_ms)))])?;
+                self.expiries.set(key, at_ms);
+            }
+            None => {
+                if self.expiries.remove(key) {
+                    let mut batch = WriteBatch::default();
+                    batch.delete_cf(self.expires_cf()?, key.as_bytes());
+                    batch.delete_cf(self.dead_letters_cf()?, key.as_bytes());
+                    self.write(batch, vec![(key, ChangeOp::Expire(None))])?;
+                }
+            }
+        }
+        Ok(true)
+    }
+    
+    async fn swap(&self, a: &str, b: &str, with_ttl: bool) -> Result<()> {
+        self.expire_if_due(a)?;
+        self.expire_if_due(b)?;
+        let dead_letters = self.dead_letters_cf()?;
+        // What each key holds now: value, expiry and dead-letter list
+        let mut held = Vec::with_capacity(2);
+        for key in [a, b] {
+            held.push((self.read(key)?, self.expiries.get(key), self.db.get_cf(dead_letters, key.as_bytes())?));
+        }
+        let (held_b, held_a) = (held.pop().unwrap(), held.pop().unwrap());
+
+        let mut batch = WriteBatch::default();
+        let mut changes = Vec::new();
+        let mut expiries = Vec::new();
+        for (key, own, other) in [(a, &held_a, &held_b), (b, &held_b, &held_a)] {
+            let value = match &other.0 {
+                Some(value) => value,
+                None => {
+                    batch.delete(key.as_bytes());
+                    batch.delete_cf(self.modified_cf()?, key.as_bytes());
+                    batch.delete_cf(self.revisions_cf()?, key.as_bytes());
+                    batch.delete_cf(self.key_tags_cf()?, key.as_bytes());
+                    batch.delete_cf(self.expires_cf()?, key.as_bytes());
+                    batch.delete_cf(dead_letters, key.as_bytes());
+                    changes.push((key, ChangeOp::Delete));
+                    expiries.push((key, None));
+                    continue;
+                }
+            };
+            self.stage_put(&mut batch, key, value, None)?;
+            changes.push((key, ChangeOp::Set(value.clone())));
+            // The dead-letter list goes with the expiry it belongs to
+            let (expiry, dlq) = if with_ttl { (other.1, &other.2) } else { (own.1, &own.2) };
+            match expiry {
+                Some(at_ms) => batch.put_cf(self.expires_cf()?, key.as_bytes(), at_ms.to_be_bytes()),
+                None => batch.delete_cf(self.expires_cf()?, key.as_bytes()),
+            }
+            match dlq.as_ref().filter(|_| expiry.is_some()) {
+                Some(dlq) => batch.put_cf(dead_letters, key.as_bytes(), dlq),
+                None => batch.delete_cf(dead_letters, key.as_bytes()),
+            }
+            changes.push((key, ChangeOp::Expire(expiry)));
+            expiries.push((key, expiry));
+        }
+        self.write(batch, changes)?;
+        for (key, expiry) in expiries {
+            match expiry {
+                Some(at_ms) => self.expiries.set(key, at_ms),
+                None => {
+                    self.expiries.remove(key);
+                }
+            }
+        }
+        Ok(())
+    }
+
+    async fn set_multiple(&self, entries: Vec<(String, DataType)>) -> Result<()> {
+        for (key, _) in &entries {
+            self.expire_if_due(key)?;
+        }
+        self.make_room()?;
+        let mut batch = WriteBatch::default();
+        for (key, value) in &entries {
+            self.stage_put(&mut batch, key, value, None)?;
+        }
+        let changes = entries.iter().map(|(key, value)| (key.as_str(), ChangeOp::Set(value.clone()))).collect();
+        self.write(batch, changes)
+    }
+
+    async fn set_tagged(&self, key: &str, value: DataType, tags: &[String]) -> Result<bool> {
+        self.expire_if_due(key)?;
+        self.make_room()?;
+        let mut batch = WriteBatch::default();
+        self.stage_put(&mut batch, key, &value, None)?;
+        let tags_cf = self.tags_cf()?;
+        for tag in self.read_tags(key)?.iter().filter(|tag| !tags.contains(tag)) {
+            batch.delete_cf(tags_cf, tag_entry(tag, key));
+        }
+        for tag in tags {
+            batch.put_cf(tags_cf, tag_entry(tag, key), []);
+        }
+        if tags.is_empty() {
+            batch.delete_cf(self.key_tags_cf()?, key.as_bytes());
+        } else {
+            let encoded = bincode::serialize(tags)
+                .map_err(|e| DiskDBError::Database(format!("Serialization error: {}", e)))?;
+            batch.put_cf(self.key_tags_cf()?, key.as_bytes(), encoded);
+        }
+        self.write(batch, vec![(key, ChangeOp::Set(value))])?;
+        Ok(true)
+    }
+
+    async fn keys_by_tag(&self, tag: &str) -> Result<Option<Vec<String>>> {
+        let tags_cf = self.tags_cf()?;
+        let prefix = tag_entry(tag, "");
+        let mut keys = Vec::new();
+        let mut stale = Vec::new();
+        for item in self.db.iterator_cf(tags_cf, IteratorMode::From(&prefix, Direction::Forward)) {
+            let (entry, _) = item?;
+            if !entry.starts_with(&prefix) {
+                break;
+            }
+            let key = String::from_utf8_lossy(&entry[prefix.len()..]).into_owned();
+            // A key deleted or expired since it was tagged, or tagged again
+            // without this tag, is left in the index until now
+            if !self.expire_if_due(&key)? && self.read_tags(&key)?.iter().any(|held| held == tag) {
+                keys.push(key);
+            } else {
+                stale.push(entry);
+            }
+        }
+        if !stale.is_empty() {
+            let mut batch = WriteBatch::default();
+            for entry in stale {
+                batch.delete_cf(tags_cf, entry);
+            }
+            self.db.write(batch)?;
+        }
+        Ok(Some(keys))
+    }
+    
+    async fn expiry(&self, key: &str) -> Result<Option<u64>> {
+        if self.expire_if_due(key)? {
+            return Ok(None);
+        }
+        Ok(self.expiries.get(key))
+    }
+    
+    async fn modified_at(&self, key: &str) -> Result<Option<u64>> {
+        if self.expire_if_due(key)? {
+            return Ok(None);
+        }
+        match self.db.get_cf(self.modified_cf()?, key.as_bytes())? {
+            Some(value) => value[..].try_into()
+                .map(|bytes| Some(u64::from_be_bytes(bytes)))
+                .map_err(|_| DiskDBError::Database("Corrupt modification time entry".to_string())),
+            None => Ok(None),
+        }
+    }
+    
+    async fn revision(&self, key: &str) -> Result<Option<u64>> {
+        if self.expire_if_due(key)? {
+            return Ok(Some(0));
+        }
+        match self.db.get_cf(self.revisions_cf()?, key.as_bytes())? {
+            Some(value) => value[..].try_into()
+                .map(|bytes| Some(u64::from_be_bytes(bytes)))
+                .map_err(|_| DiskDBError::Database("Corrupt revision entry".to_string())),
+            None => Ok(Some(0)),
+        }
+    }
+    
+    async fn set_encoded(&self, key: &str, value: DataType, encoding: ValueEncoding) -> Result<()> {
+        self.put(key, value, Some(encoding))?;
+        Ok(())
+    }
+    
+    async fn is_compressed(&self, key: &str) -> Result<bool> {
+        Ok(self.db.get(key.as_bytes())?.map_or(false, |stored| compression::is_compressed(&stored)))
+    }
+    
+    async fn set_versioned(&self, key: &str, value: DataType) -> Result<Option<u64>> {
+        self.put(key, value, None).map(Some)
+    }
+    
+    async fn set_dead_letter(&self, key: &str, dlq: Option<&str>) -> Result<bool> {
+        match dlq {
+            Some(dlq) => {
+                if self.expiry(key).await?.is_some() {
+                    self.db.put_cf(self.dead_letters_cf()?, key.as_bytes(), dlq.as_bytes())?;
+                }
+            }
+            None => self.db.delete_cf(self.dead_letters_cf()?, key.as_bytes())?,
+        }
+        Ok(true)
+    }
+    
+    async fn deliver_dead_letters(&self) -> Result<usize> {
+        // Expire keys with a dead-letter list that nobody read since they
+        // became due
+        let now = now_ms();
+        let mut due = Vec::new();
+        for item in self.db.iterator_cf(self.dead_letters_cf()?, IteratorMode::Start) {
+            let key = String::from_utf8_lossy(&item?.0).into_owned();
+            if self.expiries.is_due(&key, now) {
+                due.push(key);
+            }
+        }
+        for key in due {
+            self.expire_if_due(&key)?;
+        }
+        
+        // Values for each list in the order their keys expired
+        let mut pending: BTreeMap<String, (Vec<Box<[u8]>>, Vec<String>)> = BTreeMap::new();
+        for item in self.db.iterator_cf(self.pending_dead_letters_cf()?, IteratorMode::Start) {
+            let (sequence, entry) = item?;
+            let (dlq, value): (String, String) = bincode::deserialize(&entry)
+                .map_err(|e| DiskDBError::Database(format!("Deserialization error: {}", e)))?;
+            let (sequences, values) = pending.entry(dlq).or_default();
+            sequences.push(sequence);
+            values.push(value);
+        }
+        
+        let mut delivered = 0;
+        for (dlq, (sequences, values)) in pending {
+            let mut list = match self.get(&dlq).await? {
+                Some(DataType::List(list)) => list,
+                None => Vec::new(),
+                // Kept until the key is a list again or goes away
+                Some(_) => {
+                    warn!("Holding {} dead letters for {}, which is not a list", values.len(), dlq);
+                    continue;
+                }
+            };
+            let count = values.len();
+            list.extend(values);
+            let list = DataType::List(list);
+            let mut batch = WriteBatch::default();
+            self.stage_put(&mut batch, &dlq, &list, None)?;
+            for sequence in sequences {
+                batch.delete_cf(self.pending_dead_letters_cf()?, sequence);
+            }
+            match self.write(batch, vec![(&dlq, ChangeOp::Set(list))]) {
+                Ok(()) => delivered += count,
+                // Kept until there is room for the list
+                Err(DiskDBError::KeyLimitExceeded(_)) => {
+                    warn!("Holding {} dead letters for {}: the key limit is reached", count, dlq);
+                }
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(delivered)
+    }
+    
+    async fn memory_stats(&self) -> Result<Vec<(String, i64)>> {
+        let mut stats = vec![("expires.count".to_string(), self.expiries.len() as i64)];
+        for (name, property) in [
+            ("keys.estimated", "rocksdb.estimate-num-keys"),
+            ("memtables.bytes", "rocksdb.cur-size-all-mem-tables"),
+            ("table-readers.bytes", "rocksdb.estimate-table-readers-mem"),
+            ("live-data.bytes", "rocksdb.estimate-live-data-size"),
+        ] {
+            if let Some(value) = self.db.property_int_value(property)? {
+                stats.push((name.to_string(), value as i64));
+            }
+        }
+        Ok(stats)
+    }
+    
+    async fn compact_range(&self, from: Option<&str>, to: Option<&str>) -> Result<()> {
+        let db = self.db.clone();
+        let (from, to) = (from.map(str::to_string), to.map(str::to_string));
+        // A compaction rewrites whole table files, far too long to hold up
+        // a runtime thread
+        tokio::task::spawn_blocking(move || {
+            let (from, to) = (from.as_deref(), to.as_deref());
+            db.compact_range(from, to);
+            for name in [EXPIRES_CF, MODIFIED_CF, REVISIONS_CF, DEAD_LETTERS_CF, KEY_TAGS_CF] {
+                if let Some(cf) = db.cf_handle(name) {
+                    db.compact_range_cf(cf, from, to);
+                }
+            }
+            // The column families not keyed by key are compacted whole
+            // with the last range
+            if to.is_none() {
+                for name in [CHANGES_CF, PENDING_DEAD_LETTERS_CF, TAGS_CF] {
+                    if let Some(cf) = db.cf_handle(name) {
+                        db.compact_range_cf(cf, None::<&[u8]>, None::<&[u8]>);
+                    }
+                }
+            }
+        })
+        .await
+        .map_err(|e| DiskDBError::Database(format!("Compaction failed: {}", e)))
+    }
+    
+    async fn flush(&self) -> Result<()> {
+        let db = self.db.clone();
+        tokio::task::spawn_blocking(move || -> Result<()> {
+            db.flush_wal(true)?;
+            db.flush()?;
+            for name in [EXPIRES_CF, MODIFIED_CF, REVISIONS_CF, CHANGES_CF, DEAD_LETTERS_CF, PENDING_DEAD_LETTERS_CF, KEY_TAGS_CF, TAGS_CF] {
+                if let Some(cf) = db.cf_handle(name) {
+                    db.flush_cf(cf)?;
+                }
+            }
+            Ok(())
+        })
+        .await
+        .map_err(|e| DiskDBError::Database(format!("Flush failed: {}", e)))?
+    }
+    
+    async fn save_snapshot(&self, path: &Path) -> Result<bool> {
+        let db = self.db.clone();
+        let path = path.to_path_buf();
+        // A checkpoint hard-links the table files, which never change once
+        // written, and copies the rest, so writes go on meanwhile
+        tokio::task::spawn_blocking(move || -> Result<()> {
+            if let Some(parent) = path.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            let created_ms = now_ms();
+            Checkpoint::new(&db)?.create_checkpoint(&path)?;
+            let keys = DB::open_for_read_only(&Options::default(), &path, false)?
+                .iterator(IteratorMode::Start)
+                .count();
+            snapshot::write_manifest(&path, created_ms, keys as u64)?;
+            Ok(())
+        })
+        .await
+        .map_err(|e| DiskDBError::Database(format!("Snapshot failed: {}", e)))??;
+        Ok(true)
+    }
+    
+    async fn disk_usage(&self) -> Result<Option<u64>> {
+        Ok(self.db.property_int_value("rocksdb.total-sst-files-size")?)
+    }
+    
+    async fn estimated_key_count(&self) -> Result<Option<u64>> {
+        Ok(self.db.property_int_value("rocksdb.estimate-num-keys")?)
+    }
+    
+    async fn write_stats(&self) -> Result<Option<WriteStats>> {
+        // Each ticker is a line such as "rocksdb.wal.bytes COUNT : 1024"
+        let statistics = self.opts.get_statistics().unwrap_or_default();
+        let physical_bytes = statistics.lines()
+            .filter_map(|line| line.split_once(" COUNT : "))
+            .filter(|(name, _)| PHYSICAL_WRITE_TICKERS.contains(name))
+            .filter_map(|(_, count)| count.trim().parse::<u64>().ok())
+            .sum();
+        Ok(Some(WriteStats {
+            logical_bytes: self.logical_bytes.load(Ordering::Relaxed),
+            physical_bytes,
+        }))
+    }
+    
+    async fn compression_stats(&self) -> Result<Option<CompressionStats>> {
+        Ok(self.compressor.as_ref().map(Compressor::stats))
+    }
+    
+    async fn key_usage(&self) -> Result<Option<(u64, u64)>> {
+        Ok(self.key_limit.as_ref().map(|limit| (*limit.keys.lock().unwrap(), limit.max_keys)))
+    }
+    
+    async fn evicted_keys(&self) -> Result<Option<u64>> {
+        Ok(self.key_limit.as_ref().map(|limit| limit.evicted.load(Ordering::Relaxed)))
+    }
+    
+    async fn changes(&self, from: u64, count: usize) -> Result<Option<ChangePage>> {
+        let log = match &self.change_log {
+            Some(log) => log,
+            None => return Ok(None),
+        };
+        // Changes past this one may still be in the middle of being written
+        let next = *log.next.lock().unwrap();
+        let first = next.saturating_sub(log.retention);
+        let mut changes = Vec::new();
+        let start = from.max(first).to_be_bytes();
+        for item in self.db.iterator_cf(self.changes_cf()?, IteratorMode::From(&start, Direction::Forward)) {
+            let (offset, entry) = item?;
+            let offset = offset_from_key(&offset)?;
+            if changes.len() >= count || offset >= next {
+                break;
+            }
+            let (key, op): (String, ChangeOp) = bincode::deserialize(&entry)
+                .map_err(|e| DiskDBError::Database(format!("Deserialization error: {}", e)))?;
+            changes.push(Change { offset, key, op });
+        }
+        Ok(Some(ChangePage { changes, first, next }))
+    }
+    
+    fn watch_changes(&self) -> Option<watch::Receiver<u64>> {
+        self.change_log.as_ref().map(|log| log.notify.subscribe())
+    }
+
+    async fn reap_expired(&self, limit: usize) -> Result<(usize, usize)> {
+        let (examined, due) = self.expiries.due_within(now_ms(), limit);
+        let mut reaped = 0;
+        for key in due {
+            if self.expire_if_due(&key)? {
+                reaped += 1;
+            }
+        }
+        Ok((examined, reaped))
+    }
+    
+    async fn expiry_counts(&self) -> Result<(usize, usize)> {
+        Ok((self.expiries.len(), self.expiries.due_count(now_ms())))
+    }
+    
+    fn watch_expirations(&self) -> Option<broadcast::Receiver<String>> {
+        Some(self.expirations.subscribe())
+    }
+}
+
+/// Entry of `key` under `tag` in the tags column family. With an empty
+/// key it is the prefix of every entry under the tag.
+fn tag_entry(tag: &str, key: &str) -> Vec<u8> {
+    let mut entry = Vec::with_capacity(4 + tag.len() + key.len());
+    entry.extend_from_slice(&(tag.len() as u32).to_be_bytes());
+    entry.extend_from_slice(tag.as_bytes());
+    entry.extend_from_slice(key.as_bytes());
+    entry
+}
+
+/// Offset of a change log entry from its key
+fn offset_from_key(key: &[u8]) -> Result<u64> {
+    key.try_into()
+        .map(u64::from_be_bytes)
+        .map_err(|_| DiskDBError::Database("Corrupt change log entry".to_string()))
+}
+
+/// A uniformly random key that sorts between `first` and `last`: their
+/// common prefix followed by eight bytes drawn between the next eight bytes
+/// of each.
+fn random_key_between(first: &[u8], last: &[u8]) -> Vec<u8> {
+    let common = first.iter().zip(last).take_while(|(a, b)| a == b).count();
+    let next_eight = |key: &[u8]| {
+        let mut bytes = [0u8; 8];
+        let tail = &key[common.min(key.len())..];
+        let n = tail.len().min(8);
+        bytes[..n].copy_from_slice(&tail[..n]);
+        u64::from_be_bytes(bytes)
+    };
+    let (low, high) = (next_eight(first), next_eight(last));
+    let offset = match (high - low).checked_add(1) {
+        Some(span) => random_below(span),
+        None => random_below(u64::MAX),
+    };
+
+    let mut target = first[..common].to_vec();
+    target.extend_from_slice(&(low + offset).to_be_bytes());
+    target
+}
@@ -0,0 +1,142 @@
+use crate::error::{DiskDBError, Result};
+use sha2::{Digest, Sha256};
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+
+/// File written into every snapshot directory describing the snapshot. It
+/// is not part of the checksum.
+pub const MANIFEST_FILE: &str = "DISKDB_SNAPSHOT";
+
+/// Directory snapshots are saved under when none is configured, relative
+/// to the server's working directory.
+pub const DEFAULT_SNAPSHOT_DIR: &str = "snapshots";
+
+/// Version of the snapshot layout. Bump it whenever the files of a
+/// snapshot or the way values are stored in them change incompatibly.
+pub const SNAPSHOT_VERSION: u32 = 1;
+
+/// What the manifest of a snapshot says about it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SnapshotMeta {
+    pub version: u32,
+    /// When the snapshot was taken, in milliseconds since the epoch
+    pub created_ms: u64,
+    /// Keys stored, expired ones not yet removed included
+    pub keys: u64,
+    /// SHA-256 of the snapshot's files, in hex
+    pub checksum: String,
+}
+
+/// Where the snapshot a client names `name` lives under `dir`, or `None`
+/// if the name could lead outside it: it must be a relative path with
+/// neither `.` nor `..` in it.
+pub fn resolve(dir: &Path, name: &str) -> Option<PathBuf> {
+    let name = Path::new(name);
+    let inside = !name.as_os_str().is_empty()
+        && name.components().all(|component| matches!(component, Component::Normal(_)));
+    inside.then(|| dir.join(name))
+}
+
+/// Describe the snapshot just written to `dir` in its manifest, with a
+/// checksum of its files as they are now.
+pub fn write_manifest(dir: &Path, created_ms: u64, keys: u64) -> Result<SnapshotMeta> {
+    let meta = SnapshotMeta { version: SNAPSHOT_VERSION, created_ms, keys, checksum: checksum(dir)? };
+    let manifest = format!(
+        "version:{}\ncreated_ms:{}\nkeys:{}\nchecksum:{}\n",
+        meta.version, meta.created_ms, meta.keys, meta.checksum,
+    );
+    fs::write(dir.join(MANIFEST_FILE), manifest)?;
+    Ok(meta)
+}
+
+/// Read the manifest of the snapshot in `dir`, without checking the files.
+pub fn read_manifest(dir: &Path) -> Result<SnapshotMeta> {
+    let manifest = fs::read_to_string(dir.join(MANIFEST_FILE)).map_err(|e| {
+        DiskDBError::Database(format!("{} is not a snapshot: cannot read {}: {}", dir.display(), MANIFEST_FILE, e))
+    })?;
+    let corrupt = || DiskDBError::Database(format!("Snapshot {} has a corrupt manifest", dir.display()));
+    let field = |name: &str| {
+        manifest.lines()
+            .find_map(|line| line.strip_prefix(name)?.strip_prefix(':'))
+            .ok_or_else(corrupt)
+    };
+    Ok(SnapshotMeta {
+        version: field("version")?.parse().map_err(|_| corrupt())?,
+        created_ms: field("created_ms")?.parse().map_err(|_| corrupt())?,
+        keys: field("keys")?.parse().map_err(|_| corrupt())?,
+        checksum: field("checksum")?.to_string(),
+    })
+}
+
+/// Read the manifest of the snapshot in `dir` and check that this build
+/// can load it and that its files are those it was written with.
+pub fn verify(dir: &Path) -> Result<SnapshotMeta> {
+    let meta = read_manifest(dir)?;
+    if meta.version != SNAPSHOT_VERSION {
+        return Err(DiskDBError::Database(format!(
+            "Snapshot {} has version {}, this server loads version {}",
+            dir.display(), meta.version, SNAPSHOT_VERSION,
+        )));
+    }
+    if checksum(dir)? != meta.checksum {
+        return Err(DiskDBError::Database(format!("Snapshot {} is corrupt: its checksum does not match", dir.display())));
+    }
+    Ok(meta)
+}
+
+/// Replace the database at `database` with the snapshot in `snapshot`,
+/// once it is verified and copied in full, so a bad snapshot leaves the
+/// database as it was. A database already restored from the snapshot is
+/// left alone, writes since included, returning `None`.
+pub fn restore(snapshot: &Path, database: &Path) -> Result<Option<SnapshotMeta>> {
+    let meta = verify(snapshot)?;
+    if read_manifest(database).is_ok_and(|restored| restored.checksum == meta.checksum) {
+        return Ok(None);
+    }
+
+    let copy = sibling(database, "restoring");
+    let _ = fs::remove_dir_all(&copy);
+    fs::create_dir_all(&copy)?;
+    for entry in fs::read_dir(snapshot)? {
+        let entry = entry?;
+        fs::copy(entry.path(), copy.join(entry.file_name()))?;
+    }
+    verify(&copy)?;
+
+    let replaced = sibling(database, "replaced");
+    let _ = fs::remove_dir_all(&replaced);
+    if database.exists() {
+        fs::rename(database, &replaced)?;
+    }
+    fs::rename(&copy, database)?;
+    let _ = fs::remove_dir_all(&replaced);
+    Ok(Some(meta))
+}
+
+/// SHA-256 over the name, length and contents of every file in `dir` but
+/// the manifest, in name order.
+fn checksum(dir: &Path) -> Result<String> {
+    let mut files: Vec<PathBuf> = fs::read_dir(dir)?
+        .map(|entry| entry.map(|entry| entry.path()))
+        .collect::<std::io::Result<_>>()?;
+    files.retain(|file| file.file_name().is_some_and(|name| name != MANIFEST_FILE));
+    files.sort();
+
+    let mut hasher = Sha256::new();
+    for file in files {
+        // Table files can be large, so they are streamed through
+        let mut contents = fs::File::open(&file)?;
+        hasher.update(file.file_name().unwrap_or_default().to_string_lossy().as_bytes());
+        hasher.update(b"\0");
+        hasher.update(contents.metadata()?.len().to_be_bytes());
+        std::io::copy(&mut contents, &mut hasher)?;
+    }
+    Ok(format!("{:x}", hasher.finalize()))
+}
+
+/// `path` with `suffix` appended to its last component.
+fn sibling(path: &Path, suffix: &str) -> PathBuf {
+    let mut sibling = path.as_os_str().to_os_string();
+    sibling.push(format!(".{}", suffix));
+    PathBuf::from(sibling)
+}
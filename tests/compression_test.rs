@@ -0,0 +1,75 @@
+use diskdb::storage::compression::{decode, encode_unconfigured, is_compressed, Compression, Compressor, ValueEncoding};
+
+fn compressor(min_size: usize) -> Compressor {
+    Compressor::new(Compression { min_size, ..Compression::default() })
+}
+
+#[test]
+fn test_compresses_large_values() {
+    let compressor = compressor(64);
+    let raw = b"abcdefgh".repeat(100);
+    let stored = compressor.encode(raw.clone(), None).unwrap();
+    assert!(stored.len() < raw.len());
+    assert_eq!(decode(&stored).unwrap().as_ref(), raw.as_slice());
+
+    let stats = compressor.stats();
+    assert_eq!((stats.values, stats.compressed), (1, 1));
+    assert_eq!(stats.raw_bytes, raw.len() as u64);
+    assert_eq!(stats.stored_bytes, stored.len() as u64);
+    assert!(stats.ratio() > 1.0);
+}
+
+#[test]
+fn test_stores_small_and_incompressible_values_as_is() {
+    let compressor = compressor(64);
+    // Encoded values start with the variant index, never the zstd magic
+    let small = vec![2, 0, 0, 0, 1, 2, 3];
+    assert_eq!(compressor.encode(small.clone(), None).unwrap(), small);
+    assert_eq!(decode(&small).unwrap().as_ref(), small.as_slice());
+
+    // Bytes without any repetition grow when compressed
+    let mut noise = vec![1, 0, 0, 0];
+    let mut state = 0x2545f491u32;
+    for _ in 0..256 {
+        state ^= state << 13;
+        state ^= state >> 17;
+        state ^= state << 5;
+        noise.push(state as u8);
+    }
+    assert_eq!(compressor.encode(noise.clone(), None).unwrap(), noise);
+
+    let stats = compressor.stats();
+    assert_eq!((stats.values, stats.compressed), (2, 0));
+    assert_eq!(stats.ratio(), 1.0);
+}
+
+#[test]
+fn test_encoding_hints() {
+    let compressor = compressor(64);
+    let medium = b"abcdefgh".repeat(6);
+    let large = b"abcdefgh".repeat(100);
+
+    // A hint overrides the size threshold either way
+    let stored = compressor.encode(medium.clone(), Some(ValueEncoding::Compressed)).unwrap();
+    assert!(is_compressed(&stored));
+    assert_eq!(decode(&stored).unwrap().as_ref(), medium.as_slice());
+    assert_eq!(compressor.encode(large.clone(), Some(ValueEncoding::Raw)).unwrap(), large);
+    assert_eq!(compressor.encode(large.clone(), Some(ValueEncoding::Int)).unwrap(), large);
+
+    // Values compression would not shrink are stored as is
+    let tiny = vec![2, 0, 0, 0, 1];
+    assert_eq!(compressor.encode(tiny.clone(), Some(ValueEncoding::Compressed)).unwrap(), tiny);
+
+    let stats = compressor.stats();
+    assert_eq!((stats.values, stats.compressed), (4, 1));
+
+    // Without compression configured only the hint compresses
+    assert_eq!(encode_unconfigured(large.clone(), None).unwrap(), large);
+    assert!(is_compressed(&encode_unconfigured(large.clone(), Some(ValueEncoding::Compressed)).unwrap()));
+    assert_eq!(encode_unconfigured(tiny.clone(), Some(ValueEncoding::Compressed)).unwrap(), tiny);
+}
+
+#[test]
+fn test_ratio_before_any_write() {
+    assert_eq!(compressor(0).stats().ratio(), 1.0);
+}
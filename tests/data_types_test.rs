@@ -1,5 +1,9 @@
 use diskdb::{Config, Server};
+use diskdb::data_types::DataType;
+use diskdb::protocol::CommandClass;
 use diskdb::storage::rocksdb_storage::RocksDBStorage;
+use diskdb::storage::compression::Compression;
+use diskdb::storage::Storage;
 use std::sync::Arc;
 use std::time::Duration;
 use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
@@ -7,12 +11,28 @@ use tokio::net::TcpStream;
 use tokio::time::sleep;
 
 async fn start_test_server(port: u16) -> tokio::task::JoinHandle<()> {
+    start_configured_server(port, |_| {}).await
+}
+
+// Like start_test_server, with configure applied to the default config
+async fn start_configured_server(port: u16, configure: impl FnOnce(&mut Config)) -> tokio::task::JoinHandle<()> {
     let mut config = Config::new();
     config.server_port = port;
     config.database_path = std::path::PathBuf::from(format!("./test_db_{}", port));
+    configure(&mut config);
     
-    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
-    let server = Server::new(config, storage).unwrap();
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap()
+        .with_compression(config.compression)
+        .with_change_log(config.change_log_retention).unwrap()
+        .with_max_keys(config.max_keys_for(0)).unwrap());
+    let database_config = config.clone();
+    let server = Server::new(config, storage).unwrap()
+        .with_database_factory(Arc::new(move |index| -> diskdb::Result<Arc<dyn Storage>> {
+            Ok(Arc::new(RocksDBStorage::new(database_config.database_path_for(index))?
+                .with_compression(database_config.compression)
+                .with_change_log(database_config.change_log_retention)?
+                .with_max_keys(database_config.max_keys_for(index))?))
+        }));
     
     tokio::spawn(async move {
         server.start().await.unwrap();
@@ -58,11 +78,37 @@ async fn test_string_operations() {
     assert_eq!(send_command(&mut writer, &mut reader, "DECR counter").await, "10");
     assert_eq!(send_command(&mut writer, &mut reader, "INCRBY counter 5").await, "15");
     
+    // Test INCRPX - only the hit that creates the counter sets its expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "INCRPX hits 60000").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "INCRPX hits 1000").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL hits").await, "60");
+    
+    // Test GETEX - every read resets the expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "GETEX name EX 30").await, "Alice");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL name").await, "30");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETEX name PX 90000").await, "Alice");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL name").await, "90");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETEX nobody PX 1000").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS nobody").await, "0");
+    assert!(send_command(&mut writer, &mut reader, "GETEX name PX 0").await.starts_with("ERROR:"));
+    assert!(send_command(&mut writer, &mut reader, "GETEX name").await.starts_with("ERROR:"));
+    
     // Test APPEND
     assert_eq!(send_command(&mut writer, &mut reader, "SET msg Hello").await, "OK");
     assert_eq!(send_command(&mut writer, &mut reader, "APPEND msg  World").await, "10");
     assert_eq!(send_command(&mut writer, &mut reader, "GET msg").await, "HelloWorld");
     
+    // Test APPENDCAPPED: the front is trimmed at a newline when one is close
+    // after the cut, otherwise exactly at it
+    assert_eq!(send_command(&mut writer, &mut reader, "APPENDCAPPED log 12 \"one\\ntwo\\n\"").await, "8");
+    assert_eq!(send_command(&mut writer, &mut reader, "APPENDCAPPED log 12 \"three\\n\"").await, "10");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GET log", 3).await, vec!["two", "three", ""]);
+    assert_eq!(send_command(&mut writer, &mut reader, "APPENDCAPPED msg 6 !").await, "6");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET msg").await, "World!");
+    assert_eq!(send_command(&mut writer, &mut reader, "APPENDCAPPED msg 3 abcde").await, "3");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET msg").await, "cde");
+    assert!(send_command(&mut writer, &mut reader, "APPENDCAPPED msg 0 x").await.starts_with("ERROR:"));
+    
     // Cleanup
     std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
 }
@@ -94,6 +140,28 @@ async fn test_list_operations() {
     assert_eq!(send_command(&mut writer, &mut reader, "RPOP mylist").await, "d");
     assert_eq!(send_command(&mut writer, &mut reader, "LLEN mylist").await, "2");
     
+    // Test LTRIM - keep the last three items, then trim out of range
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH mylist x y z").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "LTRIM mylist -3 -1").await, "OK");
+    let range_result = send_command_multi(&mut writer, &mut reader, "LRANGE mylist 0 -1", 3).await;
+    assert_eq!(range_result, vec!["x", "y", "z"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "LTRIM mylist 5 10").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN mylist").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS mylist").await, "0");
+    
+    // Test capped pushes - the list never grows past the cap
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSHCAPPED capped 3 a b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSHCAPPED capped 3 c d e").await, "3");
+    let range_result = send_command_multi(&mut writer, &mut reader, "LRANGE capped 0 -1", 3).await;
+    assert_eq!(range_result, vec!["c", "d", "e"]);
+    
+    // Test popping several items at once, in the order they are popped
+    let range_result = send_command_multi(&mut writer, &mut reader, "RPOP capped 2", 2).await;
+    assert_eq!(range_result, vec!["e", "d"]);
+    let range_result = send_command_multi(&mut writer, &mut reader, "LPOP capped 5", 1).await;
+    assert_eq!(range_result, vec!["c"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS capped").await, "0");
+    
     // Cleanup
     std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
 }
@@ -120,6 +188,24 @@ async fn test_set_operations() {
     assert_eq!(send_command(&mut writer, &mut reader, "SISMEMBER myset apple").await, "1");
     assert_eq!(send_command(&mut writer, &mut reader, "SISMEMBER myset grape").await, "0");
     
+    // Test SMISMEMBER - one line per candidate, aligned with the input
+    let flags = send_command_multi(&mut writer, &mut reader, "SMISMEMBER myset apple grape banana", 3).await;
+    assert_eq!(flags, vec!["1", "0", "1"]);
+    let flags = send_command_multi(&mut writer, &mut reader, "SMISMEMBER noset apple grape", 2).await;
+    assert_eq!(flags, vec!["0", "0"]);
+    
+    // Test SRANDMEMBER - distinct members for a positive count, repeats allowed for a negative one
+    let sample = send_command_multi(&mut writer, &mut reader, "SRANDMEMBER myset 2", 2).await;
+    assert!(sample[0] != sample[1]);
+    let sample = send_command_multi(&mut writer, &mut reader, "SRANDMEMBER myset -5", 5).await;
+    assert_eq!(sample.len(), 5);
+    assert_eq!(send_command(&mut writer, &mut reader, "SRANDMEMBER noset 3").await, "(empty array)");
+    // Negative counts are bounded rather than allocated
+    for count in ["-1000000000", "-9223372036854775808"] {
+        let reply = send_command(&mut writer, &mut reader, &format!("SRANDMEMBER myset {}", count)).await;
+        assert!(reply.starts_with("ERROR: ERR value is out of range"), "{}", reply);
+    }
+    
     // Test SREM
     assert_eq!(send_command(&mut writer, &mut reader, "SREM myset apple").await, "1");
     assert_eq!(send_command(&mut writer, &mut reader, "SCARD myset").await, "2");
@@ -198,7 +284,25 @@ async fn test_sorted_set_operations() {
     // Test ZREM
     assert_eq!(send_command(&mut writer, &mut reader, "ZREM leaderboard alice").await, "1");
     assert_eq!(send_command(&mut writer, &mut reader, "ZCARD leaderboard").await, "2");
-    
+
+    // Test ZREMRANGEBYRANK: keep the top 3 by removing all but the last 3
+    assert_eq!(send_command(&mut writer, &mut reader, "ZADD top 1 a 2 b 3 c 4 d 5 e").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYRANK top 0 -4").await, "2");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "ZRANGE top 0 -1", 3).await, vec!["c", "d", "e"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYRANK top 5 10").await, "0");
+
+    // Test ZREMRANGEBYSCORE, with inclusive bounds
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYSCORE top 4 +inf").await, "2");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "ZRANGE top 0 -1", 1).await, vec!["c"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYSCORE top 3 2").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYSCORE top nope 2").await, "ERROR: ERR Protocol error: Invalid score");
+    // Removing the last member deletes the key
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYRANK top 0 -1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS top").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "ZREMRANGEBYSCORE top -inf +inf").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET plain x").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "ZREMRANGEBYRANK plain 0 -1").await.contains("WRONGTYPE"));
+
     // Cleanup
     std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
 }
@@ -287,11 +391,2290 @@ async fn test_utility_operations() {
     assert_eq!(send_command(&mut writer, &mut reader, "EXISTS mystring mylist myset").await, "3");
     assert_eq!(send_command(&mut writer, &mut reader, "EXISTS nonexistent").await, "0");
     
+    // Test SCAN and EXPORT filters
+    let page = send_command_multi(&mut writer, &mut reader, "SCAN 0 MATCH my* TYPE list", 2).await;
+    assert_eq!(page, vec!["0", "mylist"]);
+    let page = send_command_multi(&mut writer, &mut reader, "EXPORT 0 MATCH mystr?ng", 2).await;
+    assert_eq!(page, vec!["0", r#"{"key":"mystring","type":"string","value":"hello","ttl":null}"#]);
+    
     // Test DEL
     assert_eq!(send_command(&mut writer, &mut reader, "DEL mystring").await, "1");
     assert_eq!(send_command(&mut writer, &mut reader, "EXISTS mystring").await, "0");
     assert_eq!(send_command(&mut writer, &mut reader, "DEL mylist myset").await, "2");
     
+    // Test RANDOMKEY on an empty database
+    assert_eq!(send_command(&mut writer, &mut reader, "RANDOMKEY").await, "(nil)");
+
+    // Test conditional SET with expiry and compare-and-delete
+    assert_eq!(send_command(&mut writer, &mut reader, "SET lock token1 NX PX 10000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET lock token2 NX PX 10000").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL lock").await, "10");
+    assert_eq!(send_command(&mut writer, &mut reader, "DELIFEQ lock token2").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "DELIFEQ lock token1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL lock").await, "-2");
+
+    // Test GETORSET, which only sets a missing key
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GETORSET theme light", 2).await, vec!["light", "1"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GETORSET theme dark", 2).await, vec!["light", "0"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET theme").await, "light");
+    assert_eq!(send_command(&mut writer, &mut reader, "LPUSH themes dark").await, "1");
+    let response = send_command(&mut writer, &mut reader, "GETORSET themes light").await;
+    assert!(response.contains("WRONGTYPE"), "{}", response);
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL theme themes").await, "2");
+
+    // Test SET ... GET, which replies with the value it replaced
+    assert_eq!(send_command(&mut writer, &mut reader, "SET version v1 GET").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET version v2 GET PX 100000").await, "v1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL version").await, "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET version v3 NX GET").await, "v2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET version v3 XX GET KEEPTTL").await, "v2");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL version").await, "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET version").await, "v3");
+    assert_eq!(send_command(&mut writer, &mut reader, "LPUSH versions v1").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "SET versions v2 GET").await.contains("WRONGTYPE"));
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL version versions").await, "2");
+
+    // Test INCRMULTI, which increments counters together or not at all
+    assert_eq!(send_command(&mut writer, &mut reader, "SET events:total 10").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE events:total 100").await, "1");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "INCRMULTI events:total 1 events:click 1 events:eu -2", 3).await,
+        vec!["11", "1", "-2"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL events:total").await, "100");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "INCRMULTI events:total 1 events:total 5", 2).await, vec!["12", "17"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET events:name click").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "INCRMULTI events:total 1 events:name 1").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "GET events:total").await, "17");
+    assert!(send_command(&mut writer, &mut reader, "INCRMULTI events:total").await.starts_with("ERROR:"));
+    assert!(send_command(&mut writer, &mut reader, "INCRMULTI events:total x").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL events:total events:click events:eu events:name").await, "4");
+
+    // Test DECRREAP, which deletes a counter on reaching zero
+    assert_eq!(send_command(&mut writer, &mut reader, "SET refs 2").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE refs 100").await, "1");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "DECRREAP refs", 2).await, vec!["1", "0"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL refs").await, "100");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "DECRREAP refs", 2).await, vec!["0", "1"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS refs").await, "0");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "DECRREAP refs", 2).await, vec!["-1", "0"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS refs").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET refs -5").await, "OK");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "DECRREAP refs", 2).await, vec!["-6", "1"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET refs many").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "DECRREAP refs").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "GET refs").await, "many");
+    assert!(send_command(&mut writer, &mut reader, "DECRREAP").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL refs").await, "1");
+
+    // Test EXPIRE and PERSIST
+    assert_eq!(send_command(&mut writer, &mut reader, "SET temp value").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL temp").await, "-1");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE temp 100").await, "1");
+    let ttls = send_command_multi(&mut writer, &mut reader, "MTTL temp missing", 2).await;
+    assert_eq!(ttls, vec!["100", "-2"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "PERSIST temp").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL temp").await, "-1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET temp value PX 50").await, "OK");
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS temp").await, "0");
+
+    // Test PEXPIRE, which takes milliseconds
+    assert_eq!(send_command(&mut writer, &mut reader, "SET temp value").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "PEXPIRE temp 200").await, "1");
+    let pttl: i64 = send_command(&mut writer, &mut reader, "PTTL temp").await.parse().unwrap();
+    assert!(pttl > 100 && pttl <= 200, "{}", pttl);
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL temp").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "PEXPIRE missing 200").await, "0");
+    sleep(Duration::from_millis(250)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS temp").await, "0");
+
+    // Test HELLO switching to framed replies
+    assert_eq!(send_command(&mut writer, &mut reader, "HELLO 2").await, "+OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET framed value").await, "+OK");
+    let framed = send_command_multi(&mut writer, &mut reader, "GET framed", 2).await;
+    assert_eq!(framed, vec!["$5", "value"]);
+    
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_database_operations() {
+    let port = 16398;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+    
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    
+    // Test MOVE into another database
+    assert_eq!(send_command(&mut writer, &mut reader, "SET staged v1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "MOVE staged 1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET staged").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "MOVE staged 1").await, "0");
+    
+    // Test SELECT
+    assert_eq!(send_command(&mut writer, &mut reader, "SELECT 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET staged").await, "v1");
+    assert!(send_command(&mut writer, &mut reader, "SELECT 16").await.starts_with("ERROR:"));
+    
+    // MOVE refuses to overwrite an existing key in the destination
+    assert_eq!(send_command(&mut writer, &mut reader, "SELECT 0").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET staged v2").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "MOVE staged 1").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET staged").await, "v2");
+    
+    // MOVE carries the key's expiry along, and leaves none behind
+    assert_eq!(send_command(&mut writer, &mut reader, "SET session token").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE session 100").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET plain value").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "MOVE session 1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "MOVE plain 1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL session").await, "-2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SELECT 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL session").await, "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL plain").await, "-1");
+    
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all(format!("./test_db_{}-db1", port)).ok();
+}
+
+#[tokio::test]
+async fn test_dump_restore() {
+    let port = 16400;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+    
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    
+    // Test DUMP and RESTORE of a string
+    assert_eq!(send_command(&mut writer, &mut reader, "SET source hello").await, "OK");
+    let payload = send_command(&mut writer, &mut reader, "DUMP source").await;
+    assert!(!payload.is_empty() && payload != "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RESTORE copy 0 {}", payload)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET copy").await, "hello");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL copy").await, "-1");
+    
+    // RESTORE refuses to overwrite unless told to, and can set a TTL
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RESTORE copy 0 {}", payload)).await,
+        "ERROR: BUSYKEY Target key name already exists");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RESTORE copy 5000 {} REPLACE", payload)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL copy").await, "5");
+    
+    // Test DUMP and RESTORE of a list
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH items a b c").await, "3");
+    let payload = send_command(&mut writer, &mut reader, "DUMP items").await;
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RESTORE items_copy 0 {}", payload)).await, "OK");
+    let items = send_command_multi(&mut writer, &mut reader, "LRANGE items_copy 0 -1", 3).await;
+    assert_eq!(items, vec!["a", "b", "c"]);
+    
+    // Missing keys and damaged payloads
+    assert_eq!(send_command(&mut writer, &mut reader, "DUMP missing").await, "(nil)");
+    let mut damaged = payload.clone();
+    let last = if damaged.ends_with('0') { '1' } else { '0' };
+    damaged.pop();
+    damaged.push(last);
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RESTORE broken 0 {}", damaged)).await,
+        "ERROR: ERR DUMP payload version or checksum are wrong");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS broken").await, "0");
+    
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_concurrent_list_pushes() {
+    let port = 16401;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    // Plain and capped pushes from several connections at once: none of
+    // them may overwrite another's items
+    let mut tasks = Vec::new();
+    for client in 0..8 {
+        tasks.push(tokio::spawn(async move {
+            let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+            let (reader, mut writer) = stream.into_split();
+            let mut reader = BufReader::new(reader);
+            for i in 0..100 {
+                let cmd = match client % 3 {
+                    0 => format!("RPUSH jobs c{}-{}", client, i),
+                    1 => format!("LPUSH jobs c{}-{}", client, i),
+                    _ => format!("RPUSHCAPPED jobs 100000 c{}-{}", client, i),
+                };
+                send_command(&mut writer, &mut reader, &cmd).await;
+            }
+        }));
+    }
+    for task in tasks {
+        task.await.unwrap();
+    }
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN jobs").await, "800");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_concurrent_list_pops() {
+    let port = 16402;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let items: Vec<String> = (0..400).map(|i| format!("job{}", i)).collect();
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("RPUSH jobs {}", items.join(" "))).await, "400");
+
+    // Single and batch pops from both ends race for the same items: each
+    // item must reach exactly one consumer
+    let mut tasks = Vec::new();
+    for consumer in 0..8 {
+        tasks.push(tokio::spawn(async move {
+            let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+            let (reader, mut writer) = stream.into_split();
+            let mut reader = BufReader::new(reader);
+            let mut popped = Vec::new();
+            for _ in 0..25 {
+                let (cmd, count) = match consumer % 4 {
+                    0 => ("LPOP jobs", 1),
+                    1 => ("RPOP jobs", 1),
+                    2 => ("LPOP jobs 2", 2),
+                    _ => ("RPOP jobs 2", 2),
+                };
+                popped.extend(send_command_multi(&mut writer, &mut reader, cmd, count).await);
+            }
+            popped
+        }));
+    }
+    let mut popped = Vec::new();
+    for task in tasks {
+        popped.extend(task.await.unwrap());
+    }
+
+    popped.sort();
+    let mut expected: Vec<String> = items[..150].iter().chain(&items[250..]).cloned().collect();
+    expected.sort();
+    assert_eq!(popped, expected);
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN jobs").await, "100");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_memory_usage() {
+    let port = 16403;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "MEMORY USAGE missing").await, "(nil)");
+
+    // Bigger values use more memory
+    assert_eq!(send_command(&mut writer, &mut reader, "SET small hello").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET large {}", "x".repeat(1000))).await, "OK");
+    let small: i64 = send_command(&mut writer, &mut reader, "MEMORY USAGE small").await.parse().unwrap();
+    let large: i64 = send_command(&mut writer, &mut reader, "MEMORY USAGE large").await.parse().unwrap();
+    assert!(small > 5, "small value reported as {} bytes", small);
+    assert!(large >= small + 995, "large value reported as {} bytes, small as {}", large, small);
+
+    // An expiry adds its own copy of the key and the deadline
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE small 100").await, "1");
+    let expiring: i64 = send_command(&mut writer, &mut reader, "MEMORY USAGE small").await.parse().unwrap();
+    assert_eq!(expiring, small + "small".len() as i64 + 8);
+
+    // Collections count their members
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH items a").await, "1");
+    let one: i64 = send_command(&mut writer, &mut reader, "MEMORY USAGE items").await.parse().unwrap();
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH items b c d").await, "4");
+    let four: i64 = send_command(&mut writer, &mut reader, "MEMORY USAGE items").await.parse().unwrap();
+    assert!(four > one, "list of four reported as {} bytes, list of one as {}", four, one);
+
+    // MEMORY STATS starts with the server-wide figures, followed by the
+    // storage engine's
+    let stats = send_command_multi(&mut writer, &mut reader, "MEMORY STATS", 6).await;
+    assert_eq!(stats[0], "connected-clients");
+    assert_eq!(stats[1], "1");
+    assert_eq!(stats[2], "databases.open");
+    assert_eq!(stats[3], "1");
+    assert_eq!(stats[4], "expires.count");
+    assert_eq!(stats[5], "1");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_debug_object() {
+    let port = 16404;
+    start_configured_server(port, |config| config.debug_enabled = true).await;
+    start_test_server(16405).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "DEBUG OBJECT missing").await, "(nil)");
+
+    // Strings report whether they hold an integer
+    assert_eq!(send_command(&mut writer, &mut reader, "SET counter 42").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT counter").await.starts_with("encoding:int "));
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting hello").await, "OK");
+    let info = send_command(&mut writer, &mut reader, "DEBUG OBJECT greeting").await;
+
+    // The serialized length is that of the DUMP payload and the memory
+    // matches MEMORY USAGE
+    let payload = send_command(&mut writer, &mut reader, "DUMP greeting").await;
+    let memory = send_command(&mut writer, &mut reader, "MEMORY USAGE greeting").await;
+    assert_eq!(info, format!("encoding:raw serializedlength:{} memory:{} ttl:-1", payload.len() / 2, memory));
+
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE greeting 100").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT greeting").await.ends_with(" ttl:100"));
+
+    // Other types report their container
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH items a b").await, "2");
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT items").await.starts_with("encoding:vector "));
+    assert_eq!(send_command(&mut writer, &mut reader, "SADD tags a").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT tags").await.starts_with("encoding:hashtable "));
+    assert_eq!(send_command(&mut writer, &mut reader, "ZADD scores 1 a").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT scores").await.starts_with("encoding:btree "));
+
+    // Without the debug flag the command is refused
+    let stream = TcpStream::connect("127.0.0.1:16405").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting hello").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "DEBUG OBJECT greeting").await,
+        "ERROR: ERR DEBUG command not allowed, set DISKDB_ENABLE_DEBUG=1 and restart the server");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all("./test_db_16405").ok();
+}
+
+#[tokio::test]
+async fn test_key_stats() {
+    let port = 16406;
+    start_configured_server(port, |config| {
+        config.key_stats_prefixes = vec!["user:".to_string(), "user:admin:".to_string(), "session:".to_string()];
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSTATS user:", 2).await, vec!["0", "0"]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "GET user:1").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET user:1 alice").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET user:1").await, "alice");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET user:1").await, "alice");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSTATS user:", 2).await, vec!["2", "1"]);
+
+    // A key counts towards every tracked prefix it starts with
+    assert_eq!(send_command(&mut writer, &mut reader, "GET user:admin:1").await, "(nil)");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSTATS user:", 2).await, vec!["2", "2"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSTATS user:admin:", 2).await, vec!["0", "1"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSTATS session:", 2).await, vec!["0", "0"]);
+
+    // Keys outside the tracked prefixes are not counted, and untracked
+    // prefixes cannot be queried
+    assert_eq!(send_command(&mut writer, &mut reader, "GET cache:1").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSTATS cache:").await,
+        "ERROR: ERR prefix is not tracked, add it to DISKDB_KEYSTATS_PREFIXES");
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSTATS use").await,
+        "ERROR: ERR prefix is not tracked, add it to DISKDB_KEYSTATS_PREFIXES");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_move_during_swapdb() {
+    let port = 16407;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    for i in 0..200 {
+        assert_eq!(send_command(&mut writer, &mut reader, &format!("SET key{} v{}", i, i)).await, "OK");
+    }
+
+    // Moves race with swaps of the same two databases; every key must
+    // still end up in exactly one of them, with its value
+    let swapper = tokio::spawn(async move {
+        let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+        let (reader, mut writer) = stream.into_split();
+        let mut reader = BufReader::new(reader);
+        for _ in 0..100 {
+            assert_eq!(send_command(&mut writer, &mut reader, "SWAPDB 0 1").await, "OK");
+        }
+    });
+    for i in 0..200 {
+        let moved = send_command(&mut writer, &mut reader, &format!("MOVE key{} 1", i)).await;
+        assert!(moved == "0" || moved == "1", "MOVE replied {}", moved);
+    }
+    swapper.await.unwrap();
+
+    for i in 0..200 {
+        assert_eq!(send_command(&mut writer, &mut reader, "SELECT 0").await, "OK");
+        let in_0 = send_command(&mut writer, &mut reader, &format!("GET key{}", i)).await;
+        assert_eq!(send_command(&mut writer, &mut reader, "SELECT 1").await, "OK");
+        let in_1 = send_command(&mut writer, &mut reader, &format!("GET key{}", i)).await;
+        let expected = format!("v{}", i);
+        assert!(
+            (in_0 == expected && in_1 == "(nil)") || (in_0 == "(nil)" && in_1 == expected),
+            "key{} is {} in database 0 and {} in database 1", i, in_0, in_1
+        );
+    }
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all(format!("./test_db_{}-db1", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_getreset() {
+    let port = 16408;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // A missing counter reads as 0 and is created
+    assert_eq!(send_command(&mut writer, &mut reader, "GETRESET hits").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET hits").await, "0");
+
+    assert_eq!(send_command(&mut writer, &mut reader, "INCRBY hits 5").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETRESET hits").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET hits").await, "0");
+
+    // The counter keeps its expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "INCR hits").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE hits 100").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETRESET hits").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL hits").await, "100");
+
+    // Values that are not integers are left alone
+    assert_eq!(send_command(&mut writer, &mut reader, "SET name alice").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "GETRESET name").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "GET name").await, "alice");
+
+    // Flushing while other connections increment loses no increment
+    let mut tasks = Vec::new();
+    for _ in 0..4 {
+        tasks.push(tokio::spawn(async move {
+            let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+            let (reader, mut writer) = stream.into_split();
+            let mut reader = BufReader::new(reader);
+            for _ in 0..250 {
+                send_command(&mut writer, &mut reader, "INCR requests").await;
+            }
+        }));
+    }
+    let mut flushed = 0;
+    while tasks.iter().any(|task| !task.is_finished()) {
+        flushed += send_command(&mut writer, &mut reader, "GETRESET requests").await.parse::<i64>().unwrap();
+    }
+    for task in tasks {
+        task.await.unwrap();
+    }
+    flushed += send_command(&mut writer, &mut reader, "GETRESET requests").await.parse::<i64>().unwrap();
+    assert_eq!(flushed, 1000);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_rotate() {
+    let port = 16452;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // A missing key stays missing
+    assert_eq!(send_command(&mut writer, &mut reader, "ROTATE log").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS log").await, "0");
+
+    // The old value is returned and the key left empty, with its expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "APPEND log first").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE log 100").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "ROTATE log").await, "first");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET log").await, "");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS log").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL log").await, "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "APPEND log second").await, "6");
+    assert_eq!(send_command(&mut writer, &mut reader, "ROTATE log").await, "second");
+
+    // Values that are not strings are left alone
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH list a").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "ROTATE list").await.starts_with("ERROR: WRONGTYPE"));
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN list").await, "1");
+
+    // Rotating while other connections append loses no append
+    let mut tasks = Vec::new();
+    for _ in 0..4 {
+        tasks.push(tokio::spawn(async move {
+            let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+            let (reader, mut writer) = stream.into_split();
+            let mut reader = BufReader::new(reader);
+            for _ in 0..250 {
+                send_command(&mut writer, &mut reader, "APPEND events x").await;
+            }
+        }));
+    }
+    let mut archived = 0;
+    while tasks.iter().any(|task| !task.is_finished()) {
+        archived += send_command(&mut writer, &mut reader, "ROTATE events").await.trim_start_matches("(nil)").len();
+    }
+    for task in tasks {
+        task.await.unwrap();
+    }
+    archived += send_command(&mut writer, &mut reader, "ROTATE events").await.len();
+    assert_eq!(archived, 1000);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_max_args_boundary() {
+    let port = 16409;
+    start_configured_server(port, |config| config.max_args = 3).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Exactly the limit is accepted, one more is not
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k v").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k v extra").await,
+        "ERROR: ERR too many arguments, the limit is 3");
+
+    // A separator before the line terminator starts no argument
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k v \r").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k v\t\r").await, "OK");
+
+    // Quoted arguments are counted the way they are parsed
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k 'a\\\\' b'").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET k").await, "a\\' b");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k \"a\\\" b\"").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k 'a b' \"c d\"").await,
+        "ERROR: ERR too many arguments, the limit is 3");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_command_timeout() {
+    let port = 16410;
+    start_configured_server(port, |config| {
+        config.command_timeouts.insert(CommandClass::Keyspace, Duration::from_millis(1));
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Pipelined in batches, so replies never pile up unread
+    for batch in 0..50 {
+        let mut pipeline = String::new();
+        for i in batch * 1000..(batch + 1) * 1000 {
+            pipeline.push_str(&format!("SET key:{} {}\n", i, i));
+        }
+        writer.write_all(pipeline.as_bytes()).await.unwrap();
+        for _ in 0..1000 {
+            let mut line = String::new();
+            reader.read_line(&mut line).await.unwrap();
+            assert_eq!(line.trim(), "OK");
+        }
+    }
+
+    // A walk over the whole keyspace runs past its budget
+    let started = std::time::Instant::now();
+    assert_eq!(send_command(&mut writer, &mut reader, "SCAN 0 COUNT 100000 TYPE string").await,
+        "ERROR: TIMEOUT command timed out");
+    assert!(started.elapsed() < Duration::from_secs(1));
+
+    // Reads of other classes have no budget, and the connection goes on
+    assert_eq!(send_command(&mut writer, &mut reader, "GET key:42").await, "42");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET key:42 43").await, "OK");
+
+    // A keyspace-walking write stops between pages once past the budget
+    let started = std::time::Instant::now();
+    let reply = send_command(&mut writer, &mut reader, "EXPIREMATCHING key:* 100000").await;
+    assert!(reply.starts_with("ERROR: TIMEOUT command timed out after expiring "), "{}", reply);
+    assert!(started.elapsed() < Duration::from_secs(1));
+    assert_eq!(send_command(&mut writer, &mut reader, "PING").await, "PONG");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_rename_persist() {
+    let port = 16411;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // The promoted key keeps the value and loses the safety TTL
+    assert_eq!(send_command(&mut writer, &mut reader, "SET tmp:report draft").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE tmp:report 60").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "RENAMEPERSIST tmp:report report").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET report").await, "draft");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL report").await, "-1");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS tmp:report").await, "0");
+
+    // An existing destination is replaced, expiry included
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH tmp:items a b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE report 60").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "RENAMEPERSIST tmp:items report").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TYPE report").await, "list");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL report").await, "-1");
+
+    // Renaming a key to itself only removes the expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE report 60").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "RENAMEPERSIST report report").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL report").await, "-1");
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN report").await, "2");
+
+    assert_eq!(send_command(&mut writer, &mut reader, "RENAMEPERSIST missing report").await, "ERROR: NOTFOUND no such key");
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN report").await, "2");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_scan_by_age() {
+    let port = 16412;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET stale:1 a").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH stale:2 a").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET touched a").await, "OK");
+    sleep(Duration::from_millis(300)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "SET fresh a").await, "OK");
+    // Writing a key again makes it fresh; changing its expiry does not
+    assert_eq!(send_command(&mut writer, &mut reader, "APPEND touched b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE stale:1 100").await, "1");
+
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SCANBYAGE 0 200", 3).await,
+        vec!["0", "stale:1", "stale:2"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SCANBYAGE 0 200 TYPE list", 2).await,
+        vec!["0", "stale:2"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SCANBYAGE 0 0", 5).await,
+        vec!["0", "fresh", "stale:1", "stale:2", "touched"]);
+
+    // A page examines COUNT keys whether they match or not
+    let page = send_command_multi(&mut writer, &mut reader, "SCANBYAGE 0 200 COUNT 1", 2).await;
+    assert_ne!(page[0], "0");
+    assert_eq!(page[1], "(empty array)");
+
+    // Deleted keys lose their write time with them
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL stale:1").await, "1");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SCANBYAGE 0 200", 2).await,
+        vec!["0", "stale:2"]);
+
     // Cleanup
     std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
-}
\ No newline at end of file
+}
+
+#[tokio::test]
+async fn test_big_keys() {
+    let port = 16438;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting hello").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH queue a b c").await, "3");
+    assert_eq!(send_command(&mut writer, &mut reader, "HSET user name Jane").await, "1");
+
+    // Strings are measured in bytes, collections in elements
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "BIGKEYS 0", 10).await,
+        vec!["0", "greeting", "string", "5", "queue", "list", "3", "user", "hash", "1"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "BIGKEYS 0 TYPE list", 4).await,
+        vec!["0", "queue", "list", "3"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "BIGKEYS 0 MATCH u*", 4).await,
+        vec!["0", "user", "hash", "1"]);
+
+    // The walk continues from the cursor a page returns
+    let page = send_command_multi(&mut writer, &mut reader, "BIGKEYS 0 COUNT 2", 7).await;
+    assert_eq!(&page[1..], ["greeting", "string", "5", "queue", "list", "3"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, &format!("BIGKEYS {} COUNT 2", page[0]), 4).await,
+        vec!["0", "user", "hash", "1"]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "BIGKEYS zz").await, "ERROR: ERR invalid cursor");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_compression() {
+    let port = 16413;
+    start_configured_server(port, |config| {
+        config.compression = Some(Compression { min_size: 100, ..Compression::default() });
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Only the large value is compressed, and reads are unaffected
+    let large = "compressible ".repeat(200);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET small tiny").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET large \"{}\"", large)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET small").await, "tiny");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET large").await, large.trim());
+
+    let info = send_command_multi(&mut writer, &mut reader, "INFO", 31).await;
+    let field = |name: &str| info.iter()
+        .find_map(|line| line.strip_prefix(&format!("{}:", name)))
+        .unwrap_or_else(|| panic!("INFO has no {}: {:?}", name, info))
+        .to_string();
+    assert_eq!(field("compression"), "zstd");
+    assert_eq!(field("compression_min_size"), "100");
+    assert_eq!(field("values_written"), "2");
+    assert_eq!(field("values_compressed"), "1");
+    assert!(field("compression_ratio").parse::<f64>().unwrap() > 10.0);
+    // Bytes written count keys and values before compression
+    assert!(field("logical_bytes_written").parse::<u64>().unwrap() > large.len() as u64);
+    field("physical_bytes_written").parse::<u64>().unwrap();
+    field("write_amplification").parse::<f64>().unwrap();
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING large").await, "compressed");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING small").await, "raw");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING missing").await, "(nil)");
+
+    // Encoding hints override the size threshold
+    let medium = "compressible ".repeat(5);
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET medium \"{}\" ENCODING compressed", medium)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING medium").await, "compressed");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET medium").await, medium.trim());
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET large \"{}\" ENCODING raw", large)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING large").await, "raw");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET counter 42 ENCODING int PX 100000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING counter").await, "int");
+    assert_eq!(send_command(&mut writer, &mut reader, "INCR counter").await, "43");
+
+    // Hints the value does not suit fall back to the default
+    assert_eq!(send_command(&mut writer, &mut reader, "SET word hello ENCODING int").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING word").await, "raw");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET small tiny ENCODING compressed").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING small").await, "raw");
+
+    // An unknown encoding is not an option, so it is part of the value
+    assert_eq!(send_command(&mut writer, &mut reader, "SET other x ENCODING zip").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET other").await, "x ENCODING zip");
+
+    // Without compression configured, only hinted values are compressed
+    start_test_server(16448).await;
+    sleep(Duration::from_millis(100)).await;
+    let stream = TcpStream::connect("127.0.0.1:16448").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET large \"{}\"", large)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING large").await, "raw");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("SET large \"{}\" ENCODING compressed", large)).await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "OBJECT ENCODING large").await, "compressed");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all("./test_db_16448").ok();
+}
+
+#[tokio::test]
+async fn test_warmup() {
+    let port = 16414;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    for i in 0..1500 {
+        let key = if i % 3 == 0 { format!("warm:{}", i) } else { format!("cold:{}", i) };
+        assert_eq!(send_command(&mut writer, &mut reader, &format!("SET {} v", key)).await, "OK");
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "SADD other:set a").await, "1");
+
+    // Runs in the background; progress shows up in INFO
+    assert_eq!(send_command(&mut writer, &mut reader, "WARMUP warm:* other:*").await, "OK");
+    let mut info = Vec::new();
+    for _ in 0..50 {
+        info = send_command_multi(&mut writer, &mut reader, "INFO", 25).await;
+        if info.contains(&"warmup_in_progress:0".to_string()) {
+            break;
+        }
+        sleep(Duration::from_millis(20)).await;
+    }
+    assert_eq!(&info[7..11], &["# Warmup", "warmup_in_progress:0", "warmup_keys_scanned:1501", "warmup_keys_loaded:501"]);
+
+    // Without patterns every key is read
+    assert_eq!(send_command(&mut writer, &mut reader, "WARMUP").await, "OK");
+    for _ in 0..50 {
+        info = send_command_multi(&mut writer, &mut reader, "INFO", 25).await;
+        if info.contains(&"warmup_in_progress:0".to_string()) {
+            break;
+        }
+        sleep(Duration::from_millis(20)).await;
+    }
+    assert_eq!(&info[9..11], &["warmup_keys_scanned:1501", "warmup_keys_loaded:1501"]);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_change_log() {
+    let port = 16415;
+    start_configured_server(port, |config| config.change_log_retention = 4).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CHANGES 0", 2).await, vec!["0", "(empty array)"]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET user:1 \"Jane\"").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE user:1 100").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH queue a b").await, "2");
+    let changes = send_command_multi(&mut writer, &mut reader, "CHANGES 0 COUNT 2", 3).await;
+    assert_eq!(changes[0], "2");
+    assert_eq!(changes[1], r#"{"offset":0,"op":"set","key":"user:1","type":"string","value":"Jane"}"#);
+    assert!(changes[2].starts_with(r#"{"offset":1,"op":"expire","key":"user:1","expires_at":"#));
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CHANGES 2", 2).await,
+        vec!["3", r#"{"offset":2,"op":"set","key":"queue","type":"list","value":["a","b"]}"#]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "PERSIST user:1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL user:1 missing").await, "1");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CHANGES 3", 3).await, vec![
+        "5",
+        r#"{"offset":3,"op":"expire","key":"user:1","expires_at":null}"#,
+        r#"{"offset":4,"op":"del","key":"user:1"}"#,
+    ]);
+
+    // Only the latest four changes are kept
+    assert_eq!(send_command(&mut writer, &mut reader, "CHANGES 0").await,
+        "ERROR: ERR offset is no longer retained, the oldest is 1");
+    assert_eq!(send_command(&mut writer, &mut reader, "CHANGES 6").await,
+        "ERROR: ERR offset is past the end of the change log at 5");
+
+    // BLOCK waits for the next change, or replies with none once it runs out
+    let start = std::time::Instant::now();
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CHANGES 5 BLOCK 200", 2).await, vec!["5", "(empty array)"]);
+    assert!(start.elapsed() >= Duration::from_millis(200));
+
+    let other = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (other_reader, mut other_writer) = other.into_split();
+    let mut other_reader = BufReader::new(other_reader);
+    let write = tokio::spawn(async move {
+        sleep(Duration::from_millis(100)).await;
+        send_command(&mut other_writer, &mut other_reader, "SET late v").await
+    });
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CHANGES 5 BLOCK 0", 2).await,
+        vec!["6", r#"{"offset":5,"op":"set","key":"late","type":"string","value":"v"}"#]);
+    assert_eq!(write.await.unwrap(), "OK");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_change_log_disabled() {
+    let port = 16416;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "CHANGES 0").await,
+        "ERROR: ERR the change log is disabled, set DISKDB_CHANGELOG_RETENTION to enable it");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_bitmap() {
+    let port = 16417;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Setting a bit creates the bitmap and pads it with zero bytes
+    assert_eq!(send_command(&mut writer, &mut reader, "SETBIT flags 17 1").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETBIT flags 17 1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETBIT flags 0 1").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "TYPE flags").await, "bitmap");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETBIT flags 17").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETBIT flags 16").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETBIT flags 1000").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "GETBIT missing 3").await, "0");
+
+    // Ranges are in bytes, inclusive and counted from the end when negative
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags 0 -1").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags 1 2").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags -1 -1").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags 1 1").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags 5 10").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT missing").await, "0");
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SETBIT flags 17 0").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "BITCOUNT flags").await, "1");
+
+    let response = send_command(&mut writer, &mut reader, "SETBIT flags 4294967296 1").await;
+    assert!(response.contains("bit offset is not an integer or out of range"), "{}", response);
+    let response = send_command(&mut writer, &mut reader, "SETBIT flags 3 2").await;
+    assert!(response.contains("bit is not an integer or out of range"), "{}", response);
+
+    send_command(&mut writer, &mut reader, "SET plain value").await;
+    let response = send_command(&mut writer, &mut reader, "SETBIT plain 1 1").await;
+    assert!(response.contains("WRONGTYPE"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_hyperloglog() {
+    let port = 16418;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "PFADD visitors a b c").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFADD visitors a b").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "TYPE visitors").await, "hyperloglog");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT visitors").await, "3");
+
+    // Adding nothing still creates the key
+    assert_eq!(send_command(&mut writer, &mut reader, "PFADD empty").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT empty").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT missing").await, "0");
+
+    // Counting several keys estimates their union
+    send_command(&mut writer, &mut reader, "PFADD others c d e").await;
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT visitors others missing").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFMERGE all visitors others").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT all").await, "5");
+
+    // The destination's own elements stay in the merge
+    send_command(&mut writer, &mut reader, "PFADD all f").await;
+    assert_eq!(send_command(&mut writer, &mut reader, "PFMERGE all visitors").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "PFCOUNT all").await, "6");
+
+    send_command(&mut writer, &mut reader, "SET plain value").await;
+    let response = send_command(&mut writer, &mut reader, "PFADD plain x").await;
+    assert!(response.contains("WRONGTYPE"), "{}", response);
+    let response = send_command(&mut writer, &mut reader, "PFCOUNT visitors plain").await;
+    assert!(response.contains("WRONGTYPE"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_set_if_version() {
+    let port = 16419;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // A missing key is at version 0
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SETIFVERSION doc 1 v1", 2).await, vec!["0", "0"]);
+    let reply = send_command_multi(&mut writer, &mut reader, "SETIFVERSION doc 0 v1", 2).await;
+    assert_eq!(reply[1], "1");
+    let first: u64 = reply[0].parse().unwrap();
+    assert!(first > 0);
+    let reply = send_command_multi(&mut writer, &mut reader, &format!("SETIFVERSION doc {} v2", first), 2).await;
+    assert_eq!(reply[1], "1");
+    let second: u64 = reply[0].parse().unwrap();
+    assert!(second > first);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET doc").await, "v2");
+
+    // A stale version is refused with the current one
+    assert_eq!(send_command_multi(&mut writer, &mut reader, &format!("SETIFVERSION doc {} stale", first), 2).await,
+        vec![second.to_string(), "0".to_string()]);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET doc").await, "v2");
+
+    // Writing the value otherwise raises the version too, so a version
+    // once seen never matches again
+    send_command(&mut writer, &mut reader, "SET doc plain").await;
+    let reply = send_command_multi(&mut writer, &mut reader, &format!("SETIFVERSION doc {} v3", second), 2).await;
+    assert_eq!(reply[1], "0");
+    let third: u64 = reply[0].parse().unwrap();
+    assert!(third > second);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SETIFVERSION doc 0 v3", 2).await, vec![third.to_string(), "0".to_string()]);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET doc").await, "plain");
+
+    // A deleted key is missing again, at version 0, and recreating it
+    // moves past every earlier version
+    send_command(&mut writer, &mut reader, "DEL doc").await;
+    let reply = send_command_multi(&mut writer, &mut reader, "SETIFVERSION doc 0 v4", 2).await;
+    assert_eq!(reply[1], "1");
+    assert!(reply[0].parse::<u64>().unwrap() > third);
+
+    let response = send_command(&mut writer, &mut reader, "SETIFVERSION doc -1 v5").await;
+    assert!(response.contains("Invalid version"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_debug_timing() {
+    let port = 16430;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Line replies are followed by the time
+    let reply = send_command_multi(&mut writer, &mut reader, "DEBUG TIMING ON", 2).await;
+    assert_eq!(reply[0], "OK");
+    assert!(reply[1].starts_with("(server time ") && reply[1].ends_with(" us)"), "{}", reply[1]);
+    let reply = send_command_multi(&mut writer, &mut reader, "GET missing", 2).await;
+    assert_eq!(reply[0], "(nil)");
+    assert!(reply[1].starts_with("(server time "), "{}", reply[1]);
+
+    // Framed replies are preceded by an attribute holding it, for reads
+    // run concurrently too
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "HELLO 2", 4).await[3], "+OK");
+    let reply = send_command_multi(&mut writer, &mut reader, "SET name Alice", 4).await;
+    assert_eq!(&reply[..2], ["|1", "+server_time_us"]);
+    assert!(reply[2].starts_with(':') && reply[2][1..].parse::<u64>().is_ok(), "{}", reply[2]);
+    assert_eq!(reply[3], "+OK");
+    let reply = send_command_multi(&mut writer, &mut reader, "GET name", 5).await;
+    assert_eq!(&reply[..2], ["|1", "+server_time_us"]);
+    assert_eq!(&reply[3..], ["$5", "Alice"]);
+
+    // Off again, replies are plain
+    assert_eq!(send_command(&mut writer, &mut reader, "DEBUG TIMING OFF").await, "+OK");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "PING", 2).await, ["$4", "PONG"]);
+
+    let response = send_command(&mut writer, &mut reader, "DEBUG TIMING MAYBE").await;
+    assert!(response.contains("DEBUG TIMING requires ON or OFF"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_dead_letter() {
+    let port = 16431;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Expired values land on the list in the order their keys expired,
+    // whether or not anything reads the keys
+    assert_eq!(send_command(&mut writer, &mut reader, "SET job:1 first PX 50 DEADLETTER stuck").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET job:2 second PX 150 DEADLETTER stuck").await, "OK");
+    sleep(Duration::from_millis(80)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "GET job:1").await, "(nil)");
+    sleep(Duration::from_millis(400)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS job:2").await, "0");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "LRANGE stuck 0 -1", 2).await, vec!["first", "second"]);
+
+    // Deleting the key, persisting it or setting it again without the
+    // option cancels the dead letter
+    send_command(&mut writer, &mut reader, "SET job:3 deleted PX 50 DEADLETTER stuck").await;
+    send_command(&mut writer, &mut reader, "DEL job:3").await;
+    send_command(&mut writer, &mut reader, "SET job:4 persisted PX 50 DEADLETTER stuck").await;
+    send_command(&mut writer, &mut reader, "PERSIST job:4").await;
+    send_command(&mut writer, &mut reader, "SET job:5 replaced PX 50 DEADLETTER stuck").await;
+    send_command(&mut writer, &mut reader, "SET job:5 again PX 50").await;
+    // Changing only the expiry keeps it
+    send_command(&mut writer, &mut reader, "SET job:6 extended PX 50 DEADLETTER stuck").await;
+    send_command(&mut writer, &mut reader, "EXPIRE job:6 1").await;
+    sleep(Duration::from_millis(1300)).await;
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "LRANGE stuck 0 -1", 3).await, vec!["first", "second", "extended"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET job:4").await, "persisted");
+
+    // The option needs an expiry; without one the words are the value
+    assert_eq!(send_command(&mut writer, &mut reader, "SET job:7 v DEADLETTER stuck").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET job:7").await, "v DEADLETTER stuck");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_expire_matching() {
+    let port = 16432;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    for i in 0..5 {
+        send_command(&mut writer, &mut reader, &format!("SET cache:{} v", i)).await;
+    }
+    send_command(&mut writer, &mut reader, "SET other v").await;
+
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIREMATCHING cache:* 100").await, "5");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIREMATCHING nothing:* 100").await, "0");
+    let ttl: i64 = send_command(&mut writer, &mut reader, "PTTL cache:3").await.parse().unwrap();
+    assert!(ttl > 0 && ttl <= 100, "{}", ttl);
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL other").await, "-1");
+
+    sleep(Duration::from_millis(200)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS cache:0 cache:4 other").await, "1");
+
+    let response = send_command(&mut writer, &mut reader, "EXPIREMATCHING cache:* 0").await;
+    assert!(response.contains("Invalid expire time"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_client_names() {
+    let port = 16433;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let other = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (other_reader, mut other_writer) = other.into_split();
+    let mut other_reader = BufReader::new(other_reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "CLIENT GETNAME").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "CLIENT SETNAME billing-7").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "CLIENT GETNAME").await, "billing-7");
+    assert_eq!(send_command(&mut other_writer, &mut other_reader, "CLIENT SETNAME search-0").await, "OK");
+
+    // Every connection is listed with its name, oldest first
+    let list = send_command_multi(&mut writer, &mut reader, "CLIENT LIST", 2).await;
+    assert!(list[0].contains(" name=billing-7 "), "{:?}", list);
+    assert!(list[1].contains(" name=search-0 "), "{:?}", list);
+    assert!(list[0].starts_with("id=") && list[0].contains(" addr=127.0.0.1:"), "{:?}", list);
+
+    let response = send_command(&mut writer, &mut reader, "CLIENT SETNAME \"two words\"").await;
+    assert!(response.contains("cannot contain spaces"), "{}", response);
+    assert_eq!(send_command(&mut writer, &mut reader, "CLIENT GETNAME").await, "billing-7");
+
+    // A closed connection leaves the list
+    drop(other_writer);
+    drop(other_reader);
+    sleep(Duration::from_millis(100)).await;
+    let list = send_command(&mut writer, &mut reader, "CLIENT LIST").await;
+    assert!(list.contains(" name=billing-7 "), "{}", list);
+    assert_eq!(send_command(&mut writer, &mut reader, "PING").await, "PONG");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_time() {
+    let port = 16434;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    let before = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap();
+    let reply = send_command_multi(&mut writer, &mut reader, "TIME", 2).await;
+    let after = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap();
+    let seconds: u64 = reply[0].parse().unwrap();
+    let micros: u32 = reply[1].parse().unwrap();
+    assert!(micros < 1_000_000, "{:?}", reply);
+    let time = Duration::new(seconds, micros * 1000);
+    assert!(time >= before - Duration::from_micros(1) && time <= after, "{:?} not in {:?}..{:?}", time, before, after);
+
+    let response = send_command(&mut writer, &mut reader, "TIME now").await;
+    assert!(response.contains("TIME takes no arguments"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_invoke() {
+    let port = 16435;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // clamp keeps a counter within bounds
+    assert_eq!(send_command(&mut writer, &mut reader, "INVOKE clamp stock 0 10 7").await, "7");
+    assert_eq!(send_command(&mut writer, &mut reader, "INVOKE clamp stock 0 10 7").await, "10");
+    assert_eq!(send_command(&mut writer, &mut reader, "INVOKE CLAMP stock 0 10 -25").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET stock").await, "0");
+    let response = send_command(&mut writer, &mut reader, "INVOKE clamp stock 10 0").await;
+    assert!(response.contains("min is greater than max"), "{}", response);
+
+    // merge-json merges objects and removes members set to null
+    assert_eq!(
+        send_command(&mut writer, &mut reader, r#"INVOKE merge-json profile '{"name":"ada","tags":{"a":1,"b":2}}'"#).await,
+        r#"{"name":"ada","tags":{"a":1,"b":2}}"#
+    );
+    assert_eq!(
+        send_command(&mut writer, &mut reader, r#"INVOKE merge-json profile '{"tags":{"a":null,"c":3}}'"#).await,
+        r#"{"name":"ada","tags":{"b":2,"c":3}}"#
+    );
+    assert_eq!(send_command(&mut writer, &mut reader, "JSON.GET profile $").await, r#"{"name":"ada","tags":{"b":2,"c":3}}"#);
+
+    // cap-list keeps the newest items
+    assert_eq!(send_command(&mut writer, &mut reader, "INVOKE cap-list recent 3 a b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "INVOKE cap-list recent 3 c d e").await, "3");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "LRANGE recent 0 -1", 3).await, vec!["c", "d", "e"]);
+
+    // Errors leave the key alone
+    let response = send_command(&mut writer, &mut reader, "INVOKE cap-list stock 3 x").await;
+    assert!(response.contains("WRONGTYPE"), "{}", response);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET stock").await, "0");
+    let response = send_command(&mut writer, &mut reader, "INVOKE nope stock").await;
+    assert!(response.contains("unknown function 'nope'"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_write_backpressure() {
+    let port = 16436;
+    start_configured_server(port, |config| {
+        config.max_pending_write_bytes = 1;
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let other = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (other_reader, mut other_writer) = other.into_split();
+    let mut other_reader = BufReader::new(other_reader);
+
+    for batch in 0..20 {
+        let mut pipeline = String::new();
+        for i in batch * 1000..(batch + 1) * 1000 {
+            pipeline.push_str(&format!("SET key:{} {}\n", i, i));
+        }
+        writer.write_all(pipeline.as_bytes()).await.unwrap();
+        for _ in 0..1000 {
+            let mut line = String::new();
+            reader.read_line(&mut line).await.unwrap();
+            assert_eq!(line.trim(), "OK");
+        }
+    }
+
+    // A write queued behind slow keyspace walks stays pending until they
+    // are done, which fills the one-byte backlog. The walks stay under the
+    // 64 reads run at once, so the write is read, and its bytes reserved,
+    // straight away.
+    let mut pipeline = String::new();
+    for _ in 0..60 {
+        pipeline.push_str("SCAN 0 COUNT 100000 MATCH none:*\n");
+    }
+    pipeline.push_str("SET held 1\n");
+    writer.write_all(pipeline.as_bytes()).await.unwrap();
+    sleep(Duration::from_millis(10)).await;
+
+    // Other writes are refused meanwhile; reads are not
+    assert_eq!(send_command(&mut other_writer, &mut other_reader, "SET other 1").await,
+        "ERROR: TRYAGAIN write backlog is full, retry later");
+    assert_eq!(send_command(&mut other_writer, &mut other_reader, "PING").await, "PONG");
+
+    loop {
+        let mut line = String::new();
+        reader.read_line(&mut line).await.unwrap();
+        if line.trim() == "OK" {
+            break;
+        }
+    }
+
+    // Once the backlog drains the retry goes through
+    assert_eq!(send_command(&mut other_writer, &mut other_reader, "SET other 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET held").await, "1");
+    let info = send_command_multi(&mut writer, &mut reader, "INFO", 25).await;
+    assert!(info.iter().any(|line| line == "pending_write_bytes:0"), "{:?}", info);
+    assert!(info.iter().any(|line| line == "rejected_writes:1"), "{:?}", info);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_key_limits() {
+    let port = 16437;
+    start_configured_server(port, |config| {
+        config.max_keys.insert(0, 3);
+        config.max_keys.insert(1, 1);
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET a 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH b x y").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET c 1 PX 50").await, "OK");
+
+    // A full database refuses new keys but takes writes to existing ones
+    assert_eq!(send_command(&mut writer, &mut reader, "SET d 1").await,
+        "ERROR: OOM Key limit exceeded: the database holds at most 3 keys");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS d").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET a 2").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH b z").await, "3");
+    let info = send_command_multi(&mut writer, &mut reader, "INFO", 27).await;
+    assert_eq!(&info[25..], &["# Keyspace", "db0:keys=3,max_keys=3"]);
+
+    // Deleted and expired keys make room
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL a").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET d 1").await, "OK");
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "SET e 1").await, "OK");
+
+    // Each database has its own limit
+    assert_eq!(send_command(&mut writer, &mut reader, "SELECT 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET a 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET b 1").await,
+        "ERROR: OOM Key limit exceeded: the database holds at most 1 keys");
+    let info = send_command_multi(&mut writer, &mut reader, "INFO", 28).await;
+    assert_eq!(&info[25..], &["# Keyspace", "db0:keys=3,max_keys=3", "db1:keys=1,max_keys=1"]);
+
+    // Concurrent writers cannot go past the limit together
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL a").await, "1");
+    let mut tasks = Vec::new();
+    for i in 0..8 {
+        tasks.push(tokio::spawn(async move {
+            let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+            let (reader, mut writer) = stream.into_split();
+            let mut reader = BufReader::new(reader);
+            assert_eq!(send_command(&mut writer, &mut reader, "SELECT 1").await, "OK");
+            send_command(&mut writer, &mut reader, &format!("SET racer:{} 1", i)).await == "OK"
+        }));
+    }
+    let mut created = 0;
+    for task in tasks {
+        if task.await.unwrap() {
+            created += 1;
+        }
+    }
+    assert_eq!(created, 1);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all(format!("./test_db_{}-db1", port)).ok();
+}
+
+#[tokio::test]
+async fn test_compaction() {
+    let port = 16439;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "COMPACT STATUS", 3).await, vec!["0", "0", "0"]);
+
+    // Enough keys for several ranges, written a batch at a time
+    for batch in 0..25 {
+        let commands: String = (0..1000).map(|i| format!("SET key:{}:{} value\n", batch, i)).collect();
+        writer.write_all(commands.as_bytes()).await.unwrap();
+        for _ in 0..1000 {
+            let mut line = String::new();
+            reader.read_line(&mut line).await.unwrap();
+            assert_eq!(line.trim(), "OK");
+        }
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL key:0:0").await, "1");
+
+    // One compaction at a time
+    writer.write_all(b"COMPACT\nCOMPACT\n").await.unwrap();
+    let mut replies = [String::new(), String::new()];
+    for reply in &mut replies {
+        reader.read_line(reply).await.unwrap();
+    }
+    assert_eq!(replies[0].trim(), "OK");
+    assert_eq!(replies[1].trim(), "ERROR: ERR compaction already in progress");
+
+    // Cancelling stops it between ranges, before the end
+    assert_eq!(send_command(&mut writer, &mut reader, "COMPACT CANCEL").await, "OK");
+    let status = loop {
+        let status = send_command_multi(&mut writer, &mut reader, "COMPACT STATUS", 3).await;
+        if status[0] == "0" {
+            break status;
+        }
+        sleep(Duration::from_millis(10)).await;
+    };
+    assert_ne!(status[1], "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET key:24:999").await, "value");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET key:0:0").await, "(nil)");
+
+    // Left alone, it runs to the end
+    assert_eq!(send_command(&mut writer, &mut reader, "COMPACT").await, "OK");
+    let status = loop {
+        let status = send_command_multi(&mut writer, &mut reader, "COMPACT STATUS", 3).await;
+        if status[0] == "0" {
+            break status;
+        }
+        sleep(Duration::from_millis(10)).await;
+    };
+    assert_eq!(status[1], "100");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET key:12:500").await, "value");
+    // Cancelling with nothing running does nothing
+    assert_eq!(send_command(&mut writer, &mut reader, "COMPACT CANCEL").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "COMPACT NOW").await.starts_with("ERROR:"));
+
+    // A single key is compacted in place, its value unchanged
+    for i in 0..100 {
+        assert_eq!(send_command(&mut writer, &mut reader, &format!("APPEND hot {}", i % 10)).await, (i + 1).to_string());
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "COMPACT KEY hot").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET hot").await, "0123456789".repeat(10));
+    assert_eq!(send_command(&mut writer, &mut reader, "COMPACT KEY missing").await, "ERROR: NOTFOUND no such key");
+    assert!(send_command(&mut writer, &mut reader, "COMPACT KEY").await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_multiple_listeners() {
+    use diskdb::config::ListenAddress;
+    use tokio::net::UnixStream;
+
+    let port = 16440;
+    let path = std::path::PathBuf::from(format!("./test_db_{}", port));
+    let socket = std::path::PathBuf::from(format!("./test_db_{}.sock", port));
+    let mut config = Config::new();
+    config.database_path = path.clone();
+    config.listen = vec![
+        ListenAddress::Tcp(format!("127.0.0.1:{}", port)),
+        ListenAddress::Unix(socket.clone()),
+    ];
+    let storage = Arc::new(RocksDBStorage::new(&path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+    let (shutdown, stop) = tokio::sync::oneshot::channel::<()>();
+    let running = tokio::spawn(async move {
+        server.run_until(async { stop.await.ok(); }).await
+    });
+    sleep(Duration::from_millis(100)).await;
+
+    // Both listeners serve the same data
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET shared tcp").await, "OK");
+
+    let (unix_reader, mut unix_writer) = UnixStream::connect(&socket).await.unwrap().into_split();
+    let mut unix_reader = BufReader::new(unix_reader);
+    unix_writer.write_all(b"GET shared\nSET shared unix\n").await.unwrap();
+    for expected in ["tcp", "OK"] {
+        let mut line = String::new();
+        unix_reader.read_line(&mut line).await.unwrap();
+        assert_eq!(line.trim(), expected);
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "GET shared").await, "unix");
+
+    // Shutting down closes both
+    shutdown.send(()).unwrap();
+    running.await.unwrap().unwrap();
+    assert!(TcpStream::connect(format!("127.0.0.1:{}", port)).await.is_err());
+    assert!(UnixStream::connect(&socket).await.is_err());
+    assert!(!socket.exists());
+
+    // Cleanup
+    std::fs::remove_dir_all(&path).ok();
+}
+
+#[tokio::test]
+async fn test_reuse_port() {
+    use diskdb::config::ListenAddress;
+
+    // Two servers, each with its own data, share a port as in a rolling
+    // restart
+    let port = 16453;
+    let servers: Vec<_> = [16453, 16454].into_iter().map(|db| {
+        let path = std::path::PathBuf::from(format!("./test_db_{}", db));
+        let mut config = Config::new();
+        config.database_path = path.clone();
+        config.listen = vec![ListenAddress::Tcp(format!("127.0.0.1:{}", port))];
+        config.reuse_port = true;
+        config.listen_backlog = 16;
+        let storage = Arc::new(RocksDBStorage::new(&path).unwrap());
+        let server = Server::new(config, storage).unwrap();
+        let (shutdown, stop) = tokio::sync::oneshot::channel::<()>();
+        let running = tokio::spawn(async move {
+            server.run_until(async { stop.await.ok(); }).await
+        });
+        (shutdown, running, path)
+    }).collect();
+    sleep(Duration::from_millis(100)).await;
+    for (_, running, _) in &servers {
+        assert!(!running.is_finished(), "a server failed to bind");
+    }
+
+    // Once the old one stops, the new one takes every connection
+    let mut servers = servers.into_iter();
+    let (shutdown, running, old_path) = servers.next().unwrap();
+    shutdown.send(()).unwrap();
+    running.await.unwrap().unwrap();
+    for _ in 0..4 {
+        let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+        let (reader, mut writer) = stream.into_split();
+        let mut reader = BufReader::new(reader);
+        assert_eq!(send_command(&mut writer, &mut reader, "PING").await, "PONG");
+    }
+
+    // Without SO_REUSEPORT a port in use cannot be bound
+    let mut config = Config::new();
+    config.database_path = std::path::PathBuf::from("./test_db_16455");
+    config.listen = vec![ListenAddress::Tcp(format!("127.0.0.1:{}", port))];
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    assert!(Server::new(config, storage).unwrap().start().await.is_err());
+
+    // Cleanup
+    let (shutdown, running, new_path) = servers.next().unwrap();
+    shutdown.send(()).unwrap();
+    running.await.unwrap().unwrap();
+    for path in [old_path, new_path] {
+        std::fs::remove_dir_all(path).ok();
+    }
+    std::fs::remove_dir_all("./test_db_16455").ok();
+}
+
+#[tokio::test]
+async fn test_metrics() {
+    use tokio::io::AsyncReadExt;
+
+    let port = 16441;
+    let metrics_port = 16442;
+    start_configured_server(port, |config| {
+        config.metrics_address = Some(format!("127.0.0.1:{}", metrics_port));
+        config.max_keys.insert(0, 100);
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET a 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET a").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET b").await, "(nil)");
+
+    // The page ends where the reply to the PING after it starts
+    writer.write_all(b"METRICS\nPING\n").await.unwrap();
+    let mut page = Vec::new();
+    loop {
+        let mut line = String::new();
+        reader.read_line(&mut line).await.unwrap();
+        if line.trim() == "PONG" {
+            break;
+        }
+        page.push(line.trim_end().to_string());
+    }
+    assert!(page.contains(&"# TYPE diskdb_commands_total counter".to_string()));
+    assert!(page.contains(&"diskdb_commands_total{kind=\"read\"} 2".to_string()));
+    assert!(page.contains(&"diskdb_commands_total{kind=\"write\"} 1".to_string()));
+    assert!(page.contains(&"# HELP diskdb_connected_clients Clients connected.".to_string()));
+    assert!(page.contains(&"diskdb_connected_clients 1".to_string()));
+    assert!(page.contains(&"diskdb_evicted_keys_total{db=\"0\"} 0".to_string()));
+    assert!(send_command(&mut writer, &mut reader, "METRICS now").await.starts_with("ERROR:"));
+
+    // The same page is served over HTTP for Prometheus
+    let mut http = TcpStream::connect(format!("127.0.0.1:{}", metrics_port)).await.unwrap();
+    http.write_all(b"GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n").await.unwrap();
+    let mut reply = String::new();
+    http.read_to_string(&mut reply).await.unwrap();
+    assert!(reply.starts_with("HTTP/1.1 200 OK\r\n"));
+    assert!(reply.contains("Content-Type: text/plain; version=0.0.4"));
+    assert!(reply.contains("\r\n\r\n# HELP diskdb_commands_total"));
+    assert!(reply.contains("diskdb_commands_total{kind=\"other\"} 1\n"));
+
+    let mut http = TcpStream::connect(format!("127.0.0.1:{}", metrics_port)).await.unwrap();
+    http.write_all(b"GET / HTTP/1.1\r\n\r\n").await.unwrap();
+    let mut reply = String::new();
+    http.read_to_string(&mut reply).await.unwrap();
+    assert!(reply.starts_with("HTTP/1.1 404 Not Found\r\n"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_idempotent_set() {
+    let port = 16443;
+    start_configured_server(port, |config| config.max_request_ids = 2).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // A retry within the window is acknowledged without being applied, so
+    // it cannot undo a later write
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k first req-1 60000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k later").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k first req-1 60000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET k").await, "later");
+
+    // Past the window it is a new write
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k second req-2 50").await, "OK");
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "SET k later").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k second req-2 50").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET k").await, "second");
+
+    // Beyond the limit the oldest ids are forgotten early
+    for id in ["req-3", "req-4", "req-5"] {
+        assert_eq!(send_command(&mut writer, &mut reader, &format!("SETIDEM k {} {} 60000", id, id)).await, "OK");
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k again req-5 60000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET k").await, "req-5");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETIDEM k again req-3 60000").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET k").await, "again");
+
+    assert!(send_command(&mut writer, &mut reader, "SETIDEM k v req-6 0").await.starts_with("ERROR:"));
+    assert!(send_command(&mut writer, &mut reader, &format!("SETIDEM k v {} 1000", "x".repeat(300))).await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_swap() {
+    let port = 16444;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET front 1").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET back 2 PX 60000").await, "OK");
+
+    // Without WITHTTL each key keeps its own expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "SWAP front back").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET front").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET back").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "PTTL front").await, "-1");
+    assert!(send_command(&mut writer, &mut reader, "PTTL back").await.parse::<i64>().unwrap() > 0);
+
+    // With it the expiries move with the values
+    assert_eq!(send_command(&mut writer, &mut reader, "SWAP front back WITHTTL").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET front").await, "1");
+    assert!(send_command(&mut writer, &mut reader, "PTTL front").await.parse::<i64>().unwrap() > 0);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET back").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "PTTL back").await, "-1");
+
+    // A missing key swaps places with the other, of any type
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH items x y").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SWAP items missing").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS items").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "TYPE missing").await, "list");
+    assert_eq!(send_command(&mut writer, &mut reader, "LLEN missing").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SWAP front front").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET front").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SWAP nothing none").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS nothing none").await, "0");
+
+    assert!(send_command(&mut writer, &mut reader, "SWAP front").await.starts_with("ERROR:"));
+    assert!(send_command(&mut writer, &mut reader, "SWAP front back NOW").await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_audit_log() {
+    let port = 16445;
+    start_configured_server(port, |config| {
+        config.max_args = 4;
+        config.max_keys.insert(0, 1);
+        config.audit_log_size = 3;
+    }).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let local = stream.local_addr().unwrap().to_string();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "AUDITLOG LEN").await, "0");
+    assert!(send_command(&mut writer, &mut reader, "SET a b c d e").await.starts_with("ERROR: ERR too many arguments"));
+    assert!(send_command(&mut writer, &mut reader, "DEBUG OBJECT a").await.starts_with("ERROR: ERR DEBUG command not allowed"));
+    assert_eq!(send_command(&mut writer, &mut reader, "SET first v").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "set second v").await.starts_with("ERROR: OOM Key limit exceeded"));
+    assert_eq!(send_command(&mut writer, &mut reader, "AUDITLOG LEN").await, "3");
+
+    // Newest first, with the command name but not its arguments
+    let entries = send_command_multi(&mut writer, &mut reader, "AUDITLOG GET 2", 10).await;
+    assert_eq!(entries[0], "3");
+    assert!(entries[1].parse::<u64>().unwrap() > 0);
+    assert_eq!(entries[2], local);
+    assert_eq!(entries[3], "SET");
+    assert_eq!(entries[4], "OOM Key limit exceeded: the database holds at most 1 keys");
+    assert_eq!(entries[5], "2");
+    assert_eq!(entries[8], "DEBUG");
+
+    // The oldest entries make way for new ones
+    writer.write_all(b"GET \xff\n").await.unwrap();
+    let mut line = String::new();
+    reader.read_line(&mut line).await.unwrap();
+    assert_eq!(line.trim(), "ERROR: ERR request is not valid UTF-8");
+    let entries = send_command_multi(&mut writer, &mut reader, "AUDITLOG GET", 15).await;
+    assert_eq!(entries[0], "4");
+    assert_eq!(entries[3], "(nil)");
+    assert_eq!(entries[5], "3");
+    assert_eq!(entries[10], "2");
+
+    assert_eq!(send_command(&mut writer, &mut reader, "AUDITLOG RESET").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "AUDITLOG LEN").await, "0");
+    assert!(send_command(&mut writer, &mut reader, "AUDITLOG GET many").await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_debug_log_tail() {
+    let port = 16446;
+    // Every server in this process logs into the same tail
+    let _ = diskdb::log_tail::init(diskdb::log_tail::DEFAULT_LOG_TAIL_SIZE);
+    start_configured_server(port, |config| config.debug_enabled = true).await;
+    start_test_server(16447).await;
+    sleep(Duration::from_millis(100)).await;
+
+    log::warn!("log tail marker");
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Framed replies give the number of lines, which other tests vary
+    assert_eq!(send_command(&mut writer, &mut reader, "HELLO 2").await, "+OK");
+    let header = send_command(&mut writer, &mut reader, "DEBUG LOGTAIL").await;
+    let count: usize = header[1..].parse().unwrap();
+    assert!(count > 0 && count <= 100, "{}", header);
+    let mut lines = Vec::new();
+    for _ in 0..count * 2 {
+        let mut line = String::new();
+        reader.read_line(&mut line).await.unwrap();
+        lines.push(line.trim().to_string());
+    }
+    assert!(lines.iter().any(|line| line.ends_with(" WARN data_types_test: log tail marker")), "{:?}", lines);
+
+    // Each line starts with the time it was logged
+    let reply = send_command_multi(&mut writer, &mut reader, "DEBUG LOGTAIL 1", 3).await;
+    assert_eq!(reply[0], "*1");
+    let at_ms = reply[2].split(' ').next().unwrap();
+    assert!(at_ms.parse::<u64>().unwrap() > 0, "{}", reply[2]);
+    assert!(send_command(&mut writer, &mut reader, "DEBUG LOGTAIL some").await.starts_with("-"));
+
+    // Without the debug flag the command is refused
+    let stream = TcpStream::connect("127.0.0.1:16447").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "DEBUG LOGTAIL 10").await,
+        "ERROR: ERR DEBUG command not allowed, set DISKDB_ENABLE_DEBUG=1 and restart the server");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all("./test_db_16447").ok();
+}
+
+#[tokio::test]
+async fn test_shutdown() {
+    let port = 16450;
+    let running = start_configured_server(port, |config| config.shutdown_enabled = true).await;
+    start_test_server(16451).await;
+    sleep(Duration::from_millis(100)).await;
+
+    // Without the shutdown flag the command is refused and audited
+    let stream = TcpStream::connect("127.0.0.1:16451").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "SHUTDOWN NOSAVE").await,
+        "ERROR: ERR SHUTDOWN command not allowed, set DISKDB_ENABLE_SHUTDOWN=1 and restart the server");
+    let entry = send_command_multi(&mut writer, &mut reader, "AUDITLOG GET 1", 5).await;
+    assert_eq!(entry[3], "SHUTDOWN");
+    assert_eq!(send_command(&mut writer, &mut reader, "PING").await, "PONG");
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command(&mut writer, &mut reader, "SET persisted yes").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "SHUTDOWN NOW").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "SHUTDOWN SAVE").await, "OK");
+
+    // The server stops and closes its listener
+    tokio::time::timeout(Duration::from_secs(5), running).await.unwrap().unwrap();
+    assert!(TcpStream::connect(format!("127.0.0.1:{}", port)).await.is_err());
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all("./test_db_16451").ok();
+}
+
+#[tokio::test]
+async fn test_error_codes() {
+    let port = 16456;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // Every error reply starts with a code, ERR when there is no better one
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH queue a").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "INCR queue").await,
+        "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value");
+    assert_eq!(send_command(&mut writer, &mut reader, "FROB queue").await, "ERROR: ERR Invalid command: FROB");
+
+    // Framed replies carry the same codes
+    assert_eq!(send_command(&mut writer, &mut reader, "HELLO 2").await, "+OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "INCR queue").await,
+        "-WRONGTYPE Operation against a key holding the wrong kind of value");
+    assert_eq!(send_command(&mut writer, &mut reader, "FROB queue").await, "-ERR Invalid command: FROB");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_tags() {
+    let port = 16457;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:1 a user:42 web").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:2 b user:42").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:3 c user:7").await, "OK");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSBYTAG user:42", 2).await, vec!["session:1", "session:2"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSBYTAG web").await, "session:1");
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSBYTAG user:4").await, "(empty array)");
+
+    // Tags stay when the value is written any other way, and are replaced
+    // by the next SETTAGGED
+    assert_eq!(send_command(&mut writer, &mut reader, "SET session:1 a2").await, "OK");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "KEYSBYTAG user:42", 2).await, vec!["session:1", "session:2"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:1 a3 web").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSBYTAG user:42").await, "session:2");
+    assert_eq!(send_command(&mut writer, &mut reader, "GET session:1").await, "a3");
+
+    // Deleted and expired keys leave their tags, even if written again
+    assert_eq!(send_command(&mut writer, &mut reader, "DEL session:2").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET session:2 b").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSBYTAG user:42").await, "(empty array)");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:4 d user:7").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "PEXPIRE session:4 50").await, "1");
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "KEYSBYTAG user:7").await, "session:3");
+
+    // Like SET, SETTAGGED discards the expiry
+    assert_eq!(send_command(&mut writer, &mut reader, "EXPIRE session:3 100").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "SETTAGGED session:3 c2 user:7").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "TTL session:3").await, "-1");
+
+    assert!(send_command(&mut writer, &mut reader, "SETTAGGED session:5").await.starts_with("ERROR:"));
+    assert!(send_command(&mut writer, &mut reader, "KEYSBYTAG").await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_job_queue() {
+    let port = 16458;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH jobs a b").await, "2");
+    let first = send_command_multi(&mut writer, &mut reader, "CLAIMJOB jobs 100000", 2).await;
+    assert_eq!(first[1], "a");
+    let second = send_command_multi(&mut writer, &mut reader, "CLAIMJOB jobs 50", 2).await;
+    assert_eq!(second[1], "b");
+    assert_ne!(first[0], second[0]);
+    assert_eq!(send_command(&mut writer, &mut reader, "CLAIMJOB jobs 100000").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("ACKJOB jobs {}", first[0])).await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("ACKJOB jobs {}", first[0])).await, "0");
+
+    // A job not acknowledged in time goes back to the queue, and the late
+    // acknowledgement is refused
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("ACKJOB jobs {}", second[0])).await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "LRANGE jobs 0 -1").await, "b");
+    let third = send_command_multi(&mut writer, &mut reader, "CLAIMJOB jobs 100000", 2).await;
+    assert_eq!(third[1], "b");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS jobs jobs:claimed").await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("ACKJOB jobs {}", third[0])).await, "1");
+    assert_eq!(send_command(&mut writer, &mut reader, "EXISTS jobs jobs:claimed").await, "0");
+
+    assert!(send_command(&mut writer, &mut reader, "CLAIMJOB jobs 0").await.starts_with("ERROR:"));
+    assert_eq!(send_command(&mut writer, &mut reader, "SET report done").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "CLAIMJOB report 1000").await.starts_with("ERROR: WRONGTYPE"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_get_matching() {
+    let port = 16459;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET user:1 ann").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET user:2 bob").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET user:3 cy").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET order:1 pen").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH user:list a").await, "1");
+
+    // Keys holding anything but a string are skipped
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GETMATCHING 0 MATCH user:*", 7).await,
+        vec!["0", "user:1", "ann", "user:2", "bob", "user:3", "cy"]);
+
+    // The walk continues from the cursor a page returns
+    let page = send_command_multi(&mut writer, &mut reader, "GETMATCHING 0 MATCH user:* COUNT 3", 5).await;
+    assert_eq!(&page[1..], ["user:1", "ann", "user:2", "bob"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, &format!("GETMATCHING {} MATCH user:* COUNT 3", page[0]), 3).await,
+        vec!["0", "user:3", "cy"]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "GETMATCHING zz").await, "ERROR: ERR invalid cursor");
+    assert!(send_command(&mut writer, &mut reader, "GETMATCHING 0 TYPE string").await.starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_expire_reaper() {
+    let port = 16461;
+    start_configured_server(port, |config| config.active_expire_keys = 0).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    for key in ["a", "b", "c"] {
+        assert_eq!(send_command(&mut writer, &mut reader, &format!("SET {} v PX 50", key)).await, "OK");
+    }
+    assert_eq!(send_command(&mut writer, &mut reader, "SET kept v").await, "OK");
+    sleep(Duration::from_millis(300)).await;
+
+    // With the reaper off, expired keys stay until they are read
+    let stats = send_command_multi(&mut writer, &mut reader, "EXPIRESTATS", 14).await;
+    assert_eq!(&stats[..6], ["expires.count", "3", "expires.due", "3", "reaper.keys-per-cycle", "0"]);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "CONFIG SET active-expire-keys 2").await, "OK");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CONFIG GET active-expire-keys", 2).await,
+        vec!["active-expire-keys", "2"]);
+    sleep(Duration::from_millis(400)).await;
+
+    let stats = send_command_multi(&mut writer, &mut reader, "EXPIRESTATS", 14).await;
+    assert_eq!(&stats[..4], ["expires.count", "0", "expires.due", "0"]);
+    assert_eq!(&stats[12..], ["reaper.total-reaped", "3"]);
+    assert_eq!(send_command(&mut writer, &mut reader, "GET kept").await, "v");
+
+    assert!(send_command(&mut writer, &mut reader, "CONFIG SET active-expire-keys lots").await.starts_with("ERROR: ERR Invalid value"));
+    assert!(send_command(&mut writer, &mut reader, "CONFIG GET maxmemory").await.starts_with("ERROR: ERR Unknown CONFIG parameter"));
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_snapshots() {
+    let port = 16462;
+    let dir = format!("./test_snapshots_{}", port);
+    std::fs::remove_dir_all(&dir).ok();
+    start_configured_server(port, |config| config.snapshot_dir = dir.clone().into()).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "LASTSAVE").await, "0");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting hello").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "RPUSH jobs a b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SAVE first").await, "OK");
+    assert!(send_command(&mut writer, &mut reader, "LASTSAVE").await.parse::<u64>().unwrap() > 0);
+
+    // Writes after the snapshot are not in it, and it opens as a database
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting changed").await, "OK");
+    let snapshot = RocksDBStorage::new(format!("{}/first", dir)).unwrap();
+    assert!(matches!(snapshot.get("greeting").await.unwrap(), Some(DataType::String(value)) if value == "hello"));
+    assert!(snapshot.exists("jobs").await.unwrap());
+    drop(snapshot);
+
+    // A snapshot never overwrites anything
+    assert_eq!(send_command(&mut writer, &mut reader, "SAVE first").await,
+        "ERROR: ERR snapshot path 'first' already exists");
+
+    // Nor is it written outside the snapshot directory
+    for path in ["/tmp/escaped", "../escaped", "nested/../../escaped", "./first"] {
+        assert!(send_command(&mut writer, &mut reader, &format!("SAVE {}", path)).await
+            .starts_with("ERROR: ERR snapshot path must be relative to the snapshot directory"), "{}", path);
+    }
+    assert!(!std::path::Path::new("./escaped").exists());
+
+    // BGSAVE replies at once and reports completion in INFO
+    assert_eq!(send_command(&mut writer, &mut reader, "BGSAVE nested/second").await, "OK");
+    let mut info = Vec::new();
+    for _ in 0..50 {
+        info = send_command_multi(&mut writer, &mut reader, "INFO", 25).await;
+        if info.contains(&"snapshot_in_progress:0".to_string()) {
+            break;
+        }
+        sleep(Duration::from_millis(20)).await;
+    }
+    assert_eq!(&info[11..13], &["# Snapshot", "snapshot_in_progress:0"]);
+    assert_eq!(info[14], "last_snapshot_status:ok");
+    let snapshot = RocksDBStorage::new(format!("{}/nested/second", dir)).unwrap();
+    assert!(matches!(snapshot.get("greeting").await.unwrap(), Some(DataType::String(value)) if value == "changed"));
+    drop(snapshot);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all(&dir).ok();
+}
+
+#[tokio::test]
+async fn test_snapshot_restore() {
+    use diskdb::storage::snapshot;
+    use std::path::Path;
+
+    let port = 16463;
+    let dir = format!("./test_snapshots_{}", port);
+    std::fs::remove_dir_all(&dir).ok();
+    start_configured_server(port, |config| config.snapshot_dir = dir.clone().into()).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "SET greeting hello").await, "OK");
+    assert_eq!(send_command(&mut writer, &mut reader, "SADD tags a b").await, "2");
+    assert_eq!(send_command(&mut writer, &mut reader, "SAVE snap").await, "OK");
+
+    // The manifest is read and the files checked without loading anything
+    let info = send_command_multi(&mut writer, &mut reader, "SNAPSHOT INFO snap", 10).await;
+    assert_eq!(&info[..2], ["version", "1"]);
+    assert_eq!(&info[4..6], ["keys", "2"]);
+    assert_eq!(&info[8..], ["valid", "1"]);
+    assert!(info[3].parse::<u64>().unwrap() > 0);
+    assert!(send_command(&mut writer, &mut reader, "SNAPSHOT INFO missing").await.starts_with("ERROR:"));
+    // Nothing outside the snapshot directory is read
+    assert!(send_command(&mut writer, &mut reader, &format!("SNAPSHOT INFO {}/snap", dir)).await
+        .starts_with("ERROR: ERR snapshot path must be relative to the snapshot directory"));
+    assert!(send_command(&mut writer, &mut reader, "SNAPSHOT INFO ../src").await
+        .starts_with("ERROR: ERR snapshot path must be relative to the snapshot directory"));
+
+    // Restoring replaces the database, once
+    let snap = Path::new(&dir).join("snap");
+    let restored = Path::new(&dir).join("restored");
+    std::fs::create_dir_all(&restored).unwrap();
+    std::fs::write(restored.join("stale"), "old").unwrap();
+    let meta = snapshot::restore(&snap, &restored).unwrap().unwrap();
+    assert_eq!(meta.keys, 2);
+    assert!(!restored.join("stale").exists());
+    let storage = RocksDBStorage::new(&restored).unwrap();
+    assert!(matches!(storage.get("greeting").await.unwrap(), Some(DataType::String(value)) if value == "hello"));
+    drop(storage);
+    assert_eq!(snapshot::restore(&snap, &restored).unwrap(), None);
+
+    // A corrupt snapshot is refused, leaving the database as it was
+    let untouched = Path::new(&dir).join("untouched");
+    std::fs::create_dir_all(&untouched).unwrap();
+    std::fs::write(untouched.join("data"), "mine").unwrap();
+    let current = std::fs::read_to_string(snap.join("CURRENT")).unwrap();
+    std::fs::write(snap.join("CURRENT"), format!("{}x", current)).unwrap();
+    let err = snapshot::restore(&snap, &untouched).unwrap_err().to_string();
+    assert!(err.contains("checksum does not match"), "{}", err);
+    assert_eq!(std::fs::read_to_string(untouched.join("data")).unwrap(), "mine");
+    let info = send_command_multi(&mut writer, &mut reader, "SNAPSHOT INFO snap", 10).await;
+    assert_eq!(&info[8..], ["valid", "0"]);
+
+    // So is one of another version
+    std::fs::write(snap.join("CURRENT"), current).unwrap();
+    let manifest = std::fs::read_to_string(snap.join(snapshot::MANIFEST_FILE)).unwrap();
+    std::fs::write(snap.join(snapshot::MANIFEST_FILE), manifest.replace("version:1", "version:99")).unwrap();
+    let err = snapshot::restore(&snap, &untouched).unwrap_err().to_string();
+    assert!(err.contains("version 99"), "{}", err);
+    assert_eq!(std::fs::read_to_string(untouched.join("data")).unwrap(), "mine");
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+    std::fs::remove_dir_all(&dir).ok();
+}
+
+#[tokio::test]
+async fn test_rate_limit() {
+    let port = 16465;
+    start_configured_server(port, |config| config.max_commands_per_second = 5).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    // A burst past the limit is refused but the connection stays open
+    let mut limited = 0;
+    for _ in 0..10 {
+        let reply = send_command(&mut writer, &mut reader, "PING").await;
+        if reply == "ERROR: RATELIMIT too many commands per second, slow down" {
+            limited += 1;
+        } else {
+            assert_eq!(reply, "PONG");
+        }
+    }
+    assert!(limited >= 4, "only {} of 10 commands were limited", limited);
+
+    sleep(Duration::from_millis(1000)).await;
+    assert_eq!(send_command(&mut writer, &mut reader, "PING").await, "PONG");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "CONFIG GET max-commands-per-second", 2).await,
+        vec!["max-commands-per-second", "5"]);
+
+    // A limited client cannot lift the limit
+    assert!(send_command(&mut writer, &mut reader, "CONFIG SET max-commands-per-second 0").await
+        .starts_with("ERROR: ERR CONFIG parameter 'max-commands-per-second' can only be set at startup"));
+    let mut limited = 0;
+    for _ in 0..10 {
+        if send_command(&mut writer, &mut reader, "PING").await.starts_with("ERROR: RATELIMIT") {
+            limited += 1;
+        }
+    }
+    assert!(limited >= 4, "only {} of 10 commands were limited", limited);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
+
+#[tokio::test]
+async fn test_get_if_changed() {
+    let port = 16466;
+    start_test_server(port).await;
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect(format!("127.0.0.1:{}", port)).await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+
+    assert_eq!(send_command(&mut writer, &mut reader, "GETIFCHANGED config 0").await, "(nil)");
+    assert_eq!(send_command(&mut writer, &mut reader, "SET config v1").await, "OK");
+    let reply = send_command_multi(&mut writer, &mut reader, "GETIFCHANGED config 0", 2).await;
+    assert_eq!(reply[1], "v1");
+    let first: u64 = reply[0].parse().unwrap();
+    assert!(first > 0);
+
+    // Unchanged since the revision held, so no value is sent
+    assert_eq!(send_command_multi(&mut writer, &mut reader, &format!("GETIFCHANGED config {}", first), 2).await,
+        vec![first.to_string(), "(nil)".to_string()]);
+
+    // Every kind of write raises the revision, even one writing the same value
+    assert_eq!(send_command(&mut writer, &mut reader, "SET config v1").await, "OK");
+    let reply = send_command_multi(&mut writer, &mut reader, &format!("GETIFCHANGED config {}", first), 2).await;
+    let second: u64 = reply[0].parse().unwrap();
+    assert!(second > first);
+    assert_eq!(reply[1], "v1");
+    assert_eq!(send_command(&mut writer, &mut reader, "APPEND config +").await, "3");
+    let reply = send_command_multi(&mut writer, &mut reader, &format!("GETIFCHANGED config {}", second), 2).await;
+    assert!(reply[0].parse::<u64>().unwrap() > second);
+    assert_eq!(reply[1], "v1+");
+
+    // Deleting and recreating the key does not go back to an old revision
+    send_command(&mut writer, &mut reader, "DEL config").await;
+    assert_eq!(send_command(&mut writer, &mut reader, &format!("GETIFCHANGED config {}", second)).await, "(nil)");
+    send_command(&mut writer, &mut reader, "SET config v2").await;
+    let reply = send_command_multi(&mut writer, &mut reader, &format!("GETIFCHANGED config {}", second), 2).await;
+    assert_eq!(reply[1], "v2");
+
+    send_command(&mut writer, &mut reader, "RPUSH jobs a").await;
+    assert!(send_command(&mut writer, &mut reader, "GETIFCHANGED jobs 0").await.starts_with("ERROR: WRONGTYPE"));
+    let response = send_command(&mut writer, &mut reader, "GETIFCHANGED config -1").await;
+    assert!(response.contains("Invalid revision"), "{}", response);
+
+    // Cleanup
+    std::fs::remove_dir_all(format!("./test_db_{}", port)).ok();
+}
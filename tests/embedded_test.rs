@@ -0,0 +1,92 @@
+use diskdb::data_types::DataType;
+use diskdb::functions::Update;
+use diskdb::protocol::{Request, Response};
+use diskdb::storage::rocksdb_storage::RocksDBStorage;
+use diskdb::storage::Storage;
+use diskdb::{Config, DiskDBError, Embedded};
+use std::sync::Arc;
+
+#[tokio::test]
+async fn test_embedded_basic_operations() {
+    let storage = Arc::new(RocksDBStorage::new("./test_db_embedded").unwrap());
+    let mut db = Embedded::new(&Config::new(), storage);
+
+    db.set("embedded:greeting", "hello world").await.unwrap();
+    assert_eq!(db.get("embedded:greeting").await.unwrap(), Some("hello world".to_string()));
+    assert_eq!(db.get("embedded:missing").await.unwrap(), None);
+
+    let reply = db.command("LPUSH embedded:queue a b").await.unwrap();
+    assert!(matches!(reply, Response::Integer(2)));
+    let reply = db.execute(Request::LLen { key: "embedded:queue".to_string() }).await.unwrap();
+    assert!(matches!(reply, Response::Integer(2)));
+
+    assert_eq!(db.del(&["embedded:greeting", "embedded:queue", "embedded:missing"]).await.unwrap(), 2);
+    assert_eq!(db.get("embedded:greeting").await.unwrap(), None);
+}
+
+#[tokio::test]
+async fn test_embedded_errors() {
+    let storage = Arc::new(RocksDBStorage::new("./test_db_embedded_errors").unwrap());
+    let mut db = Embedded::new(&Config::new(), storage);
+
+    // Error replies come back as they would to a client from `command`
+    // and as errors from the typed methods
+    db.command("LPUSH embedded:list a").await.unwrap();
+    let reply = db.command("GET embedded:list").await.unwrap();
+    assert!(matches!(reply, Response::Error(msg) if msg.starts_with("WRONGTYPE")));
+    assert!(matches!(db.get("embedded:list").await, Err(DiskDBError::Database(msg)) if msg.starts_with("WRONGTYPE")));
+
+    // Malformed lines fail to parse
+    assert!(db.command("NOSUCHCOMMAND").await.is_err());
+
+    let reply = db.command("SUBSCRIBE news").await.unwrap();
+    assert!(matches!(reply, Response::Error(_)));
+}
+
+#[tokio::test]
+async fn test_embedded_select() {
+    let mut config = Config::new();
+    config.databases = 4;
+    config.database_path = std::path::PathBuf::from("./test_db_embedded_select");
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let database_config = config.clone();
+    let mut db = Embedded::new(&config, storage)
+        .with_database_factory(Arc::new(move |index| -> diskdb::Result<Arc<dyn Storage>> {
+            Ok(Arc::new(RocksDBStorage::new(database_config.database_path_for(index))?))
+        }));
+
+    db.set("embedded:db", "zero").await.unwrap();
+    db.command("SELECT 2").await.unwrap();
+    assert_eq!(db.get("embedded:db").await.unwrap(), None);
+    db.set("embedded:db", "two").await.unwrap();
+
+    db.command("SELECT 0").await.unwrap();
+    assert_eq!(db.get("embedded:db").await.unwrap(), Some("zero".to_string()));
+
+    let reply = db.command("SELECT 4").await.unwrap();
+    assert!(matches!(reply, Response::Error(_)));
+}
+
+#[tokio::test]
+async fn test_embedded_registered_function() {
+    let storage = Arc::new(RocksDBStorage::new("./test_db_embedded_functions").unwrap());
+    let mut db = Embedded::new(&Config::new(), storage).with_function("shout", Arc::new(|current, args| {
+        let value = match current {
+            Some(DataType::String(value)) => value,
+            Some(_) => return Err("WRONGTYPE Operation against a key holding the wrong kind of value".to_string()),
+            None => String::new(),
+        };
+        let value = value + &args.join(" ").to_uppercase();
+        Ok(Update { value: Some(DataType::String(value.clone())), reply: Response::String(Some(value)) })
+    }));
+
+    let reply = db.command("INVOKE shout embedded:fn hello world").await.unwrap();
+    assert!(matches!(reply, Response::String(Some(v)) if v == "HELLO WORLD"));
+    assert_eq!(db.get("embedded:fn").await.unwrap(), Some("HELLO WORLD".to_string()));
+
+    // The built-in functions are still there
+    let reply = db.command("INVOKE clamp embedded:counter 0 5 9").await.unwrap();
+    assert!(matches!(reply, Response::Integer(5)));
+
+    db.del(&["embedded:fn", "embedded:counter"]).await.unwrap();
+}
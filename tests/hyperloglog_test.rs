@@ -0,0 +1,51 @@
+use diskdb::hyperloglog::{HyperLogLog, SIZE};
+
+fn sketch(range: std::ops::Range<u32>) -> HyperLogLog {
+    let mut hll = HyperLogLog::new();
+    for i in range {
+        hll.add(format!("user:{}", i).as_bytes());
+    }
+    hll
+}
+
+fn assert_close(estimate: u64, actual: u64) {
+    // Three standard errors of 0.81%
+    let error = (estimate as f64 - actual as f64).abs() / actual as f64;
+    assert!(error < 0.025, "estimated {} for {} distinct elements", estimate, actual);
+}
+
+#[test]
+fn test_estimates_small_and_large_cardinalities() {
+    assert_eq!(HyperLogLog::new().count(), 0);
+    assert_eq!(sketch(0..1).count(), 1);
+    assert_eq!(sketch(0..10).count(), 10);
+    for n in [1_000, 20_000, 200_000] {
+        assert_close(sketch(0..n).count(), n as u64);
+    }
+}
+
+#[test]
+fn test_repeated_elements_are_counted_once() {
+    let mut hll = sketch(0..5_000);
+    let before = hll.count();
+    for i in 0..5_000 {
+        assert!(!hll.add(format!("user:{}", i).as_bytes()));
+    }
+    assert_eq!(hll.count(), before);
+}
+
+#[test]
+fn test_merge_estimates_the_union() {
+    let mut union = sketch(0..30_000);
+    union.merge(&sketch(20_000..50_000));
+    assert_close(union.count(), 50_000);
+    assert_eq!(union, sketch(0..50_000));
+}
+
+#[test]
+fn test_size_is_fixed() {
+    assert_eq!(SIZE, 12 * 1024);
+    assert_eq!(sketch(0..100_000).as_bytes().len(), SIZE);
+    assert!(HyperLogLog::try_from(vec![0u8; 16]).is_err());
+    assert!(HyperLogLog::try_from(vec![0u8; SIZE]).is_ok());
+}
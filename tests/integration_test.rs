@@ -2,7 +2,7 @@ use diskdb::{Config, Server};
 use diskdb::storage::rocksdb_storage::RocksDBStorage;
 use std::sync::Arc;
 use std::time::Duration;
-use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
+use tokio::io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader};
 use tokio::net::TcpStream;
 use tokio::time::sleep;
 
@@ -139,4 +139,116 @@ async fn test_multiple_clients() {
     
     // Cleanup
     std::fs::remove_dir_all("./test_db3").ok();
-}
\ No newline at end of file
+}
+
+#[tokio::test]
+async fn test_line_terminators() {
+    // Start server in background
+    let mut config = Config::new();
+    config.server_port = 16383;
+    config.database_path = std::path::PathBuf::from("./test_db4");
+    
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+    
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+    
+    sleep(Duration::from_millis(100)).await;
+    
+    let stream = TcpStream::connect("127.0.0.1:16383").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let mut response = String::new();
+    
+    // Framed replies carry the value length, so embedded CRs survive
+    writer.write_all(b"HELLO 2\r\n").await.unwrap();
+    reader.read_line(&mut response).await.unwrap();
+    assert_eq!(response, "+OK\r\n");
+    
+    // CRLF terminated command; only the terminator is stripped
+    writer.write_all(b"SET crlf_key value\r\n").await.unwrap();
+    response.clear();
+    reader.read_line(&mut response).await.unwrap();
+    assert_eq!(response, "+OK\r\n");
+    
+    // Bare CR inside a token is content, quoted \r\n is an escape
+    for command in [&b"SET cr_key a\rb\r\n"[..], &b"SET crlf_value \"line1\\r\\nline2\\r\"\n"[..]] {
+        writer.write_all(command).await.unwrap();
+        response.clear();
+        reader.read_line(&mut response).await.unwrap();
+        assert_eq!(response, "+OK\r\n");
+    }
+    
+    for (key, expected) in [("crlf_key", &b"value"[..]), ("cr_key", &b"a\rb"[..]), ("crlf_value", &b"line1\r\nline2\r"[..])] {
+        writer.write_all(format!("GET {}\r\n", key).as_bytes()).await.unwrap();
+        response.clear();
+        reader.read_line(&mut response).await.unwrap();
+        assert_eq!(response, format!("${}\r\n", expected.len()));
+        let mut value = vec![0u8; expected.len() + 2];
+        reader.read_exact(&mut value).await.unwrap();
+        assert_eq!(&value[..expected.len()], expected);
+    }
+    
+    // Cleanup
+    std::fs::remove_dir_all("./test_db4").ok();
+}
+
+#[tokio::test]
+async fn test_max_clients() {
+    let mut config = Config::new();
+    config.server_port = 16384;
+    config.database_path = std::path::PathBuf::from("./test_db5");
+    config.max_connections = 1;
+    
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+    
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+    
+    sleep(Duration::from_millis(100)).await;
+    
+    let stream = TcpStream::connect("127.0.0.1:16384").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let mut response = String::new();
+    writer.write_all(b"PING\n").await.unwrap();
+    reader.read_line(&mut response).await.unwrap();
+    assert_eq!(response.trim(), "PONG");
+    
+    // Over-limit clients are told why, even if they already sent a command
+    let mut rejected = TcpStream::connect("127.0.0.1:16384").await.unwrap();
+    rejected.write_all(b"PING\n").await.unwrap();
+    let mut reply = String::new();
+    rejected.read_to_string(&mut reply).await.unwrap();
+    assert_eq!(reply, "ERROR: ERR max number of clients reached\n");
+    
+    // A storm of rejected clients is closed promptly and holds no slots
+    let mut storm = Vec::new();
+    for _ in 0..200 {
+        storm.push(TcpStream::connect("127.0.0.1:16384").await.unwrap());
+    }
+    for mut stream in storm {
+        let mut reply = Vec::new();
+        let read = tokio::time::timeout(Duration::from_secs(2), stream.read_to_end(&mut reply)).await;
+        assert!(read.is_ok(), "rejected connection left open");
+    }
+    
+    drop(writer);
+    drop(reader);
+    sleep(Duration::from_millis(100)).await;
+    
+    let stream = TcpStream::connect("127.0.0.1:16384").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    writer.write_all(b"PING\n").await.unwrap();
+    response.clear();
+    reader.read_line(&mut response).await.unwrap();
+    assert_eq!(response.trim(), "PONG");
+    
+    // Cleanup
+    std::fs::remove_dir_all("./test_db5").ok();
+}
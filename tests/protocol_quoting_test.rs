@@ -0,0 +1,174 @@
+use diskdb::protocol::{split_args, ArgCounter, Request};
+
+// Lines produced by the Go client's encodeCommand, kept in step with
+// encodingCases in clients/golang_protocol_test.go
+const ENCODED: &[(&str, &[&str])] = &[
+    ("GET plain\n", &["GET", "plain"]),
+    ("SET greeting \"hello world\"\n", &["SET", "greeting", "hello world"]),
+    ("SET k \"\"\n", &["SET", "k", ""]),
+    ("SET k \"line1\\nline2\\r\\n\"\n", &["SET", "k", "line1\nline2\r\n"]),
+    ("SET k \"say \\\"hi\\\" \\\\o/\"\n", &["SET", "k", "say \"hi\" \\o/"]),
+    ("SET k \"it's\"\n", &["SET", "k", "it's"]),
+    ("SET k \"\\x00\\x01\\x7f\\t\"\n", &["SET", "k", "\x00\x01\x7f\t"]),
+    ("SET k \"naïve café\"\n", &["SET", "k", "naïve café"]),
+    ("SET k héllo\n", &["SET", "k", "héllo"]),
+];
+
+/// Mirror of the Go client's encodeCommand for valid UTF-8 arguments
+fn encode(args: &[String]) -> String {
+    let mut line = String::new();
+    for (i, arg) in args.iter().enumerate() {
+        if i > 0 {
+            line.push(' ');
+        }
+        let needs_quoting = arg.is_empty()
+            || arg.bytes().any(|b| b <= b' ' || b == b'"' || b == b'\'' || b == b'\\' || b == 0x7f);
+        if !needs_quoting {
+            line.push_str(arg);
+            continue;
+        }
+        line.push('"');
+        for c in arg.chars() {
+            match c {
+                '"' => line.push_str("\\\""),
+                '\\' => line.push_str("\\\\"),
+                '\n' => line.push_str("\\n"),
+                '\r' => line.push_str("\\r"),
+                '\t' => line.push_str("\\t"),
+                c if (c as u32) < 0x20 || c as u32 == 0x7f => line.push_str(&format!("\\x{:02x}", c as u32)),
+                c => line.push(c),
+            }
+        }
+        line.push('"');
+    }
+    line.push('\n');
+    line
+}
+
+/// Small deterministic generator so failures reproduce
+struct XorShift(u64);
+
+impl XorShift {
+    fn next(&mut self) -> u64 {
+        self.0 ^= self.0 << 13;
+        self.0 ^= self.0 >> 7;
+        self.0 ^= self.0 << 17;
+        self.0
+    }
+
+    fn arg(&mut self) -> String {
+        const ALPHABET: &[char] = &[
+            'a', 'Z', '0', ' ', '\t', '\n', '\r', '"', '\'', '\\', '\0', '\x01', '\x1b', '\x7f',
+            'x', 'é', '€', '😀',
+        ];
+        let len = (self.next() % 12) as usize;
+        (0..len).map(|_| ALPHABET[(self.next() % ALPHABET.len() as u64) as usize]).collect()
+    }
+}
+
+#[test]
+fn test_split_args_decodes_client_encoding() {
+    for (line, expected) in ENCODED {
+        let args = split_args(line).unwrap();
+        assert_eq!(args, *expected, "line {:?}", line);
+
+        let owned: Vec<String> = expected.iter().map(|s| s.to_string()).collect();
+        assert_eq!(encode(&owned), *line);
+    }
+}
+
+#[test]
+fn test_split_args_round_trip_fuzz() {
+    let mut rng = XorShift(0x9e37_79b9_7f4a_7c15);
+    for _ in 0..20_000 {
+        let count = 1 + (rng.next() % 5) as usize;
+        let args: Vec<String> = (0..count).map(|_| rng.arg()).collect();
+        let line = encode(&args);
+        assert_eq!(split_args(&line).unwrap(), args, "line {:?}", line);
+    }
+}
+
+#[test]
+fn test_quoted_values_reach_requests() {
+    match Request::parse("SET k \"line1\\nline2 \\\"q\\\"\"\n").unwrap() {
+        Request::Set { key, value } => {
+            assert_eq!(key, "k");
+            assert_eq!(value, "line1\nline2 \"q\"");
+        }
+        other => panic!("unexpected request {:?}", other),
+    }
+}
+
+#[test]
+fn test_escaped_invalid_utf8_is_rejected() {
+    // The Go client escapes bytes that are not valid UTF-8; the server
+    // answers with an error instead of storing altered data
+    assert!(split_args("SET k \"bad\\xff\"\n").is_err());
+    // Escaped halves of a valid character join back up
+    assert_eq!(split_args("SET k \"\\xc3\\xa9\"\n").unwrap(), vec!["SET", "k", "é"]);
+}
+
+/// Count the arguments of line with an ArgCounter, feeding it in chunks
+/// that end at each of splits
+fn count_args(line: &str, splits: &[usize]) -> usize {
+    let mut counter = ArgCounter::default();
+    let mut start = 0;
+    for &end in splits.iter().chain([line.len()].iter()) {
+        counter.feed(&line.as_bytes()[start..end]);
+        start = end;
+    }
+    counter.feed(&[])
+}
+
+#[test]
+fn test_arg_counter_matches_split_args() {
+    let mut lines: Vec<String> = ENCODED.iter().map(|(line, _)| line.to_string()).collect();
+    let quoted: &[(&str, &[&str])] = &[
+        // The line terminator is not an argument, with or without a
+        // separator before it
+        ("GET a \r\n", &["GET", "a"]),
+        ("GET a\t\r\n", &["GET", "a"]),
+        ("GET a \n", &["GET", "a"]),
+        // A carriage return that does not end the line is content
+        ("GET a\rb\n", &["GET", "a\rb"]),
+        ("GET \r a\r\n", &["GET", "\r", "a"]),
+        // Inside single quotes only \' is an escape
+        ("SET k 'a\\\\' b'\n", &["SET", "k", "a\\' b"]),
+        ("SET k 'a\\' b' c\n", &["SET", "k", "a' b", "c"]),
+        ("SET k 'a\\b' c\n", &["SET", "k", "a\\b", "c"]),
+        // Inside double quotes every backslash escapes the next byte
+        ("SET k \"a\\\\\" b\n", &["SET", "k", "a\\", "b"]),
+        ("SET k \"a\\x41 b\" c\n", &["SET", "k", "aA b", "c"]),
+    ];
+    for (line, expected) in quoted {
+        assert_eq!(split_args(line).unwrap(), *expected, "line {:?}", line);
+        lines.push(line.to_string());
+    }
+
+    let mut rng = XorShift(0x2545_f491_4f6c_dd1d);
+    for _ in 0..2_000 {
+        let count = 1 + (rng.next() % 5) as usize;
+        let args: Vec<String> = (0..count).map(|_| rng.arg()).collect();
+        let line = encode(&args);
+        lines.push(line.replace('\n', if rng.next() % 2 == 0 { "\r\n" } else { " \r\n" }));
+        lines.push(line);
+    }
+
+    for line in &lines {
+        let expected = split_args(line).unwrap().len();
+        assert_eq!(count_args(line, &[]), expected, "line {:?}", line);
+        // The count does not depend on where the line is cut into chunks
+        for split in 0..=line.len() {
+            assert_eq!(count_args(line, &[split]), expected, "line {:?} split at {}", line, split);
+        }
+    }
+}
+
+#[test]
+fn test_arg_counter_keeps_counting_malformed_lines() {
+    // split_args rejects these, but the arguments after the error still
+    // count towards the limit
+    assert_eq!(count_args("SET \"a\"b c d\n", &[]), 4);
+    assert_eq!(count_args("SET \"\\xzz\" c d\n", &[]), 4);
+    assert_eq!(count_args("SET 'open c d\n", &[]), 2);
+}
@@ -0,0 +1,277 @@
+use diskdb::pubsub::{PubSub, SUBSCRIBER_BUFFER};
+use diskdb::protocol::Response;
+use diskdb::{Config, Server};
+use diskdb::storage::rocksdb_storage::RocksDBStorage;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader};
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+use tokio::time::{sleep, timeout};
+
+#[tokio::test]
+async fn test_publish_delivers_to_subscribers() {
+    let pubsub = PubSub::default();
+    let (sender, mut messages) = mpsc::channel(SUBSCRIBER_BUFFER);
+    let subscriber = pubsub.subscriber(sender);
+
+    assert_eq!(pubsub.publish("news", "nobody listening"), 0);
+    pubsub.subscribe("news", &subscriber);
+    assert_eq!(pubsub.publish("news", "hello"), 1);
+
+    match messages.recv().await.unwrap() {
+        Response::Array(items) => {
+            assert_eq!(items.len(), 3);
+            assert!(matches!(&items[2], Response::String(Some(payload)) if payload == "hello"));
+        }
+        other => panic!("unexpected message {:?}", other),
+    }
+
+    pubsub.unsubscribe("news", &subscriber);
+    assert_eq!(pubsub.publish("news", "gone"), 0);
+}
+
+#[tokio::test]
+async fn test_slow_subscriber_is_dropped() {
+    let pubsub = PubSub::default();
+    let (slow_sender, _slow_messages) = mpsc::channel(4);
+    let slow = pubsub.subscriber(slow_sender);
+    let (fast_sender, mut fast_messages) = mpsc::channel(4);
+    let fast = pubsub.subscriber(fast_sender);
+    pubsub.subscribe("news", &slow);
+    pubsub.subscribe("sports", &slow);
+    pubsub.subscribe("news", &fast);
+
+    for i in 0..4 {
+        assert_eq!(pubsub.publish("news", &i.to_string()), 2);
+        fast_messages.recv().await.unwrap();
+    }
+
+    // The slow mailbox is full: the subscriber is dropped everywhere and
+    // told so, while the fast one keeps receiving
+    assert_eq!(pubsub.publish("news", "overflow"), 1);
+    timeout(Duration::from_secs(1), slow.overflowed()).await
+        .expect("overflow not signalled");
+    assert_eq!(pubsub.publish("sports", "score"), 0);
+    assert_eq!(pubsub.publish("news", "more"), 1);
+}
+
+#[tokio::test]
+async fn test_slow_subscriber_connection_closed() {
+    let mut config = Config::new();
+    config.server_port = 16385;
+    config.database_path = std::path::PathBuf::from("./test_db_16385");
+
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+
+    sleep(Duration::from_millis(100)).await;
+
+    // A subscriber that never reads its messages
+    let mut subscriber = TcpStream::connect("127.0.0.1:16385").await.unwrap();
+    subscriber.write_all(b"SUBSCRIBE firehose\n").await.unwrap();
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect("127.0.0.1:16385").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    let payload = "x".repeat(16 * 1024);
+    let mut receivers = String::new();
+    for _ in 0..SUBSCRIBER_BUFFER * 4 {
+        writer.write_all(format!("PUBLISH firehose {}\n", payload).as_bytes()).await.unwrap();
+        receivers.clear();
+        reader.read_line(&mut receivers).await.unwrap();
+        if receivers.trim() == "0" {
+            break;
+        }
+    }
+    assert_eq!(receivers.trim(), "0", "slow subscriber was never dropped");
+
+    // Its connection is closed once the backlog that was written drains
+    let mut buf = vec![0u8; 64 * 1024];
+    let closed = timeout(Duration::from_secs(5), async {
+        while subscriber.read(&mut buf).await.map(|n| n > 0).unwrap_or(false) {}
+    }).await;
+    assert!(closed.is_ok(), "slow subscriber connection left open");
+
+    // Cleanup
+    std::fs::remove_dir_all("./test_db_16385").ok();
+}
+
+#[tokio::test]
+async fn test_channel_introspection() {
+    let pubsub = PubSub::default();
+    let (sender, _messages) = mpsc::channel(SUBSCRIBER_BUFFER);
+    let first = pubsub.subscriber(sender.clone());
+    let second = pubsub.subscriber(sender);
+    pubsub.subscribe("news", &first);
+    pubsub.subscribe("news", &second);
+    pubsub.subscribe("sports", &first);
+
+    assert_eq!(pubsub.channels(None), vec!["news", "sports"]);
+    assert_eq!(pubsub.channels(Some("n*")), vec!["news"]);
+    assert_eq!(pubsub.subscriber_count("news"), 2);
+    assert_eq!(pubsub.subscriber_count("weather"), 0);
+
+    // Channels left without subscribers are no longer listed
+    pubsub.unsubscribe("sports", &first);
+    assert_eq!(pubsub.channels(None), vec!["news"]);
+    assert_eq!(pubsub.subscriber_count("sports"), 0);
+}
+
+#[tokio::test]
+async fn test_pubsub_command() {
+    let mut config = Config::new();
+    config.server_port = 16449;
+    config.database_path = std::path::PathBuf::from("./test_db_16449");
+
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+
+    sleep(Duration::from_millis(100)).await;
+
+    let mut subscriber = TcpStream::connect("127.0.0.1:16449").await.unwrap();
+    subscriber.write_all(b"SUBSCRIBE orders.created orders.paid\n").await.unwrap();
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect("127.0.0.1:16449").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "PUBSUB CHANNELS", 2).await, vec!["orders.created", "orders.paid"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "PUBSUB CHANNELS *.paid", 1).await, vec!["orders.paid"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "PUBSUB NUMSUB orders.paid orders.refunded", 4).await,
+        vec!["orders.paid", "1", "orders.refunded", "0"]);
+    assert!(send_command_multi(&mut writer, &mut reader, "PUBSUB SHARDS", 1).await[0].starts_with("ERROR:"));
+
+    // A closed connection no longer counts
+    drop(subscriber);
+    sleep(Duration::from_millis(100)).await;
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "PUBSUB NUMSUB orders.paid", 2).await, vec!["orders.paid", "0"]);
+
+    // Cleanup
+    std::fs::remove_dir_all("./test_db_16449").ok();
+}
+
+#[tokio::test]
+async fn test_keyspace_expired_events() {
+    let mut config = Config::new();
+    config.server_port = 16460;
+    config.database_path = std::path::PathBuf::from("./test_db_16460");
+
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+
+    sleep(Duration::from_millis(100)).await;
+
+    let subscriber = TcpStream::connect("127.0.0.1:16460").await.unwrap();
+    let (events, mut subscribe) = subscriber.into_split();
+    let mut events = BufReader::new(events);
+    subscribe.write_all(b"SUBSCRIBE __keyspace@0__:lease __keyspace@0__:other\n").await.unwrap();
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect("127.0.0.1:16460").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SET lease holder PX 200", 1).await, vec!["OK"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SET other value PX 100000", 1).await, vec!["OK"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SET unwatched value PX 100", 1).await, vec!["OK"]);
+
+    // The watched key is expired and reported without anybody reading it
+    let channel = timeout(Duration::from_secs(2), async {
+        let mut previous = String::new();
+        loop {
+            let mut line = String::new();
+            events.read_line(&mut line).await.unwrap();
+            if line.trim() == "expired" {
+                return previous;
+            }
+            previous = line.trim().to_string();
+        }
+    }).await.expect("no expired event");
+    assert_eq!(channel, "__keyspace@0__:lease");
+
+    // A deleted key did not expire, and unwatched keys are not reported
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "DEL other", 1).await, vec!["1"]);
+    let mut line = String::new();
+    assert!(timeout(Duration::from_millis(300), events.read_line(&mut line)).await.is_err(), "unexpected event {}", line);
+
+    // Cleanup
+    std::fs::remove_dir_all("./test_db_16460").ok();
+}
+
+#[tokio::test]
+async fn test_set_and_publish() {
+    let mut config = Config::new();
+    config.server_port = 16464;
+    config.database_path = std::path::PathBuf::from("./test_db_16464");
+
+    let storage = Arc::new(RocksDBStorage::new(&config.database_path).unwrap());
+    let server = Server::new(config, storage).unwrap();
+
+    tokio::spawn(async move {
+        server.start().await.unwrap();
+    });
+
+    sleep(Duration::from_millis(100)).await;
+
+    let subscriber = TcpStream::connect("127.0.0.1:16464").await.unwrap();
+    let (events, mut subscribe) = subscriber.into_split();
+    let mut events = BufReader::new(events);
+    subscribe.write_all(b"SUBSCRIBE invalidations\n").await.unwrap();
+    sleep(Duration::from_millis(100)).await;
+
+    let stream = TcpStream::connect("127.0.0.1:16464").await.unwrap();
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SET user:1 old PX 100000", 1).await, vec!["OK"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SETPUBLISH user:1 ann invalidations", 1).await, vec!["1"]);
+
+    // The key is published, and by then its new value is stored
+    let channel = timeout(Duration::from_secs(2), async {
+        let mut previous = String::new();
+        loop {
+            let mut line = String::new();
+            events.read_line(&mut line).await.unwrap();
+            if line.trim() == "user:1" {
+                return previous;
+            }
+            previous = line.trim().to_string();
+        }
+    }).await.expect("no notification");
+    assert_eq!(channel, "invalidations");
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GET user:1", 1).await, vec!["ann"]);
+    // As with SET, the old expiry is gone
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "TTL user:1", 1).await, vec!["-1"]);
+
+    // Nobody listening still stores the value
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "SETPUBLISH user:2 bob elsewhere", 1).await, vec!["0"]);
+    assert_eq!(send_command_multi(&mut writer, &mut reader, "GET user:2", 1).await, vec!["bob"]);
+    assert!(send_command_multi(&mut writer, &mut reader, "SETPUBLISH user:3 cy", 1).await[0].starts_with("ERROR:"));
+
+    // Cleanup
+    std::fs::remove_dir_all("./test_db_16464").ok();
+}
+
+// Send a command and read `lines` lines of its reply
+async fn send_command_multi(writer: &mut tokio::net::tcp::OwnedWriteHalf, reader: &mut BufReader<tokio::net::tcp::OwnedReadHalf>, cmd: &str, lines: usize) -> Vec<String> {
+    writer.write_all(format!("{}\n", cmd).as_bytes()).await.unwrap();
+    let mut reply = Vec::new();
+    for _ in 0..lines {
+        let mut line = String::new();
+        reader.read_line(&mut line).await.unwrap();
+        reply.push(line.trim().to_string());
+    }
+    reply
+}